@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/proxy"
+)
+
+// EnvoyAuthzPrefix is the path prefix of checks from Envoy's HTTP ext_authz
+// filter, configured as its path_prefix
+const EnvoyAuthzPrefix = "/envoy/"
+
+// Headers describing the decision of an authorization check
+const (
+	PolicyHeader = "X-Tproxy-Policy"
+	RuleHeader   = "X-Tproxy-Rule"
+)
+
+// check evaluates the rules for the connection in the query, answering 200
+// for PROXY and DIRECT and 403 for REJECT with the result as JSON
+func (s *Server) check(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q, err := matchQuery(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Domain = v.Get("domain")
+	if ip := v.Get("ip"); ip != "" {
+		if q.IP = net.ParseIP(ip); q.IP == nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Domain == "" && q.IP == nil {
+		http.Error(w, "domain or ip is required", http.StatusBadRequest)
+		return
+	}
+	result := s.proxy.Match(q)
+	writeJSON(w, decide(w, result), result)
+}
+
+// checkEnvoy evaluates the rules for a request forwarded by Envoy's HTTP
+// ext_authz filter: the destination is its Host, on the port of its scheme
+// unless the Host names one, and the source the last X-Forwarded-For
+// address when Envoy is set to send that header. Envoy appends the downstream
+// address it saw, earlier entries come from the client and are not trusted.
+// Denials carry the rule in a plain text body.
+func (s *Server) checkEnvoy(w http.ResponseWriter, r *http.Request) {
+	q, err := envoyQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := s.proxy.Match(q)
+	if status := decide(w, result); status != http.StatusOK {
+		http.Error(w, "rejected by rule "+result.Rule, status)
+	}
+}
+
+// envoyQuery reads the connection from a request forwarded by ext_authz
+func envoyQuery(r *http.Request) (proxy.MatchQuery, error) {
+	q := proxy.MatchQuery{Port: 80}
+	if r.Header.Get("X-Forwarded-Proto") == "https" {
+		q.Port = 443
+	}
+	host := r.Host
+	if h, port, err := net.SplitHostPort(r.Host); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return q, errors.New("invalid port in host")
+		}
+		host, q.Port = h, p
+	}
+	if host == "" {
+		return q, errors.New("host is required")
+	}
+	// An IPv6 host without a port keeps its brackets
+	if inner, ok := strings.CutPrefix(host, "["); ok {
+		if host, ok = strings.CutSuffix(inner, "]"); !ok || net.ParseIP(host) == nil {
+			return q, errors.New("invalid IPv6 host")
+		}
+	}
+	if q.IP = net.ParseIP(host); q.IP == nil {
+		q.Domain = host
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		last := xff[strings.LastIndex(xff, ",")+1:]
+		q.Source = net.ParseIP(strings.TrimSpace(last))
+	}
+	return q, nil
+}
+
+// decide sets the decision headers and returns the status answering result
+func decide(w http.ResponseWriter, result proxy.MatchResult) int {
+	w.Header().Set(PolicyHeader, string(result.Resolved))
+	if result.Rule != "" {
+		w.Header().Set(RuleHeader, result.Rule)
+	}
+	if result.Resolved == config.PolicyReject {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cnfatal/proxy/proxy"
+)
+
+func TestAuthzServer(t *testing.T) {
+	p := &fakeProxy{}
+	h := NewAuthzServer("", p).Handler()
+
+	tests := []struct {
+		path    string
+		headers map[string]string
+		status  int
+		policy  string
+		query   proxy.MatchQuery
+	}{
+		{"/check?domain=example.com&ip=192.0.2.1&port=80&src=192.168.1.20", nil, http.StatusOK, "DIRECT",
+			proxy.MatchQuery{Source: net.ParseIP("192.168.1.20"), Domain: "example.com", IP: net.ParseIP("192.0.2.1"), Port: 80}},
+		{"/check?domain=blocked.example", nil, http.StatusForbidden, "REJECT", proxy.MatchQuery{Domain: "blocked.example", Port: 443}},
+		{"/check?port=80", nil, http.StatusBadRequest, "", proxy.MatchQuery{}},
+		{"/check?ip=example.com", nil, http.StatusBadRequest, "", proxy.MatchQuery{}},
+		{"/envoy/index.html", map[string]string{"Host": "example.com", "X-Forwarded-For": "192.168.1.99, 192.168.1.20"}, http.StatusOK, "DIRECT",
+			proxy.MatchQuery{Source: net.ParseIP("192.168.1.20"), Domain: "example.com", Port: 80}},
+		{"/envoy/", map[string]string{"Host": "blocked.example:8443", "X-Forwarded-Proto": "https"}, http.StatusForbidden, "REJECT",
+			proxy.MatchQuery{Domain: "blocked.example", Port: 8443}},
+		{"/envoy/", map[string]string{"Host": "192.0.2.1", "X-Forwarded-Proto": "https"}, http.StatusOK, "DIRECT",
+			proxy.MatchQuery{IP: net.ParseIP("192.0.2.1"), Port: 443}},
+		{"/envoy/", map[string]string{"Host": "[2001:db8::1]"}, http.StatusOK, "DIRECT",
+			proxy.MatchQuery{IP: net.ParseIP("2001:db8::1"), Port: 80}},
+		{"/envoy/", map[string]string{"Host": "[2001:db8::1]:8080"}, http.StatusOK, "DIRECT",
+			proxy.MatchQuery{IP: net.ParseIP("2001:db8::1"), Port: 8080}},
+		{"/envoy/", map[string]string{"Host": "[example.com]"}, http.StatusBadRequest, "", proxy.MatchQuery{}},
+		{"/connections", nil, http.StatusNotFound, "", proxy.MatchQuery{}},
+	}
+	for _, tt := range tests {
+		p.queries = nil
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		for k, v := range tt.headers {
+			if k == "Host" {
+				req.Host = v
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status || rec.Header().Get(PolicyHeader) != tt.policy {
+			t.Errorf("%s: status = %d, policy = %q, want %d, %q", tt.path, rec.Code, rec.Header().Get(PolicyHeader), tt.status, tt.policy)
+		}
+		if tt.policy == "" {
+			continue
+		}
+		if len(p.queries) != 1 || !sameQuery(p.queries[0], tt.query) {
+			t.Errorf("%s: queries = %+v, want %+v", tt.path, p.queries, tt.query)
+		}
+		if tt.status == http.StatusForbidden && strings.HasPrefix(tt.path, EnvoyAuthzPrefix) && !strings.Contains(rec.Body.String(), "DOMAIN,blocked.example") {
+			t.Errorf("%s: body = %q, want the rule", tt.path, rec.Body.String())
+		}
+	}
+}
+
+func sameQuery(a, b proxy.MatchQuery) bool {
+	return a.Source.Equal(b.Source) && a.Domain == b.Domain && a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,392 @@
+// Package api serves the optional control API used by operators to inspect
+// and steer a running proxy. It listens on TCP, optionally over TLS, or on a
+// unix socket. The routes changing state are served only to authenticated
+// callers: those presenting the API token or a client certificate signed by
+// the configured CA, or connecting to the unix socket limited to its group.
+// A separate unix socket may serve only the read-only routes to unprivileged
+// monitoring agents, and another listener the authorization checks of
+// external systems.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cnfatal/proxy/proxy"
+)
+
+// ShutdownTimeout bounds how long in-flight API requests may run on exit
+const ShutdownTimeout = 5 * time.Second
+
+// Proxy is the part of the transparent proxy exposed through the API
+type Proxy interface {
+	Connections() []proxy.Connection
+	CloseConnection(id uint64) bool
+	Match(q proxy.MatchQuery) proxy.MatchResult
+	RotateCredentials() error
+	Upstreams() []proxy.UpstreamStatus
+	Schedules() []proxy.ScheduledRule
+	AddSchedule(r proxy.ScheduledRule) (proxy.ScheduledRule, error)
+	RemoveSchedule(id uint64) (bool, error)
+	SelectGroup(name, member string) (proxy.GroupSelection, error)
+}
+
+// Firewall reports the installed interception rules
+type Firewall interface {
+	Status() (string, error)
+}
+
+// Server is the control API
+type Server struct {
+	addr     string
+	tls      *tls.Config
+	token    []byte // bearer token required by every request, nil if unset
+	proxy    Proxy
+	firewall Firewall
+	reload   func(ctx context.Context) error
+	level    *slog.LevelVar
+	readOnly bool
+	authz    bool // serves only the authorization checks
+	gid      int  // group of the read-only socket, or -1 for everyone
+}
+
+// NewServer creates a control API listening on addr, a host:port or an
+// absolute unix socket path. TCP listeners serve TLS when tlsConfig is set.
+// Requests must carry token as a bearer token unless it is empty. firewall
+// is nil when running without nftables.
+func NewServer(addr string, tlsConfig *tls.Config, token string, p Proxy, firewall Firewall, reload func(ctx context.Context) error, level *slog.LevelVar) *Server {
+	s := &Server{addr: addr, tls: tlsConfig, proxy: p, firewall: firewall, reload: reload, level: level}
+	if token != "" {
+		s.token = []byte(token)
+	}
+	return s
+}
+
+// NewStatusServer creates a server of the read-only routes on the unix socket
+// path, accessible to the group gid, or to everyone when gid is -1
+func NewStatusServer(path string, gid int, p Proxy, firewall Firewall, level *slog.LevelVar) *Server {
+	return &Server{addr: path, proxy: p, firewall: firewall, level: level, readOnly: true, gid: gid}
+}
+
+// NewAuthzServer creates a server of the authorization checks listening on
+// addr, a host:port or an absolute unix socket path
+func NewAuthzServer(addr string, p Proxy) *Server {
+	return &Server{addr: addr, proxy: p, authz: true}
+}
+
+// Run serves the API until the context is cancelled
+func (s *Server) Run(ctx context.Context) error {
+	network := "tcp"
+	if strings.HasPrefix(s.addr, "/") {
+		network = "unix"
+		// A socket left behind by an unclean exit blocks the bind
+		if err := os.Remove(s.addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, network, s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+	if network == "unix" {
+		defer os.Remove(s.addr)
+		if err := s.setPermissions(); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+	} else if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
+
+	srv := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	switch {
+	case s.authz:
+		slog.Info("Authorization API listening", "addr", s.addr)
+	case s.readOnly:
+		slog.Info("Status API listening", "addr", s.addr)
+	default:
+		slog.Info("Control API listening", "addr", s.addr)
+		if !s.authenticated() {
+			slog.Warn("Control API serves only the read-only routes without api_token_file or client certificates on TCP", "addr", s.addr)
+		}
+	}
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// setPermissions limits the control and authorization sockets to their
+// group. The status socket is given to the configured group, or opened to
+// everyone.
+func (s *Server) setPermissions() error {
+	if !s.readOnly {
+		return os.Chmod(s.addr, 0660)
+	}
+	if s.gid < 0 {
+		return os.Chmod(s.addr, 0666)
+	}
+	if err := os.Chown(s.addr, -1, s.gid); err != nil {
+		return err
+	}
+	return os.Chmod(s.addr, 0660)
+}
+
+// authenticated reports whether every caller of the control API is
+// authenticated, by the token, a verified client certificate or the
+// permissions of the unix socket
+func (s *Server) authenticated() bool {
+	return s.token != nil || strings.HasPrefix(s.addr, "/") ||
+		s.tls != nil && s.tls.ClientAuth == tls.RequireAndVerifyClientCert
+}
+
+// Handler returns the API routes, only the read-only ones for a status server
+// or unauthenticated callers, and the checks for an authorization server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	if s.authz {
+		mux.HandleFunc("GET /check", s.check)
+		mux.HandleFunc(EnvoyAuthzPrefix, s.checkEnvoy)
+		return mux
+	}
+	mux.HandleFunc("GET /connections", s.listConnections)
+	mux.HandleFunc("GET /firewall", s.firewallStatus)
+	mux.HandleFunc("GET /rules/match", s.matchRule)
+	mux.HandleFunc("GET /upstreams", s.listUpstreams)
+	mux.HandleFunc("GET /schedules", s.listSchedules)
+	mux.HandleFunc("GET /log-level", s.getLogLevel)
+	if s.readOnly {
+		return mux
+	}
+	if s.authenticated() {
+		mux.HandleFunc("DELETE /connections/{id}", s.closeConnection)
+		mux.HandleFunc("POST /reload", s.triggerReload)
+		mux.HandleFunc("POST /upstreams/rotate-credentials", s.rotateCredentials)
+		mux.HandleFunc("POST /schedules", s.addSchedule)
+		mux.HandleFunc("DELETE /schedules/{id}", s.removeSchedule)
+		mux.HandleFunc("PUT /groups/{name}", s.selectGroup)
+		mux.HandleFunc("PUT /log-level", s.setLogLevel)
+	}
+	if s.token != nil {
+		return s.requireToken(mux)
+	}
+	return mux
+}
+
+// requireToken rejects requests without the bearer token
+func (s *Server) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tproxy"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listConnections(w http.ResponseWriter, r *http.Request) {
+	conns := s.proxy.Connections()
+	if conns == nil {
+		conns = []proxy.Connection{}
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (s *Server) closeConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !s.proxy.CloseConnection(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) firewallStatus(w http.ResponseWriter, r *http.Request) {
+	if s.firewall == nil {
+		http.Error(w, "nftables is not in use, only the explicit listeners are running", http.StatusServiceUnavailable)
+		return
+	}
+	status, err := s.firewall.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, status)
+}
+
+func (s *Server) matchRule(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+	q, err := matchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.IP = net.ParseIP(host); q.IP == nil {
+		q.Domain = host
+	}
+	writeJSON(w, http.StatusOK, s.proxy.Match(q))
+}
+
+// matchQuery reads the port, 443 by default, and the optional src address of
+// a rule query
+func matchQuery(v url.Values) (proxy.MatchQuery, error) {
+	q := proxy.MatchQuery{Port: 443}
+	if port := v.Get("port"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return q, errors.New("invalid port")
+		}
+		q.Port = p
+	}
+	if src := v.Get("src"); src != "" {
+		if q.Source = net.ParseIP(src); q.Source == nil {
+			return q, errors.New("invalid src")
+		}
+	}
+	return q, nil
+}
+
+func (s *Server) triggerReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.reload(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listUpstreams(w http.ResponseWriter, r *http.Request) {
+	upstreams := s.proxy.Upstreams()
+	if upstreams == nil {
+		upstreams = []proxy.UpstreamStatus{}
+	}
+	writeJSON(w, http.StatusOK, upstreams)
+}
+
+func (s *Server) rotateCredentials(w http.ResponseWriter, r *http.Request) {
+	if err := s.proxy.RotateCredentials(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listSchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.proxy.Schedules())
+}
+
+func (s *Server) addSchedule(w http.ResponseWriter, r *http.Request) {
+	var body proxy.ScheduledRule
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	added, err := s.proxy.AddSchedule(body)
+	switch {
+	case errors.Is(err, proxy.ErrInvalidSchedule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, added)
+	}
+}
+
+func (s *Server) removeSchedule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid schedule id", http.StatusBadRequest)
+		return
+	}
+	removed, err := s.proxy.RemoveSchedule(id)
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case !removed:
+		http.Error(w, "schedule not found", http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) selectGroup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Selected string `json:"selected"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	selection, err := s.proxy.SelectGroup(r.PathValue("name"), body.Selected)
+	switch {
+	case errors.Is(err, proxy.ErrUnknownGroup):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, proxy.ErrInvalidSelection):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, selection)
+	}
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (s *Server) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelBody{Level: strings.ToLower(s.level.Level().String())})
+}
+
+func (s *Server) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.level.Set(level)
+	slog.Info("Log level changed", "level", level)
+	writeJSON(w, http.StatusOK, logLevelBody{Level: strings.ToLower(level.String())})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
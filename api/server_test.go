@@ -0,0 +1,300 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/proxy"
+)
+
+type fakeProxy struct {
+	conns     []proxy.Connection
+	closed    []uint64
+	rotations int
+	schedules []proxy.ScheduledRule
+	queries   []proxy.MatchQuery
+}
+
+func (p *fakeProxy) Connections() []proxy.Connection { return p.conns }
+
+func (p *fakeProxy) CloseConnection(id uint64) bool {
+	for _, c := range p.conns {
+		if c.ID == id {
+			p.closed = append(p.closed, id)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *fakeProxy) Match(q proxy.MatchQuery) proxy.MatchResult {
+	p.queries = append(p.queries, q)
+	if q.Domain == "blocked.example" {
+		return proxy.MatchResult{Rule: "DOMAIN,blocked.example", Policy: config.PolicyReject, Resolved: config.PolicyReject}
+	}
+	return proxy.MatchResult{Rule: "DOMAIN," + q.Domain, Policy: config.PolicyDirect, Resolved: config.PolicyDirect}
+}
+
+func (p *fakeProxy) RotateCredentials() error {
+	p.rotations++
+	if p.rotations > 1 {
+		return errors.New("failed to read password file")
+	}
+	return nil
+}
+
+func (p *fakeProxy) Upstreams() []proxy.UpstreamStatus {
+	return []proxy.UpstreamStatus{{Name: "PROXY", URL: "socks5://proxy:1080", Exit: &proxy.ExitInfo{IP: "203.0.113.7", Country: "JP"}}}
+}
+
+func (p *fakeProxy) Schedules() []proxy.ScheduledRule { return p.schedules }
+
+func (p *fakeProxy) AddSchedule(r proxy.ScheduledRule) (proxy.ScheduledRule, error) {
+	if r.From == r.To {
+		return proxy.ScheduledRule{}, proxy.ErrInvalidSchedule
+	}
+	r.ID = uint64(len(p.schedules) + 1)
+	p.schedules = append(p.schedules, r)
+	return r, nil
+}
+
+func (p *fakeProxy) SelectGroup(name, member string) (proxy.GroupSelection, error) {
+	switch {
+	case name != "Office":
+		return proxy.GroupSelection{}, proxy.ErrUnknownGroup
+	case member != "work" && member != "personal":
+		return proxy.GroupSelection{}, proxy.ErrInvalidSelection
+	}
+	return proxy.GroupSelection{Group: name, Selected: member}, nil
+}
+
+func (p *fakeProxy) RemoveSchedule(id uint64) (bool, error) {
+	for i, r := range p.schedules {
+		if r.ID == id {
+			p.schedules = append(p.schedules[:i], p.schedules[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type fakeFirewall struct{}
+
+func (fakeFirewall) Status() (string, error) { return "table inet transparent_proxy", nil }
+
+func newTestServer(reload func(context.Context) error) (*Server, *fakeProxy, *slog.LevelVar) {
+	p := &fakeProxy{conns: []proxy.Connection{{ID: 1, Inbound: "tproxy", Destination: "1.2.3.4:443", Policy: config.PolicyDirect}}}
+	level := new(slog.LevelVar)
+	return NewServer("/run/tproxy.sock", nil, "", p, fakeFirewall{}, reload, level), p, level
+}
+
+func TestServer(t *testing.T) {
+	reloadErr := errors.New("bad config")
+	var reloads int
+	srv, p, level := newTestServer(func(context.Context) error {
+		reloads++
+		if reloads > 1 {
+			return reloadErr
+		}
+		return nil
+	})
+	h := srv.Handler()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"GET", "/connections", "", http.StatusOK, `"destination":"1.2.3.4:443"`},
+		{"DELETE", "/connections/2", "", http.StatusNotFound, ""},
+		{"DELETE", "/connections/x", "", http.StatusBadRequest, ""},
+		{"DELETE", "/connections/1", "", http.StatusNoContent, ""},
+		{"GET", "/firewall", "", http.StatusOK, "transparent_proxy"},
+		{"GET", "/rules/match?host=example.com", "", http.StatusOK, `"rule":"DOMAIN,example.com"`},
+		{"GET", "/rules/match", "", http.StatusBadRequest, ""},
+		{"GET", "/rules/match?host=example.com&port=70000", "", http.StatusBadRequest, ""},
+		{"GET", "/rules/match?host=example.com&src=lan", "", http.StatusBadRequest, ""},
+		{"POST", "/reload", "", http.StatusNoContent, ""},
+		{"POST", "/reload", "", http.StatusUnprocessableEntity, "bad config"},
+		{"GET", "/upstreams", "", http.StatusOK, `"exit":{"ip":"203.0.113.7","country":"JP"`},
+		{"POST", "/upstreams/rotate-credentials", "", http.StatusNoContent, ""},
+		{"POST", "/upstreams/rotate-credentials", "", http.StatusInternalServerError, "password file"},
+		{"POST", "/schedules", `{"rule":"DOMAIN-SUFFIX,tiktok.com,REJECT","from":"22:00","to":"07:00"}`, http.StatusCreated, `"id":1`},
+		{"POST", "/schedules", `{"rule":"DOMAIN,a.com,REJECT","from":"07:00","to":"07:00"}`, http.StatusBadRequest, "invalid scheduled rule"},
+		{"POST", "/schedules", `{`, http.StatusBadRequest, ""},
+		{"GET", "/schedules", "", http.StatusOK, `"rule":"DOMAIN-SUFFIX,tiktok.com,REJECT"`},
+		{"DELETE", "/schedules/1", "", http.StatusNoContent, ""},
+		{"DELETE", "/schedules/1", "", http.StatusNotFound, ""},
+		{"PUT", "/groups/Office", `{"selected":"personal"}`, http.StatusOK, `"selected":"personal"`},
+		{"PUT", "/groups/Office", `{"selected":"DIRECT"}`, http.StatusBadRequest, "invalid selection"},
+		{"PUT", "/groups/Missing", `{"selected":"work"}`, http.StatusNotFound, "unknown proxy group"},
+		{"PUT", "/groups/Office", `{`, http.StatusBadRequest, ""},
+		{"PUT", "/log-level", `{"level":"debug"}`, http.StatusOK, `"level":"debug"`},
+		{"PUT", "/log-level", `{"level":"loud"}`, http.StatusBadRequest, ""},
+		{"GET", "/log-level", "", http.StatusOK, `"level":"debug"`},
+		{"POST", "/connections", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+		}
+		if !strings.Contains(rec.Body.String(), tt.want) {
+			t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, rec.Body.String(), tt.want)
+		}
+	}
+
+	if len(p.closed) != 1 || p.closed[0] != 1 {
+		t.Errorf("closed = %v, want [1]", p.closed)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Errorf("level = %s, want debug", level.Level())
+	}
+}
+
+func TestServer_TCPAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		clientCert bool
+		header     string
+		method     string
+		path       string
+		status     int
+	}{
+		{"open read", "", false, "", "GET", "/connections", http.StatusOK},
+		{"open reload", "", false, "", "POST", "/reload", http.StatusNotFound},
+		{"open log level", "", false, "", "PUT", "/log-level", http.StatusMethodNotAllowed},
+		{"missing token", "secret", false, "", "GET", "/connections", http.StatusUnauthorized},
+		{"wrong token", "secret", false, "Bearer guess", "POST", "/reload", http.StatusUnauthorized},
+		{"basic auth", "secret", false, "Basic c2VjcmV0", "POST", "/reload", http.StatusUnauthorized},
+		{"token read", "secret", false, "Bearer secret", "GET", "/connections", http.StatusOK},
+		{"token reload", "secret", false, "Bearer secret", "POST", "/reload", http.StatusNoContent},
+		{"client cert reload", "", true, "", "POST", "/reload", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		var reloads int
+		var tlsConfig *tls.Config
+		if tt.clientCert {
+			tlsConfig = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert}
+		}
+		srv := NewServer("127.0.0.1:9090", tlsConfig, tt.token, &fakeProxy{}, fakeFirewall{}, func(context.Context) error {
+			reloads++
+			return nil
+		}, new(slog.LevelVar))
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: %s %s status = %d, want %d", tt.name, tt.method, tt.path, rec.Code, tt.status)
+		}
+		if want := tt.status == http.StatusNoContent; (reloads == 1) != want {
+			t.Errorf("%s: reloads = %d", tt.name, reloads)
+		}
+	}
+}
+
+func TestServer_NoFirewall(t *testing.T) {
+	srv := NewServer("/run/tproxy.sock", nil, "", &fakeProxy{}, nil, nil, new(slog.LevelVar))
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/firewall", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /firewall status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestListConnectionsEmpty(t *testing.T) {
+	srv, p, _ := newTestServer(nil)
+	p.conns = nil
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/connections", nil))
+
+	var conns []proxy.Connection
+	if err := json.Unmarshal(rec.Body.Bytes(), &conns); err != nil || conns == nil {
+		t.Errorf("body = %q, want an empty list", rec.Body.String())
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+	p := &fakeProxy{conns: []proxy.Connection{{ID: 1, Destination: "1.2.3.4:443"}}}
+	level := new(slog.LevelVar)
+	path := filepath.Join(t.TempDir(), "status.sock")
+	srv := NewStatusServer(path, -1, p, fakeFirewall{}, level)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	var info os.FileInfo
+	var err error
+	for range 100 {
+		if info, err = os.Stat(path); err == nil && info.Mode().Perm() == 0666 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || info.Mode().Perm() != 0666 {
+		t.Fatalf("socket = %v, %v, want mode 0666", info, err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/connections", "", http.StatusOK},
+		{"GET", "/upstreams", "", http.StatusOK},
+		{"GET", "/log-level", "", http.StatusOK},
+		{"DELETE", "/connections/1", "", http.StatusNotFound},
+		{"POST", "/reload", "", http.StatusNotFound},
+		{"POST", "/schedules", `{"rule":"DOMAIN,a.com,REJECT","from":"22:00","to":"07:00"}`, http.StatusMethodNotAllowed},
+		{"PUT", "/log-level", `{"level":"debug"}`, http.StatusMethodNotAllowed},
+		{"PUT", "/groups/Office", `{"selected":"work"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "http://localhost"+tt.path, strings.NewReader(tt.body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+	}
+	if len(p.closed) != 0 || len(p.schedules) != 0 || level.Level() != slog.LevelInfo {
+		t.Errorf("read-only server changed state: closed %v, schedules %v, level %s", p.closed, p.schedules, level.Level())
+	}
+}
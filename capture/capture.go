@@ -0,0 +1,85 @@
+// Package capture extracts the connections recorded in packet captures and
+// connection list exports, for replaying them through the rules
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/cnfatal/proxy/rules"
+)
+
+// Flow is a recorded connection as the rules see it
+type Flow struct {
+	Network string // tcp or udp
+	Domain  string
+	IP      net.IP
+	Port    uint16
+	SrcMAC  net.HardwareAddr
+}
+
+// Metadata returns the connection metadata the rules match for the flow
+func (f *Flow) Metadata() *rules.Metadata {
+	return &rules.Metadata{Domain: f.Domain, DstIP: f.IP, DstPort: f.Port, SrcMAC: f.SrcMAC}
+}
+
+// Read loads the flows of a pcap or pcapng capture, or of a JSON connection
+// list as returned by GET /connections, in the order they started
+func Read(path string) ([]Flow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64*1024)
+	magic, err := r.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var flows []Flow
+	if isCapture(magic) {
+		flows, err = ReadPackets(r)
+	} else {
+		flows, err = ReadConnections(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return flows, nil
+}
+
+// ReadConnections decodes a JSON connection list as returned by GET /connections
+func ReadConnections(r io.Reader) ([]Flow, error) {
+	var conns []struct {
+		Destination string `json:"destination"`
+		Domain      string `json:"domain"`
+	}
+	if err := json.NewDecoder(r).Decode(&conns); err != nil {
+		return nil, err
+	}
+
+	flows := make([]Flow, 0, len(conns))
+	for i, c := range conns {
+		host, portStr, err := net.SplitHostPort(c.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("connection %d: invalid destination %q", i+1, c.Destination)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("connection %d: invalid destination %q", i+1, c.Destination)
+		}
+		flow := Flow{Network: "tcp", Domain: c.Domain, IP: net.ParseIP(host), Port: uint16(port)}
+		// Explicit proxy clients request hosts rather than addresses
+		if flow.IP == nil && flow.Domain == "" {
+			flow.Domain = host
+		}
+		flows = append(flows, flow)
+	}
+	return flows, nil
+}
@@ -0,0 +1,234 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var clientMAC = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+// ipPacket builds an IPv4 or IPv6 packet carrying a TCP segment with flags,
+// or a UDP datagram when udp is set
+func ipPacket(src, dst netip.AddrPort, udp bool, flags byte, payload []byte) []byte {
+	var l4 []byte
+	if udp {
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	} else {
+		l4 = make([]byte, 20)
+		l4[12], l4[13] = 5<<4, flags
+	}
+	binary.BigEndian.PutUint16(l4, src.Port())
+	binary.BigEndian.PutUint16(l4[2:], dst.Port())
+	l4 = append(l4, payload...)
+
+	proto := byte(6)
+	if udp {
+		proto = 17
+	}
+	if src.Addr().Is4() {
+		h := make([]byte, 20)
+		h[0] = 0x45
+		binary.BigEndian.PutUint16(h[2:], uint16(20+len(l4)))
+		h[8], h[9] = 64, proto
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(h[12:], s[:])
+		copy(h[16:], d[:])
+		return append(h, l4...)
+	}
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(len(l4)))
+	h[6], h[7] = proto, 64
+	s, d := src.Addr().As16(), dst.Addr().As16()
+	copy(h[8:], s[:])
+	copy(h[24:], d[:])
+	return append(h, l4...)
+}
+
+func ethernet(src net.HardwareAddr, ip []byte) []byte {
+	frame := make([]byte, 14, 14+len(ip))
+	copy(frame[6:], src)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	if ip[0]>>4 == 6 {
+		binary.BigEndian.PutUint16(frame[12:], 0x86dd)
+	}
+	return append(frame, ip...)
+}
+
+func writePcap(link uint32, packets [][]byte) []byte {
+	var b bytes.Buffer
+	header := make([]byte, 24)
+	copy(header, []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0})
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], link)
+	b.Write(header)
+	for _, p := range packets {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(p)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(p)))
+		b.Write(record)
+		b.Write(p)
+	}
+	return b.Bytes()
+}
+
+func writePcapng(link uint16, packets [][]byte) []byte {
+	var b bytes.Buffer
+	block := func(kind uint32, body []byte) {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		size := uint32(12 + len(body))
+		binary.Write(&b, binary.BigEndian, kind)
+		binary.Write(&b, binary.BigEndian, size)
+		b.Write(body)
+		binary.Write(&b, binary.BigEndian, size)
+	}
+	shb := make([]byte, 16)
+	binary.BigEndian.PutUint32(shb, pcapngByteOrderMagic)
+	binary.BigEndian.PutUint16(shb[4:], 1)
+	for i := 8; i < 16; i++ {
+		shb[i] = 0xff // unknown section length
+	}
+	block(pcapngSectionHeader, shb)
+	idb := make([]byte, 8)
+	binary.BigEndian.PutUint16(idb, link)
+	block(pcapngInterface, idb)
+	block(0x0bad, []byte("custom block"))
+	for _, p := range packets {
+		epb := make([]byte, 20, 20+len(p))
+		binary.BigEndian.PutUint32(epb[12:], uint32(len(p)))
+		binary.BigEndian.PutUint32(epb[16:], uint32(len(p)))
+		block(pcapngEnhancedPacket, append(epb, p...))
+	}
+	return b.Bytes()
+}
+
+func dnsAnswer(t *testing.T, name string, ip net.IP) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Response = true
+	msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}}
+	data, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestReadPackets(t *testing.T) {
+	client := netip.MustParseAddr("192.168.1.10")
+	web := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.1"), 80)
+	cached := netip.AddrPortFrom(netip.MustParseAddr("203.0.113.2"), 443)
+	resolver := netip.AddrPortFrom(netip.MustParseAddr("192.168.1.1"), 53)
+	c1, c2, c3 := netip.AddrPortFrom(client, 40001), netip.AddrPortFrom(client, 40002), netip.AddrPortFrom(client, 40003)
+
+	request := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	packets := [][]byte{
+		ipPacket(c3, resolver, true, 0, []byte("query")),
+		ipPacket(resolver, c3, true, 0, dnsAnswer(t, "Cached.Example.", cached.Addr().AsSlice())),
+		ipPacket(c1, web, false, tcpFlagSYN, nil),
+		ipPacket(c1, web, false, tcpFlagSYN, nil), // retransmitted
+		ipPacket(web, c1, false, tcpFlagSYN|tcpFlagACK, nil),
+		// The request spans two segments
+		ipPacket(c1, web, false, tcpFlagACK, request[:10]),
+		ipPacket(c1, web, false, tcpFlagACK, request[10:]),
+		ipPacket(c2, cached, false, tcpFlagSYN, nil),
+		// Mid-stream packets of an uncaptured connection
+		ipPacket(netip.AddrPortFrom(client, 40004), web, false, tcpFlagACK, request),
+	}
+	want := []Flow{
+		{Network: "udp", IP: net.ParseIP("192.168.1.1").To4(), Port: 53, SrcMAC: clientMAC},
+		{Network: "tcp", Domain: "www.example.com", IP: net.ParseIP("203.0.113.1").To4(), Port: 80, SrcMAC: clientMAC},
+		{Network: "tcp", Domain: "cached.example", IP: net.ParseIP("203.0.113.2").To4(), Port: 443, SrcMAC: clientMAC},
+	}
+
+	frames := make([][]byte, len(packets))
+	for i, p := range packets {
+		frames[i] = ethernet(clientMAC, p)
+	}
+	raw := make([]Flow, len(want))
+	copy(raw, want)
+	for i := range raw {
+		raw[i].SrcMAC = nil
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want []Flow
+	}{
+		{"pcap ethernet", writePcap(linkEthernet, frames), want},
+		{"pcapng raw", writePcapng(linkRaw, packets), raw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture")
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			flows, err := Read(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(flows, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", flows, tt.want)
+			}
+		})
+	}
+
+	t.Run("ipv6", func(t *testing.T) {
+		src := netip.MustParseAddrPort("[2001:db8::10]:40001")
+		dst := netip.MustParseAddrPort("[2001:db8::1]:443")
+		flows, err := ReadPackets(bytes.NewReader(writePcap(linkIPv6, [][]byte{ipPacket(src, dst, false, tcpFlagSYN, nil)})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Flow{{Network: "tcp", IP: net.ParseIP("2001:db8::1"), Port: 443}}
+		if !reflect.DeepEqual(flows, want) {
+			t.Errorf("ReadPackets() = %+v, want %+v", flows, want)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		data := writePcap(linkRaw, [][]byte{ipPacket(c1, web, false, tcpFlagSYN, nil)})
+		if _, err := ReadPackets(bytes.NewReader(data[:len(data)-4])); err == nil {
+			t.Error("ReadPackets(truncated) expected error")
+		}
+	})
+}
+
+func TestReadConnections(t *testing.T) {
+	data := `[
+		{"id": 1, "inbound": "tproxy", "destination": "203.0.113.1:443", "domain": "www.example.com", "policy": "PROXY"},
+		{"id": 2, "inbound": "http", "destination": "api.example.com:8443", "policy": "DIRECT"},
+		{"id": 3, "inbound": "tproxy", "destination": "[2001:db8::1]:80", "policy": "DIRECT"}
+	]`
+	flows, err := ReadConnections(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Flow{
+		{Network: "tcp", Domain: "www.example.com", IP: net.ParseIP("203.0.113.1"), Port: 443},
+		{Network: "tcp", Domain: "api.example.com", Port: 8443},
+		{Network: "tcp", IP: net.ParseIP("2001:db8::1"), Port: 80},
+	}
+	if !reflect.DeepEqual(flows, want) {
+		t.Errorf("ReadConnections() = %+v, want %+v", flows, want)
+	}
+
+	if _, err := ReadConnections(strings.NewReader(`[{"destination": "203.0.113.1"}]`)); err == nil {
+		t.Error("ReadConnections(destination without port) expected error")
+	}
+}
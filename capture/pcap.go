@@ -0,0 +1,387 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+
+	"github.com/cnfatal/proxy/proxy"
+	"github.com/cnfatal/proxy/rules"
+	"github.com/miekg/dns"
+)
+
+// Link layer types of captured packets
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkLinuxSLL  = 113
+	linkIPv4      = 228
+	linkIPv6      = 229
+	linkLinuxSLL2 = 276
+)
+
+// pcapng block types
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 1
+	pcapngSimplePacket   = 3
+	pcapngEnhancedPacket = 6
+)
+
+const (
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	maxPacketSize        = 256 * 1024
+	maxPcapngBlockSize   = 16 * 1024 * 1024
+
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// isCapture reports whether a file starts like a pcap, in either byte order
+// or timestamp precision, or a pcapng capture
+func isCapture(magic []byte) bool {
+	switch string(magic) {
+	case "\xa1\xb2\xc3\xd4", "\xd4\xc3\xb2\xa1", "\xa1\xb2\x3c\x4d", "\x4d\x3c\xb2\xa1", "\x0a\x0d\x0d\x0a":
+		return true
+	}
+	return false
+}
+
+// ReadPackets reassembles the flows of a pcap or pcapng capture. TCP flows
+// start at the client's SYN and take the domain of the TLS ClientHello or HTTP
+// request it sent, or else of a DNS answer captured earlier for the address.
+// UDP flows are routed by address, as the proxy does. Packets of connections
+// whose start was not captured are ignored.
+func ReadPackets(r io.Reader) ([]Flow, error) {
+	a := &assembler{tcp: make(map[[2]netip.AddrPort]*tcpFlow), udp: make(map[[2]netip.AddrPort]bool), dns: make(map[netip.Addr]string)}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	var err error
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		err = readPcapng(io.MultiReader(bytes.NewReader(magic), r), a.packet)
+	} else {
+		err = readPcap(magic, r, a.packet)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.finish(), nil
+}
+
+func readPcap(magic []byte, r io.Reader, fn func(link uint32, data []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic[0] == 0xa1 {
+		order = binary.BigEndian
+	}
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("truncated pcap header: %w", err)
+	}
+	link := order.Uint32(header[16:]) & 0xffff
+
+	record := make([]byte, 16)
+	data := make([]byte, maxPacketSize)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("truncated pcap record: %w", err)
+		}
+		n := order.Uint32(record[8:])
+		if n > maxPacketSize {
+			return fmt.Errorf("pcap record of %d bytes exceeds %d", n, maxPacketSize)
+		}
+		if _, err := io.ReadFull(r, data[:n]); err != nil {
+			return fmt.Errorf("truncated pcap record: %w", err)
+		}
+		fn(link, data[:n])
+	}
+}
+
+func readPcapng(r io.Reader, fn func(link uint32, data []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var links []uint32
+	header := make([]byte, 8)
+	var block []byte
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("truncated pcapng block: %w", err)
+		}
+		if binary.LittleEndian.Uint32(header) == pcapngSectionHeader {
+			bom := make([]byte, 4)
+			if _, err := io.ReadFull(r, bom); err != nil {
+				return fmt.Errorf("truncated pcapng section header: %w", err)
+			}
+			switch {
+			case binary.LittleEndian.Uint32(bom) == pcapngByteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom) == pcapngByteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return errors.New("invalid pcapng byte order magic")
+			}
+			links = links[:0]
+			size := order.Uint32(header[4:])
+			if size < 16 || size > maxPcapngBlockSize {
+				return fmt.Errorf("invalid pcapng block length %d", size)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(size)-12); err != nil {
+				return fmt.Errorf("truncated pcapng section header: %w", err)
+			}
+			continue
+		}
+
+		kind, size := order.Uint32(header), order.Uint32(header[4:])
+		if size < 12 || size%4 != 0 || size > maxPcapngBlockSize {
+			return fmt.Errorf("invalid pcapng block length %d", size)
+		}
+		if cap(block) < int(size)-8 {
+			block = make([]byte, size-8)
+		}
+		body := block[:size-8]
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("truncated pcapng block: %w", err)
+		}
+		body = body[:len(body)-4] // trailing length
+
+		switch kind {
+		case pcapngInterface:
+			if len(body) >= 2 {
+				links = append(links, uint32(order.Uint16(body)))
+			}
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				continue
+			}
+			iface, n := order.Uint32(body), order.Uint32(body[12:])
+			if int(iface) < len(links) && int(n) <= len(body)-20 {
+				fn(links[iface], body[20:20+n])
+			}
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(links) == 0 {
+				continue
+			}
+			n := min(int(order.Uint32(body)), len(body)-4)
+			fn(links[0], body[4:4+n])
+		}
+	}
+}
+
+// packet is the part of a captured packet the flows are built from
+type packet struct {
+	srcMAC   net.HardwareAddr
+	src, dst netip.AddrPort
+	udp      bool
+	flags    byte
+	payload  []byte
+}
+
+// decode parses a TCP or UDP packet over IPv4 or IPv6
+func decode(link uint32, data []byte) (p packet, ok bool) {
+	switch link {
+	case linkEthernet:
+		if len(data) < 14 {
+			return p, false
+		}
+		p.srcMAC = data[6:12]
+		ethType, off := binary.BigEndian.Uint16(data[12:]), 14
+		for (ethType == 0x8100 || ethType == 0x88a8) && len(data) >= off+4 {
+			ethType, off = binary.BigEndian.Uint16(data[off+2:]), off+4
+		}
+		if ethType != 0x0800 && ethType != 0x86dd {
+			return p, false
+		}
+		data = data[off:]
+	case linkLinuxSLL:
+		if len(data) < 16 {
+			return p, false
+		}
+		if binary.BigEndian.Uint16(data[4:]) == 6 {
+			p.srcMAC = data[6:12]
+		}
+		data = data[16:]
+	case linkLinuxSLL2:
+		if len(data) < 20 {
+			return p, false
+		}
+		if data[11] == 6 {
+			p.srcMAC = data[12:18]
+		}
+		data = data[20:]
+	case linkNull:
+		if len(data) < 4 {
+			return p, false
+		}
+		data = data[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return p, false
+	}
+	if len(data) == 0 {
+		return p, false
+	}
+
+	var proto byte
+	var src, dst netip.Addr
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return p, false
+		}
+		ihl, total := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:]))
+		if ihl < 20 || ihl > len(data) || total < ihl || binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+			return p, false
+		}
+		proto = data[9]
+		src, dst = netip.AddrFrom4([4]byte(data[12:16])), netip.AddrFrom4([4]byte(data[16:20]))
+		data = data[ihl:min(total, len(data))]
+	case 6:
+		if len(data) < 40 {
+			return p, false
+		}
+		proto = data[6]
+		src, dst = netip.AddrFrom16([16]byte(data[8:24])), netip.AddrFrom16([16]byte(data[24:40]))
+		data = data[40:min(40+int(binary.BigEndian.Uint16(data[4:])), len(data))]
+		// Hop-by-hop, routing and destination options headers
+		for (proto == 0 || proto == 43 || proto == 60) && len(data) >= 8 {
+			n := (int(data[1]) + 1) * 8
+			if n > len(data) {
+				return p, false
+			}
+			proto, data = data[0], data[n:]
+		}
+	default:
+		return p, false
+	}
+
+	switch proto {
+	case 6:
+		if len(data) < 20 {
+			return p, false
+		}
+		off := int(data[12]>>4) * 4
+		if off < 20 || off > len(data) {
+			return p, false
+		}
+		p.flags, p.payload = data[13], data[off:]
+	case 17:
+		if len(data) < 8 {
+			return p, false
+		}
+		p.udp, p.payload = true, data[8:]
+	default:
+		return p, false
+	}
+	p.src = netip.AddrPortFrom(src.Unmap(), binary.BigEndian.Uint16(data))
+	p.dst = netip.AddrPortFrom(dst.Unmap(), binary.BigEndian.Uint16(data[2:]))
+	return p, true
+}
+
+// tcpFlow is a TCP flow awaiting the client's first bytes
+type tcpFlow struct {
+	index  int
+	buf    []byte
+	done   bool
+	cached string // domain last answered for the server address
+}
+
+// assembler builds flows from packets in capture order
+type assembler struct {
+	flows []Flow
+	tcp   map[[2]netip.AddrPort]*tcpFlow // keyed by client and server
+	udp   map[[2]netip.AddrPort]bool
+	dns   map[netip.Addr]string
+}
+
+func (a *assembler) packet(link uint32, data []byte) {
+	p, ok := decode(link, data)
+	if !ok {
+		return
+	}
+	key := [2]netip.AddrPort{p.src, p.dst}
+	if p.udp {
+		a.datagram(p, key)
+		return
+	}
+
+	if p.flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN {
+		if _, ok := a.tcp[key]; ok {
+			return // retransmitted SYN
+		}
+		a.tcp[key] = &tcpFlow{index: len(a.flows), cached: a.dns[p.dst.Addr()]}
+		a.flows = append(a.flows, a.flow("tcp", p))
+		return
+	}
+	f, ok := a.tcp[key]
+	if !ok || f.done || len(p.payload) == 0 {
+		return
+	}
+	f.buf = append(f.buf, p.payload[:min(len(p.payload), proxy.SmallBufferSize-len(f.buf))]...)
+	domain, done := proxy.SniffDomain(f.buf)
+	if done || len(f.buf) >= proxy.SmallBufferSize {
+		a.flows[f.index].Domain = domain
+		f.done, f.buf = true, nil
+	}
+}
+
+func (a *assembler) datagram(p packet, key [2]netip.AddrPort) {
+	if p.src.Port() == 53 {
+		a.storeAnswers(p.payload)
+	}
+	if a.udp[key] || a.udp[[2]netip.AddrPort{p.dst, p.src}] {
+		return
+	}
+	a.udp[key] = true
+	a.flows = append(a.flows, a.flow("udp", p))
+}
+
+func (a *assembler) flow(network string, p packet) Flow {
+	f := Flow{Network: network, IP: net.IP(p.dst.Addr().AsSlice()), Port: p.dst.Port()}
+	if p.srcMAC != nil {
+		f.SrcMAC = append(net.HardwareAddr(nil), p.srcMAC...)
+	}
+	return f
+}
+
+// storeAnswers records the domains DNS replies resolved addresses for
+func (a *assembler) storeAnswers(payload []byte) {
+	var msg dns.Msg
+	if msg.Unpack(payload) != nil || !msg.Response || len(msg.Question) == 0 {
+		return
+	}
+	domain := rules.CanonicalDomain(msg.Question[0].Name)
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			a.dns[addr.Unmap()] = domain
+		}
+	}
+}
+
+// finish gives flows whose sniff never completed the domain cached for their
+// address, as the proxy does when sniffing times out
+func (a *assembler) finish() []Flow {
+	for _, f := range a.tcp {
+		if !f.done {
+			a.flows[f.index].Domain = f.cached
+		}
+	}
+	return a.flows
+}
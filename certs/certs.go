@@ -0,0 +1,100 @@
+// Package certs provides the certificates presented by TLS listeners, read
+// from files or issued and renewed through ACME, and the CAs their client
+// certificates are verified against.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// CacheDir holds ACME account keys and issued certificates, relative to the data directory
+const CacheDir = "acme"
+
+// Source provides the certificate of a TLS listener
+type Source struct {
+	tls        *tls.Config
+	manager    *autocert.Manager
+	httpListen string
+}
+
+// New creates the certificate source described by spec, which must have
+// been validated. ACME state is stored under dataDir.
+func New(spec *config.ServerTLS, dataDir string) (*Source, error) {
+	var s *Source
+	if spec.ACME == nil {
+		cert, err := tls.LoadX509KeyPair(spec.Cert, spec.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+		s = &Source{tls: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	} else {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(spec.ACME.Domains...),
+			Cache:      autocert.DirCache(filepath.Join(dataDir, CacheDir)),
+			Email:      spec.ACME.Email,
+		}
+		if spec.ACME.DirectoryURL != "" {
+			m.Client = &acme.Client{DirectoryURL: spec.ACME.DirectoryURL}
+		}
+		s = &Source{tls: m.TLSConfig(), manager: m, httpListen: spec.ACME.HTTPListen}
+	}
+
+	if spec.ClientCA != "" {
+		data, err := os.ReadFile(spec.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in client CA %s", spec.ClientCA)
+		}
+		s.tls.ClientCAs = pool
+		s.tls.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return s, nil
+}
+
+// TLSConfig returns the server configuration presenting the certificate.
+// With ACME it also answers TLS-ALPN-01 challenges, certificates are
+// issued on the first handshake and renewed before they expire.
+func (s *Source) TLSConfig() *tls.Config {
+	return s.tls
+}
+
+// Run answers HTTP-01 challenges until the context is cancelled, other
+// plain HTTP requests are redirected to https. It returns immediately
+// when HTTP-01 is not configured.
+func (s *Source) Run(ctx context.Context) error {
+	if s.manager == nil || s.httpListen == "" {
+		return nil
+	}
+	srv := &http.Server{
+		Addr:              s.httpListen,
+		Handler:           s.manager.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("ACME HTTP-01 challenges listening", "addr", s.httpListen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy.example.com"},
+		DNSNames:     []string{"proxy.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestNew_Files(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSigned(t, dir)
+
+	source, err := New(&config.ServerTLS{Cert: certFile, Key: keyFile}, dir)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cert := source.TLSConfig().Certificates[0].Leaf
+	if cert == nil || cert.Subject.CommonName != "proxy.example.com" {
+		t.Errorf("certificate = %v, want proxy.example.com", cert)
+	}
+	if err := source.Run(t.Context()); err != nil {
+		t.Errorf("Run() error = %v, want immediate return", err)
+	}
+
+	if _, err := New(&config.ServerTLS{Cert: certFile, Key: filepath.Join(dir, "missing.pem")}, dir); err == nil {
+		t.Error("New() with a missing key succeeded")
+	}
+	if cfg := source.TLSConfig(); cfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("ClientAuth = %v without client_ca", cfg.ClientAuth)
+	}
+
+	source, err = New(&config.ServerTLS{Cert: certFile, Key: keyFile, ClientCA: certFile}, dir)
+	if err != nil {
+		t.Fatalf("New() with client_ca error = %v", err)
+	}
+	if cfg := source.TLSConfig(); cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Errorf("ClientAuth = %v, want client certificates verified", cfg.ClientAuth)
+	}
+	if _, err := New(&config.ServerTLS{Cert: certFile, Key: keyFile, ClientCA: keyFile}, dir); err == nil {
+		t.Error("New() with a client CA without certificates succeeded")
+	}
+}
+
+func TestNew_ACME(t *testing.T) {
+	dir := t.TempDir()
+	source, err := New(&config.ServerTLS{ACME: &config.ACMEConfig{Domains: []string{"proxy.example.com"}}}, dir)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	cfg := source.TLSConfig()
+	if !slices.Contains(cfg.NextProtos, acme.ALPNProto) {
+		t.Errorf("NextProtos = %v, want %s for TLS-ALPN-01", cfg.NextProtos, acme.ALPNProto)
+	}
+	if got, want := source.manager.Cache, autocert.DirCache(filepath.Join(dir, CacheDir)); got != want {
+		t.Errorf("cache = %v, want %v", got, want)
+	}
+
+	// Names outside the configured domains are refused before contacting the CA
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("GetCertificate(other.example.com) succeeded, want host policy rejection")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/iptables"
+	"github.com/cnfatal/proxy/proxy"
+)
+
+// Cleanup targets, removed in this order
+var cleanupTargets = []string{"firewall", "routing", "state", "data"}
+
+// runCleanupCommand implements the "cleanup" subcommand removing what the
+// proxy installs in the kernel or leaves in the data directory, and returns
+// the exit code. Without targets it removes the firewall and routing, as the
+// proxy does on exit.
+func runCleanupCommand(args []string) int {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	cfgPath := flags.String("config", "config.yaml", "Configuration naming the state and data files")
+	dataDir := flags.String("data-dir", "", "Directory for downloaded and persisted data (overrides data_dir)")
+	dryRun := flags.Bool("dry-run", false, "Print what would be removed without removing it")
+	flags.Parse(args)
+
+	targets := flags.Args()
+	switch {
+	case len(targets) == 0:
+		targets = cleanupTargets[:2]
+	case slices.Contains(targets, "all"):
+		targets = cleanupTargets
+	}
+	for _, t := range targets {
+		if !slices.Contains(cleanupTargets, t) {
+			fmt.Fprintf(os.Stderr, "unknown cleanup target %q\n", t)
+			fmt.Fprintln(os.Stderr, "usage: tproxy cleanup [-dry-run] [-config config.yaml] [firewall] [routing] [state] [data] [all]")
+			return 2
+		}
+	}
+
+	if slices.Contains(targets, "firewall") || slices.Contains(targets, "routing") {
+		if err := iptables.CheckRoot(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	var cfg *config.Config
+	if slices.Contains(targets, "state") || slices.Contains(targets, "data") {
+		var err error
+		if cfg, err = config.Load(*cfgPath, *dataDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	mgr := iptables.NewManager(nil, iptables.Options{})
+	failed := false
+	for _, target := range cleanupTargets {
+		if !slices.Contains(targets, target) {
+			continue
+		}
+		var removed []string
+		var err error
+		switch target {
+		case "firewall":
+			removed, err = mgr.CleanupFirewall(*dryRun)
+		case "routing":
+			removed, err = mgr.CleanupRouting(*dryRun)
+		case "state":
+			removed, err = removeFiles(stateFiles(cfg), *dryRun)
+		case "data":
+			removed, err = removeFiles(dataFiles(cfg), *dryRun)
+		}
+		for _, item := range removed {
+			if *dryRun {
+				fmt.Printf("would remove %s\n", item)
+			} else {
+				fmt.Printf("removed %s\n", item)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", target, err)
+			failed = true
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// stateFiles are the files the proxy persists at runtime
+func stateFiles(cfg *config.Config) []string {
+	files := []string{cfg.DataPath(proxy.ScheduleFile), cfg.DataPath(proxy.SelectionFile)}
+	if cfg.StateFile != "" {
+		files = append(files, cfg.DataPath(cfg.StateFile))
+	}
+	return files
+}
+
+// dataFiles are the downloaded rule sets, which are fetched again on start
+func dataFiles(cfg *config.Config) []string {
+	var files []string
+	for _, p := range cfg.RuleProviders {
+		if p.Type == config.ProviderHTTP {
+			files = append(files, cfg.DataPath(p.Path))
+		}
+	}
+	slices.Sort(files)
+	return files
+}
+
+// removeFiles removes the existing files among paths and returns them, or
+// with dryRun only returns them
+func removeFiles(paths []string, dryRun bool) ([]string, error) {
+	var removed []string
+	var errs []error
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		removed = append(removed, path)
+	}
+	return removed, errors.Join(errs...)
+}
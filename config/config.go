@@ -2,12 +2,37 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cnfatal/proxy/datadir"
+	"github.com/cnfatal/proxy/dhcp"
+	"github.com/cnfatal/proxy/iptables"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// DefaultMaxOpenFiles is the RLIMIT_NOFILE target when max_open_files is unset
+	DefaultMaxOpenFiles = 65535
+	// DefaultDialTimeout bounds connecting to a destination, in seconds, when dial_timeout is unset
+	DefaultDialTimeout = 10
+	// DefaultIdleTimeout closes relays without traffic, in seconds, when idle_timeout is unset
+	DefaultIdleTimeout = 300
+	// DefaultKeepWarmRefresh replaces an unused warm tunnel, in seconds, when
+	// refresh is unset; servers tend to drop connections that send nothing
+	DefaultKeepWarmRefresh = 20
+	// DefaultMetricsSample records the connection histograms for every connection
+	DefaultMetricsSample = 1
+	// DefaultQoSWeight is the bandwidth share of connections without a qos weight
+	DefaultQoSWeight = 1
+)
+
 // Policy represents the action to take for matched traffic
 type Policy string
 
@@ -17,25 +42,261 @@ const (
 	PolicyReject Policy = "REJECT"
 )
 
+// ParsePolicy normalizes built-in policies to upper case; other names
+// refer to proxies or proxy groups and are case-sensitive
+func ParsePolicy(s string) Policy {
+	switch p := Policy(strings.ToUpper(s)); p {
+	case PolicyProxy, PolicyDirect, PolicyReject:
+		return p
+	}
+	return Policy(s)
+}
+
+// IsBuiltin reports whether p is PROXY, DIRECT or REJECT
+func (p Policy) IsBuiltin() bool {
+	return p == PolicyProxy || p == PolicyDirect || p == PolicyReject
+}
+
+// Proxy group types
+const (
+	GroupSelect      = "select"
+	GroupFallback    = "fallback"
+	GroupURLTest     = "url-test"
+	GroupLoadBalance = "load-balance"
+	// GroupTrafficClass sends destinations observed as bulk transfers to its
+	// second member and everything else to its first
+	GroupTrafficClass = "traffic-class"
+)
+
+const (
+	// DefaultHealthCheckURL is probed by fallback, url-test and load-balance groups when url is unset
+	DefaultHealthCheckURL = "http://www.gstatic.com/generate_204"
+	// DefaultHealthCheckInterval is the probe interval in seconds when interval is unset
+	DefaultHealthCheckInterval = 300
+	// DefaultExitCheckInterval is the exit lookup interval in seconds when interval is unset
+	DefaultExitCheckInterval = 600
+	// DefaultWarmup is the traffic-class observation window in seconds
+	DefaultWarmup = 10
+	// DefaultBulkRate is the traffic-class throughput above which a destination is bulk
+	DefaultBulkRate ByteSize = 1 << 20
+)
+
+// Interception modes
+const (
+	// ModeTProxy marks traffic with nftables TPROXY rules for IPv4 and IPv6, TCP and UDP
+	ModeTProxy = "tproxy"
+	// ModeRedirect NATs TCP traffic to the proxy port and reads SO_ORIGINAL_DST
+	ModeRedirect = "redirect"
+)
+
 // Config represents the main configuration structure
 type Config struct {
 	// Listen address for the transparent proxy (e.g., ":12345")
 	Listen string `yaml:"listen"`
 
-	// Upstream proxy URL (http:// or socks5://)
-	Upstream string `yaml:"upstream"`
+	// Optional listen addresses of explicit HTTP CONNECT and SOCKS5 proxies
+	HTTPListen  string `yaml:"http_listen"`
+	SOCKSListen string `yaml:"socks_listen"`
+
+	// Optional control API address, or an absolute path for a unix socket
+	APIListen string `yaml:"api_listen"`
+
+	// Serve the control API over TLS (TCP only)
+	APITLS *ServerTLS `yaml:"api_tls"`
+
+	// File holding the bearer token every control API request must carry.
+	// Without it a TCP api_listen serves only the read-only routes.
+	APITokenFile string `yaml:"api_token_file"`
+
+	// Optional unix socket serving the read-only API routes to unprivileged users
+	StatusListen string `yaml:"status_listen"`
+
+	// Group allowed to connect to status_listen, everyone when empty
+	StatusGroup string `yaml:"status_group"`
+
+	// Optional address, or absolute unix socket path, answering whether the
+	// rules would let a connection through, for external authorization
+	AuthzListen string `yaml:"authz_listen"`
+
+	// Optional address serving Prometheus metrics at /metrics
+	MetricsListen string `yaml:"metrics_listen"`
+
+	// Record the size and duration histograms for one in every N connections
+	MetricsSample int `yaml:"metrics_sample"`
+
+	// Interception mode: tproxy (default) or redirect
+	Mode string `yaml:"mode"`
+
+	// Also intercept traffic forwarded from LAN hosts when running on a router
+	Gateway bool `yaml:"gateway"`
+
+	// Source networks intercepted in gateway mode. The explicit listeners
+	// admit clients beyond loopback only from its include networks.
+	GatewaySources SourceFilter `yaml:"gateway_sources"`
+
+	// UDP destination ports intercepted via TPROXY (e.g., [53, 443] for DNS and QUIC)
+	UDPPorts []uint16 `yaml:"udp_ports"`
+
+	// Upstream proxy, or chain of proxies, used by the PROXY policy
+	Upstream ProxyChain `yaml:"upstream"`
+
+	// Install the interception rules only once a health check through the
+	// upstream succeeds, so a down upstream does not cut off all traffic
+	RequireUpstreamHealthy bool `yaml:"require_upstream_healthy"`
+
+	// Named upstream proxies or chains usable as rule policies
+	Proxies map[string]ProxyChain `yaml:"proxies"`
+
+	// Named DIRECT variants leaving through their own kernel routing table,
+	// usable as rule policies and group members
+	DirectRoutes map[string]DirectRoute `yaml:"direct_routes"`
+
+	// Clash-style proxy groups usable as rule policies
+	ProxyGroups []ProxyGroup `yaml:"proxy-groups"`
+
+	// Periodic lookup of the address and country each upstream exits from
+	ExitCheck ExitCheck `yaml:"exit_check"`
 
 	// DNS configuration
 	DNS DNSConfig `yaml:"dns"`
 
 	// Clash-compatible rules
-	Rules []string `yaml:"rules"`
+	Rules []RuleEntry `yaml:"rules"`
+
+	// Parameterized rule lists callable from rules
+	RuleTemplates map[string]RuleTemplate `yaml:"rule_templates"`
+
+	// Answer rejected connections with an HTTP 403 page naming the matched rule
+	// and its comment, or a TLS access_denied alert, instead of just closing them
+	RejectResponse bool `yaml:"reject_response"`
+
+	// Detection of plaintext HTTP, FTP and SMTP on non-standard ports
+	Plaintext PlaintextConfig `yaml:"plaintext"`
+
+	// Handling of FTP and SIP, which carry addresses in their payload
+	ALG ALGConfig `yaml:"alg"`
+
+	// Destinations kept pre-connected through the upstream they route to
+	KeepWarm []KeepWarm `yaml:"keep_warm"`
+
+	// Rule sets referenced by RULE-SET rules
+	RuleProviders map[string]RuleProvider `yaml:"rule-providers"`
+
+	// MaxMind/GeoLite2 country database used by GEOIP rules
+	GeoIPDatabase string `yaml:"geoip_database"`
+
+	// Daily window for automatic rule set and GeoIP database updates
+	Updates Updates `yaml:"updates"`
 
 	// Log level (debug, info, warn, error)
 	LogLevel string `yaml:"log_level"`
 
-	// Parsed upstream URL
-	UpstreamURL *url.URL `yaml:"-"`
+	// Per-connection reactions to transferred volume, e.g. throttle after 1GB
+	TransferLimits []TransferLimit `yaml:"transfer_limits"`
+
+	// Throughput cap of all relays, shared between connections by weight
+	QoS QoS `yaml:"qos"`
+
+	// Conntrack marks set on relayed connections by policy, for tc, nfacct and
+	// other firewall accounting
+	ConnMark ConnMark `yaml:"connmark"`
+
+	// Connection middleware compiled into the binary, run in order around
+	// every forwarded connection
+	Middleware []MiddlewareConfig `yaml:"middleware"`
+
+	// Target RLIMIT_NOFILE raised at startup
+	MaxOpenFiles uint64 `yaml:"max_open_files"`
+
+	// Seconds allowed to connect to a destination, including upstream handshakes
+	DialTimeout int `yaml:"dial_timeout"`
+
+	// Seconds a relay may go without traffic in either direction before it is
+	// closed; negative disables the timeout
+	IdleTimeout int `yaml:"idle_timeout"`
+
+	// Concurrent TCP connections accepted across all listeners, unlimited if 0
+	MaxConnections int `yaml:"max_connections"`
+
+	// Seconds without new connections after which the proxy idles: health
+	// checks slow down, warm tunnels close and caches are released until the
+	// next connection. Disabled if 0.
+	IdleModeAfter int `yaml:"idle_mode_after"`
+
+	// DHCP lease files used to name LAN devices in logs
+	DHCPLeases []DHCPLeaseConfig `yaml:"dhcp_leases"`
+
+	// Directory for downloaded rule sets, geo databases and persisted state.
+	// Relative data paths in this file are resolved against it.
+	DataDir string `yaml:"data_dir"`
+
+	// Path where session state is saved on shutdown and restored on start (disabled if empty)
+	StateFile string `yaml:"state_file"`
+
+	// Parsed upstream chain
+	UpstreamChain []ProxyHop `yaml:"-"`
+
+	// Parsed named proxy chains
+	ProxyChains map[string][]ProxyHop `yaml:"-"`
+}
+
+// SourceFilter selects client networks by CIDR
+type SourceFilter struct {
+	// Only these networks are included (all if empty)
+	Include []string `yaml:"include"`
+
+	// These networks are always excluded
+	Exclude []string `yaml:"exclude"`
+
+	// Parsed networks
+	IncludeNets []*net.IPNet `yaml:"-"`
+	ExcludeNets []*net.IPNet `yaml:"-"`
+}
+
+// DirectRoute connects directly, looking up Table by the socket mark
+type DirectRoute struct {
+	// Kernel routing table, e.g. one whose default route uses a second uplink
+	Table int `yaml:"table"`
+	// SO_MARK of outbound sockets matched by the ip rule, defaults to Table
+	Mark int `yaml:"mark"`
+}
+
+// ProxyGroup picks one of its members for each connection
+type ProxyGroup struct {
+	Name string `yaml:"name"`
+
+	// select, fallback, url-test or load-balance
+	Type string `yaml:"type"`
+
+	// Members: proxy names, built-in policies or groups defined earlier in the list
+	Proxies []string `yaml:"proxies"`
+
+	// Health check URL for fallback, url-test and load-balance groups
+	URL string `yaml:"url"`
+
+	// Health check interval in seconds
+	Interval int `yaml:"interval"`
+
+	// Country codes of exits preferred among the healthy members, as found
+	// by exit_check; other members are used when none of them is up
+	PreferCountries []string `yaml:"prefer_countries"`
+
+	// traffic-class: throughput observation window in seconds
+	Warmup int `yaml:"warmup"`
+
+	// traffic-class: bytes per second over a window that mark a destination as bulk
+	BulkRate ByteSize `yaml:"bulk_rate"`
+}
+
+// ExitCheck fetches an echo endpoint through every upstream to learn the
+// address and country its connections leave from
+type ExitCheck struct {
+	// Endpoint answering with the caller's address, as plain text or JSON with
+	// an "ip" field and optionally a country code; lookups are disabled if empty
+	URL string `yaml:"url"`
+
+	// Seconds between lookups
+	Interval int `yaml:"interval"`
 }
 
 // DNSConfig represents DNS proxy configuration
@@ -50,8 +311,240 @@ type DNSConfig struct {
 	Rules []string `yaml:"rules"`
 }
 
-// Load reads and parses a configuration file
-func Load(path string) (*Config, error) {
+// TransferLimit throttles or closes a connection once it has relayed a number of bytes
+type TransferLimit struct {
+	// Apply only to connections matched with this policy or group (all connections if empty)
+	Policy Policy `yaml:"policy"`
+
+	// Bytes relayed in both directions before the limit takes effect
+	After ByteSize `yaml:"after"`
+
+	// Bandwidth per direction once exceeded, in bytes per second; 0 closes the connection
+	Rate ByteSize `yaml:"rate"`
+}
+
+// QoS caps the throughput of all TCP relays per direction and divides it
+// between traffic classes by weight when the cap is reached
+type QoS struct {
+	// Bytes per second relayed to clients and from them, unlimited if 0
+	Download ByteSize `yaml:"download"`
+	Upload   ByteSize `yaml:"upload"`
+
+	// Weight of connections by matched rule, written as in rules, or by
+	// policy. Connections matching neither weigh DefaultQoSWeight.
+	Weights map[string]int `yaml:"weights"`
+}
+
+// ConnMark sets the conntrack mark of both connections of a relay, from the
+// client and to the destination or upstream proxy, once its policy is known
+type ConnMark struct {
+	// Bits of the conntrack mark set by the proxy, the others are kept
+	// (default all)
+	Mask int `yaml:"mask"`
+
+	// Mark per policy: PROXY, DIRECT or the name of a proxy, direct route or
+	// proxy group. Connections matched with a name without a mark use the
+	// mark of PROXY or DIRECT.
+	Marks map[Policy]int `yaml:"marks"`
+}
+
+// MiddlewareConfig enables a registered connection middleware with options it interprets
+type MiddlewareConfig struct {
+	Name    string         `yaml:"name"`
+	Options map[string]any `yaml:"options"`
+}
+
+// Plaintext detection actions
+const (
+	PlaintextWarn   = "warn"
+	PlaintextReject = "reject"
+)
+
+// PlaintextConfig flags connections speaking a plaintext protocol on a port
+// other than its standard one, which usually means credentials or mail cross
+// the network unencrypted
+type PlaintextConfig struct {
+	// warn logs the connection, reject closes it; detection is disabled if empty
+	Action string `yaml:"action"`
+
+	// Destination ports where plaintext is expected and not reported
+	IgnorePorts []int `yaml:"ignore_ports"`
+}
+
+// ALG actions, each including the ones before
+const (
+	ALGWarn    = "warn"
+	ALGDirect  = "direct"
+	ALGRewrite = "rewrite"
+)
+
+// ALGConfig handles protocols embedding client addresses in their payload,
+// which break once the proxy re-originates their connections: active FTP has
+// the server connect back to the client and SIP advertises where to send media
+type ALGConfig struct {
+	// warn logs active FTP and SIP flows, direct also keeps them off upstream
+	// proxies, rewrite translates active FTP to passive instead of forcing it
+	// direct; disabled if empty
+	Action string `yaml:"action"`
+
+	// Destination ports of FTP control connections, default 21
+	FTPPorts []int `yaml:"ftp_ports"`
+
+	// Destination ports of SIP, default 5060 and 5061
+	SIPPorts []int `yaml:"sip_ports"`
+}
+
+// KeepWarm is a destination that always has a connected tunnel ready, so
+// connecting to it skips the upstream handshakes
+type KeepWarm struct {
+	// host:port as clients request it
+	Target string `yaml:"target"`
+
+	// Seconds an unused tunnel is kept before it is replaced
+	Refresh int `yaml:"refresh"`
+}
+
+// Rule provider sources and behaviors
+const (
+	ProviderFile = "file"
+	ProviderHTTP = "http"
+
+	BehaviorDomain    = "domain"
+	BehaviorIPCIDR    = "ipcidr"
+	BehaviorClassical = "classical"
+
+	// DefaultProviderInterval is the refresh interval in seconds of http providers
+	DefaultProviderInterval = 86400
+	// ProviderCacheDir caches downloaded rule sets in the data directory when path is unset
+	ProviderCacheDir = "rules"
+)
+
+// RuleProvider is a rule list loaded from a local file or downloaded over HTTP(S)
+type RuleProvider struct {
+	// file or http
+	Type string `yaml:"type"`
+
+	// domain, ipcidr or classical
+	Behavior string `yaml:"behavior"`
+
+	// Download URL for http providers
+	URL string `yaml:"url"`
+
+	// Local file, relative to the data directory; for http providers the download cache
+	Path string `yaml:"path"`
+
+	// Refresh interval in seconds (0 disables refreshing file providers)
+	Interval int `yaml:"interval"`
+}
+
+// Updates restricts automatic updates of rule providers and the GeoIP
+// database to a daily maintenance window and reports what they change
+type Updates struct {
+	// Window as HH:MM in local time, From after To spans midnight. Updates
+	// run whenever they are due if both are empty.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+
+	// Domains or IP addresses whose matched rule is logged when an update changes it
+	Samples []string `yaml:"samples"`
+
+	// Parsed window in minutes after midnight
+	FromMinute int `yaml:"-"`
+	ToMinute   int `yaml:"-"`
+}
+
+// Until returns how long after t the update window opens, 0 within the
+// window or without one
+func (u *Updates) Until(t time.Time) time.Duration {
+	if u.From == "" {
+		return 0
+	}
+	m := t.Hour()*60 + t.Minute()
+	if u.FromMinute < u.ToMinute && m >= u.FromMinute && m < u.ToMinute ||
+		u.FromMinute > u.ToMinute && (m >= u.FromMinute || m < u.ToMinute) {
+		return 0
+	}
+	wait := time.Duration((u.FromMinute-m+24*60)%(24*60)) * time.Minute
+	return wait - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond())
+}
+
+// RuleEntry is a rule written either as a Clash string ("TYPE,VALUE,POLICY")
+// or as a mapping with type, value, policy and an optional comment. A mapping
+// may instead call a rule template, expanded by Validate.
+type RuleEntry struct {
+	Type     string `yaml:"type"`
+	Value    string `yaml:"value"`
+	Policy   string `yaml:"policy"`
+	Comment  string `yaml:"comment"`
+	Template string `yaml:"template"`
+
+	// Raw is the rule string when written in Clash form
+	Raw string `yaml:"-"`
+}
+
+// UnmarshalYAML accepts both the string and the mapping form of a rule
+func (r *RuleEntry) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		r.Raw = node.Value
+		return nil
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			switch key := node.Content[i].Value; key {
+			case "type", "value", "policy", "comment", "template":
+			default:
+				return fmt.Errorf("line %d: unknown rule field %q", node.Line, key)
+			}
+		}
+
+		type plain RuleEntry
+		if err := node.Decode((*plain)(r)); err != nil {
+			return err
+		}
+		if r.Template != "" {
+			if r.Type != "" || r.Value != "" || r.Policy != "" {
+				return fmt.Errorf("line %d: template cannot be combined with type, value or policy", node.Line)
+			}
+			return nil
+		}
+		if r.Type == "" {
+			return fmt.Errorf("line %d: rule type is required", node.Line)
+		}
+		if r.Policy == "" {
+			return fmt.Errorf("line %d: rule policy is required", node.Line)
+		}
+		if r.Value == "" && !strings.EqualFold(r.Type, "MATCH") {
+			return fmt.Errorf("line %d: rule value is required for %s", node.Line, r.Type)
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: rule must be a string or a mapping", node.Line)
+	}
+}
+
+// String returns the rule in Clash format
+func (r RuleEntry) String() string {
+	if r.Raw != "" {
+		return r.Raw
+	}
+	if r.Value == "" {
+		return r.Type + "," + r.Policy
+	}
+	return r.Type + "," + r.Value + "," + r.Policy
+}
+
+// DHCPLeaseConfig points to a DHCP server lease database
+type DHCPLeaseConfig struct {
+	// Lease file path (e.g., /var/lib/misc/dnsmasq.leases)
+	Path string `yaml:"path"`
+
+	// Lease file format: dnsmasq or kea
+	Format string `yaml:"format"`
+}
+
+// Load reads and validates a configuration file. A non-empty dataDir
+// overrides data_dir before relative paths are resolved.
+func Load(path, dataDir string) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -61,6 +554,9 @@ func Load(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if dataDir != "" {
+		cfg.DataDir = dataDir
+	}
 
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -74,19 +570,537 @@ func (c *Config) Validate() error {
 	if c.Listen == "" {
 		return fmt.Errorf("listen address is required")
 	}
+	for name, addr := range map[string]string{"http_listen": c.HTTPListen, "socks_listen": c.SOCKSListen, "metrics_listen": c.MetricsListen} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, addr, err)
+		}
+	}
+	for name, addr := range map[string]string{"api_listen": c.APIListen, "authz_listen": c.AuthzListen} {
+		if addr != "" && !strings.HasPrefix(addr, "/") {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, addr, err)
+			}
+		}
+	}
+	if c.AuthzListen != "" && (c.AuthzListen == c.APIListen || c.AuthzListen == c.StatusListen) {
+		return fmt.Errorf("authz_listen must differ from api_listen and status_listen")
+	}
+	switch {
+	case c.StatusListen != "" && !strings.HasPrefix(c.StatusListen, "/"):
+		return fmt.Errorf("status_listen %q must be an absolute unix socket path", c.StatusListen)
+	case c.StatusListen != "" && c.StatusListen == c.APIListen:
+		return fmt.Errorf("status_listen must differ from api_listen")
+	case c.StatusGroup != "" && c.StatusListen == "":
+		return fmt.Errorf("status_group requires status_listen")
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModeTProxy
+	case ModeTProxy:
+	case ModeRedirect:
+		if len(c.UDPPorts) > 0 {
+			return fmt.Errorf("udp_ports requires tproxy mode")
+		}
+	default:
+		return fmt.Errorf("mode must be tproxy or redirect, got %q", c.Mode)
+	}
 
-	if c.Upstream != "" {
-		u, err := url.Parse(c.Upstream)
+	var err error
+	if c.GatewaySources.IncludeNets, err = parseCIDRs(c.GatewaySources.Include); err != nil {
+		return fmt.Errorf("gateway_sources.include: %w", err)
+	}
+	if c.GatewaySources.ExcludeNets, err = parseCIDRs(c.GatewaySources.Exclude); err != nil {
+		return fmt.Errorf("gateway_sources.exclude: %w", err)
+	}
+
+	if c.MaxOpenFiles == 0 {
+		c.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+	if c.MetricsSample == 0 {
+		c.MetricsSample = DefaultMetricsSample
+	}
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout must be positive")
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max_connections must not be negative")
+	}
+	if c.IdleModeAfter < 0 {
+		return fmt.Errorf("idle_mode_after must not be negative")
+	}
+	if c.MetricsSample < 0 {
+		return fmt.Errorf("metrics_sample must be positive")
+	}
+
+	if c.DataDir == "" {
+		c.DataDir = datadir.Default
+	}
+
+	if c.APITokenFile != "" {
+		if c.APIListen == "" {
+			return fmt.Errorf("api_token_file requires api_listen")
+		}
+		c.APITokenFile = c.DataPath(c.APITokenFile)
+	}
+
+	if c.APITLS != nil {
+		if c.APIListen == "" || strings.HasPrefix(c.APIListen, "/") {
+			return fmt.Errorf("api_tls requires a TCP api_listen")
+		}
+		if err := c.APITLS.Validate(); err != nil {
+			return fmt.Errorf("api_tls: %w", err)
+		}
+		if c.APITLS.ClientCA == "" && c.APITokenFile == "" {
+			return fmt.Errorf("api_tls requires client_ca or api_token_file to authenticate clients")
+		}
+		c.APITLS.Cert = c.DataPath(c.APITLS.Cert)
+		c.APITLS.Key = c.DataPath(c.APITLS.Key)
+		c.APITLS.ClientCA = c.DataPath(c.APITLS.ClientCA)
+	}
+
+	if len(c.Upstream) > 0 {
+		chain, err := c.parseChain(c.Upstream)
 		if err != nil {
-			return fmt.Errorf("invalid upstream URL: %w", err)
+			return fmt.Errorf("upstream: %w", err)
 		}
+		c.UpstreamChain = chain
+	} else if c.RequireUpstreamHealthy {
+		return fmt.Errorf("require_upstream_healthy needs an upstream")
+	}
 
-		if u.Scheme != "http" && u.Scheme != "socks5" {
-			return fmt.Errorf("upstream must be http:// or socks5://, got %s", u.Scheme)
+	if c.ExitCheck.URL != "" {
+		if u, err := url.Parse(c.ExitCheck.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("exit_check.url must be an http or https URL, got %q", c.ExitCheck.URL)
+		}
+		if c.ExitCheck.Interval == 0 {
+			c.ExitCheck.Interval = DefaultExitCheckInterval
+		}
+		if c.ExitCheck.Interval < 0 {
+			return fmt.Errorf("exit_check.interval must be positive")
 		}
+	}
+
+	if err := c.validateProxies(); err != nil {
+		return err
+	}
+
+	if err := c.validateRuleProviders(); err != nil {
+		return err
+	}
+
+	if err := c.validateUpdates(); err != nil {
+		return err
+	}
+
+	if err := c.expandTemplates(); err != nil {
+		return err
+	}
+
+	for i := range c.TransferLimits {
+		l := &c.TransferLimits[i]
+		l.Policy = ParsePolicy(string(l.Policy))
+		if l.Policy == PolicyReject || (l.Policy != "" && !c.HasPolicy(l.Policy)) {
+			return fmt.Errorf("transfer_limits[%d]: unknown policy %q", i, l.Policy)
+		}
+		if l.After <= 0 {
+			return fmt.Errorf("transfer_limits[%d]: after must be positive", i)
+		}
+		if l.Rate < 0 {
+			return fmt.Errorf("transfer_limits[%d]: rate must not be negative", i)
+		}
+	}
 
-		c.UpstreamURL = u
+	if err := c.validateQoS(); err != nil {
+		return err
+	}
+
+	if err := c.validateConnMark(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(c.Middleware))
+	for i, m := range c.Middleware {
+		if m.Name == "" {
+			return fmt.Errorf("middleware[%d]: name is required", i)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("middleware[%d]: %s is listed twice", i, m.Name)
+		}
+		names[m.Name] = true
+	}
+
+	switch c.Plaintext.Action {
+	case "", PlaintextWarn, PlaintextReject:
+	default:
+		return fmt.Errorf("plaintext.action must be warn or reject, got %q", c.Plaintext.Action)
+	}
+
+	switch c.ALG.Action {
+	case "":
+	case ALGWarn, ALGDirect, ALGRewrite:
+		if len(c.ALG.FTPPorts) == 0 {
+			c.ALG.FTPPorts = []int{21}
+		}
+		if len(c.ALG.SIPPorts) == 0 {
+			c.ALG.SIPPorts = []int{5060, 5061}
+		}
+		for _, port := range slices.Concat(c.ALG.FTPPorts, c.ALG.SIPPorts) {
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("alg: invalid port %d", port)
+			}
+		}
+	default:
+		return fmt.Errorf("alg.action must be warn, direct or rewrite, got %q", c.ALG.Action)
+	}
+
+	seen := make(map[string]bool, len(c.KeepWarm))
+	for i := range c.KeepWarm {
+		w := &c.KeepWarm[i]
+		host, port, err := net.SplitHostPort(w.Target)
+		if err != nil || host == "" {
+			return fmt.Errorf("keep_warm[%d]: target must be host:port, got %q", i, w.Target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("keep_warm[%d]: invalid port %q", i, port)
+		}
+		w.Target = net.JoinHostPort(strings.TrimSuffix(strings.ToLower(host), "."), port)
+		if seen[w.Target] {
+			return fmt.Errorf("keep_warm[%d]: duplicate target %s", i, w.Target)
+		}
+		seen[w.Target] = true
+		if w.Refresh == 0 {
+			w.Refresh = DefaultKeepWarmRefresh
+		}
+		if w.Refresh < 0 {
+			return fmt.Errorf("keep_warm[%d]: refresh must be positive", i)
+		}
+	}
+
+	for i, l := range c.DHCPLeases {
+		if l.Path == "" {
+			return fmt.Errorf("dhcp_leases[%d]: path is required", i)
+		}
+		if l.Format != dhcp.FormatDnsmasq && l.Format != dhcp.FormatKea {
+			return fmt.Errorf("dhcp_leases[%d]: format must be %s or %s, got %q", i, dhcp.FormatDnsmasq, dhcp.FormatKea, l.Format)
+		}
 	}
 
 	return nil
 }
+
+// validateProxies parses named proxies and checks direct routes and proxy group definitions
+func (c *Config) validateProxies() error {
+	c.ProxyChains = make(map[string][]ProxyHop, len(c.Proxies))
+	for name, spec := range c.Proxies {
+		if ParsePolicy(name).IsBuiltin() {
+			return fmt.Errorf("proxies: %q is a built-in policy name", name)
+		}
+		chain, err := c.parseChain(spec)
+		if err != nil {
+			return fmt.Errorf("proxies: %q: %w", name, err)
+		}
+		c.ProxyChains[name] = chain
+	}
+	if err := c.validateDirectRoutes(); err != nil {
+		return err
+	}
+
+	// Members may only refer to earlier groups, which rules out cycles
+	defined := make(map[string]bool, len(c.ProxyGroups))
+	for i := range c.ProxyGroups {
+		g := &c.ProxyGroups[i]
+		if g.Name == "" {
+			return fmt.Errorf("proxy-groups[%d]: name is required", i)
+		}
+		if ParsePolicy(g.Name).IsBuiltin() || c.ProxyChains[g.Name] != nil || c.hasDirectRoute(g.Name) || defined[g.Name] {
+			return fmt.Errorf("proxy-groups[%d]: duplicate name %q", i, g.Name)
+		}
+
+		if len(g.PreferCountries) > 0 && (g.Type == GroupSelect || g.Type == GroupTrafficClass) {
+			return fmt.Errorf("proxy-groups[%d]: prefer_countries needs a health checked group", i)
+		}
+		switch g.Type {
+		case GroupSelect:
+		case GroupFallback, GroupURLTest, GroupLoadBalance:
+			if g.URL == "" {
+				g.URL = DefaultHealthCheckURL
+			}
+			if g.Interval == 0 {
+				g.Interval = DefaultHealthCheckInterval
+			}
+			if g.Interval < 0 {
+				return fmt.Errorf("proxy-groups[%d]: interval must be positive", i)
+			}
+			if len(g.PreferCountries) > 0 && c.ExitCheck.URL == "" {
+				return fmt.Errorf("proxy-groups[%d]: prefer_countries requires exit_check.url", i)
+			}
+			for j, cc := range g.PreferCountries {
+				if len(cc) != 2 {
+					return fmt.Errorf("proxy-groups[%d]: invalid country code %q", i, cc)
+				}
+				g.PreferCountries[j] = strings.ToUpper(cc)
+			}
+		case GroupTrafficClass:
+			if len(g.Proxies) != 2 {
+				return fmt.Errorf("proxy-groups[%d]: traffic-class needs exactly two proxies (interactive, bulk)", i)
+			}
+			if g.Warmup == 0 {
+				g.Warmup = DefaultWarmup
+			}
+			if g.BulkRate == 0 {
+				g.BulkRate = DefaultBulkRate
+			}
+			if g.Warmup < 0 || g.BulkRate < 0 {
+				return fmt.Errorf("proxy-groups[%d]: warmup and bulk_rate must be positive", i)
+			}
+		default:
+			return fmt.Errorf("proxy-groups[%d]: unsupported type %q", i, g.Type)
+		}
+
+		if len(g.Proxies) == 0 {
+			return fmt.Errorf("proxy-groups[%d]: proxies is required", i)
+		}
+		for j, member := range g.Proxies {
+			p := ParsePolicy(member)
+			if !p.IsBuiltin() && c.ProxyChains[member] == nil && !c.hasDirectRoute(member) && !defined[member] {
+				return fmt.Errorf("proxy-groups[%d]: unknown member %q", i, member)
+			}
+			g.Proxies[j] = string(p)
+		}
+
+		defined[g.Name] = true
+	}
+
+	return nil
+}
+
+// validateDirectRoutes checks direct routes and fills in their default marks
+func (c *Config) validateDirectRoutes() error {
+	marks := make(map[int]string, len(c.DirectRoutes))
+	for name, r := range c.DirectRoutes {
+		if ParsePolicy(name).IsBuiltin() || c.ProxyChains[name] != nil {
+			return fmt.Errorf("direct_routes: duplicate name %q", name)
+		}
+		switch r.Table {
+		case 0, iptables.RoutingTable, 253, 254, 255:
+			return fmt.Errorf("direct_routes: %q: table must be set and not %d or a reserved table", name, iptables.RoutingTable)
+		}
+		if r.Mark == 0 {
+			r.Mark = r.Table
+		}
+		if r.Mark == iptables.FWMark || r.Mark == iptables.BypassMark {
+			return fmt.Errorf("direct_routes: %q: mark 0x%x is used by the proxy", name, r.Mark)
+		}
+		if other, ok := marks[r.Mark]; ok {
+			return fmt.Errorf("direct_routes: %q and %q use the same mark 0x%x", name, other, r.Mark)
+		}
+		marks[r.Mark] = name
+		c.DirectRoutes[name] = r
+	}
+	return nil
+}
+
+// validateQoS checks the caps and normalizes policy weights. Rule weights
+// are parsed by the proxy.
+func (c *Config) validateQoS() error {
+	q := &c.QoS
+	if q.Download < 0 || q.Upload < 0 {
+		return fmt.Errorf("qos: download and upload must not be negative")
+	}
+	if len(q.Weights) == 0 {
+		return nil
+	}
+	if q.Download == 0 && q.Upload == 0 {
+		return fmt.Errorf("qos: weights require a download or upload cap")
+	}
+	weights := make(map[string]int, len(q.Weights))
+	for key, w := range q.Weights {
+		if w <= 0 {
+			return fmt.Errorf("qos: weight of %q must be positive", key)
+		}
+		if !strings.Contains(key, ",") {
+			p := ParsePolicy(key)
+			if p == PolicyReject || !c.HasPolicy(p) {
+				return fmt.Errorf("qos: unknown policy %q", key)
+			}
+			key = string(p)
+		}
+		weights[key] = w
+	}
+	q.Weights = weights
+	return nil
+}
+
+// validateConnMark checks the conntrack marks and normalizes their policy names
+func (c *Config) validateConnMark() error {
+	m := &c.ConnMark
+	if len(m.Marks) == 0 {
+		return nil
+	}
+	if m.Mask == 0 {
+		m.Mask = 0xffffffff
+	}
+	if m.Mask < 0 || m.Mask > 0xffffffff {
+		return fmt.Errorf("connmark: mask 0x%x is not a 32-bit mark", m.Mask)
+	}
+	marks := make(map[Policy]int, len(m.Marks))
+	for name, mark := range m.Marks {
+		p := ParsePolicy(string(name))
+		if p == PolicyReject || !c.HasPolicy(p) {
+			return fmt.Errorf("connmark: unknown policy %q", name)
+		}
+		if mark <= 0 || mark&^m.Mask != 0 {
+			return fmt.Errorf("connmark: mark 0x%x of %q must be nonzero and within mask 0x%x", mark, name, m.Mask)
+		}
+		marks[p] = mark
+	}
+	m.Marks = marks
+	return nil
+}
+
+func (c *Config) hasDirectRoute(name string) bool {
+	_, ok := c.DirectRoutes[name]
+	return ok
+}
+
+// HasPolicy reports whether p is a built-in policy, a named proxy, a direct route or a proxy group
+func (c *Config) HasPolicy(p Policy) bool {
+	if p.IsBuiltin() || c.ProxyChains[string(p)] != nil || c.hasDirectRoute(string(p)) {
+		return true
+	}
+	for _, g := range c.ProxyGroups {
+		if g.Name == string(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyNames returns the names of all proxies, direct routes and proxy groups
+func (c *Config) PolicyNames() []string {
+	names := make([]string, 0, len(c.ProxyChains)+len(c.DirectRoutes)+len(c.ProxyGroups))
+	for name := range c.ProxyChains {
+		names = append(names, name)
+	}
+	for name := range c.DirectRoutes {
+		names = append(names, name)
+	}
+	for _, g := range c.ProxyGroups {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+// validateRuleProviders checks rule providers and fills in defaults
+func (c *Config) validateRuleProviders() error {
+	for name, p := range c.RuleProviders {
+		switch p.Behavior {
+		case BehaviorDomain, BehaviorIPCIDR, BehaviorClassical:
+		default:
+			return fmt.Errorf("rule-providers: %q has unsupported behavior %q", name, p.Behavior)
+		}
+
+		switch p.Type {
+		case ProviderFile:
+			if p.Path == "" {
+				return fmt.Errorf("rule-providers: %q requires a path", name)
+			}
+		case ProviderHTTP:
+			u, err := url.Parse(p.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("rule-providers: %q requires an http(s) url", name)
+			}
+			if p.Path == "" {
+				p.Path = filepath.Join(ProviderCacheDir, name+".yaml")
+			}
+			if p.Interval == 0 {
+				p.Interval = DefaultProviderInterval
+			}
+		default:
+			return fmt.Errorf("rule-providers: %q has unsupported type %q", name, p.Type)
+		}
+
+		if p.Interval < 0 {
+			return fmt.Errorf("rule-providers: %q interval must not be negative", name)
+		}
+		c.RuleProviders[name] = p
+	}
+	return nil
+}
+
+func (c *Config) validateUpdates() error {
+	u := &c.Updates
+	if u.From != "" || u.To != "" {
+		var err error
+		if u.FromMinute, err = ParseClock(u.From); err != nil {
+			return fmt.Errorf("updates.from: %w", err)
+		}
+		if u.ToMinute, err = ParseClock(u.To); err != nil {
+			return fmt.Errorf("updates.to: %w", err)
+		}
+		if u.FromMinute == u.ToMinute {
+			return fmt.Errorf("updates: from and to must differ")
+		}
+	}
+	for i, s := range u.Samples {
+		s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+		if s == "" {
+			return fmt.Errorf("updates.samples[%d] is empty", i)
+		}
+		u.Samples[i] = s
+	}
+	return nil
+}
+
+// ParseClock parses HH:MM into minutes after midnight
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// DataPath resolves a configured path against the data directory.
+// Absolute and empty paths are returned unchanged.
+func (c *Config) DataPath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.DataDir, p)
+}
+
+// parseCIDRs parses networks, accepting bare addresses as single hosts
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"crypto/tls"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestLoad_ValidConfig(t *testing.T) {
@@ -21,7 +25,7 @@ rules:
 		t.Fatal(err)
 	}
 
-	cfg, err := Load(configPath)
+	cfg, err := Load(configPath, "")
 	if err != nil {
 		t.Fatalf("Load() error = %v", err)
 	}
@@ -29,17 +33,17 @@ rules:
 	if cfg.Listen != ":12345" {
 		t.Errorf("Listen = %v, want :12345", cfg.Listen)
 	}
-	if cfg.Upstream != "http://proxy.example.com:8080" {
+	if cfg.Upstream.String() != "http://proxy.example.com:8080" {
 		t.Errorf("Upstream = %v", cfg.Upstream)
 	}
 	if len(cfg.Rules) != 3 {
 		t.Errorf("len(Rules) = %v, want 3", len(cfg.Rules))
 	}
-	if cfg.UpstreamURL == nil {
-		t.Error("UpstreamURL should be parsed")
+	if len(cfg.UpstreamChain) != 1 {
+		t.Fatal("UpstreamChain should be parsed")
 	}
-	if cfg.UpstreamURL.Scheme != "http" {
-		t.Errorf("UpstreamURL.Scheme = %v, want http", cfg.UpstreamURL.Scheme)
+	if cfg.UpstreamChain[0].URL.Scheme != "http" {
+		t.Errorf("UpstreamChain[0].URL.Scheme = %v, want http", cfg.UpstreamChain[0].URL.Scheme)
 	}
 }
 
@@ -56,16 +60,17 @@ rules:
 		t.Fatal(err)
 	}
 
-	cfg, err := Load(configPath)
+	cfg, err := Load(configPath, "")
 	if err != nil {
 		t.Fatalf("Load() error = %v", err)
 	}
 
-	if cfg.UpstreamURL.Scheme != "socks5" {
-		t.Errorf("Scheme = %v, want socks5", cfg.UpstreamURL.Scheme)
+	u := cfg.UpstreamChain[0].URL
+	if u.Scheme != "socks5" {
+		t.Errorf("Scheme = %v, want socks5", u.Scheme)
 	}
-	if cfg.UpstreamURL.User.Username() != "user" {
-		t.Errorf("Username = %v, want user", cfg.UpstreamURL.User.Username())
+	if u.User.Username() != "user" {
+		t.Errorf("Username = %v, want user", u.User.Username())
 	}
 }
 
@@ -81,7 +86,7 @@ rules:
 		t.Fatal(err)
 	}
 
-	_, err := Load(configPath)
+	_, err := Load(configPath, "")
 	if err == nil {
 		t.Error("Expected error for missing listen")
 	}
@@ -99,12 +104,12 @@ rules:
 		t.Fatal(err)
 	}
 
-	cfg, err := Load(configPath)
+	cfg, err := Load(configPath, "")
 	if err != nil {
 		t.Errorf("Load() error = %v, missing upstream should be valid", err)
 	}
-	if cfg.UpstreamURL != nil {
-		t.Error("UpstreamURL should be nil when upstream is not specified")
+	if cfg.UpstreamChain != nil {
+		t.Error("UpstreamChain should be nil when upstream is not specified")
 	}
 }
 
@@ -121,14 +126,14 @@ rules:
 		t.Fatal(err)
 	}
 
-	_, err := Load(configPath)
+	_, err := Load(configPath, "")
 	if err == nil {
 		t.Error("Expected error for invalid upstream scheme")
 	}
 }
 
 func TestLoad_FileNotFound(t *testing.T) {
-	_, err := Load("/nonexistent/config.yaml")
+	_, err := Load("/nonexistent/config.yaml", "")
 	if err == nil {
 		t.Error("Expected error for missing file")
 	}
@@ -137,14 +142,941 @@ func TestLoad_FileNotFound(t *testing.T) {
 func TestValidate(t *testing.T) {
 	cfg := &Config{
 		Listen:   ":12345",
-		Upstream: "http://proxy:8080",
+		Upstream: ProxyChain{{URL: "http://proxy:8080"}},
 	}
 
 	err := cfg.Validate()
 	if err != nil {
 		t.Errorf("Validate() error = %v", err)
 	}
-	if cfg.UpstreamURL == nil {
-		t.Error("UpstreamURL should be set after Validate()")
+	if cfg.UpstreamChain == nil {
+		t.Error("UpstreamChain should be set after Validate()")
+	}
+}
+
+func TestValidate_DHCPLeases(t *testing.T) {
+	cfg := &Config{
+		Listen:     ":12345",
+		DHCPLeases: []DHCPLeaseConfig{{Path: "/var/lib/misc/dnsmasq.leases", Format: "dnsmasq"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	cfg.DHCPLeases[0].Format = "isc"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unsupported lease format")
+	}
+}
+
+func TestLoad_TransferLimits(t *testing.T) {
+	content := `
+listen: ":12345"
+transfer_limits:
+  - {policy: proxy, after: 1GB, rate: 1MB}
+  - {after: 10GB, rate: 0}
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configPath, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := []TransferLimit{
+		{Policy: PolicyProxy, After: 1 << 30, Rate: 1 << 20},
+		{After: 10 << 30},
+	}
+	if len(cfg.TransferLimits) != len(want) {
+		t.Fatalf("len(TransferLimits) = %v, want %v", len(cfg.TransferLimits), len(want))
+	}
+	for i := range want {
+		if cfg.TransferLimits[i] != want[i] {
+			t.Errorf("TransferLimits[%d] = %+v, want %+v", i, cfg.TransferLimits[i], want[i])
+		}
+	}
+
+	cfg.TransferLimits = []TransferLimit{{Policy: "REJECT", After: 1}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for REJECT transfer limit")
+	}
+	cfg.TransferLimits = []TransferLimit{{}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for zero after")
+	}
+}
+
+func TestLoad_ProxyGroups(t *testing.T) {
+	content := `
+listen: ":12345"
+proxies:
+  work: socks5://10.0.0.1:1080
+  personal: http://192.168.1.1:8080
+proxy-groups:
+  - name: Auto
+    type: url-test
+    proxies: [work, personal]
+  - name: Office
+    type: select
+    proxies: [Auto, direct]
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configPath, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.ProxyChains["work"][0].URL.Host != "10.0.0.1:1080" {
+		t.Errorf("ProxyChains[work] = %v", cfg.ProxyChains["work"])
+	}
+	auto := cfg.ProxyGroups[0]
+	if auto.URL != DefaultHealthCheckURL || auto.Interval != DefaultHealthCheckInterval {
+		t.Errorf("Auto health check = %q every %d, want defaults", auto.URL, auto.Interval)
+	}
+	if got := cfg.ProxyGroups[1].Proxies[1]; got != string(PolicyDirect) {
+		t.Errorf("Office member = %q, want DIRECT", got)
+	}
+	for _, p := range []Policy{"work", "Auto", "Office", PolicyReject} {
+		if !cfg.HasPolicy(p) {
+			t.Errorf("HasPolicy(%s) = false", p)
+		}
+	}
+	if cfg.HasPolicy("office") {
+		t.Error("HasPolicy should be case-sensitive for group names")
+	}
+}
+
+func TestValidate_ProxyGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []ProxyGroup
+	}{
+		{"unknown type", []ProxyGroup{{Name: "A", Type: "relay", Proxies: []string{"DIRECT"}}}},
+		{"no members", []ProxyGroup{{Name: "A", Type: GroupSelect}}},
+		{"unknown member", []ProxyGroup{{Name: "A", Type: GroupSelect, Proxies: []string{"missing"}}}},
+		{"traffic-class needs two members", []ProxyGroup{{Name: "A", Type: GroupTrafficClass, Proxies: []string{"DIRECT"}}}},
+		{"builtin name", []ProxyGroup{{Name: "Proxy", Type: GroupSelect, Proxies: []string{"DIRECT"}}}},
+		{"forward reference", []ProxyGroup{
+			{Name: "A", Type: GroupSelect, Proxies: []string{"B"}},
+			{Name: "B", Type: GroupSelect, Proxies: []string{"DIRECT"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", ProxyGroups: tt.groups}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+
+	cfg := &Config{Listen: ":12345", Proxies: map[string]ProxyChain{"bad": {{URL: "ftp://host"}}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unsupported proxy scheme")
+	}
+}
+
+func TestValidate_RuleProviders(t *testing.T) {
+	cfg := &Config{
+		Listen: ":12345",
+		RuleProviders: map[string]RuleProvider{
+			"remote": {Type: ProviderHTTP, Behavior: BehaviorDomain, URL: "https://example.com/list.yaml"},
+			"local":  {Type: ProviderFile, Behavior: BehaviorIPCIDR, Path: "/etc/tproxy/lan.txt"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	remote := cfg.RuleProviders["remote"]
+	if remote.Path != filepath.Join(ProviderCacheDir, "remote.yaml") || remote.Interval != DefaultProviderInterval {
+		t.Errorf("remote defaults = %q every %d", remote.Path, remote.Interval)
+	}
+
+	invalid := []RuleProvider{
+		{Type: ProviderFile, Behavior: BehaviorDomain},
+		{Type: ProviderHTTP, Behavior: BehaviorDomain, URL: "ftp://example.com/list"},
+		{Type: ProviderFile, Behavior: "regex", Path: "/tmp/x"},
+		{Type: "inline", Behavior: BehaviorDomain},
+	}
+	for _, p := range invalid {
+		cfg := &Config{Listen: ":12345", RuleProviders: map[string]RuleProvider{"x": p}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for provider %+v", p)
+		}
+	}
+}
+
+func TestValidate_Mode(t *testing.T) {
+	cfg := &Config{Listen: ":12345"}
+	if err := cfg.Validate(); err != nil || cfg.Mode != ModeTProxy {
+		t.Fatalf("Validate() = %v, mode %q; want tproxy default", err, cfg.Mode)
+	}
+
+	cfg = &Config{Listen: ":12345", Mode: ModeRedirect, UDPPorts: []uint16{53}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for udp_ports in redirect mode")
+	}
+
+	cfg = &Config{Listen: ":12345", Mode: "tun"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for unsupported mode")
+	}
+}
+
+func TestValidate_APIListen(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{"127.0.0.1:9090", false},
+		{"/run/tproxy.sock", false},
+		{"localhost", true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Listen: ":12345", APIListen: tt.addr}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(api_listen %q) error = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+
+	cfg := &Config{Listen: ":12345", APITokenFile: "api.token"}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Expected error for api_token_file without api_listen")
+	}
+	cfg = &Config{Listen: ":12345", APIListen: "127.0.0.1:9090", APITokenFile: "api.token", DataDir: "/data"}
+	if err := cfg.Validate(); err != nil || cfg.APITokenFile != "/data/api.token" {
+		t.Errorf("Validate() = %v, api_token_file = %s, want it under the data directory", err, cfg.APITokenFile)
+	}
+}
+
+func TestValidate_StatusListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"socket", Config{StatusListen: "/run/tproxy-status.sock"}, false},
+		{"group", Config{StatusListen: "/run/tproxy-status.sock", StatusGroup: "monitoring"}, false},
+		{"tcp", Config{StatusListen: "127.0.0.1:9091"}, true},
+		{"same as api", Config{APIListen: "/run/tproxy.sock", StatusListen: "/run/tproxy.sock"}, true},
+		{"group only", Config{StatusGroup: "monitoring"}, true},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.Listen = ":12345"
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidate_AuthzListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"tcp", Config{AuthzListen: "127.0.0.1:9092"}, false},
+		{"socket", Config{AuthzListen: "/run/tproxy-authz.sock"}, false},
+		{"no port", Config{AuthzListen: "127.0.0.1"}, true},
+		{"same as api", Config{APIListen: "/run/tproxy.sock", AuthzListen: "/run/tproxy.sock"}, true},
+		{"same as status", Config{StatusListen: "/run/tproxy-status.sock", AuthzListen: "/run/tproxy-status.sock"}, true},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		cfg.Listen = ":12345"
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidate_APITLS(t *testing.T) {
+	acme := &ACMEConfig{Domains: []string{"proxy.example.com"}}
+	tests := []struct {
+		name         string
+		addr         string
+		tls          ServerTLS
+		apiTokenFile string
+		wantErr      bool
+	}{
+		{"files", "0.0.0.0:9443", ServerTLS{Cert: "api.pem", Key: "api.key", ClientCA: "clients.pem"}, "", false},
+		{"acme", "0.0.0.0:443", ServerTLS{ACME: acme, ClientCA: "clients.pem"}, "", false},
+		{"acme http-01", "0.0.0.0:443", ServerTLS{ACME: &ACMEConfig{Domains: acme.Domains, HTTPListen: ":80"}, ClientCA: "clients.pem"}, "", false},
+		{"token", "0.0.0.0:443", ServerTLS{ACME: acme}, "api.token", false},
+		{"no client auth", "0.0.0.0:443", ServerTLS{ACME: acme}, "", true},
+		{"unix socket", "/run/tproxy.sock", ServerTLS{ACME: acme, ClientCA: "clients.pem"}, "", true},
+		{"missing key", "0.0.0.0:9443", ServerTLS{Cert: "api.pem", ClientCA: "clients.pem"}, "", true},
+		{"files and acme", "0.0.0.0:443", ServerTLS{Cert: "api.pem", Key: "api.key", ACME: acme, ClientCA: "clients.pem"}, "", true},
+		{"no domains", "0.0.0.0:443", ServerTLS{ACME: &ACMEConfig{}, ClientCA: "clients.pem"}, "", true},
+		{"bad http-01 address", "0.0.0.0:443", ServerTLS{ACME: &ACMEConfig{Domains: acme.Domains, HTTPListen: "80"}, ClientCA: "clients.pem"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", APIListen: tt.addr, APITLS: &tt.tls, APITokenFile: tt.apiTokenFile, DataDir: "/data"}
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.name == "files" && (cfg.APITLS.Cert != "/data/api.pem" || cfg.APITLS.Key != "/data/api.key" || cfg.APITLS.ClientCA != "/data/clients.pem") {
+				t.Errorf("certificate files = %s, %s, %s, want them under the data directory", cfg.APITLS.Cert, cfg.APITLS.Key, cfg.APITLS.ClientCA)
+			}
+		})
+	}
+}
+
+func TestValidate_GatewaySources(t *testing.T) {
+	cfg := &Config{Listen: ":12345", Gateway: true, GatewaySources: SourceFilter{
+		Include: []string{"192.168.1.0/24", "fd00::/8"},
+		Exclude: []string{"192.168.1.10", "fd00::1"},
+	}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error: %v", err)
+	}
+
+	want := []string{"192.168.1.0/24", "fd00::/8"}
+	for i, n := range cfg.GatewaySources.IncludeNets {
+		if n.String() != want[i] {
+			t.Errorf("IncludeNets[%d] = %s, want %s", i, n, want[i])
+		}
+	}
+	want = []string{"192.168.1.10/32", "fd00::1/128"}
+	for i, n := range cfg.GatewaySources.ExcludeNets {
+		if n.String() != want[i] {
+			t.Errorf("ExcludeNets[%d] = %s, want %s", i, n, want[i])
+		}
+	}
+
+	for _, bad := range []string{"192.168.1.0/33", "lan"} {
+		cfg := &Config{Listen: ":12345", GatewaySources: SourceFilter{Include: []string{bad}}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Expected error for source %q", bad)
+		}
+	}
+}
+
+func TestConfig_DataPath(t *testing.T) {
+	cfg := &Config{Listen: ":12345"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != "/var/lib/proxy" {
+		t.Errorf("DataDir = %q, want /var/lib/proxy", cfg.DataDir)
+	}
+
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"state.json", "/var/lib/proxy/state.json"},
+		{"rules/cn.yaml", "/var/lib/proxy/rules/cn.yaml"},
+		{"/etc/tproxy/lan.txt", "/etc/tproxy/lan.txt"},
+	}
+	for _, tt := range tests {
+		if got := cfg.DataPath(tt.in); got != tt.want {
+			t.Errorf("DataPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoad_StructuredRules(t *testing.T) {
+	content := `
+listen: ":12345"
+rules:
+  - DOMAIN-SUFFIX,cn,DIRECT
+  - {type: DOMAIN-SUFFIX, value: google.com, policy: PROXY, comment: search}
+  - type: MATCH
+    policy: DIRECT
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configPath, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(cfg.Rules) != 3 {
+		t.Fatalf("len(Rules) = %v, want 3", len(cfg.Rules))
+	}
+	if cfg.Rules[0].Raw != "DOMAIN-SUFFIX,cn,DIRECT" {
+		t.Errorf("Rules[0].Raw = %q", cfg.Rules[0].Raw)
+	}
+	if cfg.Rules[1].Value != "google.com" || cfg.Rules[1].Comment != "search" {
+		t.Errorf("Rules[1] = %+v", cfg.Rules[1])
+	}
+	if got := cfg.Rules[2].String(); got != "MATCH,DIRECT" {
+		t.Errorf("Rules[2].String() = %q, want MATCH,DIRECT", got)
+	}
+}
+
+func TestLoad_InvalidStructuredRules(t *testing.T) {
+	tests := map[string]string{
+		"unknown field":  "  - {type: DOMAIN, value: a.com, policy: PROXY, polcy: DIRECT}",
+		"missing policy": "  - {type: DOMAIN, value: a.com}",
+		"missing value":  "  - {type: DOMAIN-SUFFIX, policy: PROXY}",
+		"sequence":       "  - [DOMAIN, a.com, PROXY]",
+		"template rule":  "  - {template: block(a.com), policy: PROXY}",
+	}
+
+	for name, rule := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := "listen: \":12345\"\nrules:\n" + rule + "\n"
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(configPath, ""); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestLoad_RuleTemplates(t *testing.T) {
+	content := `
+listen: ":12345"
+rule_templates:
+  block_all_subdomains:
+    params: [domain, policy]
+    rules:
+      - DOMAIN,{domain},{policy}
+      - {type: DOMAIN-SUFFIX, value: "{domain}", policy: "{policy}", comment: "{domain} subdomains"}
+rules:
+  - template: block_all_subdomains(ads.example, REJECT)
+    comment: ads
+  - template: block_all_subdomains( tracker.example , REJECT )
+  - MATCH,DIRECT
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(configPath, "")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	want := []RuleEntry{
+		{Raw: "DOMAIN,ads.example,REJECT", Comment: "ads"},
+		{Type: "DOMAIN-SUFFIX", Value: "ads.example", Policy: "REJECT", Comment: "ads.example subdomains"},
+		{Raw: "DOMAIN,tracker.example,REJECT"},
+		{Type: "DOMAIN-SUFFIX", Value: "tracker.example", Policy: "REJECT", Comment: "tracker.example subdomains"},
+		{Raw: "MATCH,DIRECT"},
+	}
+	if !reflect.DeepEqual(cfg.Rules, want) {
+		t.Errorf("Rules = %+v, want %+v", cfg.Rules, want)
+	}
+}
+
+func TestValidate_RuleTemplates(t *testing.T) {
+	block := RuleTemplate{Params: []string{"domain"}, Rules: []RuleEntry{{Raw: "DOMAIN-SUFFIX,{domain},REJECT"}}}
+	tests := []struct {
+		name      string
+		templates map[string]RuleTemplate
+		call      string
+	}{
+		{"unknown template", nil, "block(a.example)"},
+		{"argument count", map[string]RuleTemplate{"block": block}, "block(a.example, REJECT)"},
+		{"malformed call", map[string]RuleTemplate{"block": block}, "block a.example"},
+		{"undeclared parameter", map[string]RuleTemplate{"block": {Params: []string{"domain"}, Rules: []RuleEntry{{Raw: "DOMAIN,{domain},{policy}"}}}}, "block(a.example)"},
+		{"duplicate parameter", map[string]RuleTemplate{"block": {Params: []string{"d", "d"}, Rules: block.Rules}}, "block(a, b)"},
+		{"nested template", map[string]RuleTemplate{"block": {Rules: []RuleEntry{{Template: "other()"}}}}, "block()"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", RuleTemplates: tt.templates, Rules: []RuleEntry{{Template: tt.call}}}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Validate() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLoad_UpstreamChain(t *testing.T) {
+	content := `
+listen: ":12345"
+upstream:
+  - socks5://a.example:1080
+  - url: https://b.example
+    username: user
+    password: secret
+    server_name: proxy.example
+    insecure: true
+proxies:
+  tls: {url: "socks5+tls://c.example", insecure: true}
+`
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(configPath, tmpDir)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.DataDir != tmpDir {
+		t.Errorf("DataDir = %q, want the override %q", cfg.DataDir, tmpDir)
+	}
+	if got, want := cfg.Upstream.String(), "socks5://a.example:1080 -> https://b.example"; got != want {
+		t.Errorf("Upstream = %q, want %q", got, want)
+	}
+
+	chain := cfg.UpstreamChain
+	if len(chain) != 2 || chain[0].TLS != nil {
+		t.Fatalf("UpstreamChain = %+v", chain)
+	}
+	b := chain[1]
+	if password, _ := b.URL.User.Password(); b.URL.User.Username() != "user" || password != "secret" {
+		t.Errorf("hop 2 credentials = %v", b.URL.User)
+	}
+	if b.TLS == nil || b.TLS.ServerName != "proxy.example" || !b.TLS.InsecureSkipVerify {
+		t.Errorf("hop 2 TLS = %+v", b.TLS)
+	}
+	if tls := cfg.ProxyChains["tls"][0].TLS; tls == nil || tls.ServerName != "c.example" {
+		t.Errorf("ProxyChains[tls] TLS = %+v", tls)
+	}
+}
+
+func TestValidate_UpstreamChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain ProxyChain
+	}{
+		{"unknown scheme", ProxyChain{{URL: "ftp://host"}}},
+		{"missing host", ProxyChain{{URL: "socks5://"}}},
+		{"TLS settings on plain proxy", ProxyChain{{URL: "http://host", Insecure: true}}},
+		{"missing CA file", ProxyChain{{URL: "https://host", CA: "missing.pem"}}},
+		{"cert without key", ProxyChain{{URL: "https://host", Cert: "client.pem"}}},
+		{"bad second hop", ProxyChain{{URL: "socks5://a"}, {URL: "gopher://b"}}},
+		{"password file without username", ProxyChain{{URL: "http://host", PasswordFile: "password"}}},
+		{"password and password file", ProxyChain{{URL: "http://host", Username: "u", Password: "p", PasswordFile: "password"}}},
+		{"missing password file", ProxyChain{{URL: "http://host", Username: "u", PasswordFile: "missing"}}},
+		{"unset password env", ProxyChain{{URL: "http://host", Username: "u", PasswordEnv: "TPROXY_TEST_UNSET"}}},
+		{"multiplexed socks5", ProxyChain{{URL: "socks5+tls://host", Multiplex: true}}},
+		{"multiplexed second hop", ProxyChain{{URL: "https://a"}, {URL: "https://b", Multiplex: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", DataDir: t.TempDir(), Upstream: tt.chain}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestValidate_UpstreamTLSPolicy(t *testing.T) {
+	cfg := &Config{Listen: ":12345", Upstream: ProxyChain{{
+		URL:          "https://proxy.example",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"X25519", "p256"},
+	}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := cfg.UpstreamChain[0].TLS
+	if c.MinVersion != tls.VersionTLS12 || !slices.Equal(c.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}) ||
+		!slices.Equal(c.CurvePreferences, []tls.CurveID{tls.X25519, tls.CurveP256}) || c.ClientSessionCache == nil {
+		t.Errorf("TLS = %+v", c)
+	}
+
+	tests := []struct {
+		name    string
+		spec    ProxySpec
+		wantErr bool
+	}{
+		{"tls 1.3 only", ProxySpec{URL: "socks5+tls://proxy.example", MinTLSVersion: "1.3", NoSessionTickets: true}, false},
+		{"tls 1.1", ProxySpec{URL: "https://proxy.example", MinTLSVersion: "1.1"}, true},
+		{"suites with tls 1.3", ProxySpec{URL: "https://proxy.example", MinTLSVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, true},
+		{"tls 1.3 suite", ProxySpec{URL: "https://proxy.example", CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}, true},
+		{"insecure suite", ProxySpec{URL: "https://proxy.example", CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, true},
+		{"unknown curve", ProxySpec{URL: "https://proxy.example", Curves: []string{"p224"}}, true},
+		{"plain proxy", ProxySpec{URL: "http://proxy.example", MinTLSVersion: "1.3"}, true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Listen: ":12345", Upstream: ProxyChain{tt.spec}}
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && (cfg.UpstreamChain[0].TLS.MinVersion != tls.VersionTLS13 || !cfg.UpstreamChain[0].TLS.SessionTicketsDisabled) {
+			t.Errorf("%s: TLS = %+v", tt.name, cfg.UpstreamChain[0].TLS)
+		}
+	}
+}
+
+func TestValidate_RequireUpstreamHealthy(t *testing.T) {
+	cfg := &Config{Listen: ":12345", RequireUpstreamHealthy: true}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate() without upstream succeeded, want error")
+	}
+	cfg.Upstream = ProxyChain{{URL: "socks5://proxy.example:1080"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestValidate_Middleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware []MiddlewareConfig
+		wantErr    bool
+	}{
+		{"ordered", []MiddlewareConfig{{Name: "audit", Options: map[string]any{"path": "audit.jsonl"}}, {Name: "quota"}}, false},
+		{"missing name", []MiddlewareConfig{{Options: map[string]any{"path": "audit.jsonl"}}}, true},
+		{"duplicate", []MiddlewareConfig{{Name: "audit"}, {Name: "audit"}}, true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Listen: ":12345", Middleware: tt.middleware}
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidate_PasswordSources(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TPROXY_TEST_PASSWORD", "from-env")
+
+	cfg := &Config{
+		Listen:  ":12345",
+		DataDir: dir,
+		Upstream: ProxyChain{
+			{URL: "http://user@a.example", PasswordFile: "password"},
+			{URL: "socks5://b.example", Username: "user", PasswordEnv: "TPROXY_TEST_PASSWORD"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		file     string
+	}{
+		{"from-file", filepath.Join(dir, "password")},
+		{"from-env", ""},
+	}
+	for i, tt := range tests {
+		hop := cfg.UpstreamChain[i]
+		if password, _ := hop.URL.User.Password(); password != tt.password || hop.URL.User.Username() != "user" {
+			t.Errorf("hop %d credentials = %v, want password %q", i+1, hop.URL.User, tt.password)
+		}
+		if hop.PasswordFile != tt.file {
+			t.Errorf("hop %d PasswordFile = %q, want %q", i+1, hop.PasswordFile, tt.file)
+		}
+	}
+}
+
+func TestValidate_Reauth(t *testing.T) {
+	t.Setenv("TPROXY_TEST_PASSWORD", "secret")
+	flow := &DeviceFlow{DeviceURL: "https://login.example/device", TokenURL: "https://login.example/token", ClientID: "tproxy"}
+	tests := []struct {
+		name    string
+		spec    ProxySpec
+		wantErr bool
+	}{
+		{"command", ProxySpec{URL: "http://user@proxy.example", Reauth: &Reauth{Command: []string{"login"}}}, false},
+		{"device flow", ProxySpec{URL: "https://proxy.example", Reauth: &Reauth{DeviceFlow: flow}}, false},
+		{"none", ProxySpec{URL: "http://proxy.example", Reauth: &Reauth{}}, true},
+		{"both", ProxySpec{URL: "http://proxy.example", Reauth: &Reauth{Command: []string{"login"}, DeviceFlow: flow}}, true},
+		{"password env", ProxySpec{URL: "http://user@proxy.example", PasswordEnv: "TPROXY_TEST_PASSWORD", Reauth: &Reauth{Command: []string{"login"}}}, true},
+		{"socks5 without username", ProxySpec{URL: "socks5://proxy.example", Reauth: &Reauth{Command: []string{"login"}}}, true},
+		{"negative timeout", ProxySpec{URL: "http://proxy.example", Reauth: &Reauth{Command: []string{"login"}, Timeout: -1}}, true},
+		{"no client id", ProxySpec{URL: "http://proxy.example", Reauth: &Reauth{DeviceFlow: &DeviceFlow{DeviceURL: flow.DeviceURL, TokenURL: flow.TokenURL}}}, true},
+		{"bad token url", ProxySpec{URL: "http://proxy.example", Reauth: &Reauth{DeviceFlow: &DeviceFlow{DeviceURL: flow.DeviceURL, TokenURL: "/token", ClientID: "tproxy"}}}, true},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Listen: ":12345", DataDir: t.TempDir(), Upstream: ProxyChain{tt.spec}}
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && cfg.UpstreamChain[0].Reauth.Timeout != 60 {
+			t.Errorf("%s: timeout = %d, want the default 60", tt.name, cfg.UpstreamChain[0].Reauth.Timeout)
+		}
+	}
+}
+
+func TestValidate_DirectRoutes(t *testing.T) {
+	cfg := &Config{
+		Listen:       ":12345",
+		DirectRoutes: map[string]DirectRoute{"wan1": {Table: 201}, "wan2": {Table: 202, Mark: 0x1202}},
+		ProxyGroups:  []ProxyGroup{{Name: "Uplinks", Type: GroupFallback, Proxies: []string{"wan1", "wan2"}}},
+		Rules:        []RuleEntry{{Raw: "MATCH,Uplinks"}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.DirectRoutes["wan1"].Mark; got != 201 {
+		t.Errorf("wan1 mark = %d, want the table number", got)
+	}
+	if !cfg.HasPolicy("wan2") {
+		t.Error("HasPolicy(wan2) = false")
+	}
+
+	tests := map[string]map[string]DirectRoute{
+		"missing table":     {"wan1": {}},
+		"proxy table":       {"wan1": {Table: 100}},
+		"main table":        {"wan1": {Table: 254}},
+		"bypass mark":       {"wan1": {Table: 201, Mark: 0xff}},
+		"shared mark":       {"wan1": {Table: 201}, "wan2": {Table: 202, Mark: 201}},
+		"builtin name":      {"direct": {Table: 201}},
+		"named proxy clash": {"work": {Table: 201}},
+	}
+	for name, routes := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", DirectRoutes: routes, Proxies: map[string]ProxyChain{"work": {{URL: "socks5://work"}}}}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestValidate_ConnMark(t *testing.T) {
+	cfg := &Config{
+		Listen:       ":12345",
+		DirectRoutes: map[string]DirectRoute{"wan2": {Table: 202}},
+		ConnMark:     ConnMark{Marks: map[Policy]int{"proxy": 0x10, "wan2": 0x20}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ConnMark.Mask != 0xffffffff {
+		t.Errorf("mask = 0x%x, want all bits", cfg.ConnMark.Mask)
+	}
+	if cfg.ConnMark.Marks[PolicyProxy] != 0x10 {
+		t.Errorf("marks = %v, want proxy normalized to PROXY", cfg.ConnMark.Marks)
+	}
+
+	tests := map[string]ConnMark{
+		"reject":         {Marks: map[Policy]int{"REJECT": 1}},
+		"unknown policy": {Marks: map[Policy]int{"wan9": 1}},
+		"zero mark":      {Marks: map[Policy]int{"DIRECT": 0}},
+		"outside mask":   {Mask: 0xff00, Marks: map[Policy]int{"DIRECT": 0x10}},
+		"wide mask":      {Mask: 1 << 32, Marks: map[Policy]int{"DIRECT": 0x10}},
+	}
+	for name, m := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", ConnMark: m}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestValidate_Updates(t *testing.T) {
+	cfg := &Config{Listen: ":12345", Updates: Updates{From: "23:30", To: "02:00", Samples: []string{" Example.COM. ", "192.0.2.1"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Updates.FromMinute != 23*60+30 || cfg.Updates.ToMinute != 2*60 {
+		t.Errorf("window = %d-%d, want 1410-120", cfg.Updates.FromMinute, cfg.Updates.ToMinute)
+	}
+	if !slices.Equal(cfg.Updates.Samples, []string{"example.com", "192.0.2.1"}) {
+		t.Errorf("samples = %q, want normalized", cfg.Updates.Samples)
+	}
+
+	tests := map[string]Updates{
+		"from only":   {From: "03:00"},
+		"invalid":     {From: "3am", To: "05:00"},
+		"empty range": {From: "03:00", To: "03:00"},
+		"empty":       {Samples: []string{" "}},
+	}
+	for name, u := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", Updates: u}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestUpdates_Until(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("15:04:05", clock, time.Local)
+		return t
+	}
+	tests := []struct {
+		from, to int
+		now      string
+		want     time.Duration
+	}{
+		{180, 300, "04:00:00", 0},
+		{180, 300, "02:59:30", 30 * time.Second},
+		{180, 300, "05:00:00", 22 * time.Hour},
+		{1380, 60, "00:30:00", 0},
+		{1380, 60, "23:00:00", 0},
+		{1380, 60, "12:00:00", 11 * time.Hour},
+	}
+	for _, tt := range tests {
+		u := Updates{From: "set", FromMinute: tt.from, ToMinute: tt.to}
+		if got := u.Until(at(tt.now)); got != tt.want {
+			t.Errorf("Until(%s) with %d-%d = %v, want %v", tt.now, tt.from, tt.to, got, tt.want)
+		}
+	}
+	if got := (&Updates{}).Until(at("12:00:00")); got != 0 {
+		t.Errorf("Until() without window = %v, want 0", got)
+	}
+}
+
+func TestValidate_QoS(t *testing.T) {
+	cfg := &Config{
+		Listen: ":12345",
+		QoS:    QoS{Download: 10 << 20, Weights: map[string]int{"direct": 4, "DOMAIN-SUFFIX,zoom.us,DIRECT": 8}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QoS.Weights[string(PolicyDirect)] != 4 {
+		t.Errorf("weights = %v, want direct normalized to DIRECT", cfg.QoS.Weights)
+	}
+
+	tests := map[string]QoS{
+		"negative":       {Upload: -1},
+		"without cap":    {Weights: map[string]int{"PROXY": 2}},
+		"zero weight":    {Download: 1 << 20, Weights: map[string]int{"PROXY": 0}},
+		"reject":         {Download: 1 << 20, Weights: map[string]int{"REJECT": 2}},
+		"unknown policy": {Download: 1 << 20, Weights: map[string]int{"wan9": 2}},
+	}
+	for name, q := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", QoS: q}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
+	}
+}
+
+func TestValidate_Timeouts(t *testing.T) {
+	cfg := &Config{Listen: ":12345"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DialTimeout != DefaultDialTimeout || cfg.IdleTimeout != DefaultIdleTimeout {
+		t.Errorf("timeouts = %d, %d, want defaults", cfg.DialTimeout, cfg.IdleTimeout)
+	}
+
+	for _, cfg := range []*Config{
+		{Listen: ":12345", DialTimeout: -1},
+		{Listen: ":12345", MaxConnections: -1},
+		{Listen: ":12345", IdleModeAfter: -1},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(%+v) expected error", cfg)
+		}
+	}
+}
+
+func TestValidate_Plaintext(t *testing.T) {
+	for action, wantErr := range map[string]bool{"": false, "warn": false, "reject": false, "block": true} {
+		cfg := &Config{Listen: ":12345", Plaintext: PlaintextConfig{Action: action}}
+		if err := cfg.Validate(); (err != nil) != wantErr {
+			t.Errorf("Validate(plaintext.action %q) error = %v, wantErr %v", action, err, wantErr)
+		}
+	}
+}
+
+func TestValidate_ALG(t *testing.T) {
+	for action, wantErr := range map[string]bool{"": false, "warn": false, "direct": false, "rewrite": false, "nat": true} {
+		cfg := &Config{Listen: ":12345", ALG: ALGConfig{Action: action}}
+		if err := cfg.Validate(); (err != nil) != wantErr {
+			t.Errorf("Validate(alg.action %q) error = %v, wantErr %v", action, err, wantErr)
+		}
+	}
+
+	cfg := &Config{Listen: ":12345", ALG: ALGConfig{Action: ALGWarn, FTPPorts: []int{2121}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.ALG.FTPPorts, []int{2121}) || !reflect.DeepEqual(cfg.ALG.SIPPorts, []int{5060, 5061}) {
+		t.Errorf("ALG ports = %v %v, want [2121] [5060 5061]", cfg.ALG.FTPPorts, cfg.ALG.SIPPorts)
+	}
+	cfg = &Config{Listen: ":12345", ALG: ALGConfig{Action: ALGWarn, SIPPorts: []int{70000}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate(alg.sip_ports 70000) expected error")
+	}
+}
+
+func TestValidate_KeepWarm(t *testing.T) {
+	cfg := &Config{Listen: ":12345", KeepWarm: []KeepWarm{{Target: "SSO.Corp.Example.:443"}, {Target: "[2001:db8::1]:8443", Refresh: 5}}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := []KeepWarm{{Target: "sso.corp.example:443", Refresh: DefaultKeepWarmRefresh}, {Target: "[2001:db8::1]:8443", Refresh: 5}}
+	if !reflect.DeepEqual(cfg.KeepWarm, want) {
+		t.Errorf("KeepWarm = %+v, want %+v", cfg.KeepWarm, want)
+	}
+
+	for _, w := range []KeepWarm{
+		{Target: "sso.corp.example"},
+		{Target: ":443"},
+		{Target: "sso.corp.example:https"},
+		{Target: "sso.corp.example:70000"},
+		{Target: "sso.corp.example:443", Refresh: -1},
+	} {
+		cfg := &Config{Listen: ":12345", KeepWarm: []KeepWarm{w}}
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("Validate(keep_warm %+v) expected error", w)
+		}
+	}
+	cfg = &Config{Listen: ":12345", KeepWarm: []KeepWarm{{Target: "a.example:443"}, {Target: "A.example:443"}}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Validate(duplicate keep_warm targets) expected error")
+	}
+}
+
+func TestValidate_ExitCheck(t *testing.T) {
+	proxies := map[string]ProxyChain{"a": {{URL: "http://a:8080"}}}
+	cfg := &Config{
+		Listen:      ":12345",
+		Proxies:     proxies,
+		ExitCheck:   ExitCheck{URL: "https://api.ip.sb/geoip"},
+		ProxyGroups: []ProxyGroup{{Name: "Japan", Type: GroupFallback, Proxies: []string{"a", "DIRECT"}, PreferCountries: []string{"jp"}}},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ExitCheck.Interval != DefaultExitCheckInterval {
+		t.Errorf("ExitCheck.Interval = %d, want %d", cfg.ExitCheck.Interval, DefaultExitCheckInterval)
+	}
+	if got := cfg.ProxyGroups[0].PreferCountries; !reflect.DeepEqual(got, []string{"JP"}) {
+		t.Errorf("PreferCountries = %v, want [JP]", got)
+	}
+
+	tests := []struct {
+		name  string
+		check ExitCheck
+		group ProxyGroup
+	}{
+		{"bad url", ExitCheck{URL: "ftp://example.com"}, ProxyGroup{Name: "A", Type: GroupSelect, Proxies: []string{"a"}}},
+		{"negative interval", ExitCheck{URL: "http://example.com", Interval: -1}, ProxyGroup{Name: "A", Type: GroupSelect, Proxies: []string{"a"}}},
+		{"prefer without exit_check", ExitCheck{}, ProxyGroup{Name: "A", Type: GroupURLTest, Proxies: []string{"a"}, PreferCountries: []string{"JP"}}},
+		{"prefer on select", ExitCheck{URL: "http://example.com"}, ProxyGroup{Name: "A", Type: GroupSelect, Proxies: []string{"a"}, PreferCountries: []string{"JP"}}},
+		{"bad country", ExitCheck{URL: "http://example.com"}, ProxyGroup{Name: "A", Type: GroupURLTest, Proxies: []string{"a"}, PreferCountries: []string{"Japan"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Listen: ":12345", Proxies: proxies, ExitCheck: tt.check, ProxyGroups: []ProxyGroup{tt.group}}
+			if err := cfg.Validate(); err == nil {
+				t.Error("Expected validation error")
+			}
+		})
 	}
 }
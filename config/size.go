@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a byte count written as a plain number or with a KB/MB/GB/TB suffix (powers of 1024)
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses strings like "512", "64KB" or "1.5GB"
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return ByteSize(v * float64(scale)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	v, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// String formats the size with the largest exact unit
+func (b ByteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if int64(b) >= u.scale && int64(b)%u.scale == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/u.scale, u.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
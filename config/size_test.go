@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ByteSize
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"64KB", 64 << 10, false},
+		{"1gb", 1 << 30, false},
+		{"1.5 MB", 3 << 19, false},
+		{"10B", 10, false},
+		{"-1MB", 0, true},
+		{"lots", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseByteSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+
+	if s := ByteSize(1 << 30).String(); s != "1GB" {
+		t.Errorf("String() = %q, want 1GB", s)
+	}
+}
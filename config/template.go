@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// RuleTemplate is a parameterized list of rules, used from the rules list as
+// "template: name(arg, ...)". Rules refer to parameters as {param}.
+type RuleTemplate struct {
+	Params []string    `yaml:"params"`
+	Rules  []RuleEntry `yaml:"rules"`
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// validate checks that the rules only use declared parameters
+func (t RuleTemplate) validate() error {
+	if len(t.Rules) == 0 {
+		return fmt.Errorf("rules are required")
+	}
+	for i, p := range t.Params {
+		if p == "" || slices.Contains(t.Params[:i], p) {
+			return fmt.Errorf("invalid or duplicate parameter %q", p)
+		}
+	}
+	for i, r := range t.Rules {
+		if r.Template != "" {
+			return fmt.Errorf("rule %d: templates cannot use other templates", i+1)
+		}
+		for _, field := range []string{r.Raw, r.Type, r.Value, r.Policy, r.Comment} {
+			for _, m := range templatePlaceholder.FindAllStringSubmatch(field, -1) {
+				if !slices.Contains(t.Params, m[1]) {
+					return fmt.Errorf("rule %d: unknown parameter {%s}", i+1, m[1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expand returns the rules of the template with args substituted. The
+// comment of the calling entry applies to rules without their own.
+func (t RuleTemplate) expand(args []string, comment string) []RuleEntry {
+	pairs := make([]string, 0, 2*len(args))
+	for i, p := range t.Params {
+		pairs = append(pairs, "{"+p+"}", args[i])
+	}
+	r := strings.NewReplacer(pairs...)
+
+	rules := make([]RuleEntry, len(t.Rules))
+	for i, e := range t.Rules {
+		rules[i] = RuleEntry{
+			Type:    r.Replace(e.Type),
+			Value:   r.Replace(e.Value),
+			Policy:  r.Replace(e.Policy),
+			Comment: r.Replace(e.Comment),
+			Raw:     r.Replace(e.Raw),
+		}
+		if rules[i].Comment == "" {
+			rules[i].Comment = comment
+		}
+	}
+	return rules
+}
+
+// parseTemplateCall splits "name(arg, ...)" into the name and its arguments
+func parseTemplateCall(call string) (string, []string, error) {
+	name, rest, ok := strings.Cut(strings.TrimSpace(call), "(")
+	args, ok2 := strings.CutSuffix(strings.TrimSpace(rest), ")")
+	if !ok || !ok2 || strings.TrimSpace(name) == "" {
+		return "", nil, fmt.Errorf("invalid template call %q, expected name(arg, ...)", call)
+	}
+	var parsed []string
+	if strings.TrimSpace(args) != "" {
+		for a := range strings.SplitSeq(args, ",") {
+			parsed = append(parsed, strings.TrimSpace(a))
+		}
+	}
+	return strings.TrimSpace(name), parsed, nil
+}
+
+// expandTemplates replaces rules calling a template with the rules it expands to
+func (c *Config) expandTemplates() error {
+	for name, t := range c.RuleTemplates {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("rule_templates.%s: %w", name, err)
+		}
+	}
+
+	expanded := make([]RuleEntry, 0, len(c.Rules))
+	for i, r := range c.Rules {
+		if r.Template == "" {
+			expanded = append(expanded, r)
+			continue
+		}
+		name, args, err := parseTemplateCall(r.Template)
+		if err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		t, ok := c.RuleTemplates[name]
+		if !ok {
+			return fmt.Errorf("rules[%d]: unknown rule template %q", i, name)
+		}
+		if len(args) != len(t.Params) {
+			return fmt.Errorf("rules[%d]: template %s takes %d arguments, got %d", i, name, len(t.Params), len(args))
+		}
+		expanded = append(expanded, t.expand(args, r.Comment)...)
+	}
+	c.Rules = expanded
+	return nil
+}
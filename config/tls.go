@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+// ServerTLS is the certificate a TLS listener presents: either read from
+// files or issued and renewed through ACME
+type ServerTLS struct {
+	Cert string      `yaml:"cert"`
+	Key  string      `yaml:"key"`
+	ACME *ACMEConfig `yaml:"acme"`
+
+	// PEM bundle of the CAs client certificates must chain to, clients
+	// are not asked for one when empty
+	ClientCA string `yaml:"client_ca"`
+}
+
+// ACMEConfig requests certificates from an ACME CA such as Let's Encrypt.
+// TLS-ALPN-01 challenges are answered on the TLS listener itself, HTTP-01
+// challenges only when HTTPListen is set.
+type ACMEConfig struct {
+	// Names certificates are issued for
+	Domains []string `yaml:"domains"`
+
+	// Contact address for expiry and account notices (optional)
+	Email string `yaml:"email"`
+
+	// Optional address answering HTTP-01 challenges, usually ":80"
+	HTTPListen string `yaml:"http_listen"`
+
+	// Directory URL of the CA, Let's Encrypt if empty
+	DirectoryURL string `yaml:"directory_url"`
+}
+
+// Validate checks that exactly one certificate source is configured
+func (t *ServerTLS) Validate() error {
+	if t.ACME == nil {
+		if t.Cert == "" || t.Key == "" {
+			return fmt.Errorf("cert and key, or acme, are required")
+		}
+		return nil
+	}
+	if t.Cert != "" || t.Key != "" {
+		return fmt.Errorf("cert and key cannot be combined with acme")
+	}
+	if len(t.ACME.Domains) == 0 {
+		return fmt.Errorf("acme.domains is required")
+	}
+	if t.ACME.HTTPListen != "" {
+		if _, _, err := net.SplitHostPort(t.ACME.HTTPListen); err != nil {
+			return fmt.Errorf("invalid acme.http_listen %q: %w", t.ACME.HTTPListen, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Upstream proxy schemes
+const (
+	SchemeHTTP      = "http"
+	SchemeHTTPS     = "https"
+	SchemeSOCKS5    = "socks5"
+	SchemeSOCKS5TLS = "socks5+tls"
+)
+
+// ProxyChain is an upstream reached by tunneling through each proxy in turn.
+// In YAML it is a single proxy or a list of them.
+type ProxyChain []ProxySpec
+
+// UnmarshalYAML accepts a single proxy as well as a list
+func (c *ProxyChain) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode((*[]ProxySpec)(c))
+	}
+	var spec ProxySpec
+	if err := node.Decode(&spec); err != nil {
+		return err
+	}
+	*c = ProxyChain{spec}
+	return nil
+}
+
+// String returns the proxy URLs without passwords, joined by arrows
+func (c ProxyChain) String() string {
+	hops := make([]string, len(c))
+	for i, s := range c {
+		hops[i] = s.URL
+		if u, err := url.Parse(s.URL); err == nil {
+			hops[i] = u.Redacted()
+		}
+	}
+	return strings.Join(hops, " -> ")
+}
+
+// ProxySpec is one proxy of a chain, written as a URL or as a mapping with
+// credentials and TLS settings
+type ProxySpec struct {
+	URL string `yaml:"url"`
+
+	// Credentials replacing those in the URL. The password can instead be
+	// read from an environment variable, or from a file that is watched so
+	// rotated passwords apply to new connections without a reload.
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordEnv  string `yaml:"password_env"`
+	PasswordFile string `yaml:"password_file"`
+
+	// TLS settings of https:// and socks5+tls:// proxies. CA is a PEM bundle
+	// trusted instead of the system roots; Cert and Key authenticate the client.
+	CA         string `yaml:"ca"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ServerName string `yaml:"server_name"`
+	Insecure   bool   `yaml:"insecure"`
+
+	// TLS policy for deployments that must restrict what the proxy may
+	// negotiate. MinTLSVersion is "1.2" (default) or "1.3"; CipherSuites only
+	// apply to TLS 1.2 since TLS 1.3 suites are not configurable; Curves are
+	// x25519, p256, p384, p521 or x25519mlkem768 in order of preference.
+	// Sessions are resumed with tickets unless NoSessionTickets is set.
+	MinTLSVersion    string   `yaml:"min_tls_version"`
+	CipherSuites     []string `yaml:"cipher_suites"`
+	Curves           []string `yaml:"curves"`
+	NoSessionTickets bool     `yaml:"no_session_tickets"`
+
+	// Multiplex carries the connections to an https:// proxy as HTTP/2 streams
+	// over shared TLS connections, as served by "tproxy server". Only the first
+	// proxy of a chain can be multiplexed.
+	Multiplex bool `yaml:"multiplex"`
+
+	// Reauth obtains new credentials when the proxy rejects the current ones,
+	// for proxies whose sessions expire
+	Reauth *Reauth `yaml:"reauth"`
+}
+
+// Reauth renews the credentials of a proxy by running a command or with the
+// OAuth 2.0 device authorization grant (RFC 8628). The new password or token
+// is sent with the configured username, or as a bearer token without one.
+type Reauth struct {
+	// Command prints the new password or token on stdout
+	Command []string `yaml:"command"`
+	// Seconds the command may run (default 60)
+	Timeout int `yaml:"timeout"`
+
+	DeviceFlow *DeviceFlow `yaml:"device_flow"`
+}
+
+// DeviceFlow names the OAuth endpoints and client of the device authorization grant
+type DeviceFlow struct {
+	DeviceURL string `yaml:"device_url"`
+	TokenURL  string `yaml:"token_url"`
+	ClientID  string `yaml:"client_id"`
+	Scope     string `yaml:"scope"`
+}
+
+// UnmarshalYAML accepts both the URL and the mapping form of a proxy
+func (s *ProxySpec) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		s.URL = node.Value
+		return nil
+	case yaml.MappingNode:
+		type plain ProxySpec
+		if err := node.Decode((*plain)(s)); err != nil {
+			return err
+		}
+		if s.URL == "" {
+			return fmt.Errorf("line %d: proxy url is required", node.Line)
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: proxy must be a URL or a mapping", node.Line)
+	}
+}
+
+// ProxyHop is a parsed proxy of a chain
+type ProxyHop struct {
+	// URL carries the scheme, address and credentials
+	URL *url.URL
+	// TLS is set for https and socks5+tls proxies
+	TLS *tls.Config
+	// PasswordFile is the resolved password file path, empty if not used
+	PasswordFile string
+	// Multiplex opens tunnels as HTTP/2 streams
+	Multiplex bool
+	// Reauth renews rejected credentials, nil if not used
+	Reauth *Reauth
+}
+
+// ReadPassword reads a password file, ignoring surrounding whitespace
+func ReadPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parseChain parses and checks every proxy of chain, loading TLS files
+// relative to the data directory
+func (c *Config) parseChain(chain ProxyChain) ([]ProxyHop, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("at least one proxy is required")
+	}
+	hops := make([]ProxyHop, len(chain))
+	for i, spec := range chain {
+		hop, err := c.parseHop(spec)
+		if err == nil && i > 0 && hop.Multiplex {
+			err = fmt.Errorf("only the first proxy of a chain can be multiplexed")
+		}
+		if err != nil {
+			if len(chain) > 1 {
+				return nil, fmt.Errorf("hop %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		hops[i] = hop
+	}
+	return hops, nil
+}
+
+func (c *Config) parseHop(spec ProxySpec) (ProxyHop, error) {
+	u, err := url.Parse(spec.URL)
+	if err != nil {
+		return ProxyHop{}, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Hostname() == "" {
+		return ProxyHop{}, fmt.Errorf("URL %q has no host", u.Redacted())
+	}
+	if spec.Username != "" {
+		u.User = url.UserPassword(spec.Username, spec.Password)
+	}
+
+	hop := ProxyHop{URL: u}
+	if spec.PasswordEnv != "" || spec.PasswordFile != "" {
+		if spec.Password != "" || (spec.PasswordEnv != "" && spec.PasswordFile != "") {
+			return ProxyHop{}, fmt.Errorf("only one of password, password_env and password_file may be set")
+		}
+		if u.User == nil {
+			return ProxyHop{}, fmt.Errorf("password_env and password_file require a username")
+		}
+		password := os.Getenv(spec.PasswordEnv)
+		if spec.PasswordEnv != "" && password == "" {
+			return ProxyHop{}, fmt.Errorf("environment variable %s is not set", spec.PasswordEnv)
+		}
+		if spec.PasswordFile != "" {
+			hop.PasswordFile = c.DataPath(spec.PasswordFile)
+			if password, err = ReadPassword(hop.PasswordFile); err != nil {
+				return ProxyHop{}, err
+			}
+		}
+		u.User = url.UserPassword(u.User.Username(), password)
+	}
+
+	switch u.Scheme {
+	case SchemeHTTP, SchemeSOCKS5:
+		if spec.CA != "" || spec.Cert != "" || spec.Key != "" || spec.ServerName != "" || spec.Insecure ||
+			spec.MinTLSVersion != "" || len(spec.CipherSuites) > 0 || len(spec.Curves) > 0 || spec.NoSessionTickets {
+			return ProxyHop{}, fmt.Errorf("TLS settings require an https:// or socks5+tls:// proxy, got %s", u.Scheme)
+		}
+	case SchemeHTTPS, SchemeSOCKS5TLS:
+		if hop.TLS, err = c.proxyTLSConfig(spec, u.Hostname()); err != nil {
+			return ProxyHop{}, err
+		}
+	default:
+		return ProxyHop{}, fmt.Errorf("must be http://, https://, socks5:// or socks5+tls://, got %s", u.Scheme)
+	}
+	if spec.Multiplex && u.Scheme != SchemeHTTPS {
+		return ProxyHop{}, fmt.Errorf("multiplex requires an https:// proxy, got %s", u.Scheme)
+	}
+	hop.Multiplex = spec.Multiplex
+	if spec.Reauth != nil {
+		if err := validateReauth(spec, u); err != nil {
+			return ProxyHop{}, fmt.Errorf("reauth: %w", err)
+		}
+		hop.Reauth = spec.Reauth
+	}
+	return hop, nil
+}
+
+// validateReauth checks the reauth settings of spec and applies their defaults
+func validateReauth(spec ProxySpec, u *url.URL) error {
+	r := spec.Reauth
+	switch {
+	case (len(r.Command) > 0) == (r.DeviceFlow != nil):
+		return fmt.Errorf("exactly one of command and device_flow is required")
+	case spec.PasswordEnv != "" || spec.PasswordFile != "":
+		return fmt.Errorf("cannot be combined with password_env or password_file")
+	case (u.Scheme == SchemeSOCKS5 || u.Scheme == SchemeSOCKS5TLS) && u.User == nil:
+		return fmt.Errorf("SOCKS5 proxies require a username")
+	case r.Timeout < 0:
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if r.Timeout == 0 {
+		r.Timeout = 60
+	}
+	if f := r.DeviceFlow; f != nil {
+		if f.ClientID == "" {
+			return fmt.Errorf("device_flow requires client_id")
+		}
+		for _, e := range [][2]string{{"device_url", f.DeviceURL}, {"token_url", f.TokenURL}} {
+			if u, err := url.Parse(e[1]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("device_flow %s %q must be an http or https URL", e[0], e[1])
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) proxyTLSConfig(spec ProxySpec, host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:             spec.ServerName,
+		InsecureSkipVerify:     spec.Insecure,
+		SessionTicketsDisabled: spec.NoSessionTickets,
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if !spec.NoSessionTickets {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if err := setTLSPolicy(cfg, spec); err != nil {
+		return nil, err
+	}
+
+	if spec.CA != "" {
+		pem, err := os.ReadFile(c.DataPath(spec.CA))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca %s contains no certificates", spec.CA)
+		}
+	}
+
+	if (spec.Cert == "") != (spec.Key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+	if spec.Cert != "" {
+		pair, err := tls.LoadX509KeyPair(c.DataPath(spec.Cert), c.DataPath(spec.Key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+// tlsCurves maps the names accepted in curves to their key exchanges
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+	"x25519mlkem768": tls.X25519MLKEM768,
+}
+
+// setTLSPolicy applies the TLS version, cipher suite and curve settings of spec
+func setTLSPolicy(cfg *tls.Config, spec ProxySpec) error {
+	switch spec.MinTLSVersion {
+	case "", "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+		if len(spec.CipherSuites) > 0 {
+			return fmt.Errorf("cipher_suites have no effect with min_tls_version 1.3")
+		}
+	default:
+		return fmt.Errorf("min_tls_version must be 1.2 or 1.3, got %q", spec.MinTLSVersion)
+	}
+
+	for _, name := range spec.CipherSuites {
+		id, err := tls12CipherSuite(name)
+		if err != nil {
+			return err
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range spec.Curves {
+		id, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+	return nil
+}
+
+// tls12CipherSuite returns the ID of a secure TLS 1.2 cipher suite
+func tls12CipherSuite(name string) (uint16, error) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name != name {
+			continue
+		}
+		if !slices.Contains(s.SupportedVersions, tls.VersionTLS12) {
+			return 0, fmt.Errorf("cipher suite %s is TLS 1.3 only and not configurable", name)
+		}
+		return s.ID, nil
+	}
+	return 0, fmt.Errorf("unknown or insecure cipher suite %q", name)
+}
@@ -0,0 +1,213 @@
+package dhcp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReloadInterval is how often lease files are checked for changes
+const ReloadInterval = 10 * time.Second
+
+// Lease file formats
+const (
+	FormatDnsmasq = "dnsmasq"
+	FormatKea     = "kea"
+)
+
+// LeaseFile describes a DHCP server lease database
+type LeaseFile struct {
+	Path   string
+	Format string
+}
+
+// Lease is a single DHCP lease
+type Lease struct {
+	IP       net.IP
+	MAC      net.HardwareAddr
+	Hostname string
+}
+
+// Leases maps client addresses to device names using DHCP lease files
+type Leases struct {
+	files []LeaseFile
+
+	mu      sync.RWMutex
+	byIP    map[string]Lease
+	modTime map[string]time.Time
+}
+
+// NewLeases creates a lease table for the given files. Files are read on Reload.
+func NewLeases(files []LeaseFile) *Leases {
+	return &Leases{
+		files:   files,
+		byIP:    make(map[string]Lease),
+		modTime: make(map[string]time.Time),
+	}
+}
+
+// Name returns the hostname leased to ip, or "" if unknown
+func (l *Leases) Name(ip net.IP) string {
+	if l == nil || ip == nil {
+		return ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.byIP[ip.String()].Hostname
+}
+
+// Lookup returns the lease for ip
+func (l *Leases) Lookup(ip net.IP) (Lease, bool) {
+	if l == nil || ip == nil {
+		return Lease{}, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lease, ok := l.byIP[ip.String()]
+	return lease, ok
+}
+
+// Run reloads lease files whenever they change until ctx is cancelled
+func (l *Leases) Run(ctx context.Context) error {
+	l.Reload()
+
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			l.Reload()
+		}
+	}
+}
+
+// Reload re-reads lease files whose modification time changed
+func (l *Leases) Reload() {
+	changed := false
+	for _, f := range l.files {
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			slog.Debug("Failed to stat DHCP lease file", "path", f.Path, "error", err)
+			continue
+		}
+		if l.modTime[f.Path].Equal(info.ModTime()) {
+			continue
+		}
+		l.modTime[f.Path] = info.ModTime()
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	byIP := make(map[string]Lease)
+	for _, f := range l.files {
+		leases, err := readLeaseFile(f)
+		if err != nil {
+			slog.Warn("Failed to read DHCP lease file", "path", f.Path, "error", err)
+			continue
+		}
+		for _, lease := range leases {
+			byIP[lease.IP.String()] = lease
+		}
+	}
+
+	l.mu.Lock()
+	l.byIP = byIP
+	l.mu.Unlock()
+
+	slog.Debug("DHCP leases loaded", "leases", len(byIP))
+}
+
+func readLeaseFile(f LeaseFile) ([]Lease, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch f.Format {
+	case FormatDnsmasq:
+		return ParseDnsmasq(file)
+	case FormatKea:
+		return ParseKea(file)
+	default:
+		return nil, fmt.Errorf("unsupported lease format: %s", f.Format)
+	}
+}
+
+// ParseDnsmasq parses a dnsmasq lease file.
+// Format: EXPIRY MAC IP HOSTNAME CLIENT-ID, with "*" for an unknown hostname.
+func ParseDnsmasq(r io.Reader) ([]Lease, error) {
+	var leases []Lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			// DHCPv6 "duid" lines and malformed entries
+			continue
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			continue
+		}
+		mac, _ := net.ParseMAC(fields[1])
+		hostname := fields[3]
+		if hostname == "*" {
+			hostname = ""
+		}
+		leases = append(leases, Lease{IP: ip, MAC: mac, Hostname: hostname})
+	}
+	return leases, scanner.Err()
+}
+
+// ParseKea parses a Kea memfile CSV lease database, using its header to locate columns
+func ParseKea(r io.Reader) ([]Lease, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+
+	columns := make(map[string]int)
+	for i, name := range strings.Split(scanner.Text(), ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	addrCol, ok := columns["address"]
+	if !ok {
+		return nil, fmt.Errorf("missing address column in kea lease header")
+	}
+	hwCol, hasHW := columns["hwaddr"]
+	nameCol, hasName := columns["hostname"]
+
+	var leases []Lease
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if addrCol >= len(fields) {
+			continue
+		}
+		ip := net.ParseIP(fields[addrCol])
+		if ip == nil {
+			continue
+		}
+		lease := Lease{IP: ip}
+		if hasHW && hwCol < len(fields) {
+			lease.MAC, _ = net.ParseMAC(fields[hwCol])
+		}
+		if hasName && nameCol < len(fields) {
+			lease.Hostname = strings.TrimSuffix(fields[nameCol], ".")
+		}
+		// Kea appends later lease updates, so the last entry for an address wins
+		leases = append(leases, lease)
+	}
+	return leases, scanner.Err()
+}
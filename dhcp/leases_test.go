@@ -0,0 +1,71 @@
+package dhcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDnsmasq(t *testing.T) {
+	data := `1735689600 aa:bb:cc:dd:ee:ff 192.168.1.10 living-room-tv 01:aa:bb:cc:dd:ee:ff
+1735689600 11:22:33:44:55:66 192.168.1.11 * *
+duid 00:01:00:01:2a:2b:2c:2d:2e:2f:30:31:32:33
+`
+	leases, err := ParseDnsmasq(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseDnsmasq() error = %v", err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("len(leases) = %d, want 2", len(leases))
+	}
+	if leases[0].Hostname != "living-room-tv" {
+		t.Errorf("Hostname = %q, want living-room-tv", leases[0].Hostname)
+	}
+	if leases[0].MAC.String() != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("MAC = %v", leases[0].MAC)
+	}
+	if leases[1].Hostname != "" {
+		t.Errorf("Hostname = %q, want empty for *", leases[1].Hostname)
+	}
+}
+
+func TestParseKea(t *testing.T) {
+	data := `address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.168.1.20,aa:bb:cc:dd:ee:01,,3600,1735689600,1,0,0,phone.lan.,0,
+192.168.1.21,aa:bb:cc:dd:ee:02,,3600,1735689600,1,0,0,,0,
+`
+	leases, err := ParseKea(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseKea() error = %v", err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("len(leases) = %d, want 2", len(leases))
+	}
+	if leases[0].Hostname != "phone.lan" {
+		t.Errorf("Hostname = %q, want phone.lan", leases[0].Hostname)
+	}
+}
+
+func TestLeases_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	if err := os.WriteFile(path, []byte("0 aa:bb:cc:dd:ee:ff 192.168.1.10 laptop *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLeases([]LeaseFile{{Path: path, Format: FormatDnsmasq}})
+	l.Reload()
+
+	if got := l.Name(net.ParseIP("192.168.1.10")); got != "laptop" {
+		t.Errorf("Name() = %q, want laptop", got)
+	}
+	if got := l.Name(net.ParseIP("192.168.1.99")); got != "" {
+		t.Errorf("Name() = %q, want empty", got)
+	}
+
+	var nilLeases *Leases
+	if got := nilLeases.Name(net.ParseIP("192.168.1.10")); got != "" {
+		t.Errorf("nil Leases Name() = %q, want empty", got)
+	}
+}
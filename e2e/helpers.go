@@ -4,6 +4,7 @@
 package e2e
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/google/nftables"
 	"github.com/vishvananda/netns"
 )
 
@@ -36,6 +38,10 @@ const (
 	HostIP = "10.200.1.1/24"
 	// NSIP is the IP address for the namespace side of veth
 	NSIP = "10.200.1.2/24"
+	// HostAltIP is a second host address, reached from the namespace through the same veth
+	HostAltIP = "10.200.1.3/32"
+	// HostDirectIP is a third host address, for targets reached without the upstream
+	HostDirectIP = "10.200.1.4/32"
 )
 
 // TestEnvironment manages the e2e test environment with network namespace isolation
@@ -167,6 +173,13 @@ func (env *TestEnvironment) setupNetworkNamespace() error {
 			return fmt.Errorf("failed to add host IP: %w", err)
 		}
 	}
+	for _, ip := range []string{HostAltIP, HostDirectIP} {
+		if err := runCmd("ip", "addr", "add", ip, "dev", VethHost); err != nil {
+			if !strings.Contains(err.Error(), "exists") {
+				return fmt.Errorf("failed to add host IP %s: %w", ip, err)
+			}
+		}
+	}
 	if err := runCmd("ip", "link", "set", VethHost, "up"); err != nil {
 		return fmt.Errorf("failed to bring up host veth: %w", err)
 	}
@@ -207,12 +220,7 @@ func (env *TestEnvironment) StartProxy(ctx context.Context) error {
 		return fmt.Errorf("failed to start proxy: %w", err)
 	}
 
-	env.CleanupFns = append(env.CleanupFns, func() {
-		if env.ProxyCmd.Process != nil {
-			env.ProxyCmd.Process.Signal(syscall.SIGTERM)
-			env.ProxyCmd.Wait()
-		}
-	})
+	env.CleanupFns = append(env.CleanupFns, env.StopProxy)
 
 	// Wait for proxy to be ready
 	time.Sleep(500 * time.Millisecond)
@@ -230,17 +238,21 @@ func (env *TestEnvironment) StartProxyDirect(ctx context.Context) error {
 		return fmt.Errorf("failed to start proxy: %w", err)
 	}
 
-	env.CleanupFns = append(env.CleanupFns, func() {
-		if env.ProxyCmd.Process != nil {
-			env.ProxyCmd.Process.Signal(syscall.SIGTERM)
-			env.ProxyCmd.Wait()
-		}
-	})
+	env.CleanupFns = append(env.CleanupFns, env.StopProxy)
 
 	time.Sleep(500 * time.Millisecond)
 	return nil
 }
 
+// StopProxy terminates the proxy and waits for it to exit, letting it remove its rules
+func (env *TestEnvironment) StopProxy() {
+	if env.ProxyCmd == nil || env.ProxyCmd.Process == nil || env.ProxyCmd.ProcessState != nil {
+		return
+	}
+	env.ProxyCmd.Process.Signal(syscall.SIGTERM)
+	env.ProxyCmd.Wait()
+}
+
 // Cleanup tears down the test environment
 func (env *TestEnvironment) Cleanup() {
 	// Run cleanup functions in reverse order
@@ -306,6 +318,86 @@ func HTTPGet(url string, timeout time.Duration) (int, string, error) {
 	return resp.StatusCode, string(body), nil
 }
 
+// DialInNS opens a TCP connection from inside the test namespace, so it passes
+// the OUTPUT hook of the proxy's nftables rules like local traffic would
+func DialInNS(addr string, timeout time.Duration) (net.Conn, error) {
+	// Sockets belong to the namespace of the thread creating them
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNS, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get original namespace: %w", err)
+	}
+	defer origNS.Close()
+	ns, err := netns.GetFromName(TestNamespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get test namespace: %w", err)
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return nil, fmt.Errorf("failed to enter test namespace: %w", err)
+	}
+	defer netns.Set(origNS)
+
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// HTTPGetInNS performs an HTTP GET of / on addr from inside the test namespace
+func HTTPGetInNS(addr string, timeout time.Duration) (int, string, error) {
+	conn, err := DialInNS(addr, timeout)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", addr); err != nil {
+		return 0, "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, "", err
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// ProxyTableInNS reports whether the proxy's nftables table exists in the test namespace
+func ProxyTableInNS() (bool, error) {
+	ns, err := netns.GetFromName(TestNamespace)
+	if err != nil {
+		return false, fmt.Errorf("failed to get test namespace: %w", err)
+	}
+	defer ns.Close()
+
+	conn, err := nftables.New(nftables.WithNetNSFd(int(ns)))
+	if err != nil {
+		return false, fmt.Errorf("failed to create nftables connection: %w", err)
+	}
+	tables, err := conn.ListTables()
+	if err != nil {
+		return false, fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Name == "transparent_proxy" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RunCommandInNS runs a command in the test namespace and returns its output
+func RunCommandInNS(name string, args ...string) (string, error) {
+	return RunCommand("ip", append([]string{"netns", "exec", TestNamespace, name}, args...)...)
+}
+
 // RunCommand runs a command and returns its output
 func RunCommand(name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
@@ -0,0 +1,167 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// hostAddr, hostAltAddr and hostDirectAddr are the host addresses of the veth pair without prefix
+	hostAddr       = "10.200.1.1"
+	hostAltAddr    = "10.200.1.3"
+	hostDirectAddr = "10.200.1.4"
+	// upstreamAddr is where the mock upstream proxy listens
+	upstreamAddr = hostAddr + ":18080"
+)
+
+// interceptModes are the interception modes exercised end to end; redirect
+// mode reads the destination with SO_ORIGINAL_DST instead of TPROXY
+var interceptModes = []string{"tproxy", "redirect"}
+
+// routingConfig sends hostAddr through upstream, rejects hostAltAddr and
+// connects everything else directly
+const routingConfig = `
+listen: ":12345"
+mode: %q
+upstream: %q
+log_level: "debug"
+dns:
+  local_nameservers:
+    - "8.8.8.8"
+rules:
+  - IP-CIDR,` + hostAltAddr + `/32,REJECT
+  - IP-CIDR,` + hostAddr + `/32,PROXY
+  - MATCH,DIRECT
+`
+
+// startTarget serves body on addr until the test ends
+func startTarget(t *testing.T, addr, body string) *MockTargetServer {
+	t.Helper()
+	target := NewMockTargetServer(body)
+	if err := target.StartAt(addr); err != nil {
+		t.Fatalf("Failed to start target server on %s: %v", addr, err)
+	}
+	t.Cleanup(target.Stop)
+	return target
+}
+
+// startInterceptingProxy runs the proxy in the test namespace with its nftables
+// rules installed and waits until it accepts connections
+func startInterceptingProxy(t *testing.T, env *TestEnvironment, config string) {
+	t.Helper()
+	if err := env.Setup(config); err != nil {
+		t.Fatalf("Failed to setup environment: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	if err := env.StartProxy(ctx); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	if err := WaitForPortInNS(TestProxyPort, 5*time.Second); err != nil {
+		t.Fatalf("Proxy did not start: %v", err)
+	}
+}
+
+func TestInterceptRouting(t *testing.T) {
+	RequireLinux(t)
+	RequireRoot(t)
+
+	for _, mode := range interceptModes {
+		t.Run(mode, func(t *testing.T) {
+			env := NewTestEnvironment()
+			defer env.Cleanup()
+			startInterceptingProxy(t, env, fmt.Sprintf(routingConfig, mode, "http://"+upstreamAddr))
+
+			// Servers bind the host side of the veth pair created above
+			upstream := NewMockProxy()
+			if err := upstream.StartAt(upstreamAddr); err != nil {
+				t.Fatalf("Failed to start mock proxy: %v", err)
+			}
+			defer upstream.Stop()
+			proxied := startTarget(t, hostAddr+":80", "proxied")
+			direct := startTarget(t, hostDirectAddr+":80", "direct")
+			rejected := startTarget(t, hostAltAddr+":80", "rejected")
+
+			tests := []struct {
+				name     string
+				addr     string
+				target   *MockTargetServer
+				wantBody string // empty if the connection must be rejected
+				via      bool   // whether the upstream must see the connection
+			}{
+				{name: "proxy", addr: hostAddr + ":80", target: proxied, wantBody: "proxied", via: true},
+				{name: "direct", addr: hostDirectAddr + ":80", target: direct, wantBody: "direct"},
+				{name: "reject", addr: hostAltAddr + ":80", target: rejected},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					before := tt.target.RequestCount()
+					status, body, err := HTTPGetInNS(tt.addr, DefaultTimeout)
+
+					if tt.wantBody == "" {
+						if err == nil && status == http.StatusOK {
+							t.Errorf("Expected connection to %s to be rejected, got %d %q", tt.addr, status, body)
+						}
+						if n := tt.target.RequestCount(); n != before {
+							t.Errorf("Rejected target received %d requests", n-before)
+						}
+						return
+					}
+
+					if err != nil {
+						t.Fatalf("Request to %s failed: %v", tt.addr, err)
+					}
+					if status != http.StatusOK || body != tt.wantBody {
+						t.Errorf("Got %d %q, want 200 %q", status, body, tt.wantBody)
+					}
+					if via := slices.Contains(upstream.Targets(), tt.addr); via != tt.via {
+						t.Errorf("Upstream saw %s: %v, want %v (targets %v)", tt.addr, via, tt.via, upstream.Targets())
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCleanupRemovesRouting(t *testing.T) {
+	RequireLinux(t)
+	RequireRoot(t)
+
+	for _, mode := range interceptModes {
+		t.Run(mode, func(t *testing.T) {
+			env := NewTestEnvironment()
+			defer env.Cleanup()
+			startInterceptingProxy(t, env, fmt.Sprintf(routingConfig, mode, "http://"+upstreamAddr))
+
+			// Redirect mode uses NAT only, tproxy mode adds policy routing
+			policyRouting := mode == "tproxy"
+			check := func(wantInstalled bool) {
+				t.Helper()
+				if got, err := ProxyTableInNS(); err != nil || got != wantInstalled {
+					t.Errorf("nftables table installed: %v, want %v (%v)", got, wantInstalled, err)
+				}
+				rules, _ := RunCommandInNS("ip", "rule", "show")
+				if got := strings.Contains(rules, "fwmark 0x1 lookup 100"); got != (wantInstalled && policyRouting) {
+					t.Errorf("fwmark rule installed: %v, want %v\n%s", got, wantInstalled && policyRouting, rules)
+				}
+				// Listing a table that does not exist fails
+				routes, err := RunCommandInNS("ip", "route", "show", "table", "100")
+				if got := err == nil && routes != ""; got != (wantInstalled && policyRouting) {
+					t.Errorf("routes in table 100: %v, want %v\n%s", got, wantInstalled && policyRouting, routes)
+				}
+			}
+
+			check(true)
+			env.StopProxy()
+			check(false)
+		})
+	}
+}
@@ -19,6 +19,7 @@ type MockProxy struct {
 	listener    net.Listener
 	addr        string
 	connections int
+	targets     []string
 	mu          sync.Mutex
 	ctx         context.Context
 	cancel      context.CancelFunc
@@ -35,7 +36,12 @@ func NewMockProxy() *MockProxy {
 
 // Start starts the mock proxy on a random port
 func (p *MockProxy) Start() error {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	return p.StartAt("127.0.0.1:0")
+}
+
+// StartAt starts the mock proxy on addr
+func (p *MockProxy) StartAt(addr string) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
@@ -63,6 +69,13 @@ func (p *MockProxy) ConnectionCount() int {
 	return p.connections
 }
 
+// Targets returns the CONNECT targets requested so far
+func (p *MockProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
 // Stop stops the mock proxy
 func (p *MockProxy) Stop() {
 	p.cancel()
@@ -107,6 +120,10 @@ func (p *MockProxy) handleConnection(conn net.Conn) {
 }
 
 func (p *MockProxy) handleConnect(conn net.Conn, req *http.Request) {
+	p.mu.Lock()
+	p.targets = append(p.targets, req.Host)
+	p.mu.Unlock()
+
 	// Connect to target
 	targetConn, err := net.Dial("tcp", req.Host)
 	if err != nil {
@@ -183,7 +200,12 @@ func NewMockTargetServer(response string) *MockTargetServer {
 
 // Start starts the mock target server
 func (m *MockTargetServer) Start() error {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	return m.StartAt("127.0.0.1:0")
+}
+
+// StartAt starts the mock target server on addr
+func (m *MockTargetServer) StartAt(addr string) error {
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,36 @@
+package iptables
+
+import (
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// nftConn is the part of *nftables.Conn the Manager uses. Changes are queued
+// and applied atomically by Flush.
+type nftConn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	ListTables() ([]*nftables.Table, error)
+	AddChain(c *nftables.Chain) *nftables.Chain
+	AddRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	Flush() error
+}
+
+// netlinkOps is the part of *netlink.Handle the Manager uses for policy routing.
+// Unlike nftables changes, each call takes effect immediately.
+type netlinkOps interface {
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleList(family int) ([]netlink.Rule, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	LinkByName(name string) (netlink.Link, error)
+}
+
+// dialNFTables opens a netlink connection to the kernel's nftables
+func dialNFTables() (nftConn, error) {
+	return nftables.New()
+}
@@ -0,0 +1,274 @@
+package iptables
+
+import (
+	"fmt"
+	"slices"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// fakeKernel implements nftConn and netlinkOps in memory. Like the kernel it
+// applies queued nftables changes atomically on Flush and rejects duplicate
+// or missing routing entries. Netlink calls and flushes are logged in order
+// and fail with failOn[line] when set.
+type fakeKernel struct {
+	log    []string
+	failOn map[string]error
+
+	nft     nftState
+	pending []func(*nftState) error
+	handle  uint64
+
+	rules  []netlink.Rule
+	routes []netlink.Route
+}
+
+type nftState struct {
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	rules  []*nftables.Rule
+}
+
+func (s nftState) clone() nftState {
+	return nftState{tables: slices.Clone(s.tables), chains: slices.Clone(s.chains), rules: slices.Clone(s.rules)}
+}
+
+func (s *nftState) chainIndex(table, chain string) int {
+	return slices.IndexFunc(s.chains, func(c *nftables.Chain) bool { return c.Table.Name == table && c.Name == chain })
+}
+
+func newFakeKernel() *fakeKernel {
+	return &fakeKernel{failOn: make(map[string]error)}
+}
+
+func (k *fakeKernel) dial() (nftConn, error) { return k, nil }
+
+// call logs line and returns its injected error
+func (k *fakeKernel) call(line string) error {
+	k.log = append(k.log, line)
+	return k.failOn[line]
+}
+
+func (k *fakeKernel) AddTable(t *nftables.Table) *nftables.Table {
+	k.pending = append(k.pending, func(s *nftState) error {
+		if !slices.ContainsFunc(s.tables, func(e *nftables.Table) bool { return e.Name == t.Name }) {
+			s.tables = append(s.tables, t)
+		}
+		return nil
+	})
+	return t
+}
+
+func (k *fakeKernel) DelTable(t *nftables.Table) {
+	k.pending = append(k.pending, func(s *nftState) error {
+		i := slices.IndexFunc(s.tables, func(e *nftables.Table) bool { return e.Name == t.Name })
+		if i < 0 {
+			return syscall.ENOENT
+		}
+		s.tables = slices.Delete(s.tables, i, i+1)
+		s.chains = slices.DeleteFunc(s.chains, func(c *nftables.Chain) bool { return c.Table.Name == t.Name })
+		s.rules = slices.DeleteFunc(s.rules, func(r *nftables.Rule) bool { return r.Table.Name == t.Name })
+		return nil
+	})
+}
+
+func (k *fakeKernel) ListTables() ([]*nftables.Table, error) {
+	return slices.Clone(k.nft.tables), nil
+}
+
+func (k *fakeKernel) AddChain(c *nftables.Chain) *nftables.Chain {
+	k.pending = append(k.pending, func(s *nftState) error {
+		if !slices.ContainsFunc(s.tables, func(t *nftables.Table) bool { return t.Name == c.Table.Name }) {
+			return syscall.ENOENT
+		}
+		if s.chainIndex(c.Table.Name, c.Name) < 0 {
+			s.chains = append(s.chains, c)
+		}
+		return nil
+	})
+	return c
+}
+
+func (k *fakeKernel) AddRule(r *nftables.Rule) *nftables.Rule {
+	k.pending = append(k.pending, func(s *nftState) error {
+		if s.chainIndex(r.Table.Name, r.Chain.Name) < 0 {
+			return syscall.ENOENT
+		}
+		k.handle++
+		r.Handle = k.handle
+		s.rules = append(s.rules, r)
+		return nil
+	})
+	return r
+}
+
+func (k *fakeKernel) DelRule(r *nftables.Rule) error {
+	if r.Handle == 0 {
+		return fmt.Errorf("rule has no handle")
+	}
+	k.pending = append(k.pending, func(s *nftState) error {
+		i := slices.IndexFunc(s.rules, func(e *nftables.Rule) bool { return e.Handle == r.Handle })
+		if i < 0 {
+			return syscall.ENOENT
+		}
+		s.rules = slices.Delete(s.rules, i, i+1)
+		return nil
+	})
+	return nil
+}
+
+func (k *fakeKernel) GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	if k.nft.chainIndex(t.Name, c.Name) < 0 {
+		return nil, syscall.ENOENT
+	}
+	var out []*nftables.Rule
+	for _, r := range k.nft.rules {
+		if r.Table.Name == t.Name && r.Chain.Name == c.Name {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (k *fakeKernel) Flush() error {
+	pending := k.pending
+	k.pending = nil
+	if err := k.call("flush"); err != nil {
+		return err
+	}
+	next := k.nft.clone()
+	for _, op := range pending {
+		if err := op(&next); err != nil {
+			return err
+		}
+	}
+	k.nft = next
+	return nil
+}
+
+func family(f int) string {
+	return map[int]string{netlink.FAMILY_V4: "v4", netlink.FAMILY_V6: "v6"}[f]
+}
+
+func ruleLine(r *netlink.Rule) string {
+	return fmt.Sprintf("%s prio %d mark 0x%x table %d", family(r.Family), r.Priority, r.Mark, r.Table)
+}
+
+func routeLine(r *netlink.Route) string {
+	return fmt.Sprintf("%s %s table %d", family(r.Family), r.Dst, r.Table)
+}
+
+func (k *fakeKernel) RuleAdd(rule *netlink.Rule) error {
+	if err := k.call("rule add " + ruleLine(rule)); err != nil {
+		return err
+	}
+	if slices.ContainsFunc(k.rules, func(r netlink.Rule) bool { return ruleLine(&r) == ruleLine(rule) }) {
+		return syscall.EEXIST
+	}
+	k.rules = append(k.rules, *rule)
+	return nil
+}
+
+func (k *fakeKernel) RuleDel(rule *netlink.Rule) error {
+	if err := k.call("rule del " + ruleLine(rule)); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(k.rules, func(r netlink.Rule) bool { return ruleLine(&r) == ruleLine(rule) })
+	if i < 0 {
+		return syscall.ENOENT
+	}
+	k.rules = slices.Delete(k.rules, i, i+1)
+	return nil
+}
+
+func (k *fakeKernel) RuleList(f int) ([]netlink.Rule, error) {
+	var out []netlink.Rule
+	for _, r := range k.rules {
+		if r.Family == f {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+// routeType is the type the kernel compares, netlink sends unicast when unset
+func routeType(r *netlink.Route) int {
+	if r.Type == 0 {
+		return syscall.RTN_UNICAST
+	}
+	return r.Type
+}
+
+func (k *fakeKernel) findRoute(route *netlink.Route) int {
+	return slices.IndexFunc(k.routes, func(r netlink.Route) bool {
+		return routeLine(&r) == routeLine(route) && routeType(&r) == routeType(route)
+	})
+}
+
+func (k *fakeKernel) RouteAdd(route *netlink.Route) error {
+	if err := k.call("route add " + routeLine(route)); err != nil {
+		return err
+	}
+	if k.findRoute(route) >= 0 {
+		return syscall.EEXIST
+	}
+	k.routes = append(k.routes, *route)
+	return nil
+}
+
+func (k *fakeKernel) RouteDel(route *netlink.Route) error {
+	if err := k.call("route del " + routeLine(route)); err != nil {
+		return err
+	}
+	i := k.findRoute(route)
+	if i < 0 {
+		return syscall.ESRCH
+	}
+	k.routes = slices.Delete(k.routes, i, i+1)
+	return nil
+}
+
+func (k *fakeKernel) RouteListFiltered(f int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	var out []netlink.Route
+	for _, r := range k.routes {
+		if r.Family == f && (mask&netlink.RT_FILTER_TABLE == 0 || r.Table == filter.Table) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (k *fakeKernel) LinkByName(name string) (netlink.Link, error) {
+	if name != "lo" {
+		return nil, fmt.Errorf("link %s not found", name)
+	}
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Index: 1}}, nil
+}
+
+// state describes what is installed, one sorted line per table, chain,
+// routing rule and route
+func (k *fakeKernel) state() []string {
+	var out []string
+	for _, t := range k.nft.tables {
+		out = append(out, "table "+t.Name)
+	}
+	for _, c := range k.nft.chains {
+		n := 0
+		for _, r := range k.nft.rules {
+			if r.Table.Name == c.Table.Name && r.Chain.Name == c.Name {
+				n++
+			}
+		}
+		out = append(out, fmt.Sprintf("chain %s: %d rules", c.Name, n))
+	}
+	for _, r := range k.rules {
+		out = append(out, "rule "+ruleLine(&r))
+	}
+	for _, r := range k.routes {
+		out = append(out, "route "+routeLine(&r))
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,816 @@
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+)
+
+// Manager manages nftables rules and policy routing for transparent proxying
+type Manager struct {
+	rules []TProxyRule
+	opts  Options
+	dial  func() (nftConn, error)
+	nl    netlinkOps
+	conn  nftConn
+	table *nftables.Table
+
+	// Chains holding the per-port rules
+	output    *nftables.Chain
+	intercept *nftables.Chain
+}
+
+// NewManager creates a new nftables manager
+func NewManager(rules []TProxyRule, opts Options) *Manager {
+	return newManager(rules, opts, dialNFTables, &netlink.Handle{})
+}
+
+// newManager creates a manager programming the kernel through dial and nl
+func newManager(rules []TProxyRule, opts Options, dial func() (nftConn, error), nl netlinkOps) *Manager {
+	return &Manager{
+		rules: rules,
+		opts:  opts,
+		dial:  dial,
+		nl:    nl,
+	}
+}
+
+// Setup configures nftables rules and policy routing to intercept traffic to the proxy
+func (m *Manager) Setup() error {
+	slog.Info("Setting up nftables rules", "mode", m.opts.Mode, "gateway", m.opts.Gateway, "rules", m.rules)
+
+	// Create netlink connection
+	conn, err := m.dial()
+	if err != nil {
+		return fmt.Errorf("failed to create nftables connection: %w", err)
+	}
+	m.conn = conn
+
+	// First cleanup any existing rules
+	m.cleanupExisting()
+
+	// Rules of direct routes are replaced as a whole, the marks may have changed
+	m.cleanupRouteRules()
+	if err := m.setupRouteRules(); err != nil {
+		m.cleanupRouteRules()
+		return fmt.Errorf("failed to setup direct routes: %w", err)
+	}
+
+	if m.opts.Mode == ModeRedirect {
+		return m.setupRedirect()
+	}
+
+	// Setup policy routing first
+	if err := m.setupPolicyRouting(); err != nil {
+		m.cleanupPolicyRouting()
+		m.cleanupRouteRules()
+		return fmt.Errorf("failed to setup policy routing: %w", err)
+	}
+
+	// Create nftables table (Inet family handles both IPv4 and IPv6)
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   tableName,
+	}
+	m.table = m.conn.AddTable(table)
+
+	// Create OUTPUT chain (for locally generated traffic)
+	m.output = m.conn.AddChain(&nftables.Chain{
+		Name:     outputChain,
+		Table:    m.table,
+		Type:     nftables.ChainTypeRoute,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	})
+
+	// Create PREROUTING chain (for traffic from other devices)
+	preroutingCh := &nftables.Chain{
+		Name:     preroutingChain,
+		Table:    m.table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+	}
+	m.conn.AddChain(preroutingCh)
+
+	// Regular chain holding the TPROXY rules, entered from PREROUTING
+	m.intercept = m.conn.AddChain(&nftables.Chain{
+		Name:  interceptChain,
+		Table: m.table,
+	})
+
+	// Add bypass rules to OUTPUT chain
+	m.addBypassRules(m.output)
+
+	// Local traffic marked in OUTPUT comes back through PREROUTING via policy routing
+	m.conn.AddRule(&nftables.Rule{
+		Table: m.table,
+		Chain: preroutingCh,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryUint32(FWMark)},
+			&expr.Verdict{Kind: expr.VerdictGoto, Chain: interceptChain},
+		},
+	})
+	if m.opts.Gateway {
+		m.addGatewayRules(preroutingCh)
+	}
+
+	// Add rules to both chains
+	for _, r := range expandRules(m.rules) {
+		m.addPortRule(r)
+	}
+
+	// Apply all nftables changes
+	if err := m.conn.Flush(); err != nil {
+		m.cleanupPolicyRouting()
+		m.cleanupRouteRules()
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+
+	slog.Info("nftables rules and policy routing configured successfully")
+	return nil
+}
+
+// addBypassRules exempts the proxy's own traffic, including that of direct routes
+func (m *Manager) addBypassRules(chain *nftables.Chain) {
+	m.addBypassRule(chain, BypassMark)
+	for _, r := range m.opts.Routes {
+		m.addBypassRule(chain, r.Mark)
+	}
+}
+
+// addBypassRule accepts packets carrying mark without intercepting them
+func (m *Manager) addBypassRule(chain *nftables.Chain, mark uint32) {
+	m.conn.AddRule(&nftables.Rule{
+		Table: m.table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{
+				Key:      expr.MetaKeyMARK,
+				Register: 1,
+			},
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     binaryUint32(mark),
+			},
+			&expr.Verdict{
+				Kind: expr.VerdictAccept,
+			},
+		},
+	})
+}
+
+// portRule intercepts one protocol and destination port, port 0 meaning all ports
+type portRule struct {
+	protocol string
+	port     uint16
+	dstPort  uint16
+}
+
+// tag is stored as rule user data so Update can find the rules installed for r
+func (r portRule) tag() []byte {
+	return fmt.Appendf(nil, "%s/%d/%d", r.protocol, r.port, r.dstPort)
+}
+
+// expandRules flattens rules into one entry per protocol and port
+func expandRules(rules []TProxyRule) []portRule {
+	var out []portRule
+	for _, r := range rules {
+		if r.Protocols == "" {
+			continue
+		}
+		// If no ports specified or contains 0, match all ports (represented by a single rule with port 0)
+		ports := r.Ports
+		if len(ports) == 0 || slices.Contains(ports, 0) {
+			ports = []uint16{0}
+		}
+		for _, port := range ports {
+			out = append(out, portRule{protocol: r.Protocols, port: port, dstPort: r.DstPort})
+		}
+	}
+	return out
+}
+
+// addPortRule queues the OUTPUT and intercept chain rules for r
+func (m *Manager) addPortRule(r portRule) {
+	add := func(chain *nftables.Chain, exprs ...expr.Any) {
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: exprs, UserData: r.tag()})
+	}
+	match := matchExprs(r.protocol, r.port)
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+
+	if m.opts.Mode == ModeRedirect {
+		if r.protocol != "tcp" {
+			slog.Warn("Redirect mode only intercepts TCP, skipping rule", "protocol", r.protocol, "port", r.port)
+			return
+		}
+		redirect := append(match,
+			&expr.Immediate{Register: 1, Data: binaryPort(r.dstPort)},
+			&expr.Redir{RegisterProtoMin: 1},
+		)
+		add(m.output, redirect...)
+		add(m.intercept, redirect...)
+		return
+	}
+
+	// Marking in OUTPUT reroutes local traffic through PREROUTING via policy routing
+	mark := append(match,
+		&expr.Immediate{Register: 1, Data: binaryUint32(FWMark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	)
+	add(m.output, slices.Concat(mark, []expr.Any{accept})...)
+
+	// TPROXY needs one rule per address family
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		add(m.intercept, slices.Concat(mark, []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(family)}},
+			&expr.Immediate{Register: 1, Data: binaryPort(r.dstPort)},
+			&expr.TProxy{Family: byte(family), TableFamily: byte(nftables.TableFamilyINet), RegPort: 1},
+			accept,
+		})...)
+	}
+}
+
+// Update applies a new set of interception rules, replacing only the nftables
+// rules of ports that were added or removed so established traffic is unaffected
+func (m *Manager) Update(rules []TProxyRule) error {
+	if m.conn == nil || m.table == nil {
+		return errors.New("nftables rules are not set up")
+	}
+
+	current := expandRules(m.rules)
+	next := expandRules(rules)
+	var removed, added []portRule
+	for _, r := range current {
+		if !slices.Contains(next, r) {
+			removed = append(removed, r)
+		}
+	}
+	for _, r := range next {
+		if !slices.Contains(current, r) {
+			added = append(added, r)
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+
+	for _, chain := range []*nftables.Chain{m.output, m.intercept} {
+		installed, err := m.conn.GetRules(m.table, chain)
+		if err != nil {
+			return fmt.Errorf("failed to list %s rules: %w", chain.Name, err)
+		}
+		for _, rule := range installed {
+			if slices.ContainsFunc(removed, func(r portRule) bool { return bytes.Equal(rule.UserData, r.tag()) }) {
+				if err := m.conn.DelRule(rule); err != nil {
+					return fmt.Errorf("failed to delete rule: %w", err)
+				}
+			}
+		}
+	}
+	for _, r := range added {
+		m.addPortRule(r)
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+	m.rules = rules
+
+	slog.Info("nftables rules updated", "added", len(added), "removed", len(removed))
+	return nil
+}
+
+// addGatewayRules sends forwarded traffic from allowed sources to the intercept chain.
+// Traffic addressed to this host itself is left alone.
+func (m *Manager) addGatewayRules(chain *nftables.Chain) {
+	add := func(exprs ...expr.Any) {
+		m.conn.AddRule(&nftables.Rule{Table: m.table, Chain: chain, Exprs: exprs})
+	}
+	ret := &expr.Verdict{Kind: expr.VerdictReturn}
+	intercept := &expr.Verdict{Kind: expr.VerdictGoto, Chain: interceptChain}
+
+	add(
+		&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryUint32(syscall.RTN_LOCAL)},
+		ret,
+	)
+	for _, n := range m.opts.ExcludeSources {
+		add(append(sourceExprs(n), ret)...)
+	}
+	if len(m.opts.IncludeSources) == 0 {
+		add(intercept)
+		return
+	}
+	for _, n := range m.opts.IncludeSources {
+		add(append(sourceExprs(n), intercept)...)
+	}
+}
+
+// sourceExprs matches packets whose source address is in n
+func sourceExprs(n *net.IPNet) []expr.Any {
+	family, offset, ip := nftables.TableFamilyIPv4, uint32(12), n.IP.To4()
+	mask := []byte(n.Mask)
+	if ip == nil {
+		family, offset, ip = nftables.TableFamilyIPv6, 8, n.IP.To16()
+	}
+	if len(mask) != len(ip) {
+		mask = mask[len(mask)-len(ip):]
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(family)}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(ip))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(ip)), Mask: mask, Xor: make([]byte, len(ip))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(n.Mask)},
+	}
+}
+
+// matchExprs matches the L4 protocol and, unless port is 0, the destination port
+func matchExprs(protocol string, port uint16) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     []byte{ternary(protocol == "udp", byte(17), byte(6))},
+		},
+	}
+	if port != 0 {
+		exprs = append(exprs, &expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       2, // Destination port offset in TCP/UDP header
+			Len:          2,
+		}, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryPort(port),
+		})
+	}
+	return exprs
+}
+
+// setupRedirect installs NAT chains that REDIRECT intercepted TCP traffic to
+// the proxy port. No policy routing is needed; the proxy reads SO_ORIGINAL_DST.
+func (m *Manager) setupRedirect() error {
+	m.table = m.conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   tableName,
+	})
+
+	m.output = m.conn.AddChain(&nftables.Chain{
+		Name:     outputChain,
+		Table:    m.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	m.intercept = m.conn.AddChain(&nftables.Chain{
+		Name:  interceptChain,
+		Table: m.table,
+	})
+
+	// Forwarded traffic only passes PREROUTING, local traffic is redirected in OUTPUT
+	if m.opts.Gateway {
+		preroutingCh := m.conn.AddChain(&nftables.Chain{
+			Name:     preroutingChain,
+			Table:    m.table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+		})
+		m.addGatewayRules(preroutingCh)
+	}
+
+	m.addBypassRules(m.output)
+
+	for _, r := range expandRules(m.rules) {
+		m.addPortRule(r)
+	}
+
+	if err := m.conn.Flush(); err != nil {
+		m.cleanupRouteRules()
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+
+	slog.Info("nftables redirect rules configured successfully")
+	return nil
+}
+
+// setupPolicyRouting configures ip rule and routing table
+func (m *Manager) setupPolicyRouting() error {
+	// Add IPv4 rule: fwmark FWMark lookup table 100
+	rule4 := netlink.NewRule()
+	rule4.Mark = FWMark
+	rule4.Table = RoutingTable
+	rule4.Priority = fwmarkRulePriority
+	rule4.Family = netlink.FAMILY_V4
+
+	if err := m.nl.RuleAdd(rule4); err != nil {
+		if !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add ipv4 rule: %w", err)
+		}
+	}
+
+	// Add IPv6 rule: fwmark FWMark lookup table 100
+	rule6 := netlink.NewRule()
+	rule6.Mark = FWMark
+	rule6.Table = RoutingTable
+	rule6.Priority = fwmarkRulePriority
+	rule6.Family = netlink.FAMILY_V6
+
+	if err := m.nl.RuleAdd(rule6); err != nil {
+		if !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add ipv6 rule: %w", err)
+		}
+	}
+
+	// Add routes in table 100: local default via lo for IPv4 and IPv6
+	routes, err := m.policyRoutes()
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := m.nl.RouteAdd(route); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add route %s: %w", route.Dst, err)
+		}
+	}
+
+	slog.Debug("Policy routing configured", "mark", fmt.Sprintf("0x%x", FWMark), "table", RoutingTable)
+	return nil
+}
+
+// cleanupPolicyRouting removes the policy routing rules
+func (m *Manager) cleanupPolicyRouting() {
+	// Remove IPv4 rule
+	rule4 := netlink.NewRule()
+	rule4.Mark = FWMark
+	rule4.Table = RoutingTable
+	rule4.Priority = fwmarkRulePriority
+	rule4.Family = netlink.FAMILY_V4
+	if err := m.nl.RuleDel(rule4); err != nil {
+		slog.Debug("Failed to delete IPv4 rule", "error", err)
+	}
+
+	// Remove IPv6 rule
+	rule6 := netlink.NewRule()
+	rule6.Mark = FWMark
+	rule6.Table = RoutingTable
+	rule6.Priority = fwmarkRulePriority
+	rule6.Family = netlink.FAMILY_V6
+	if err := m.nl.RuleDel(rule6); err != nil {
+		slog.Debug("Failed to delete IPv6 rule", "error", err)
+	}
+
+	// Remove routes from table, matching the type and scope they were added with
+	routes, err := m.policyRoutes()
+	if err != nil {
+		return
+	}
+	for _, route := range routes {
+		if err := m.nl.RouteDel(route); err != nil {
+			slog.Debug("Failed to delete route", "dst", route.Dst, "error", err)
+		}
+	}
+}
+
+// policyRoutes returns the routes of RoutingTable delivering marked packets locally
+func (m *Manager) policyRoutes() ([]*netlink.Route, error) {
+	lo, err := m.nl.LinkByName("lo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get loopback interface: %w", err)
+	}
+	_, defaultNet4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, defaultNet6, _ := net.ParseCIDR("::/0")
+	route := func(dst *net.IPNet, family int) *netlink.Route {
+		return &netlink.Route{
+			LinkIndex: lo.Attrs().Index,
+			Type:      syscall.RTN_LOCAL,
+			Dst:       dst,
+			Table:     RoutingTable,
+			Family:    family,
+			Scope:     netlink.SCOPE_HOST,
+		}
+	}
+	return []*netlink.Route{route(defaultNet4, netlink.FAMILY_V4), route(defaultNet6, netlink.FAMILY_V6)}, nil
+}
+
+// setupRouteRules adds an ip rule per direct route: fwmark Mark lookup Table
+func (m *Manager) setupRouteRules() error {
+	for _, r := range m.opts.Routes {
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rule := netlink.NewRule()
+			rule.Mark = r.Mark
+			rule.Table = r.Table
+			rule.Priority = routeRulePriority
+			rule.Family = family
+			if err := m.nl.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+				return fmt.Errorf("failed to add rule for mark 0x%x: %w", r.Mark, err)
+			}
+		}
+		slog.Debug("Direct route configured", "mark", fmt.Sprintf("0x%x", r.Mark), "table", r.Table)
+	}
+	return nil
+}
+
+// cleanupRouteRules removes the ip rules of direct routes, found by their priority
+func (m *Manager) cleanupRouteRules() {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := m.nl.RuleList(family)
+		if err != nil {
+			slog.Debug("Failed to list rules", "error", err)
+			continue
+		}
+		for _, r := range rules {
+			if r.Priority != routeRulePriority || r.Mark == 0 {
+				continue
+			}
+			if err := m.nl.RuleDel(&r); err != nil {
+				slog.Debug("Failed to delete direct route rule", "mark", fmt.Sprintf("0x%x", r.Mark), "error", err)
+			}
+		}
+	}
+}
+
+// binaryPort converts a port number to network byte order (big-endian)
+func binaryPort(port uint16) []byte {
+	return []byte{byte(port >> 8), byte(port & 0xff)}
+}
+
+// binaryUint32 converts a uint32 to bytes (native byte order for UID)
+func binaryUint32(v uint32) []byte {
+	return []byte{
+		byte(v),
+		byte(v >> 8),
+		byte(v >> 16),
+		byte(v >> 24),
+	}
+}
+
+// Cleanup removes the nftables rules and policy routing
+func (m *Manager) Cleanup() error {
+	slog.Info("Cleaning up nftables rules and policy routing")
+	_, errFirewall := m.CleanupFirewall(false)
+	_, errRouting := m.CleanupRouting(false)
+	if err := errors.Join(errFirewall, errRouting); err != nil {
+		return err
+	}
+	slog.Debug("Cleanup completed")
+	return nil
+}
+
+// CleanupFirewall removes the nftables table of the proxy and returns what was
+// removed, or with dryRun what would be
+func (m *Manager) CleanupFirewall(dryRun bool) ([]string, error) {
+	if m.conn == nil {
+		conn, err := m.dial()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create nftables connection: %w", err)
+		}
+		m.conn = conn
+	}
+	tables, err := m.ownTables()
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, len(tables))
+	for i, t := range tables {
+		removed[i] = m.describeTable(t)
+	}
+	if dryRun || len(tables) == 0 {
+		return removed, nil
+	}
+	for _, t := range tables {
+		m.conn.DelTable(t)
+	}
+	if err := m.conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to cleanup nftables rules: %w", err)
+	}
+	return removed, nil
+}
+
+// cleanupExisting queues the removal of our table if it exists
+func (m *Manager) cleanupExisting() {
+	if m.conn == nil {
+		return
+	}
+	tables, _ := m.ownTables()
+	for _, t := range tables {
+		m.conn.DelTable(t)
+	}
+}
+
+// ownTables lists the tables of the proxy, the inet one or an ip one left by
+// an older version
+func (m *Manager) ownTables() ([]*nftables.Table, error) {
+	tables, err := m.conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	return slices.DeleteFunc(tables, func(t *nftables.Table) bool {
+		return t.Name != tableName || (t.Family != nftables.TableFamilyIPv4 && t.Family != nftables.TableFamilyINet)
+	}), nil
+}
+
+// describeTable names t and the rules in its chains
+func (m *Manager) describeTable(t *nftables.Table) string {
+	family := "inet"
+	if t.Family == nftables.TableFamilyIPv4 {
+		family = "ip"
+	}
+	var chains []string
+	for _, name := range []string{outputChain, preroutingChain, interceptChain} {
+		if rules, err := m.conn.GetRules(t, &nftables.Chain{Name: name, Table: t}); err == nil {
+			chains = append(chains, fmt.Sprintf("%s (%d rules)", name, len(rules)))
+		}
+	}
+	desc := fmt.Sprintf("nftables table %s %s", family, t.Name)
+	if len(chains) > 0 {
+		desc += ": chains " + strings.Join(chains, ", ")
+	}
+	return desc
+}
+
+// CleanupRouting removes the ip rule and routes delivering marked packets to
+// the proxy and the ip rules of direct routes, and returns what was removed,
+// or with dryRun what would be. Other rules at the same priorities and other
+// routes in RoutingTable are kept.
+func (m *Manager) CleanupRouting(dryRun bool) ([]string, error) {
+	var removed []string
+	var errs []error
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := m.nl.RuleList(family)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list rules: %w", err))
+		}
+		for _, r := range rules {
+			if !isOwnRule(&r) {
+				continue
+			}
+			if !dryRun {
+				if err := m.nl.RuleDel(&r); err != nil {
+					errs = append(errs, fmt.Errorf("failed to delete %s: %w", describeRule(&r), err))
+					continue
+				}
+			}
+			removed = append(removed, describeRule(&r))
+		}
+
+		routes, err := m.nl.RouteListFiltered(family, &netlink.Route{Table: RoutingTable}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to list routes: %w", err))
+		}
+		for _, r := range routes {
+			if r.Type != syscall.RTN_LOCAL || (r.Dst != nil && !isDefaultNet(r.Dst)) {
+				continue
+			}
+			if !dryRun {
+				if err := m.nl.RouteDel(&r); err != nil {
+					errs = append(errs, fmt.Errorf("failed to delete %s: %w", describeRoute(&r), err))
+					continue
+				}
+			}
+			removed = append(removed, describeRoute(&r))
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// isOwnRule reports whether r is the FWMark rule or a direct route rule
+func isOwnRule(r *netlink.Rule) bool {
+	switch r.Priority {
+	case fwmarkRulePriority:
+		return r.Mark == FWMark && r.Table == RoutingTable
+	case routeRulePriority:
+		return r.Mark != 0
+	}
+	return false
+}
+
+func isDefaultNet(n *net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+// describeRule and describeRoute print entries as ip(8) lists them
+func describeRule(r *netlink.Rule) string {
+	return fmt.Sprintf("%s rule pref %d fwmark 0x%x lookup %d", ipCommand(r.Family), r.Priority, r.Mark, r.Table)
+}
+
+func describeRoute(r *netlink.Route) string {
+	return fmt.Sprintf("%s route local default table %d", ipCommand(r.Family), r.Table)
+}
+
+func ipCommand(family int) string {
+	if family == netlink.FAMILY_V6 {
+		return "ip -6"
+	}
+	return "ip"
+}
+
+// Status returns the current nftables rules for debugging
+func (m *Manager) Status() (string, error) {
+	if m.conn == nil {
+		conn, err := m.dial()
+		if err != nil {
+			return "", fmt.Errorf("failed to create nftables connection: %w", err)
+		}
+		m.conn = conn
+	}
+
+	tables, err := m.conn.ListTables()
+	if err != nil {
+		return "", fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	result := "nftables tables:\n"
+	for _, t := range tables {
+		result += fmt.Sprintf("  - %s (family: %v)\n", t.Name, t.Family)
+	}
+
+	// Show policy routing info
+	rules4, _ := m.nl.RuleList(netlink.FAMILY_V4)
+	rules6, _ := m.nl.RuleList(netlink.FAMILY_V6)
+	result += "\nPolicy routing rules (IPv4):\n"
+	for _, r := range rules4 {
+		if r.Mark == FWMark || r.Priority == routeRulePriority {
+			result += fmt.Sprintf("  - mark 0x%x -> table %d\n", r.Mark, r.Table)
+		}
+	}
+	result += "\nPolicy routing rules (IPv6):\n"
+	for _, r := range rules6 {
+		if r.Mark == FWMark || r.Priority == routeRulePriority {
+			result += fmt.Sprintf("  - mark 0x%x -> table %d\n", r.Mark, r.Table)
+		}
+	}
+
+	return result, nil
+}
+
+// CheckRoot checks if running as root (required for nftables)
+func CheckRoot() error {
+	// Try to create an nftables connection - this will fail if not root
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables requires root privileges: %w", err)
+	}
+
+	// Try to list tables to verify permissions
+	_, err = conn.ListTables()
+	if err != nil {
+		return fmt.Errorf("nftables requires root privileges: %w", err)
+	}
+
+	return nil
+}
+
+// CheckAvailable checks if nftables is available
+func CheckAvailable() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables not available: %w", err)
+	}
+
+	// Try a simple operation to verify it works
+	_, err = conn.ListTables()
+	if err != nil {
+		return fmt.Errorf("nftables not functional: %w", err)
+	}
+
+	slog.Debug("nftables is available")
+	return nil
+}
+
+// CheckForwarding reports an error if IPv4 forwarding is disabled, which gateway mode needs
+func CheckForwarding() error {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	if err != nil {
+		return fmt.Errorf("failed to read ip_forward: %w", err)
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return errors.New("net.ipv4.ip_forward is disabled")
+	}
+	return nil
+}
+
+func ternary[T any](cond bool, a, b T) T {
+	if cond {
+		return a
+	}
+	return b
+}
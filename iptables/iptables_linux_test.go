@@ -0,0 +1,271 @@
+package iptables
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+var testRules = []TProxyRule{{Protocols: "tcp", Ports: []uint16{80, 443}, DstPort: 12345}}
+
+var policyRouting = []string{
+	"rule v4 prio 100 mark 0x1 table 100",
+	"rule v6 prio 100 mark 0x1 table 100",
+	"route v4 0.0.0.0/0 table 100",
+	"route v6 ::/0 table 100",
+}
+
+func sorted(lines ...[]string) []string {
+	return slices.Sorted(slices.Values(slices.Concat(lines...)))
+}
+
+func TestManager_SetupCleanup(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "tproxy",
+			opts: Options{Mode: ModeTProxy},
+			want: sorted(policyRouting, []string{
+				"table transparent_proxy",
+				"chain output: 3 rules",
+				"chain prerouting: 1 rules",
+				"chain intercept: 4 rules",
+			}),
+		},
+		{
+			name: "tproxy with direct route",
+			opts: Options{Mode: ModeTProxy, Routes: []Route{{Mark: 0x10, Table: 10}}},
+			want: sorted(policyRouting, []string{
+				"table transparent_proxy",
+				"chain output: 4 rules",
+				"chain prerouting: 1 rules",
+				"chain intercept: 4 rules",
+				"rule v4 prio 110 mark 0x10 table 10",
+				"rule v6 prio 110 mark 0x10 table 10",
+			}),
+		},
+		{
+			name: "tproxy gateway",
+			opts: Options{Mode: ModeTProxy, Gateway: true, ExcludeSources: []*net.IPNet{lan}},
+			want: sorted(policyRouting, []string{
+				"table transparent_proxy",
+				"chain output: 3 rules",
+				"chain prerouting: 4 rules",
+				"chain intercept: 4 rules",
+			}),
+		},
+		{
+			name: "redirect",
+			opts: Options{Mode: ModeRedirect},
+			want: sorted([]string{
+				"table transparent_proxy",
+				"chain output: 3 rules",
+				"chain intercept: 2 rules",
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newFakeKernel()
+			m := newManager(testRules, tt.opts, k.dial, k)
+			if err := m.Setup(); err != nil {
+				t.Fatalf("Setup() error = %v", err)
+			}
+			if got := k.state(); !slices.Equal(got, tt.want) {
+				t.Errorf("after Setup\ngot  %q\nwant %q", got, tt.want)
+			}
+
+			// Setting up again, as after a crash, replaces the previous rules
+			if err := newManager(testRules, tt.opts, k.dial, k).Setup(); err != nil {
+				t.Fatalf("second Setup() error = %v", err)
+			}
+			if got := k.state(); !slices.Equal(got, tt.want) {
+				t.Errorf("after second Setup\ngot  %q\nwant %q", got, tt.want)
+			}
+
+			if err := m.Cleanup(); err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			if got := k.state(); len(got) != 0 {
+				t.Errorf("after Cleanup: %q", got)
+			}
+			if err := newManager(nil, Options{}, k.dial, k).Cleanup(); err != nil {
+				t.Errorf("Cleanup() of nothing error = %v", err)
+			}
+		})
+	}
+}
+
+func TestManager_CleanupTargets(t *testing.T) {
+	k := newFakeKernel()
+	m := newManager(testRules, Options{Mode: ModeTProxy, Routes: []Route{{Mark: 0x10, Table: 10}}}, k.dial, k)
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries of other tools sharing the priorities and the table
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	k.rules = append(k.rules,
+		netlink.Rule{Family: netlink.FAMILY_V4, Priority: 110, Table: 200},
+		netlink.Rule{Family: netlink.FAMILY_V4, Priority: 100, Mark: 0x2, Table: 100},
+	)
+	k.routes = append(k.routes, netlink.Route{Family: netlink.FAMILY_V4, Dst: lan, Table: 100})
+	foreign := []string{
+		"route v4 10.0.0.0/8 table 100",
+		"rule v4 prio 100 mark 0x2 table 100",
+		"rule v4 prio 110 mark 0x0 table 200",
+	}
+	installed := k.state()
+
+	firewall, err := m.CleanupFirewall(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFirewall := []string{"nftables table inet transparent_proxy: chains output (4 rules), prerouting (1 rules), intercept (4 rules)"}
+	if !slices.Equal(firewall, wantFirewall) {
+		t.Errorf("CleanupFirewall(dry run) = %q, want %q", firewall, wantFirewall)
+	}
+	routing, err := m.CleanupRouting(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRouting := sorted([]string{
+		"ip rule pref 100 fwmark 0x1 lookup 100",
+		"ip -6 rule pref 100 fwmark 0x1 lookup 100",
+		"ip rule pref 110 fwmark 0x10 lookup 10",
+		"ip -6 rule pref 110 fwmark 0x10 lookup 10",
+		"ip route local default table 100",
+		"ip -6 route local default table 100",
+	})
+	if got := sorted(routing); !slices.Equal(got, wantRouting) {
+		t.Errorf("CleanupRouting(dry run) = %q, want %q", got, wantRouting)
+	}
+	if got := k.state(); !slices.Equal(got, installed) {
+		t.Errorf("dry run changed the kernel: %q", got)
+	}
+
+	if got, err := m.CleanupFirewall(false); err != nil || !slices.Equal(got, wantFirewall) {
+		t.Fatalf("CleanupFirewall() = %q, %v", got, err)
+	}
+	if got := k.state(); !slices.Equal(got, sorted(policyRouting, foreign, []string{"rule v4 prio 110 mark 0x10 table 10", "rule v6 prio 110 mark 0x10 table 10"})) {
+		t.Errorf("after CleanupFirewall: %q", got)
+	}
+	if got, err := m.CleanupRouting(false); err != nil || !slices.Equal(sorted(got), wantRouting) {
+		t.Fatalf("CleanupRouting() = %q, %v", got, err)
+	}
+	if got := k.state(); !slices.Equal(got, sorted(foreign)) {
+		t.Errorf("after CleanupRouting: %q, want only the entries of other tools", got)
+	}
+}
+
+func TestManager_SetupOrder(t *testing.T) {
+	k := newFakeKernel()
+	m := newManager(testRules, Options{Mode: ModeTProxy, Routes: []Route{{Mark: 0x10, Table: 10}}}, k.dial, k)
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets are only marked once the routing delivering them is in place
+	flush := slices.Index(k.log, "flush")
+	if flush != len(k.log)-1 {
+		t.Errorf("nftables rules are not applied last: %q", k.log)
+	}
+	for _, line := range []string{
+		"rule add v4 prio 110 mark 0x10 table 10",
+		"rule add v4 prio 100 mark 0x1 table 100",
+		"route add v4 0.0.0.0/0 table 100",
+	} {
+		if i := slices.Index(k.log, line); i < 0 || i > flush {
+			t.Errorf("%q not applied before nftables rules: %q", line, k.log)
+		}
+	}
+}
+
+func TestManager_SetupRollback(t *testing.T) {
+	errInjected := errors.New("injected")
+	routes := []Route{{Mark: 0x10, Table: 10}}
+	tests := []struct {
+		name   string
+		mode   Mode
+		failOn string
+	}{
+		{"direct route rule", ModeTProxy, "rule add v6 prio 110 mark 0x10 table 10"},
+		{"fwmark rule", ModeTProxy, "rule add v6 prio 100 mark 0x1 table 100"},
+		{"route", ModeTProxy, "route add v6 ::/0 table 100"},
+		{"nftables", ModeTProxy, "flush"},
+		{"redirect nftables", ModeRedirect, "flush"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := newFakeKernel()
+			k.failOn[tt.failOn] = errInjected
+			m := newManager(testRules, Options{Mode: tt.mode, Routes: routes}, k.dial, k)
+			if err := m.Setup(); !errors.Is(err, errInjected) {
+				t.Fatalf("Setup() error = %v, want %v", err, errInjected)
+			}
+			if got := k.state(); len(got) != 0 {
+				t.Errorf("left behind after failed Setup: %q", got)
+			}
+		})
+	}
+}
+
+func TestManager_Update(t *testing.T) {
+	k := newFakeKernel()
+	m := newManager(testRules, Options{Mode: ModeTProxy}, k.dial, k)
+	if err := m.Update(testRules); err == nil {
+		t.Error("Update() before Setup succeeded")
+	}
+	if err := m.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// handles returns the handles of the rules installed for each tag
+	handles := func() map[string][]uint64 {
+		out := make(map[string][]uint64)
+		for _, r := range k.nft.rules {
+			if r.UserData != nil {
+				out[string(r.UserData)] = append(out[string(r.UserData)], r.Handle)
+			}
+		}
+		return out
+	}
+	before := handles()
+
+	next := []TProxyRule{{Protocols: "tcp", Ports: []uint16{443, 8080}, DstPort: 12345}}
+	if err := m.Update(next); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	after := handles()
+
+	if _, ok := after["tcp/80/12345"]; ok {
+		t.Error("rules of removed port 80 are still installed")
+	}
+	if got := after["tcp/8080/12345"]; len(got) != 3 {
+		t.Errorf("port 8080 has %d rules, want 3", len(got))
+	}
+	if !slices.Equal(after["tcp/443/12345"], before["tcp/443/12345"]) {
+		t.Errorf("rules of unchanged port 443 were replaced: %v -> %v", before["tcp/443/12345"], after["tcp/443/12345"])
+	}
+
+	// An unchanged rule set does not touch nftables
+	flushes := len(k.log)
+	if err := m.Update(next); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.log) != flushes {
+		t.Errorf("Update() with unchanged rules flushed: %q", k.log[flushes:])
+	}
+	for _, line := range []string{"chain output: 3 rules", "chain intercept: 4 rules"} {
+		if !slices.Contains(k.state(), line) {
+			t.Errorf("state after Update %q, want %q", k.state(), line)
+		}
+	}
+}
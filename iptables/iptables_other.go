@@ -0,0 +1,38 @@
+//go:build !linux
+
+package iptables
+
+// Manager is a stub on platforms without nftables; every operation fails with ErrNotSupported
+type Manager struct{}
+
+// NewManager creates a new nftables manager
+func NewManager(rules []TProxyRule, opts Options) *Manager {
+	return &Manager{}
+}
+
+// Setup always fails with ErrNotSupported
+func (m *Manager) Setup() error { return ErrNotSupported }
+
+// Update always fails with ErrNotSupported
+func (m *Manager) Update(rules []TProxyRule) error { return ErrNotSupported }
+
+// Cleanup always fails with ErrNotSupported
+func (m *Manager) Cleanup() error { return ErrNotSupported }
+
+// CleanupFirewall always fails with ErrNotSupported
+func (m *Manager) CleanupFirewall(dryRun bool) ([]string, error) { return nil, ErrNotSupported }
+
+// CleanupRouting always fails with ErrNotSupported
+func (m *Manager) CleanupRouting(dryRun bool) ([]string, error) { return nil, ErrNotSupported }
+
+// Status always fails with ErrNotSupported
+func (m *Manager) Status() (string, error) { return "", ErrNotSupported }
+
+// CheckRoot always fails with ErrNotSupported
+func CheckRoot() error { return ErrNotSupported }
+
+// CheckAvailable always fails with ErrNotSupported
+func CheckAvailable() error { return ErrNotSupported }
+
+// CheckForwarding always fails with ErrNotSupported
+func CheckForwarding() error { return ErrNotSupported }
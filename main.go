@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"os/user"
+	"strconv"
 	"strings"
 	"syscall"
 
+	"github.com/cnfatal/proxy/api"
+	"github.com/cnfatal/proxy/certs"
 	"github.com/cnfatal/proxy/config"
 	"github.com/cnfatal/proxy/iptables"
+	"github.com/cnfatal/proxy/metrics"
 	"github.com/cnfatal/proxy/proxy"
 	"github.com/cnfatal/proxy/rules"
 )
@@ -18,60 +25,72 @@ import (
 var (
 	configPath = flag.String("config", "config.yaml", "Path to configuration file")
 	setupOnly  = flag.Bool("setup", false, "Only setup iptables rules and exit")
-	cleanup    = flag.Bool("cleanup", false, "Only cleanup iptables rules and exit")
+	dataDir    = flag.String("data-dir", "", "Directory for downloaded and persisted data (overrides data_dir)")
+
+	// logLevel is shared by the default logger so it can be adjusted without a restart
+	logLevel = new(slog.LevelVar)
+	// configuredLevel is the level of the loaded configuration, SIGUSR2 returns to it
+	configuredLevel = new(slog.LevelVar)
 )
 
 func main() {
-	flag.Parse()
-
-	// Handle cleanup mode
-	if *cleanup {
-		cleanupAndExit()
-		return
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rules":
+			os.Exit(runRulesCommand(os.Args[2:]))
+		case "server":
+			os.Exit(runServerCommand(os.Args[2:]))
+		case "cleanup":
+			os.Exit(runCleanupCommand(os.Args[2:]))
+		}
 	}
 
+	flag.Parse()
+	os.Exit(run())
+}
+
+// run starts the transparent proxy and blocks until it stops. Failures return
+// a non-zero exit code after the deferred cleanup removed the nftables rules.
+func run() int {
 	// Load configuration
-	cfg, err := config.Load(*configPath)
+	cfg, err := config.Load(*configPath, *dataDir)
 	if err != nil {
 		slog.Error("Failed to load configuration", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
-	// Initialize logger with level
-	var level slog.Level
-	switch strings.ToLower(cfg.LogLevel) {
-	case "debug":
-		level = slog.LevelDebug
-	case "info":
-		level = slog.LevelInfo
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
-	}
+	// Initialize logger with a level that can be changed at runtime
+	level := parseLogLevel(cfg.LogLevel)
+	logLevel.Set(level)
+	configuredLevel.Set(level)
 
 	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: level,
+		Level: logLevel,
 	})
 	slog.SetDefault(slog.New(handler))
 
 	slog.Info("Configuration loaded",
 		"listen", cfg.Listen,
+		"mode", cfg.Mode,
+		"gateway", cfg.Gateway,
 		"upstream", cfg.Upstream,
+		"data_dir", cfg.DataDir,
+		"proxies", len(cfg.Proxies),
+		"proxy_groups", len(cfg.ProxyGroups),
 		"rules", len(cfg.Rules),
 	)
 
-	// Parse rules
-	parsedRules, err := rules.ParseRules(cfg.Rules)
-	if err != nil {
-		slog.Error("Failed to parse rules", "error", err)
-		os.Exit(1)
+	raiseFileLimit(cfg.MaxOpenFiles)
+	if n, err := openFileCount(); err == nil {
+		slog.Debug("Open file descriptors", "count", n)
 	}
 
-	// Create rule matcher
-	matcher := rules.NewMatcher(parsedRules)
+	// Parse rules and load the GeoIP database and rule sets they use
+	matcher, providers, err := loadMatcher(context.Background(), cfg, rules.Providers{})
+	if err != nil {
+		slog.Error("Failed to load rules", "error", err)
+		return 1
+	}
 
 	// Create buffer pool
 	pool := proxy.NewBufferPool()
@@ -80,67 +99,219 @@ func main() {
 	port, err := proxy.GetListenPort(cfg.Listen)
 	if err != nil {
 		slog.Error("Failed to get listen port", "error", err)
-		os.Exit(1)
-	}
-
-	// Check prerequisites
-	if err := iptables.CheckRoot(); err != nil {
-		slog.Error("Permission check failed", "error", err)
-		os.Exit(1)
+		return 1
 	}
 
 	slog.Info("Running as", "uid", os.Getuid())
 
-	if err := iptables.CheckAvailable(); err != nil {
-		slog.Error("nftables check failed", "error", err)
-		os.Exit(1)
-	}
+	// Setup signal handling for cleanup
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	// Setup nftables
-	// We intercept both TCP and UDP traffic to the proxy port
-	rules := []iptables.TProxyRule{
-		{Protocols: "tcp", Ports: []uint16{80, 443}, DstPort: uint16(port)},
-	}
-
-	iptMgr := iptables.NewManager(rules)
-	if err := iptMgr.Setup(); err != nil {
-		slog.Error("Failed to setup nftables", "error", err)
-		os.Exit(1)
+	// Without nftables the explicit listeners still serve the rules
+	var iptMgr *iptables.Manager
+	if err := checkNftables(); err != nil {
+		if *setupOnly || (cfg.HTTPListen == "" && cfg.SOCKSListen == "") {
+			slog.Error("nftables check failed", "error", err)
+			return 1
+		}
+		slog.Warn("nftables unavailable, only the explicit listeners accept connections", "error", err,
+			"http_listen", cfg.HTTPListen, "socks_listen", cfg.SOCKSListen)
+		if len(cfg.DirectRoutes) > 0 {
+			slog.Warn("direct_routes need nftables, their connections use the default route")
+		}
+		fmt.Fprint(os.Stderr, userModeEnv(cfg))
+	} else {
+		if cfg.RequireUpstreamHealthy {
+			slog.Info("Waiting for the upstream to be healthy before intercepting traffic", "upstream", cfg.Upstream)
+			if err := proxy.WaitUpstreamHealthy(ctx, cfg, config.DefaultHealthCheckURL); err != nil {
+				return 0
+			}
+		}
+		iptMgr, err = setupNftables(cfg, port)
+		if err != nil {
+			slog.Error("Failed to setup nftables", "error", err)
+			return 1
+		}
 	}
 
 	// Handle setup-only mode
 	if *setupOnly {
-		slog.Info("nftables rules configured, run with -cleanup to remove")
-		return
+		slog.Info("nftables rules configured, run tproxy cleanup to remove")
+		return 0
 	}
 
-	// Setup signal handling for cleanup
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	// SIGUSR2 toggles debug logging
+	go toggleDebugOnSignal(ctx)
 
 	// Cleanup on exit
 	defer func() {
 		slog.Info("Shutting down...")
-		iptMgr.Cleanup()
+		if iptMgr != nil {
+			iptMgr.Cleanup()
+		}
 	}()
 
 	// Create and start transparent proxy
-	tp := proxy.NewTransparentProxy(cfg, matcher, pool)
+	tp, err := proxy.NewTransparentProxy(cfg, matcher, pool)
+	if err != nil {
+		slog.Error("Failed to create proxy", "error", err)
+		return 1
+	}
+	if iptMgr == nil {
+		tp.DisableInterception()
+	} else {
+		go selfTest(ctx, tp)
+	}
+
+	// SIGHUP reloads the configuration, rule sets refresh in the background
+	r := newReloader(ctx, cfg, port, tp, iptMgr, providers)
+	go r.run(ctx)
+
+	if reg := tp.Metrics(); reg != nil {
+		reg.NewGaugeFunc("tproxy_open_files", "File descriptors open by the process.", func() (float64, bool) {
+			n, err := openFileCount()
+			return float64(n), err == nil
+		})
+		go func() {
+			if err := metrics.Serve(ctx, cfg.MetricsListen, reg); err != nil {
+				slog.Error("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	var firewall api.Firewall
+	if iptMgr != nil {
+		firewall = iptMgr
+	}
+	if cfg.APIListen != "" {
+		var apiTLS *tls.Config
+		if cfg.APITLS != nil {
+			source, err := certs.New(cfg.APITLS, cfg.DataDir)
+			if err != nil {
+				slog.Error("Failed to set up control API TLS", "error", err)
+				return 1
+			}
+			apiTLS = source.TLSConfig()
+			go func() {
+				if err := source.Run(ctx); err != nil {
+					slog.Error("ACME challenge server error", "error", err)
+				}
+			}()
+		}
+		var token string
+		if cfg.APITokenFile != "" {
+			if token, err = config.ReadPassword(cfg.APITokenFile); err == nil && token == "" {
+				err = fmt.Errorf("token file %s is empty", cfg.APITokenFile)
+			}
+			if err != nil {
+				slog.Error("Failed to read the control API token", "error", err)
+				return 1
+			}
+		}
+		srv := api.NewServer(cfg.APIListen, apiTLS, token, tp, firewall, r.reload, logLevel)
+		go func() {
+			if err := srv.Run(ctx); err != nil {
+				slog.Error("Control API error", "error", err)
+			}
+		}()
+	}
+
+	if cfg.StatusListen != "" {
+		gid := -1
+		if cfg.StatusGroup != "" {
+			group, err := user.LookupGroup(cfg.StatusGroup)
+			if err != nil {
+				slog.Error("Failed to look up status_group", "error", err)
+				return 1
+			}
+			gid, _ = strconv.Atoi(group.Gid)
+		}
+		srv := api.NewStatusServer(cfg.StatusListen, gid, tp, firewall, logLevel)
+		go func() {
+			if err := srv.Run(ctx); err != nil {
+				slog.Error("Status API error", "error", err)
+			}
+		}()
+	}
+
+	if cfg.AuthzListen != "" {
+		srv := api.NewAuthzServer(cfg.AuthzListen, tp)
+		go func() {
+			if err := srv.Run(ctx); err != nil {
+				slog.Error("Authorization API error", "error", err)
+			}
+		}()
+	}
 
 	// Run proxy (blocks until signal or error)
 	if err := tp.Run(ctx); err != nil {
 		slog.Error("Proxy error", "error", err)
+		return 1
 	}
+	return 0
 }
 
-func cleanupAndExit() {
+// checkNftables verifies the process may manage nftables
+func checkNftables() error {
 	if err := iptables.CheckRoot(); err != nil {
-		slog.Error("Permission check failed", "error", err)
-		os.Exit(1)
+		return err
+	}
+	return iptables.CheckAvailable()
+}
+
+// setupNftables installs the rules steering intercepted traffic to port
+func setupNftables(cfg *config.Config, port int) (*iptables.Manager, error) {
+	if cfg.Gateway {
+		if err := iptables.CheckForwarding(); err != nil {
+			slog.Warn("Gateway mode needs IP forwarding", "error", err, "hint", "sysctl -w net.ipv4.ip_forward=1")
+		}
 	}
 
-	// Create manager just for cleanup (rules don't matter)
-	iptMgr := iptables.NewManager(nil)
-	iptMgr.Cleanup()
-	slog.Info("Cleanup completed")
+	iptMgr := iptables.NewManager(interceptRules(cfg, port), iptables.Options{
+		Mode:           iptables.Mode(cfg.Mode),
+		Gateway:        cfg.Gateway,
+		IncludeSources: cfg.GatewaySources.IncludeNets,
+		ExcludeSources: cfg.GatewaySources.ExcludeNets,
+		Routes:         directRoutes(cfg),
+	})
+	if err := iptMgr.Setup(); err != nil {
+		return nil, err
+	}
+	return iptMgr, nil
+}
+
+// selfTest reports at startup whether intercepted local connections reach the proxy
+func selfTest(ctx context.Context, tp *proxy.TransparentProxy) {
+	if err := tp.SelfTest(ctx); err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Self-test failed, intercepted traffic does not reach the proxy", "error", err,
+				"hint", "check nft list table inet transparent_proxy and ip rule")
+		}
+		return
+	}
+	slog.Info("Self-test passed, intercepted traffic reaches the proxy")
+}
+
+// directRoutes returns the ip rules needed by the configured direct routes
+func directRoutes(cfg *config.Config) []iptables.Route {
+	routes := make([]iptables.Route, 0, len(cfg.DirectRoutes))
+	for _, r := range cfg.DirectRoutes {
+		routes = append(routes, iptables.Route{Mark: uint32(r.Mark), Table: r.Table})
+	}
+	return routes
+}
+
+// parseLogLevel converts a config log level to a slog level, defaulting to info
+func parseLogLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
 }
@@ -0,0 +1,323 @@
+// Package metrics implements the counters, gauges and histograms exported in
+// the Prometheus text format. Lookups by label happen once per connection;
+// updates on the relay path are single atomic operations.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry holds metrics in registration order and serves them over HTTP
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// ServeHTTP renders all metrics in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	for _, m := range r.metrics {
+		m.write(bw)
+	}
+	r.mu.Unlock()
+	bw.Flush()
+}
+
+// Serve exposes the registry on addr at /metrics until the context is cancelled
+func Serve(ctx context.Context, addr string, r *Registry) error {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", r)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("Metrics listening", "addr", addr)
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomic.Int64
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+
+// Inc increases the counter by one
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Add changes the gauge by n
+func (g *Gauge) Add(n int64) { g.v.Add(n) }
+
+// Inc increases the gauge by one
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec decreases the gauge by one
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64 // per bucket, the last one is +Inf
+	sum     float64
+}
+
+// Observe records v
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// vec keeps one child per combination of label values
+type vec[T any] struct {
+	name, help, kind string
+	labels           []string
+	newChild         func() *T
+	writeChild       func(w *bufio.Writer, name, labels string, c *T)
+
+	mu       sync.RWMutex
+	children map[string]*T
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c = v.newChild()
+	v.children[key] = c
+	return c
+}
+
+func (v *vec[T]) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		v.writeChild(w, v.name, formatLabels(v.labels, k), v.children[k])
+	}
+	v.mu.RUnlock()
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec[Counter]
+}
+
+// NewCounterVec registers a counter with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec[Counter]{
+		name: name, help: help, kind: "counter", labels: labels,
+		newChild:   func() *Counter { return new(Counter) },
+		writeChild: func(w *bufio.Writer, name, labels string, c *Counter) { writeSample(w, name, labels, c.v.Load()) },
+		children:   make(map[string]*Counter),
+	}}
+	r.register(c)
+	return c
+}
+
+// With returns the counter for the label values, in the registered order
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec[Gauge]
+}
+
+// NewGaugeVec registers a gauge with the given label names
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec[Gauge]{
+		name: name, help: help, kind: "gauge", labels: labels,
+		newChild:   func() *Gauge { return new(Gauge) },
+		writeChild: func(w *bufio.Writer, name, labels string, g *Gauge) { writeSample(w, name, labels, g.v.Load()) },
+		children:   make(map[string]*Gauge),
+	}}
+	r.register(g)
+	return g
+}
+
+// With returns the gauge for the label values, in the registered order
+func (g *GaugeVec) With(values ...string) *Gauge { return g.with(values) }
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// NewHistogramVec registers a histogram with sorted upper bucket bounds
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{vec[Histogram]{
+		name: name, help: help, kind: "histogram", labels: labels,
+		newChild: func() *Histogram {
+			return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+		},
+		writeChild: writeHistogram,
+		children:   make(map[string]*Histogram),
+	}}
+	r.register(h)
+	return h
+}
+
+// With returns the histogram for the label values, in the registered order
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+// DefBuckets suits latencies from a few milliseconds to tens of seconds
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count bounds starting at start, each factor times the previous
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// gaugeFunc reads its value when scraped
+type gaugeFunc struct {
+	name, help string
+	fn         func() (float64, bool)
+}
+
+// NewGaugeFunc registers a gauge computed by fn at scrape time; it is
+// omitted while fn reports false
+func (r *Registry) NewGaugeFunc(name, help string, fn func() (float64, bool)) {
+	r.register(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	v, ok := g.fn()
+	if !ok {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(v))
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v int64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatInt(v, 10))
+	w.WriteByte('\n')
+}
+
+func writeHistogram(w *bufio.Writer, name, labels string, h *Histogram) {
+	h.mu.Lock()
+	counts := slices.Clone(h.counts)
+	sum := h.sum
+	h.mu.Unlock()
+
+	// Bucket labels are appended to the partition labels
+	prefix := "{"
+	if labels != "" {
+		prefix = labels[:len(labels)-1] + ","
+	}
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = formatFloat(h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", name, prefix, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, labels, formatFloat(sum), name, labels, cumulative)
+}
+
+// formatLabels renders the label set of a child from its map key
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range strings.Split(key, "\xff") {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(names[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(v))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
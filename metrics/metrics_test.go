@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	conns := r.NewCounterVec("conns_total", "Connections.", "policy", "rule")
+	active := r.NewGaugeVec("active", "Active relays.", "inbound")
+	latency := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "upstream")
+	r.NewGaugeFunc("open_files", "Open files.", func() (float64, bool) { return 7, true })
+	r.NewGaugeFunc("unavailable", "Not reported.", func() (float64, bool) { return 0, false })
+
+	conns.With("DIRECT", `DOMAIN,"a"`).Add(3)
+	conns.With("PROXY", "MATCH").Inc()
+	active.With("tproxy").Inc()
+	active.With("tproxy").Inc()
+	active.With("tproxy").Dec()
+	latency.With("proxy:8080").Observe(0.05)
+	latency.With("proxy:8080").Observe(0.5)
+	latency.With("proxy:8080").Observe(3)
+
+	out := scrape(t, r)
+	for _, want := range []string{
+		"# TYPE conns_total counter\n",
+		`conns_total{policy="DIRECT",rule="DOMAIN,\"a\""} 3` + "\n",
+		`conns_total{policy="PROXY",rule="MATCH"} 1` + "\n",
+		`active{inbound="tproxy"} 1` + "\n",
+		"# TYPE latency_seconds histogram\n",
+		`latency_seconds_bucket{upstream="proxy:8080",le="0.1"} 1` + "\n",
+		`latency_seconds_bucket{upstream="proxy:8080",le="1"} 2` + "\n",
+		`latency_seconds_bucket{upstream="proxy:8080",le="+Inf"} 3` + "\n",
+		`latency_seconds_sum{upstream="proxy:8080"} 3.55` + "\n",
+		`latency_seconds_count{upstream="proxy:8080"} 3` + "\n",
+		"open_files 7\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "unavailable") {
+		t.Errorf("unavailable gauge func was exported\n%s", out)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("h", "Help.", []float64{1})
+	h.With().Observe(1)
+
+	out := scrape(t, r)
+	for _, want := range []string{`h_bucket{le="1"} 1`, `h_bucket{le="+Inf"} 1`, "h_sum 1\n", "h_count 1\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	got := ExponentialBuckets(1024, 4, 3)
+	if want := []float64{1024, 4096, 16384}; !slices.Equal(got, want) {
+		t.Errorf("ExponentialBuckets() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// Protocols embedding addresses in their payload
+const (
+	algFTP = "ftp"
+	algSIP = "sip"
+)
+
+// ftpLineLimit bounds a buffered FTP control line, longer ones pass untouched
+const ftpLineLimit = 512
+
+// algPolicy decides how FTP and SIP connections are handled
+type algPolicy struct {
+	action   string
+	ftpPorts []int
+	sipPorts []int
+}
+
+func newALGPolicy(cfg config.ALGConfig) algPolicy {
+	return algPolicy{action: cfg.Action, ftpPorts: cfg.FTPPorts, sipPorts: cfg.SIPPorts}
+}
+
+// protocol returns the ALG protocol served on a destination port, or empty
+func (a algPolicy) protocol(port int) string {
+	switch {
+	case a.action == "":
+		return ""
+	case slices.Contains(a.ftpPorts, port):
+		return algFTP
+	case slices.Contains(a.sipPorts, port):
+		return algSIP
+	}
+	return ""
+}
+
+// direct reports whether connections of protocol bypass upstream proxies.
+// SIP cannot be rewritten, so rewrite keeps it direct too.
+func (a algPolicy) direct(protocol string) bool {
+	return a.action == config.ALGDirect || (a.action == config.ALGRewrite && protocol == algSIP)
+}
+
+// apply keeps FTP and SIP off upstream proxies when configured
+func (a algPolicy) apply(protocol string, policy config.Policy, upstream *Upstream) (config.Policy, *Upstream) {
+	if policy == config.PolicyProxy && protocol != "" && a.direct(protocol) {
+		return config.PolicyDirect, nil
+	}
+	return policy, upstream
+}
+
+// warnALG reports a UDP flow whose payload addresses are not rewritten
+func (tp *TransparentProxy) warnALG(dst *net.UDPAddr, src net.Addr) {
+	rt := tp.routing.Load()
+	if rt.alg.protocol(dst.Port) == algSIP {
+		slog.Warn("SIP flow, addresses in its messages are not rewritten", "target", dst, "device", tp.deviceName(src))
+	}
+}
+
+// ftpControl follows an FTP control connection for active mode, where the
+// client names an address for the server to connect back to. Through the
+// proxy that address is unreachable or refused, so without rewrite the first
+// PORT or EPRT command is only reported. With rewrite the proxy answers them
+// itself: the server is asked for passive mode instead and the proxy relays
+// the data connection between the server and the client's address.
+type ftpControl struct {
+	client   net.IP // the only address active mode may name
+	extended bool   // ask with EPSV, the server being reached over IPv6
+	rewrite  bool
+	warn     func()
+	openData func(serverPort int, client *net.TCPAddr)
+
+	once    sync.Once
+	mu      sync.Mutex
+	pending []*net.TCPAddr // client addresses of substituted commands, nil if refused
+	secured bool           // AUTH was sent, the rest is encrypted
+}
+
+// command inspects a line the client sends, returning what is sent instead
+func (c *ftpControl) command(line []byte) []byte {
+	switch {
+	case hasPrefixFold(line, "AUTH "):
+		c.mu.Lock()
+		c.secured = true
+		c.mu.Unlock()
+		return line
+	case hasPrefixFold(line, "PORT "), hasPrefixFold(line, "EPRT "):
+	default:
+		return line
+	}
+	if !c.rewrite {
+		c.once.Do(c.warn)
+		return line
+	}
+
+	addr, err := parseFTPActive(line)
+	if err == nil && !addr.IP.Equal(c.client) {
+		err = fmt.Errorf("address %s is not the client's", addr.IP)
+	}
+	if err != nil {
+		slog.Warn("Refusing FTP active mode", "client", c.client, "error", err)
+		addr = nil
+	}
+	c.mu.Lock()
+	c.pending = append(c.pending, addr)
+	c.mu.Unlock()
+	switch {
+	case addr == nil:
+		return []byte("NOOP\r\n")
+	case c.extended:
+		return []byte("EPSV\r\n")
+	}
+	return []byte("PASV\r\n")
+}
+
+// reply inspects a line the server sends, replacing the replies to the
+// substituted commands with the ones the client expects for PORT
+func (c *ftpControl) reply(line []byte) []byte {
+	c.mu.Lock()
+	if c.secured || len(c.pending) == 0 {
+		c.mu.Unlock()
+		return line
+	}
+	// Only the last line of a multiline reply has a space after the code
+	if len(line) < 4 || line[3] != ' ' {
+		c.mu.Unlock()
+		return nil
+	}
+	addr := c.pending[0]
+	c.pending = c.pending[1:]
+	c.mu.Unlock()
+
+	if addr == nil {
+		return []byte("500 Illegal PORT command.\r\n")
+	}
+	port, err := parseFTPPassive(line)
+	if err != nil {
+		slog.Warn("FTP server refused passive mode", "error", err)
+		return []byte("425 Can't open data connection.\r\n")
+	}
+	go c.openData(port, addr)
+	return []byte("200 PORT command successful.\r\n")
+}
+
+// done reports whether the control connection is no longer inspected
+func (c *ftpControl) done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secured
+}
+
+// parseFTPActive reads the client address of a PORT or EPRT command
+func parseFTPActive(line []byte) (*net.TCPAddr, error) {
+	arg := string(bytes.TrimSpace(line[5:]))
+	if hasPrefixFold(line, "PORT ") {
+		n, err := parseFTPNumbers(arg)
+		if err != nil {
+			return nil, err
+		}
+		return &net.TCPAddr{IP: net.IPv4(byte(n[0]), byte(n[1]), byte(n[2]), byte(n[3])), Port: n[4]<<8 | n[5]}, nil
+	}
+
+	// EPRT |1|132.235.1.2|6275|, any delimiter
+	if len(arg) < 2 {
+		return nil, errors.New("malformed EPRT command")
+	}
+	fields := bytes.Split([]byte(arg[1:]), []byte(arg[:1]))
+	if len(fields) != 4 || len(fields[3]) != 0 {
+		return nil, errors.New("malformed EPRT command")
+	}
+	ip := net.ParseIP(string(fields[1]))
+	port, err := strconv.Atoi(string(fields[2]))
+	if ip == nil || err != nil || port < 1 || port > 65535 {
+		return nil, errors.New("malformed EPRT command")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseFTPPassive reads the port of a 227 or 229 reply. The address of a 227
+// reply is ignored, data goes to the host the control connection reaches.
+func parseFTPPassive(line []byte) (int, error) {
+	code, text := string(line[:3]), string(bytes.TrimSpace(line[4:]))
+	switch code {
+	case "227":
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2): the numbers start
+		// at the first digit
+		i := 0
+		for i < len(text) && (text[i] < '0' || text[i] > '9') {
+			i++
+		}
+		j := i
+		for j < len(text) && (text[j] == ',' || (text[j] >= '0' && text[j] <= '9')) {
+			j++
+		}
+		n, err := parseFTPNumbers(text[i:j])
+		if err != nil {
+			return 0, err
+		}
+		return n[4]<<8 | n[5], nil
+	case "229":
+		// 229 Entering Extended Passive Mode (|||6446|)
+		open, end := bytes.IndexByte(line, '('), bytes.LastIndexByte(line, ')')
+		if open < 0 || end < open+5 {
+			break
+		}
+		inner := line[open+1 : end]
+		fields := bytes.Split(inner[1:], inner[:1])
+		if len(fields) != 4 {
+			break
+		}
+		port, err := strconv.Atoi(string(fields[2]))
+		if err != nil || port < 1 || port > 65535 {
+			break
+		}
+		return port, nil
+	default:
+		return 0, fmt.Errorf("reply %q", text)
+	}
+	return 0, fmt.Errorf("malformed reply %q", text)
+}
+
+// parseFTPNumbers reads the h1,h2,h3,h4,p1,p2 form of an address
+func parseFTPNumbers(s string) ([6]int, error) {
+	var n [6]int
+	fields := bytes.Split([]byte(s), []byte(","))
+	if len(fields) != 6 {
+		return n, fmt.Errorf("malformed address %q", s)
+	}
+	for i, f := range fields {
+		v, err := strconv.Atoi(string(f))
+		if err != nil || v < 0 || v > 255 {
+			return n, fmt.Errorf("malformed address %q", s)
+		}
+		n[i] = v
+	}
+	return n, nil
+}
+
+// ftpConn applies an ftpControl filter to the lines read from one side of
+// the control connection until it is no longer inspected
+type ftpConn struct {
+	net.Conn
+	ctl     *ftpControl
+	filter  func(line []byte) []byte
+	partial []byte // incomplete line
+	out     []byte
+	err     error
+}
+
+func (c *ftpConn) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.ctl.done() {
+			if len(c.partial) == 0 {
+				return c.Conn.Read(b)
+			}
+			c.out, c.partial = c.partial, nil
+			break
+		}
+		n, err := c.Conn.Read(b)
+		c.err = err
+		data := append(c.partial, b[:n]...)
+		c.partial = nil
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				if len(data) > ftpLineLimit {
+					c.out = append(c.out, data...)
+				} else {
+					c.partial = data
+				}
+				break
+			}
+			c.out = append(c.out, c.filter(data[:i+1])...)
+			data = data[i+1:]
+		}
+		if err != nil && len(c.partial) > 0 {
+			c.out, c.partial = append(c.out, c.partial...), nil
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *ftpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// relayFTPData connects to the passive data port the server opened for the
+// control connection's plan and to the client's active mode address, relaying
+// between them with the hooks of the control connection's traffic class
+func (tp *TransparentProxy) relayFTPData(ctx context.Context, rt *routing, plan dialPlan, serverPort int, client *net.TCPAddr, up, down RelayHook) {
+	host, _, _ := net.SplitHostPort(plan.target)
+	plan.target = net.JoinHostPort(host, strconv.Itoa(serverPort))
+
+	dialCtx, cancel := context.WithTimeout(ctx, rt.dialTimeout)
+	defer cancel()
+	server, err := tp.dial(dialCtx, plan)
+	if err != nil {
+		slog.Warn("Failed to connect FTP data connection", "target", plan.target, "error", err)
+		return
+	}
+	defer server.Close()
+	conn, err := newBypassDialer().DialContext(dialCtx, "tcp", client.String())
+	if err != nil {
+		slog.Warn("Failed to connect FTP data connection", "client", client, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	slog.Debug("Relaying FTP data connection", "target", plan.target, "client", client)
+	Relay(server, conn, tp.pool, up, down, 0)
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestParseFTP(t *testing.T) {
+	active := []struct {
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{"PORT 192,168,1,10,4,1\r\n", "192.168.1.10:1025", false},
+		{"port 10,0,0,1,0,21\r\n", "10.0.0.1:21", false},
+		{"EPRT |1|192.168.1.10|6275|\r\n", "192.168.1.10:6275", false},
+		{"EPRT !2!2001:db8::10!6275!\r\n", "[2001:db8::10]:6275", false},
+		{"PORT 192,168,1,10,4\r\n", "", true},
+		{"PORT 192,168,1,300,4,1\r\n", "", true},
+		{"EPRT |1|192.168.1.10|0|\r\n", "", true},
+		{"EPRT |1|host|21|\r\n", "", true},
+	}
+	for _, tt := range active {
+		addr, err := parseFTPActive([]byte(tt.line))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFTPActive(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err == nil && addr.String() != tt.want {
+			t.Errorf("parseFTPActive(%q) = %s, want %s", tt.line, addr, tt.want)
+		}
+	}
+
+	passive := []struct {
+		line    string
+		want    int
+		wantErr bool
+	}{
+		{"227 Entering Passive Mode (10,0,0,1,200,10).\r\n", 51210, false},
+		{"227 =10,0,0,1,0,99\r\n", 99, false},
+		{"229 Entering Extended Passive Mode (|||6446|)\r\n", 6446, false},
+		{"229 Extended Passive Mode (!!!6446!)\r\n", 6446, false},
+		{"500 Unknown command.\r\n", 0, true},
+		{"227 Entering Passive Mode.\r\n", 0, true},
+		{"229 Entering Extended Passive Mode (|||x|)\r\n", 0, true},
+	}
+	for _, tt := range passive {
+		port, err := parseFTPPassive([]byte(tt.line))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFTPPassive(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if port != tt.want {
+			t.Errorf("parseFTPPassive(%q) = %d, want %d", tt.line, port, tt.want)
+		}
+	}
+}
+
+// startFTPServer runs a passive-only FTP server sending data for every RETR
+func startFTPServer(t *testing.T, data string) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "220-Welcome\r\n220 Ready\r\n")
+				var dataLn net.Listener
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd, _, _ := strings.Cut(strings.TrimSpace(line), " "); cmd {
+					case "PASV":
+						if dataLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+							return
+						}
+						port := dataLn.Addr().(*net.TCPAddr).Port
+						fmt.Fprintf(conn, "227 Entering Passive Mode (127,0,0,1,%d,%d).\r\n", port>>8, port&0xff)
+					case "RETR":
+						fmt.Fprint(conn, "150 Opening data connection\r\n")
+						dc, err := dataLn.Accept()
+						if err != nil {
+							return
+						}
+						io.WriteString(dc, data)
+						dc.Close()
+						dataLn.Close()
+						fmt.Fprint(conn, "226 Transfer complete\r\n")
+					case "PORT", "EPRT":
+						fmt.Fprint(conn, "500 Active mode disabled\r\n")
+					default:
+						fmt.Fprint(conn, "200 OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestFTPRewrite(t *testing.T) {
+	server := startFTPServer(t, "hello over active mode")
+	tp := newTestProxy(t, &config.Config{ALG: config.ALGConfig{Action: config.ALGRewrite, FTPPorts: []int{server.Port}}}, "MATCH,DIRECT")
+
+	// The client reaches the proxy as an explicit proxy client would
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp.forward(context.Background(), conn, "socks", "", server, nil, nil)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	expect := func(cmd, want string) {
+		t.Helper()
+		if cmd != "" {
+			fmt.Fprint(conn, cmd+"\r\n")
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		if !strings.HasPrefix(line, want) {
+			t.Fatalf("%s: reply %q, want %s", cmd, line, want)
+		}
+	}
+	expect("", "220-")
+	expect("", "220 ")
+	expect("USER anonymous", "200 ")
+
+	// Only the client's own address is accepted
+	expect("PORT 10,9,9,9,4,1", "500 ")
+
+	dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataLn.Close()
+	port := dataLn.Addr().(*net.TCPAddr).Port
+	expect(fmt.Sprintf("PORT 127,0,0,1,%d,%d", port>>8, port&0xff), "200 PORT")
+	fmt.Fprint(conn, "RETR file\r\n")
+	dc, err := dataLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dc)
+	dc.Close()
+	if err != nil || string(got) != "hello over active mode" {
+		t.Fatalf("data = %q, %v", got, err)
+	}
+	expect("", "150 ")
+	expect("", "226 ")
+}
+
+func TestALGDirect(t *testing.T) {
+	dst := net.ParseIP("203.0.113.1")
+	for _, tt := range []struct {
+		action string
+		port   int
+		want   config.Policy
+	}{
+		{config.ALGWarn, 5060, config.PolicyProxy},
+		{config.ALGDirect, 5060, config.PolicyDirect},
+		{config.ALGDirect, 21, config.PolicyDirect},
+		{config.ALGDirect, 443, config.PolicyProxy},
+		{config.ALGRewrite, 5061, config.PolicyDirect},
+		{config.ALGRewrite, 21, config.PolicyProxy},
+	} {
+		tp := newTestProxy(t, &config.Config{ALG: config.ALGConfig{Action: tt.action}}, "MATCH,PROXY")
+		if policy, _ := tp.route(dst, tt.port, nil); policy != tt.want {
+			t.Errorf("%s: route(port %d) = %s, want %s", tt.action, tt.port, policy, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+const (
+	// BulkTargetTTL is how long a destination stays classified as bulk after its last bulk window
+	BulkTargetTTL = 30 * time.Minute
+	// maxBulkTargets bounds the classification table of a traffic-class group
+	maxBulkTargets = 4096
+)
+
+// bulkTargets remembers destinations recently observed transferring in bulk.
+// A connection cannot change upstream mid-stream, so the classification
+// applies to later connections to the same destination.
+type bulkTargets struct {
+	mu      sync.RWMutex
+	expires map[string]time.Time
+}
+
+func newBulkTargets() *bulkTargets {
+	return &bulkTargets{expires: make(map[string]time.Time)}
+}
+
+func (b *bulkTargets) contains(target string) bool {
+	b.mu.RLock()
+	expires, ok := b.expires[target]
+	b.mu.RUnlock()
+	return ok && time.Now().Before(expires)
+}
+
+func (b *bulkTargets) mark(target string) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.expires[target]; !ok && len(b.expires) >= maxBulkTargets {
+		for t, expires := range b.expires {
+			if now.After(expires) {
+				delete(b.expires, t)
+			}
+		}
+		if len(b.expires) >= maxBulkTargets {
+			return
+		}
+	}
+	b.expires[target] = now.Add(BulkTargetTTL)
+}
+
+// classifier returns a relay hook feeding the throughput of a connection to
+// the first traffic-class group on the path of policy, or nil if there is none
+func (t *policyTable) classifier(policy config.Policy, target string) RelayHook {
+	for {
+		g, ok := t.groups[string(policy)]
+		if !ok {
+			return nil
+		}
+		if g.kind == config.GroupTrafficClass {
+			c := &throughputMeter{group: g, target: target, windowStart: time.Now()}
+			return c.account
+		}
+		policy = g.pick(target)
+	}
+}
+
+// throughputMeter measures a connection over consecutive warm-up windows and
+// marks its destination as bulk when a window exceeds the group's bulk rate
+type throughputMeter struct {
+	group  *proxyGroup
+	target string
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowBytes int64
+}
+
+func (m *throughputMeter) account(n int) error {
+	m.mu.Lock()
+	m.windowBytes += int64(n)
+	elapsed := time.Since(m.windowStart)
+	if elapsed < m.group.warmup {
+		m.mu.Unlock()
+		return nil
+	}
+	rate := float64(m.windowBytes) / elapsed.Seconds()
+	m.windowStart = m.windowStart.Add(elapsed)
+	m.windowBytes = 0
+	m.mu.Unlock()
+
+	if rate >= float64(m.group.bulkRate) {
+		m.group.bulk.mark(m.target)
+	}
+	return nil
+}
+
+// chainHooks combines relay hooks, skipping nil ones
+func chainHooks(hooks ...RelayHook) RelayHook {
+	var active []RelayHook
+	for _, h := range hooks {
+		if h != nil {
+			active = append(active, h)
+		}
+	}
+	switch len(active) {
+	case 0:
+		return nil
+	case 1:
+		return active[0]
+	}
+	return func(n int) error {
+		for _, h := range active {
+			if err := h(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestTrafficClass_Classify(t *testing.T) {
+	table := newTestPolicyTable(t, &config.Config{
+		Proxies: map[string]config.ProxyChain{
+			"fast": {{URL: "socks5://fast:1080"}},
+			"wide": {{URL: "socks5://wide:1080"}},
+		},
+		ProxyGroups: []config.ProxyGroup{
+			{Name: "Split", Type: config.GroupTrafficClass, Proxies: []string{"fast", "wide"}, BulkRate: 1000},
+		},
+	})
+	g := table.groups["Split"]
+	g.warmup = 10 * time.Millisecond
+
+	host := func(target string) string {
+		_, u := table.resolve("Split", target)
+		return u.hops[0].URL.Host
+	}
+
+	if got := host("video.example"); got != "fast:1080" {
+		t.Fatalf("unclassified target uses %s, want fast:1080", got)
+	}
+
+	// A slow connection stays interactive
+	slow := table.classifier("Split", "chat.example")
+	slow(1)
+	time.Sleep(15 * time.Millisecond)
+	slow(1)
+	if got := host("chat.example"); got != "fast:1080" {
+		t.Errorf("slow target uses %s, want fast:1080", got)
+	}
+
+	// A window above the bulk rate moves later connections to the bulk member
+	bulk := table.classifier("Split", "video.example")
+	bulk(1 << 20)
+	time.Sleep(15 * time.Millisecond)
+	bulk(1 << 20)
+	if got := host("video.example"); got != "wide:1080" {
+		t.Errorf("bulk target uses %s, want wide:1080", got)
+	}
+
+	if table.classifier(config.PolicyProxy, "video.example") != nil {
+		t.Error("Expected no classifier outside traffic-class groups")
+	}
+}
+
+func TestChainHooks(t *testing.T) {
+	if chainHooks(nil, nil) != nil {
+		t.Error("Expected nil for only nil hooks")
+	}
+
+	var calls []int
+	a := func(n int) error { calls = append(calls, n); return nil }
+	b := func(n int) error { return ErrTransferLimit }
+	if err := chainHooks(a, nil, b)(3); err != ErrTransferLimit {
+		t.Errorf("chained error = %v, want ErrTransferLimit", err)
+	}
+	if len(calls) != 1 || calls[0] != 3 {
+		t.Errorf("calls = %v, want [3]", calls)
+	}
+}
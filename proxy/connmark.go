@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync/atomic"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// connMarks maps policies to the conntrack marks of their connections
+type connMarks struct {
+	mask  uint32
+	marks map[config.Policy]uint32
+}
+
+func newConnMarks(cfg config.ConnMark) connMarks {
+	m := connMarks{mask: uint32(cfg.Mask), marks: make(map[config.Policy]uint32, len(cfg.Marks))}
+	for p, mark := range cfg.Marks {
+		m.marks[p] = uint32(mark)
+	}
+	return m
+}
+
+// lookup returns the mark of a connection matched with policy and made with
+// resolved, preferring the mark of the policy itself
+func (m connMarks) lookup(policy, resolved config.Policy) (uint32, bool) {
+	if mark, ok := m.marks[policy]; ok {
+		return mark, true
+	}
+	mark, ok := m.marks[resolved]
+	return mark, ok
+}
+
+// connMarker sets conntrack marks, reporting the first failure as a warning
+type connMarker struct {
+	ct     conntrack
+	warned atomic.Bool
+}
+
+// mark sets mark on the conntrack entries of the client connection and of the
+// connection to the destination or first upstream proxy. The client's entry
+// is found by its reply tuple, which matches the socket even when NAT
+// redirected the connection. Multiplexed streams share a connection with
+// other policies and leave it unmarked.
+func (m *connMarker) mark(mask, mark uint32, client, server net.Conn) {
+	err := m.setMark(client, true, mark, mask)
+	if err == nil {
+		err = m.setMark(server, false, mark, mask)
+	}
+	if err == nil {
+		return
+	}
+	if m.warned.CompareAndSwap(false, true) {
+		slog.Warn("Failed to set conntrack marks, later failures are logged at debug level", "error", err)
+	} else {
+		slog.Debug("Failed to set conntrack mark", "client", client.RemoteAddr(), "error", err)
+	}
+}
+
+func (m *connMarker) setMark(conn net.Conn, reply bool, mark, mask uint32) error {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || remote == nil {
+		return nil
+	}
+	return m.ct.setMark(local, remote, reply, mark, mask)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ctnetlink message and attribute types, from linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtNew = 0
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+	ctaMark       = 8
+	ctaMarkMask   = 21
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+)
+
+// conntrack changes conntrack entries over a ctnetlink socket opened on first use
+type conntrack struct {
+	once sync.Once
+	conn *netlink.Conn
+	err  error
+}
+
+// setMark sets the bits of mask in the mark of the TCP conntrack entry whose
+// original tuple, or reply tuple with reply, goes from local to remote
+func (c *conntrack) setMark(local, remote *net.TCPAddr, reply bool, mark, mask uint32) error {
+	c.once.Do(func() {
+		c.conn, c.err = netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	})
+	if c.err != nil {
+		return fmt.Errorf("failed to open ctnetlink socket: %w", c.err)
+	}
+
+	family, src, dst := uint8(unix.AF_INET), local.IP.To4(), remote.IP.To4()
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if src == nil || dst == nil {
+		family, src, dst = unix.AF_INET6, local.IP.To16(), remote.IP.To16()
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+	}
+	tuple := uint16(ctaTupleOrig)
+	if reply {
+		tuple = ctaTupleReply
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(tuple, func(nae *netlink.AttributeEncoder) error {
+		nae.Nested(ctaTupleIP, func(ip *netlink.AttributeEncoder) error {
+			ip.Bytes(srcType, src)
+			ip.Bytes(dstType, dst)
+			return nil
+		})
+		nae.Nested(ctaTupleProto, func(proto *netlink.AttributeEncoder) error {
+			proto.Uint8(ctaProtoNum, unix.IPPROTO_TCP)
+			proto.Uint16(ctaProtoSrcPort, uint16(local.Port))
+			proto.Uint16(ctaProtoDstPort, uint16(remote.Port))
+			return nil
+		})
+		return nil
+	})
+	ae.Uint32(ctaMark, mark)
+	ae.Uint32(ctaMarkMask, mask)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	// nfgenmsg: family, version, resource id
+	data := append([]byte{family, unix.NFNETLINK_V0, 0, 0}, attrs...)
+	_, err = c.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtNew),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("conntrack entry %s -> %s: %w", local, remote, err)
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// conntrack is a stub on platforms without netfilter
+type conntrack struct{}
+
+func (c *conntrack) setMark(local, remote *net.TCPAddr, reply bool, mark, mask uint32) error {
+	return errors.New("conntrack marks require Linux")
+}
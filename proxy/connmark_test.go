@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestConnMarks_Lookup(t *testing.T) {
+	m := newConnMarks(config.ConnMark{Mask: 0xff, Marks: map[config.Policy]int{
+		config.PolicyProxy:  0x10,
+		config.PolicyDirect: 0x20,
+		"wan2":              0x30,
+	}})
+	tests := []struct {
+		policy, resolved config.Policy
+		want             uint32
+		ok               bool
+	}{
+		{config.PolicyProxy, config.PolicyProxy, 0x10, true},
+		{"wan2", config.PolicyDirect, 0x30, true},
+		{"Uplinks", config.PolicyDirect, 0x20, true},
+		{"Uplinks", config.PolicyReject, 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := m.lookup(tt.policy, tt.resolved); got != tt.want || ok != tt.ok {
+			t.Errorf("lookup(%s, %s) = 0x%x, %v, want 0x%x, %v", tt.policy, tt.resolved, got, ok, tt.want, tt.ok)
+		}
+	}
+}
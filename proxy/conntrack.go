@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// Connection is a snapshot of an active relayed TCP connection
+type Connection struct {
+	ID          uint64        `json:"id"`
+	Inbound     string        `json:"inbound"`
+	Source      string        `json:"source"`
+	Device      string        `json:"device,omitempty"`
+	Destination string        `json:"destination"`
+	Domain      string        `json:"domain,omitempty"`
+	Rule        string        `json:"rule,omitempty"`
+	Policy      config.Policy `json:"policy"`
+	Upstream    string        `json:"upstream,omitempty"`
+	Start       time.Time     `json:"start"`
+	Upload      int64         `json:"upload"`
+	Download    int64         `json:"download"`
+}
+
+// connTracker records the connections being relayed so they can be listed and closed
+type connTracker struct {
+	nextID atomic.Uint64
+
+	mu    sync.Mutex
+	conns map[uint64]*trackedConn
+}
+
+type trackedConn struct {
+	info     Connection
+	upload   atomic.Int64
+	download atomic.Int64
+	closer   func()
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[uint64]*trackedConn)}
+}
+
+// add registers a connection; closer aborts its relay
+func (t *connTracker) add(info Connection, closer func()) *trackedConn {
+	info.ID = t.nextID.Add(1)
+	info.Start = time.Now()
+	c := &trackedConn{info: info, closer: closer}
+
+	t.mu.Lock()
+	t.conns[info.ID] = c
+	t.mu.Unlock()
+	return c
+}
+
+func (t *connTracker) remove(c *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, c.info.ID)
+	t.mu.Unlock()
+}
+
+// list returns the active connections ordered by ID
+func (t *connTracker) list() []Connection {
+	t.mu.Lock()
+	out := make([]Connection, 0, len(t.conns))
+	for _, c := range t.conns {
+		info := c.info
+		info.Upload = c.upload.Load()
+		info.Download = c.download.Load()
+		out = append(out, info)
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(out, func(a, b Connection) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
+
+// close aborts the connection with the given ID, reporting whether it existed
+func (t *connTracker) close(id uint64) bool {
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if ok {
+		c.closer()
+	}
+	return ok
+}
+
+func (c *trackedConn) countUpload(n int) error {
+	c.upload.Add(int64(n))
+	return nil
+}
+
+func (c *trackedConn) countDownload(n int) error {
+	c.download.Add(int64(n))
+	return nil
+}
+
+// Connections lists the active TCP connections, or nil if tracking is disabled
+func (tp *TransparentProxy) Connections() []Connection {
+	if tp.conns == nil {
+		return nil
+	}
+	return tp.conns.list()
+}
+
+// CloseConnection aborts an active connection, reporting whether it was found
+func (tp *TransparentProxy) CloseConnection(id uint64) bool {
+	return tp.conns != nil && tp.conns.close(id)
+}
+
+// MatchResult explains how a destination would be routed
+type MatchResult struct {
+	Rule     string        `json:"rule,omitempty"`
+	Policy   config.Policy `json:"policy"`
+	Resolved config.Policy `json:"resolved"`
+	Upstream string        `json:"upstream,omitempty"`
+}
+
+// MatchQuery is a connection to evaluate against the rules. At least one of
+// Domain and IP is set; Source, if set, is used by SRC-MAC rules.
+type MatchQuery struct {
+	Source net.IP
+	Domain string
+	IP     net.IP
+	Port   int
+}
+
+// Match evaluates the scheduled and loaded rules for a connection
+func (tp *TransparentProxy) Match(q MatchQuery) MatchResult {
+	md := &rules.Metadata{Domain: q.Domain, DstIP: q.IP, DstPort: uint16(q.Port)}
+	rt := tp.routing.Load()
+	if q.Source != nil && tp.neighbors != nil && (rt.matcher.HasSourceMACRules() || tp.schedule.hasSourceMACRules()) {
+		md.SrcMAC = tp.neighbors.Lookup(q.Source)
+	}
+
+	result, ok := tp.schedule.match(md, time.Now())
+	if !ok {
+		result = rt.matcher.MatchMetadata(md)
+	}
+	resolved, upstream := rt.policies.resolve(result.Policy, routingKey(q.Domain, q.IP))
+
+	out := MatchResult{Policy: result.Policy, Resolved: resolved}
+	if result.Rule != nil {
+		out.Rule = result.Rule.String()
+	}
+	if upstream != nil {
+		out.Upstream = upstream.String()
+	}
+	return out
+}
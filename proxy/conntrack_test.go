@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestConnTracking(t *testing.T) {
+	echo := startEcho(t)
+	tp := newInboundTestProxy(t, "IP-CIDR,127.0.0.0/8,DIRECT", "MATCH,REJECT")
+	tp.conns = newConnTracker()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		tp.handleSOCKS5(t.Context(), server)
+	}()
+
+	client.Write([]byte{socks5Version, 1, socks5AuthNone})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write(append([]byte{socks5Version, socks5CmdConnect, 0}, appendSOCKS5Addr(nil, &net.UDPAddr{IP: echo.IP, Port: echo.Port})...))
+	io.ReadFull(client, make([]byte, 3))
+	readSOCKS5Addr(client)
+	expectEcho(t, client)
+
+	conns := tp.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("connections = %d, want 1", len(conns))
+	}
+	c := conns[0]
+	if c.Inbound != "socks5" || c.Policy != config.PolicyDirect || c.Destination != echo.String() {
+		t.Errorf("connection = %+v", c)
+	}
+	if c.Upload != 4 || c.Download != 4 {
+		t.Errorf("counters = %d up, %d down, want 4 and 4", c.Upload, c.Download)
+	}
+
+	if tp.CloseConnection(c.ID + 1) {
+		t.Error("closing an unknown connection succeeded")
+	}
+	if !tp.CloseConnection(c.ID) {
+		t.Fatal("closing the connection failed")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relay still running after close")
+	}
+	if n := len(tp.Connections()); n != 0 {
+		t.Errorf("connections after close = %d, want 0", n)
+	}
+}
+
+func TestForwardMetrics(t *testing.T) {
+	echo := startEcho(t)
+	tp := newInboundTestProxy(t, "IP-CIDR,127.0.0.0/8,DIRECT")
+	tp.metrics = newProxyMetrics(1)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		tp.forward(t.Context(), server, "tproxy", "", echo, nil, nil)
+	}()
+	expectEcho(t, client)
+	client.Close()
+	<-done
+
+	rec := httptest.NewRecorder()
+	tp.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+	for _, want := range []string{
+		`tproxy_connections_total{inbound="tproxy",policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT"} 1`,
+		`tproxy_relay_bytes_total{direction="up",policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT"} 4`,
+		`tproxy_relay_bytes_total{direction="down",policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT"} 4`,
+		`tproxy_active_relays{inbound="tproxy"} 0`,
+		`tproxy_connection_bytes_bucket{direction="up",policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT",le="1024"} 1`,
+		`tproxy_connection_bytes_sum{direction="down",policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT"} 4`,
+		`tproxy_connection_duration_seconds_count{policy="DIRECT",rule="IP-CIDR,127.0.0.0/8,DIRECT"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q\n%s", want, out)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tp := newInboundTestProxy(t, "DOMAIN-SUFFIX,example.com,REJECT", "IP-CIDR,10.0.0.0/8,DIRECT", "MATCH,PROXY")
+
+	tests := []struct {
+		host   string
+		policy config.Policy
+	}{
+		{"www.example.com", config.PolicyReject},
+		{"10.1.2.3", config.PolicyDirect},
+		{"other.org", config.PolicyProxy},
+	}
+	for _, tt := range tests {
+		q := MatchQuery{Port: 443}
+		if q.IP = net.ParseIP(tt.host); q.IP == nil {
+			q.Domain = tt.host
+		}
+		got := tp.Match(q)
+		if got.Policy != tt.policy {
+			t.Errorf("Match(%q) policy = %s, want %s", tt.host, got.Policy, tt.policy)
+		}
+		if got.Rule == "" {
+			t.Errorf("Match(%q) has no rule", tt.host)
+		}
+	}
+}
+
+func TestProxyMetrics_Sample(t *testing.T) {
+	tests := []struct {
+		every int
+		want  int
+	}{
+		{0, 6},
+		{1, 6},
+		{3, 2},
+	}
+	for _, tt := range tests {
+		m := newProxyMetrics(tt.every)
+		sampled := 0
+		for range 6 {
+			if m.sample() {
+				sampled++
+			}
+		}
+		if sampled != tt.want {
+			t.Errorf("newProxyMetrics(%d) sampled %d of 6, want %d", tt.every, sampled, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// CredentialCheckInterval is how often upstream password files are checked for changes
+const CredentialCheckInterval = 10 * time.Second
+
+// hopCredentials holds the current credentials of one proxy of a chain.
+// Connections load them once, so a rotation only affects later connections.
+type hopCredentials struct {
+	file   string         // password file, empty if the credentials are fixed
+	reauth *config.Reauth // renews rejected credentials, nil if not used
+	user   atomic.Pointer[url.Userinfo]
+
+	mu      sync.Mutex
+	modTime time.Time
+
+	renewMu      sync.Mutex
+	renewing     chan struct{} // closed when the running renewal ends, nil if none
+	renewErr     error         // result of the last renewal
+	renewed      time.Time     // end of the last renewal
+	refreshToken string        // of the device flow, renews without the user
+}
+
+func newHopCredentials(hop config.ProxyHop) *hopCredentials {
+	c := &hopCredentials{file: hop.PasswordFile, reauth: hop.Reauth}
+	c.user.Store(hop.URL.User)
+	return c
+}
+
+// refresh rereads the password file if it was modified since the last read,
+// or unconditionally with force. It reports whether the password changed.
+func (c *hopCredentials) refresh(force bool) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, err := os.Stat(c.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat password file: %w", err)
+	}
+	if !force && info.ModTime().Equal(c.modTime) {
+		return false, nil
+	}
+	password, err := config.ReadPassword(c.file)
+	if err != nil {
+		return false, err
+	}
+	c.modTime = info.ModTime()
+
+	current := c.user.Load()
+	if old, _ := current.Password(); old == password {
+		return false, nil
+	}
+	c.user.Store(url.UserPassword(current.Username(), password))
+	return true, nil
+}
+
+// user returns the current credentials of hop i
+func (u *Upstream) user(i int) *url.Userinfo {
+	return u.creds[i].user.Load()
+}
+
+// hasPasswordFiles reports whether any proxy of the chain reads its password from a file
+func (u *Upstream) hasPasswordFiles() bool {
+	for _, c := range u.creds {
+		if c.file != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateCredentials refreshes the password files of the chain
+func (u *Upstream) rotateCredentials(force bool) error {
+	var errs []error
+	for i, c := range u.creds {
+		if c.file == "" {
+			continue
+		}
+		changed, err := c.refresh(force)
+		if err != nil {
+			errs = append(errs, u.hopError(i, err))
+			continue
+		}
+		if changed {
+			slog.Info("Upstream credentials rotated", "upstream", u, "hop", i+1)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// eachUpstream calls fn with every upstream and the policy naming it
+func (t *policyTable) eachUpstream(fn func(name string, u *Upstream)) {
+	if t.upstream != nil {
+		fn(string(config.PolicyProxy), t.upstream)
+	}
+	for name, u := range t.proxies {
+		fn(name, u)
+	}
+}
+
+// rotateCredentials refreshes the password files of every upstream. Without
+// force only files modified since the last check are read.
+func (t *policyTable) rotateCredentials(force bool) error {
+	var errs []error
+	t.eachUpstream(func(name string, u *Upstream) {
+		if err := u.rotateCredentials(force); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (t *policyTable) hasPasswordFiles() bool {
+	found := false
+	t.eachUpstream(func(_ string, u *Upstream) {
+		found = found || u.hasPasswordFiles()
+	})
+	return found
+}
+
+// credentialLoop applies modified password files, checking every interval
+// until the context is cancelled
+func (t *policyTable) credentialLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.rotateCredentials(false); err != nil {
+			slog.Warn("Failed to refresh upstream credentials", "error", err)
+		}
+	}
+}
+
+// RotateCredentials rereads the password files of all upstreams now. New
+// credentials apply to connections opened afterwards.
+func (tp *TransparentProxy) RotateCredentials() error {
+	return tp.routing.Load().policies.rotateCredentials(true)
+}
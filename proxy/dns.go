@@ -9,47 +9,10 @@ import (
 	"time"
 
 	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
 	"github.com/miekg/dns"
 )
 
-func (tp *TransparentProxy) handleDNSUDP(ctx context.Context, srcAddr net.Addr, origDst *net.UDPAddr, data []byte) {
-	msg := new(dns.Msg)
-	if err := msg.Unpack(data); err != nil {
-		return
-	}
-
-	w := &udpDNSWriter{
-		conn:    tp.udpConn,
-		srcAddr: srcAddr,
-	}
-
-	tp.handleDNSRequest(ctx, w, msg)
-}
-
-type udpDNSWriter struct {
-	conn    *net.UDPConn
-	srcAddr net.Addr
-}
-
-func (w *udpDNSWriter) LocalAddr() net.Addr  { return nil }
-func (w *udpDNSWriter) RemoteAddr() net.Addr { return w.srcAddr }
-func (w *udpDNSWriter) WriteMsg(m *dns.Msg) error {
-	data, err := m.Pack()
-	if err != nil {
-		return err
-	}
-	_, err = w.conn.WriteTo(data, w.srcAddr)
-	return err
-}
-
-func (w *udpDNSWriter) Write(b []byte) (int, error) {
-	return w.conn.WriteTo(b, w.srcAddr)
-}
-func (w *udpDNSWriter) Close() error        { return nil }
-func (w *udpDNSWriter) TsigStatus() error   { return nil }
-func (w *udpDNSWriter) TsigTimersOnly(bool) {}
-func (w *udpDNSWriter) Hijack()             {}
-
 func (tp *TransparentProxy) handleDNSTCP(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 	dnsConn := &dns.Conn{Conn: conn}
@@ -88,11 +51,13 @@ func (tp *TransparentProxy) handleDNSRequest(ctx context.Context, w dns.Response
 	}
 
 	q := r.Question[0]
-	domain := strings.TrimSuffix(q.Name, ".")
+	domain := rules.CanonicalDomain(q.Name)
 	slog.Debug("DNS request", "query", q.Name, "type", dns.TypeToString[q.Qtype])
 
+	rt := tp.routing.Load()
+
 	// 1. Check custom DNS rules (prefix, suffix, etc.)
-	for _, rule := range tp.dnsConfig.Rules {
+	for _, rule := range rt.dns.Rules {
 		parts := strings.Split(rule, ",")
 		if len(parts) != 2 {
 			continue
@@ -118,33 +83,33 @@ func (tp *TransparentProxy) handleDNSRequest(ctx context.Context, w dns.Response
 		if matched {
 			switch policy {
 			case "DIRECT":
-				tp.resolveDirect(ctx, w, r)
+				tp.resolveDirect(ctx, w, r, rt.dns.LocalNameservers)
 				return
 			case "PROXY":
-				tp.resolveProxy(ctx, w, r)
+				tp.resolveProxy(ctx, w, r, rt.dns.Nameservers, rt.policies.upstream)
 				return
 			}
 		}
 	}
 
 	// 2. Check main rule matcher
-	result := tp.matcher.Match(domain, nil)
-	if result.Policy == config.PolicyProxy {
-		tp.resolveProxy(ctx, w, r)
+	result := tp.match(rt, domain, nil, 0, w.RemoteAddr())
+	if policy, upstream := rt.policies.resolve(result.Policy, domain); policy == config.PolicyProxy {
+		tp.resolveProxy(ctx, w, r, rt.dns.Nameservers, upstream)
 	} else {
-		tp.resolveDirect(ctx, w, r)
+		tp.resolveDirect(ctx, w, r, rt.dns.LocalNameservers)
 	}
 }
 
-func (tp *TransparentProxy) resolveDirect(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
-	if len(tp.dnsConfig.LocalNameservers) == 0 {
+func (tp *TransparentProxy) resolveDirect(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, nameservers []string) {
+	if len(nameservers) == 0 {
 		dns.HandleFailed(w, r)
 		return
 	}
 
 	var reply *dns.Msg
 	var err error
-	for _, ns := range tp.dnsConfig.LocalNameservers {
+	for _, ns := range nameservers {
 		reply, err = tp.exchangeDNSDirect(ctx, r, ns)
 		if err == nil {
 			break
@@ -160,19 +125,20 @@ func (tp *TransparentProxy) resolveDirect(ctx context.Context, w dns.ResponseWri
 	if reply != nil {
 		reply.Id = r.Id
 		w.WriteMsg(reply)
+		tp.domains.storeAnswers(reply)
 	}
 }
 
-func (tp *TransparentProxy) resolveProxy(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
-	if len(tp.dnsConfig.Nameservers) == 0 {
+func (tp *TransparentProxy) resolveProxy(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, nameservers []string, upstream *Upstream) {
+	if len(nameservers) == 0 {
 		dns.HandleFailed(w, r)
 		return
 	}
 
 	var reply *dns.Msg
 	var err error
-	for _, ns := range tp.dnsConfig.Nameservers {
-		reply, err = tp.exchangeDNSProxy(ctx, r, ns)
+	for _, ns := range nameservers {
+		reply, err = tp.exchangeDNSProxy(ctx, r, ns, upstream)
 		if err == nil {
 			break
 		}
@@ -187,6 +153,7 @@ func (tp *TransparentProxy) resolveProxy(ctx context.Context, w dns.ResponseWrit
 	if reply != nil {
 		reply.Id = r.Id
 		w.WriteMsg(reply)
+		tp.domains.storeAnswers(reply)
 	}
 }
 
@@ -205,16 +172,16 @@ func (tp *TransparentProxy) exchangeDNSDirect(ctx context.Context, m *dns.Msg, n
 	return reply, err
 }
 
-func (tp *TransparentProxy) exchangeDNSProxy(ctx context.Context, m *dns.Msg, ns string) (*dns.Msg, error) {
+func (tp *TransparentProxy) exchangeDNSProxy(ctx context.Context, m *dns.Msg, ns string, upstream *Upstream) (*dns.Msg, error) {
 	if _, _, err := net.SplitHostPort(ns); err != nil {
 		ns = net.JoinHostPort(ns, "53")
 	}
 
-	if tp.upstream == nil {
+	if upstream == nil {
 		return nil, fmt.Errorf("no upstream proxy configured for DNS resolution")
 	}
 
-	conn, err := tp.upstream.Connect(ctx, ns)
+	conn, err := upstream.Connect(ctx, ns)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/rules"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DomainCacheTTL is how long a domain learned for an IP is used to match
+	// later connections whose domain cannot be derived in time
+	DomainCacheTTL = 10 * time.Minute
+	// maxCachedDomains bounds the IP to domain cache
+	maxCachedDomains = 16384
+)
+
+// domainCache remembers the domain recently seen for each destination IP,
+// from sniffed connections and DNS answers
+type domainCache struct {
+	mu      sync.RWMutex
+	entries map[netip.Addr]cachedDomain
+}
+
+type cachedDomain struct {
+	domain  string
+	expires time.Time
+}
+
+func newDomainCache() *domainCache {
+	return &domainCache{entries: make(map[netip.Addr]cachedDomain)}
+}
+
+func (c *domainCache) lookup(ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ""
+	}
+	c.mu.RLock()
+	e, ok := c.entries[addr.Unmap()]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(e.expires) {
+		return ""
+	}
+	return e.domain
+}
+
+func (c *domainCache) store(ip net.IP, domain string) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || domain == "" {
+		return
+	}
+	addr = addr.Unmap()
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[addr]; !ok && len(c.entries) >= maxCachedDomains {
+		for a, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, a)
+			}
+		}
+		if len(c.entries) >= maxCachedDomains {
+			return
+		}
+	}
+	c.entries[addr] = cachedDomain{domain: domain, expires: now.Add(DomainCacheTTL)}
+}
+
+// purge drops the expired entries
+func (c *domainCache) purge() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for a, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, a)
+		}
+	}
+}
+
+// storeAnswers records the addresses a DNS reply resolved its question to
+func (c *domainCache) storeAnswers(reply *dns.Msg) {
+	if len(reply.Question) == 0 {
+		return
+	}
+	domain := rules.CanonicalDomain(reply.Question[0].Name)
+	for _, rr := range reply.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			c.store(rr.A, domain)
+		case *dns.AAAA:
+			c.store(rr.AAAA, domain)
+		}
+	}
+}
+
+// lateSniffConn finishes a sniff that ran out of time while the relay reads
+// the client, recording the domain for later connections to the same IP
+type lateSniffConn struct {
+	net.Conn
+	pool  BufferPool
+	buf   []byte // nil once the sniff is over, left to the GC if it never ends
+	ip    net.IP
+	cache *domainCache
+}
+
+func newLateSniffConn(conn net.Conn, pool BufferPool, ip net.IP, cache *domainCache) *lateSniffConn {
+	return &lateSniffConn{Conn: conn, pool: pool, buf: pool.GetSmall()[:0], ip: ip, cache: cache}
+}
+
+func (c *lateSniffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.buf != nil {
+		c.observe(b[:n])
+	}
+	return n, err
+}
+
+func (c *lateSniffConn) observe(data []byte) {
+	c.buf = append(c.buf, data[:min(len(data), SmallBufferSize-len(c.buf))]...)
+	domain, _, done := parseDomain(c.buf)
+	if !done && len(c.buf) < SmallBufferSize {
+		return
+	}
+	c.cache.store(c.ip, domain)
+	c.pool.Put(c.buf)
+	c.buf = nil
+}
+
+func (c *lateSniffConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
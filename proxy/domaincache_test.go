@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDomainCache(t *testing.T) {
+	c := newDomainCache()
+	c.store(net.ParseIP("203.0.113.1"), "example.com")
+	if got := c.lookup(net.IPv4(203, 0, 113, 1).To4()); got != "example.com" {
+		t.Errorf("lookup = %q, want example.com", got)
+	}
+	if got := c.lookup(net.ParseIP("203.0.113.2")); got != "" {
+		t.Errorf("lookup of unknown IP = %q, want empty", got)
+	}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("WWW.Example.ORG.", dns.TypeA)
+	reply.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.org.", Rrtype: dns.TypeCNAME}, Target: "cdn.example.net."},
+		&dns.A{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA}, A: net.ParseIP("198.51.100.7")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP("2001:db8::7")},
+	}
+	c.storeAnswers(reply)
+	for _, ip := range []string{"198.51.100.7", "2001:db8::7"} {
+		if got := c.lookup(net.ParseIP(ip)); got != "www.example.org" {
+			t.Errorf("lookup(%s) = %q, want the queried name", ip, got)
+		}
+	}
+
+	c.entries[netip.MustParseAddr("203.0.113.1")] = cachedDomain{domain: "stale.example", expires: time.Now().Add(-time.Second)}
+	if got := c.lookup(net.ParseIP("203.0.113.1")); got != "" {
+		t.Errorf("lookup of expired entry = %q, want empty", got)
+	}
+
+	c.purge()
+	if _, ok := c.entries[netip.MustParseAddr("203.0.113.1")]; ok || len(c.entries) != 2 {
+		t.Errorf("entries after purge = %v, want only the DNS answers", c.entries)
+	}
+}
+
+func TestLateSniffConn(t *testing.T) {
+	hello := captureClientHello(t, "late.example.com")
+	pool := NewBufferPool()
+	ip := net.ParseIP("192.0.2.10")
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		want   string
+	}{
+		{"split client hello", [][]byte{hello[:20], hello[20:]}, "late.example.com"},
+		{"http", [][]byte{[]byte("GET / HTTP/1.1\r\n"), []byte("Host: web.example:8080\r\n\r\n")}, "web.example"},
+		{"unknown protocol", [][]byte{[]byte("SSH-2.0-OpenSSH\r\n")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newDomainCache()
+			client, server := net.Pipe()
+			var wg sync.WaitGroup
+			wg.Go(func() {
+				for _, c := range tt.chunks {
+					client.Write(c)
+				}
+				client.Close()
+			})
+
+			conn := newLateSniffConn(server, pool, ip, cache)
+			got, err := io.ReadAll(conn)
+			wg.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(bytes.Join(tt.chunks, nil)); len(got) != want {
+				t.Errorf("relayed %d bytes, want %d", len(got), want)
+			}
+			if domain := cache.lookup(ip); domain != tt.want {
+				t.Errorf("cached domain = %q, want %q", domain, tt.want)
+			}
+		})
+	}
+}
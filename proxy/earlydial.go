@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// dialPlan is where a connection is dialed once its rules are matched
+type dialPlan struct {
+	policy   config.Policy // PolicyDirect or PolicyProxy
+	upstream *Upstream     // nil dials target directly
+	target   string        // address dialed, or requested from the upstream
+}
+
+func newDialPlan(policy config.Policy, upstream *Upstream, domain string, dst *net.TCPAddr, targetAddr string) dialPlan {
+	plan := dialPlan{policy: policy, upstream: upstream, target: targetAddr}
+	if policy == config.PolicyProxy && upstream != nil {
+		plan.target = buildUpstreamTargetAddr(domain, dst)
+	}
+	return plan
+}
+
+func (tp *TransparentProxy) dial(ctx context.Context, plan dialPlan) (net.Conn, error) {
+	switch {
+	case plan.upstream == nil:
+		return DirectConnect(ctx, plan.target)
+	case plan.policy == config.PolicyDirect:
+		return plan.upstream.Connect(ctx, plan.target)
+	}
+	start := time.Now()
+	conn, err := plan.upstream.Connect(ctx, plan.target)
+	if err == nil && tp.metrics != nil {
+		tp.metrics.observeConnect(plan.upstream, time.Since(start))
+	}
+	return conn, err
+}
+
+// earlyDial connects to the destination a cached domain routes to while the
+// client is still being sniffed. The connection is used only if the sniffed
+// domain leads to the same plan, saving the sniff time for hot destinations.
+// The match of the cached domain is kept so a sniff confirming it is not
+// matched again.
+type earlyDial struct {
+	rt     *routing
+	domain string
+	result rules.MatchResult
+	plan   dialPlan
+	cancel context.CancelFunc // nil when nothing was dialed
+	done   chan struct{}
+	conn   net.Conn
+	err    error
+	taken  bool
+}
+
+// dialEarly starts dialing for an intercepted connection to dst assuming it
+// is for domain. Nothing is dialed when the rules reject such a connection.
+func (tp *TransparentProxy) dialEarly(ctx context.Context, domain string, dst *net.TCPAddr, src net.Addr) *earlyDial {
+	rt := tp.routing.Load()
+	e := &earlyDial{rt: rt, domain: domain, result: tp.match(rt, domain, dst.IP, dst.Port, src)}
+	policy, upstream := rt.policies.resolve(e.result.Policy, routingKey(domain, dst.IP))
+	policy, upstream = rt.alg.apply(rt.alg.protocol(dst.Port), policy, upstream)
+	if policy == config.PolicyReject {
+		return e
+	}
+
+	ctx, e.cancel = context.WithTimeout(ctx, rt.dialTimeout)
+	e.plan = newDialPlan(policy, upstream, domain, dst, dst.String())
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		e.conn, e.err = tp.dial(ctx, e.plan)
+	}()
+	return e
+}
+
+// dialing reports whether a connection is being dialed
+func (e *earlyDial) dialing() bool {
+	return e != nil && e.cancel != nil
+}
+
+// matched returns the match of the cached domain if the connection turned out
+// to be for domain under the same rules
+func (e *earlyDial) matched(rt *routing, domain string) (rules.MatchResult, bool) {
+	if e == nil || e.rt != rt || e.domain != domain {
+		return rules.MatchResult{}, false
+	}
+	return e.result, true
+}
+
+// take waits for the early connection if it was dialed for plan
+func (e *earlyDial) take(plan dialPlan) (net.Conn, error, bool) {
+	if !e.dialing() || e.plan != plan {
+		return nil, nil, false
+	}
+	<-e.done
+	e.cancel()
+	e.taken = true
+	return e.conn, e.err, true
+}
+
+// release abandons the early connection unless it was taken
+func (e *earlyDial) release() {
+	if !e.dialing() || e.taken {
+		return
+	}
+	e.taken = true
+	e.cancel()
+	go func() {
+		<-e.done
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}()
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestForward_EarlyDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	closed := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	dst := ln.Addr().(*net.TCPAddr)
+	tp := newInboundTestProxy(t, "DOMAIN,blocked.example,REJECT", "MATCH,DIRECT")
+
+	tests := []struct {
+		name    string
+		sniffed string
+		reused  bool
+	}{
+		{"same destination", "hot.example", true},
+		{"other domain with the same plan", "other.example", true},
+		{"rejected", "blocked.example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted.Store(0)
+			pre := tp.dialEarly(t.Context(), "hot.example", dst, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)})
+			if !pre.dialing() {
+				t.Fatal("dialEarly() dialed nothing, want a dial for DIRECT")
+			}
+			<-pre.done // the dial completes while the client is sniffed
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer server.Close()
+				tp.forward(t.Context(), server, "tproxy", tt.sniffed, dst, pre, nil)
+				pre.release()
+			}()
+
+			if tt.reused {
+				expectEcho(t, client)
+			}
+			client.Close()
+			<-done
+
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("early connection left open")
+			}
+			if got := accepted.Load(); got != 1 {
+				t.Errorf("destination accepted %d connections, want 1", got)
+			}
+		})
+	}
+
+	if pre := tp.dialEarly(t.Context(), "blocked.example", dst, nil); pre.dialing() {
+		pre.release()
+		t.Error("dialEarly() for a rejected domain started a dial")
+	}
+}
+
+func TestDialEarly_ALG(t *testing.T) {
+	tp := newTestProxy(t, &config.Config{ALG: config.ALGConfig{Action: config.ALGDirect}}, "MATCH,PROXY")
+	pre := tp.dialEarly(t.Context(), "sip.example", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5060}, nil)
+	defer pre.release()
+	if pre.plan.policy != config.PolicyDirect {
+		t.Errorf("early plan policy = %s, want the DIRECT the ALG routes SIP to", pre.plan.policy)
+	}
+	if result, ok := pre.matched(tp.routing.Load(), "sip.example"); !ok || result.Policy != config.PolicyProxy {
+		t.Errorf("matched() = %v, %v, want the PROXY match kept for forward", result.Policy, ok)
+	}
+	if _, ok := pre.matched(tp.routing.Load(), "other.example"); ok {
+		t.Error("matched() reused the match for another domain")
+	}
+}
+
+// denier refuses every connection when it is accepted
+type denier struct{}
+
+func (denier) OnAccept(*ConnInfo) error                                { return errors.New("denied") }
+func (denier) OnMatch(*ConnInfo) error                                 { return nil }
+func (denier) OnDialed(_ *ConnInfo, server net.Conn) (net.Conn, error) { return server, nil }
+func (denier) OnClose(*ConnInfo, int64, int64)                         {}
+
+func TestHandleConnection_MiddlewareSkipsEarlyDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	dst := ln.Addr().(*net.TCPAddr)
+
+	tp := newInboundTestProxy(t, "MATCH,DIRECT")
+	tp.origDst = fixedOriginalDst{dst}
+	tp.sniffer = NewSniffer(tp.pool, 100*time.Millisecond)
+	tp.domains = newDomainCache()
+	tp.domains.store(dst.IP, "hot.example")
+	tp.middleware = middlewareChain{denier{}}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tp.handleConnection(t.Context(), server)
+	}()
+	// The client sends nothing until the sniff gives up
+	<-done
+	client.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if got := accepted.Load(); got != 0 {
+		t.Errorf("destination accepted %d connections for a connection middleware rejects", got)
+	}
+}
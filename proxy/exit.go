@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxExitResponse bounds the echo endpoint response read
+const maxExitResponse = 4 * KB
+
+// ExitInfo is where the connections of an upstream leave to the internet
+type ExitInfo struct {
+	IP      string    `json:"ip,omitempty"`
+	Country string    `json:"country,omitempty"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"` // of the latest lookup, which kept the previous address
+}
+
+// UpstreamStatus describes a named upstream or direct route
+type UpstreamStatus struct {
+	Name string    `json:"name"`
+	URL  string    `json:"url,omitempty"`
+	Exit *ExitInfo `json:"exit,omitempty"`
+}
+
+// Upstreams lists the upstreams and direct routes with their latest exit lookups
+func (tp *TransparentProxy) Upstreams() []UpstreamStatus {
+	var list []UpstreamStatus
+	tp.routing.Load().policies.eachExit(func(name string, u *Upstream) {
+		s := UpstreamStatus{Name: name, Exit: u.exit.Load()}
+		if len(u.hops) > 0 {
+			s.URL = u.String()
+		}
+		list = append(list, s)
+	})
+	slices.SortFunc(list, func(a, b UpstreamStatus) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// eachExit calls fn for every upstream and direct route
+func (t *policyTable) eachExit(fn func(name string, u *Upstream)) {
+	t.eachUpstream(fn)
+	for name, u := range t.routes {
+		fn(name, u)
+	}
+}
+
+// exitCheckLoop looks up the exits every interval, starting with a lookup if
+// now is set, until the context is cancelled
+func (t *policyTable) exitCheckLoop(ctx context.Context, interval time.Duration, now bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if now {
+		t.checkExits(ctx)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.checkExits(ctx)
+	}
+}
+
+// checkExits looks up every exit concurrently, then lets the groups prefer
+// members by the countries found
+func (t *policyTable) checkExits(ctx context.Context) {
+	var wg sync.WaitGroup
+	t.eachExit(func(name string, u *Upstream) {
+		wg.Go(func() {
+			ip, country, err := t.lookupExit(ctx, u)
+			if ctx.Err() != nil {
+				return
+			}
+			prev := u.exit.Load()
+			info := &ExitInfo{IP: ip, Country: country, Checked: time.Now()}
+			if err != nil {
+				slog.Debug("Exit lookup failed", "upstream", name, "error", err)
+				info.Error = err.Error()
+				if prev != nil {
+					info.IP, info.Country = prev.IP, prev.Country
+				}
+			} else if prev == nil || prev.IP != ip {
+				slog.Info("Upstream exit", "upstream", name, "ip", ip, "country", country)
+			}
+			u.exit.Store(info)
+		})
+	})
+	wg.Wait()
+	if ctx.Err() == nil {
+		t.updatePreferred()
+	}
+}
+
+// lookupExit fetches the echo endpoint through u
+func (t *policyTable) lookupExit(ctx context.Context, u *Upstream) (ip, country string, err error) {
+	client := &http.Client{
+		Timeout: HealthCheckTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return u.Connect(ctx, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.exitURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Accept", "application/json, text/plain")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("exit check returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxExitResponse))
+	if err != nil {
+		return "", "", err
+	}
+
+	addr, country, err := parseExit(body)
+	if err != nil {
+		return "", "", err
+	}
+	if country == "" && t.country != nil {
+		country = t.country(addr)
+	}
+	return addr.String(), country, nil
+}
+
+// parseExit reads an echo endpoint response: a bare address, or JSON naming
+// the address and possibly the country as the common services do
+func parseExit(body []byte) (net.IP, string, error) {
+	text := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(text, "{") {
+		line, _, _ := strings.Cut(text, "\n")
+		if ip := net.ParseIP(strings.TrimSpace(line)); ip != nil {
+			return ip, "", nil
+		}
+		return nil, "", errors.New("exit check response is not an address")
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, "", fmt.Errorf("invalid exit check response: %w", err)
+	}
+	var ip net.IP
+	for _, key := range []string{"ip", "query", "ip_addr"} {
+		if s, ok := fields[key].(string); ok {
+			if ip = net.ParseIP(s); ip != nil {
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return nil, "", errors.New("exit check response names no address")
+	}
+	for _, key := range []string{"country_code", "countryCode", "country_iso", "country"} {
+		if s, ok := fields[key].(string); ok && len(s) == 2 {
+			return ip, strings.ToUpper(s), nil
+		}
+	}
+	return ip, "", nil
+}
+
+// updatePreferred marks the members of groups with prefer_countries whose
+// current exit is in one of them. Members that are groups count with the
+// member they resolve to now.
+func (t *policyTable) updatePreferred() {
+	for _, g := range t.groups {
+		if len(g.preferCountries) == 0 {
+			continue
+		}
+		preferred := make([]bool, len(g.members))
+		for i, m := range g.members {
+			if _, u := t.resolve(m, ""); u != nil {
+				if exit := u.exit.Load(); exit != nil {
+					preferred[i] = slices.Contains(g.preferCountries, exit.Country)
+				}
+			}
+		}
+		g.mu.Lock()
+		g.preferred = preferred
+		g.mu.Unlock()
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestParseExit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		ip      string
+		country string
+		wantErr bool
+	}{
+		{"plain text", "203.0.113.7\n", "203.0.113.7", "", false},
+		{"ipv6", "2001:db8::7", "2001:db8::7", "", false},
+		{"ip.sb", `{"ip":"203.0.113.7","country_code":"JP","country":"Japan"}`, "203.0.113.7", "JP", false},
+		{"ip-api", `{"status":"success","countryCode":"us","query":"198.51.100.1"}`, "198.51.100.1", "US", false},
+		{"no country code", `{"ip":"203.0.113.7","country":"Japan"}`, "203.0.113.7", "", false},
+		{"html", "<html>blocked</html>", "", "", true},
+		{"json without address", `{"country_code":"JP"}`, "", "", true},
+		{"broken json", `{"ip":`, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, country, err := parseExit([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ip.String() != tt.ip || country != tt.country {
+				t.Errorf("parseExit() = %s, %q, want %s, %q", ip, country, tt.ip, tt.country)
+			}
+		})
+	}
+}
+
+// startExitProxy runs an HTTP CONNECT proxy answering every tunneled request
+// itself with body, as an echo endpoint seen from that exit would
+func startExitProxy(t *testing.T, body string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				fmt.Fprint(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestPolicyTable_CheckExits(t *testing.T) {
+	us := startExitProxy(t, `{"ip":"198.51.100.1","country_code":"US"}`)
+	jp := startExitProxy(t, "203.0.113.7")
+
+	table := newTestPolicyTable(t, &config.Config{
+		Proxies: map[string]config.ProxyChain{
+			"us": {{URL: us}},
+			"jp": {{URL: jp}},
+		},
+		ProxyGroups: []config.ProxyGroup{
+			{Name: "Japan", Type: config.GroupURLTest, Proxies: []string{"us", "jp"}, PreferCountries: []string{"jp"}},
+		},
+		ExitCheck: config.ExitCheck{URL: "http://echo.example/"},
+	})
+	table.country = func(ip net.IP) string {
+		if ip.Equal(net.ParseIP("203.0.113.7")) {
+			return "JP"
+		}
+		return ""
+	}
+
+	g := table.groups["Japan"]
+	g.delays, g.probed = []time.Duration{10 * time.Millisecond, 50 * time.Millisecond}, true
+	if got := g.pick(""); got != "us" {
+		t.Fatalf("pick() before exit check = %s, want us", got)
+	}
+
+	table.checkExits(context.Background())
+
+	for name, want := range map[string]string{"us": "US", "jp": "JP"} {
+		exit := table.proxies[name].exit.Load()
+		if exit == nil || exit.Country != want || exit.Error != "" {
+			t.Errorf("%s exit = %+v, want country %s", name, exit, want)
+		}
+	}
+	if got := g.pick(""); got != "jp" {
+		t.Errorf("pick() = %s, want the faster member in JP", got)
+	}
+	g.delays[1] = 0
+	if got := g.pick(""); got != "us" {
+		t.Errorf("pick() with JP down = %s, want us", got)
+	}
+
+	// A failed lookup keeps the previous exit
+	table.exitURL = "http://echo.example:0/%"
+	table.checkExits(context.Background())
+	if exit := table.proxies["jp"].exit.Load(); exit.IP != "203.0.113.7" || exit.Error == "" {
+		t.Errorf("jp exit after failed lookup = %+v", exit)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/rules"
+)
+
+const (
+	// ExplainInterval is how often the rule match of one destination is explained at debug level
+	ExplainInterval = time.Minute
+	// explainPruneSize is the number of tracked destinations above which expired ones are dropped
+	explainPruneSize = 4096
+)
+
+// explainThrottle limits rule match explanations to one per destination per interval
+type explainThrottle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (t *explainThrottle) allow(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.last == nil {
+		t.last = make(map[string]time.Time)
+	}
+	if last, ok := t.last[key]; ok && now.Sub(last) < ExplainInterval {
+		return false
+	}
+	if len(t.last) >= explainPruneSize {
+		for k, last := range t.last {
+			if now.Sub(last) >= ExplainInterval {
+				delete(t.last, k)
+			}
+		}
+	}
+	t.last[key] = now
+	return true
+}
+
+// explainMatch logs at debug level how the rules decided a match
+func (tp *TransparentProxy) explainMatch(rt *routing, md *rules.Metadata, result rules.MatchResult) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	dst := net.JoinHostPort(routingKey(md.Domain, md.DstIP), strconv.Itoa(int(md.DstPort)))
+	if !tp.explained.allow(dst, time.Now()) {
+		return
+	}
+
+	e := rt.matcher.Explain(md, result)
+	attrs := []any{"target", dst, "policy", result.Policy, "evaluated", e.Evaluated}
+	if result.Rule == nil {
+		slog.Debug("No rule matched, using default policy", attrs...)
+		return
+	}
+	attrs = append(attrs, "rule", result.Rule.String())
+	if e.Field != "" {
+		attrs = append(attrs, "field", e.Field, "value", e.Value)
+	}
+	slog.Debug("Rule matched", attrs...)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExplainThrottle(t *testing.T) {
+	var th explainThrottle
+	now := time.Now()
+
+	if !th.allow("example.com:443", now) {
+		t.Fatal("first explanation was throttled")
+	}
+	if th.allow("example.com:443", now.Add(time.Second)) {
+		t.Error("repeated explanation within the interval was allowed")
+	}
+	if !th.allow("other.org:443", now.Add(time.Second)) {
+		t.Error("explanation of another destination was throttled")
+	}
+	if !th.allow("example.com:443", now.Add(ExplainInterval)) {
+		t.Error("explanation after the interval was throttled")
+	}
+
+	for i := range explainPruneSize {
+		th.allow(strconv.Itoa(i), now)
+	}
+	th.allow("late", now.Add(2*ExplainInterval))
+	if n := len(th.last); n > 3 {
+		t.Errorf("tracked destinations after pruning = %d, want at most 3", n)
+	}
+}
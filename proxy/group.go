@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// HealthCheckTimeout bounds a single proxy group health probe
+const HealthCheckTimeout = 5 * time.Second
+
+// UpstreamWaitInterval is how often the upstream is probed while interception
+// waits for it to be healthy
+const UpstreamWaitInterval = 5 * time.Second
+
+var errRejected = errors.New("policy rejects connections")
+
+// policyTable resolves rule policies, including named proxies and proxy
+// groups, to a built-in policy and the upstream that serves it
+type policyTable struct {
+	upstream *Upstream // serves the PROXY policy, nil if unset
+	proxies  map[string]*Upstream
+	routes   map[string]*Upstream // direct routes, serving DIRECT
+	groups   map[string]*proxyGroup
+
+	// exit lookups, disabled without a URL
+	exitURL      string
+	exitInterval time.Duration
+	country      func(net.IP) string // GeoIP country of exits the endpoint did not name
+}
+
+// proxyGroup picks one member per connection, using health check results
+// for fallback, url-test and load-balance groups
+type proxyGroup struct {
+	name     string
+	kind     string
+	members  []config.Policy
+	url      string
+	interval time.Duration
+	selected atomic.Int32 // member used by select groups
+
+	mu     sync.RWMutex
+	delays []time.Duration // latest probe latency per member, 0 when down
+	probed bool
+
+	preferCountries []string
+	preferred       []bool // members whose exit is in preferCountries
+
+	// traffic-class state
+	warmup   time.Duration
+	bulkRate int64
+	bulk     *bulkTargets
+}
+
+func newPolicyTable(cfg *config.Config) *policyTable {
+	t := &policyTable{
+		proxies: make(map[string]*Upstream, len(cfg.ProxyChains)),
+		routes:  make(map[string]*Upstream, len(cfg.DirectRoutes)),
+		groups:  make(map[string]*proxyGroup, len(cfg.ProxyGroups)),
+
+		exitURL:      cfg.ExitCheck.URL,
+		exitInterval: time.Duration(cfg.ExitCheck.Interval) * time.Second,
+	}
+	if len(cfg.UpstreamChain) > 0 {
+		t.upstream = NewUpstream(cfg.UpstreamChain...)
+	}
+	for name, chain := range cfg.ProxyChains {
+		t.proxies[name] = NewUpstream(chain...)
+	}
+	for name, r := range cfg.DirectRoutes {
+		t.routes[name] = newDirectRoute(name, r.Mark)
+	}
+	for _, g := range cfg.ProxyGroups {
+		members := make([]config.Policy, len(g.Proxies))
+		for i, m := range g.Proxies {
+			members[i] = config.Policy(m)
+		}
+		pg := &proxyGroup{
+			name:     g.Name,
+			kind:     g.Type,
+			members:  members,
+			url:      g.URL,
+			interval: time.Duration(g.Interval) * time.Second,
+			delays:   make([]time.Duration, len(members)),
+			warmup:   time.Duration(g.Warmup) * time.Second,
+			bulkRate: int64(g.BulkRate),
+
+			preferCountries: g.PreferCountries,
+		}
+		if g.Type == config.GroupTrafficClass {
+			pg.bulk = newBulkTargets()
+		}
+		t.groups[g.Name] = pg
+	}
+	return t
+}
+
+// resolve follows policy through groups to DIRECT, REJECT or PROXY. For PROXY
+// the upstream is returned, nil meaning none is configured; for DIRECT the
+// direct route, nil meaning the default route. The target keeps load-balance
+// groups sending a destination to the same member.
+func (t *policyTable) resolve(policy config.Policy, target string) (config.Policy, *Upstream) {
+	for {
+		switch policy {
+		case config.PolicyDirect, config.PolicyReject:
+			return policy, nil
+		case config.PolicyProxy:
+			return policy, t.upstream
+		}
+		if u, ok := t.proxies[string(policy)]; ok {
+			return config.PolicyProxy, u
+		}
+		if u, ok := t.routes[string(policy)]; ok {
+			return config.PolicyDirect, u
+		}
+		g, ok := t.groups[string(policy)]
+		if !ok {
+			// Unreachable once rules are validated against the config
+			return config.PolicyDirect, nil
+		}
+		policy = g.pick(target)
+	}
+}
+
+// pick returns the member serving target
+func (g *proxyGroup) pick(target string) config.Policy {
+	switch g.kind {
+	case config.GroupSelect:
+		return g.members[g.selected.Load()]
+	case config.GroupTrafficClass:
+		if g.bulk.contains(target) {
+			return g.members[1]
+		}
+		return g.members[0]
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	// Until the first probe completes every member is assumed healthy
+	if !g.probed {
+		if g.kind == config.GroupLoadBalance {
+			return g.members[hashTarget(target)%uint32(len(g.members))]
+		}
+		return g.members[0]
+	}
+
+	// Healthy members with an exit in prefer_countries win over the others
+	var alive, preferred []int
+	for i, d := range g.delays {
+		if d > 0 {
+			alive = append(alive, i)
+			if g.preferred != nil && g.preferred[i] {
+				preferred = append(preferred, i)
+			}
+		}
+	}
+	if len(alive) == 0 {
+		return g.members[0]
+	}
+	if len(preferred) > 0 {
+		alive = preferred
+	}
+
+	switch g.kind {
+	case config.GroupURLTest:
+		best := alive[0]
+		for _, i := range alive[1:] {
+			if g.delays[i] < g.delays[best] {
+				best = i
+			}
+		}
+		return g.members[best]
+	case config.GroupLoadBalance:
+		return g.members[alive[hashTarget(target)%uint32(len(alive))]]
+	default: // fallback
+		return g.members[alive[0]]
+	}
+}
+
+func hashTarget(target string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return h.Sum32()
+}
+
+// Run health checks groups that need them, watches upstream password files
+// and looks up the upstream exits until the context is cancelled. While idle
+// all run IdleIntervalFactor times less often and keep their last results
+// until the first check.
+func (t *policyTable) Run(ctx context.Context, idle bool) error {
+	scale := time.Duration(1)
+	if idle {
+		scale = IdleIntervalFactor
+	}
+	var wg sync.WaitGroup
+	if t.hasPasswordFiles() {
+		wg.Go(func() { t.credentialLoop(ctx, CredentialCheckInterval*scale) })
+	}
+	for _, g := range t.groups {
+		if g.kind == config.GroupSelect || g.kind == config.GroupTrafficClass {
+			continue
+		}
+		wg.Go(func() { t.healthCheckLoop(ctx, g, g.interval*scale, !idle) })
+	}
+	if t.exitURL != "" {
+		wg.Go(func() { t.exitCheckLoop(ctx, t.exitInterval*scale, !idle) })
+	}
+	wg.Wait()
+	return nil
+}
+
+// healthCheckLoop checks g every interval, starting with a check if now is set
+func (t *policyTable) healthCheckLoop(ctx context.Context, g *proxyGroup, interval time.Duration, now bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if now {
+		t.healthCheck(ctx, g)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		t.healthCheck(ctx, g)
+	}
+}
+
+// healthCheck probes every member of g concurrently and records their latency
+func (t *policyTable) healthCheck(ctx context.Context, g *proxyGroup) {
+	delays := make([]time.Duration, len(g.members))
+	var wg sync.WaitGroup
+	for i, member := range g.members {
+		wg.Go(func() {
+			d, err := t.probe(ctx, member, g.url)
+			if err != nil {
+				slog.Debug("Proxy group member unhealthy", "group", g.name, "member", member, "error", err)
+				return
+			}
+			delays[i] = d
+		})
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	before := g.pick("")
+	g.mu.Lock()
+	g.delays = delays
+	g.probed = true
+	g.mu.Unlock()
+
+	if after := g.pick(""); after != before {
+		slog.Info("Proxy group switched", "group", g.name, "from", before, "to", after)
+	}
+	if !slices.ContainsFunc(delays, func(d time.Duration) bool { return d > 0 }) {
+		slog.Warn("All proxy group members are unhealthy", "group", g.name)
+	}
+}
+
+// WaitUpstreamHealthy fetches url through the PROXY upstream of cfg every
+// UpstreamWaitInterval until it answers or ctx is cancelled
+func WaitUpstreamHealthy(ctx context.Context, cfg *config.Config, url string) error {
+	t := newPolicyTable(cfg)
+	for attempt := 1; ; attempt++ {
+		d, err := t.probe(ctx, config.PolicyProxy, url)
+		if err == nil {
+			slog.Info("Upstream is healthy", "upstream", cfg.Upstream, "delay", d)
+			return nil
+		}
+		if ctx.Err() == nil {
+			slog.Warn("Upstream health check failed, traffic is not intercepted yet", "upstream", cfg.Upstream, "attempt", attempt, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(UpstreamWaitInterval):
+		}
+	}
+}
+
+// probe fetches url through member and returns the round-trip time
+func (t *policyTable) probe(ctx context.Context, member config.Policy, url string) (time.Duration, error) {
+	policy, upstream := t.resolve(member, "")
+	if policy == config.PolicyReject {
+		return 0, errRejected
+	}
+
+	dial := DirectConnect
+	if upstream != nil {
+		dial = upstream.Connect
+	}
+	client := &http.Client{
+		Timeout: HealthCheckTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dial(ctx, addr)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return max(time.Since(start), time.Nanosecond), nil
+}
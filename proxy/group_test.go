@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+func newTestPolicyTable(t *testing.T, cfg *config.Config) *policyTable {
+	t.Helper()
+	cfg.Listen = ":12345"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	return newPolicyTable(cfg)
+}
+
+func TestPolicyTable_Resolve(t *testing.T) {
+	table := newTestPolicyTable(t, &config.Config{
+		Upstream: config.ProxyChain{{URL: "http://default:8080"}},
+		Proxies: map[string]config.ProxyChain{
+			"work":     {{URL: "socks5://work:1080"}},
+			"personal": {{URL: "http://personal:8080"}},
+		},
+		DirectRoutes: map[string]config.DirectRoute{"wan2": {Table: 202}},
+		ProxyGroups: []config.ProxyGroup{
+			{Name: "Office", Type: config.GroupSelect, Proxies: []string{"work", "personal"}},
+			{Name: "Uplink", Type: config.GroupSelect, Proxies: []string{"wan2"}},
+			{Name: "Blocked", Type: config.GroupSelect, Proxies: []string{"reject"}},
+			{Name: "Nested", Type: config.GroupSelect, Proxies: []string{"Office"}},
+		},
+	})
+
+	tests := []struct {
+		policy config.Policy
+		want   config.Policy
+		host   string
+	}{
+		{config.PolicyDirect, config.PolicyDirect, ""},
+		{config.PolicyReject, config.PolicyReject, ""},
+		{config.PolicyProxy, config.PolicyProxy, "default:8080"},
+		{"personal", config.PolicyProxy, "personal:8080"},
+		{"Office", config.PolicyProxy, "work:1080"},
+		{"Blocked", config.PolicyReject, ""},
+		{"Nested", config.PolicyProxy, "work:1080"},
+		{"wan2", config.PolicyDirect, "wan2"},
+		{"Uplink", config.PolicyDirect, "wan2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			policy, upstream := table.resolve(tt.policy, "example.com")
+			if policy != tt.want {
+				t.Fatalf("resolve(%s) policy = %s, want %s", tt.policy, policy, tt.want)
+			}
+			host := ""
+			switch {
+			case upstream == nil:
+			case len(upstream.hops) == 0:
+				host = upstream.String()
+			default:
+				host = upstream.hops[0].URL.Host
+			}
+			if host != tt.host {
+				t.Errorf("resolve(%s) upstream = %q, want %q", tt.policy, host, tt.host)
+			}
+		})
+	}
+}
+
+func TestProxyGroup_Pick(t *testing.T) {
+	members := []config.Policy{"a", "b", "c"}
+	ms := time.Millisecond
+
+	tests := []struct {
+		name   string
+		kind   string
+		delays []time.Duration
+		want   config.Policy
+	}{
+		{"fallback skips dead members", config.GroupFallback, []time.Duration{0, 30 * ms, 10 * ms}, "b"},
+		{"url-test picks fastest", config.GroupURLTest, []time.Duration{50 * ms, 0, 10 * ms}, "c"},
+		{"all dead uses first", config.GroupURLTest, []time.Duration{0, 0, 0}, "a"},
+		{"load-balance avoids dead members", config.GroupLoadBalance, []time.Duration{0, 0, 10 * ms}, "c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &proxyGroup{kind: tt.kind, members: members, delays: tt.delays, probed: true}
+			if got := g.pick("example.com"); got != tt.want {
+				t.Errorf("pick() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("load-balance is sticky per target", func(t *testing.T) {
+		g := &proxyGroup{kind: config.GroupLoadBalance, members: members, delays: make([]time.Duration, 3)}
+		first := g.pick("example.com")
+		for range 10 {
+			if got := g.pick("example.com"); got != first {
+				t.Fatalf("pick() = %s, want %s", got, first)
+			}
+		}
+	})
+}
+
+func TestPolicyTable_HealthCheck(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	// Nothing listens on this port, so the member fails its probe
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadProxy := (&url.URL{Scheme: "http", Host: l.Addr().String()}).String()
+	l.Close()
+
+	table := newTestPolicyTable(t, &config.Config{
+		Proxies: map[string]config.ProxyChain{"dead": {{URL: deadProxy}}},
+		ProxyGroups: []config.ProxyGroup{
+			{Name: "Auto", Type: config.GroupFallback, Proxies: []string{"dead", "DIRECT"}, URL: target.URL},
+		},
+	})
+
+	g := table.groups["Auto"]
+	if got := g.pick(""); got != "dead" {
+		t.Fatalf("pick() before probing = %s, want dead", got)
+	}
+
+	table.healthCheck(context.Background(), g)
+
+	if got := g.pick(""); got != config.PolicyDirect {
+		t.Errorf("pick() after probing = %s, want DIRECT", got)
+	}
+	if g.delays[0] != 0 || g.delays[1] <= 0 {
+		t.Errorf("delays = %v, want [0 >0]", g.delays)
+	}
+}
+
+func TestWaitUpstreamHealthy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	var want atomic.Value
+	want.Store("")
+	up := &config.Config{Listen: ":12345", Upstream: config.ProxyChain{{URL: "http://" + startAuthProxy(t, &want)}}}
+	if err := up.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := WaitUpstreamHealthy(context.Background(), up, target.URL); err != nil {
+		t.Errorf("WaitUpstreamHealthy() with a working upstream error = %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := &config.Config{Listen: ":12345", Upstream: config.ProxyChain{{URL: "http://" + l.Addr().String()}}}
+	l.Close()
+	if err := down.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := WaitUpstreamHealthy(ctx, down, target.URL); err != context.DeadlineExceeded {
+		t.Errorf("WaitUpstreamHealthy() with a down upstream error = %v, want to wait until cancelled", err)
+	}
+}
+
+func TestSelectGroup(t *testing.T) {
+	cfg := &config.Config{
+		Listen:  ":12345",
+		DataDir: t.TempDir(),
+		Proxies: map[string]config.ProxyChain{
+			"work":     {{URL: "socks5://work:1080"}},
+			"personal": {{URL: "http://personal:8080"}},
+		},
+		ProxyGroups: []config.ProxyGroup{
+			{Name: "Office", Type: config.GroupSelect, Proxies: []string{"work", "personal"}},
+			{Name: "Auto", Type: config.GroupFallback, Proxies: []string{"work", "personal"}},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tp, err := NewTransparentProxy(cfg, rules.NewMatcher(nil), NewBufferPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := func(tp *TransparentProxy) string {
+		_, upstream := tp.routing.Load().policies.resolve("Office", "")
+		return upstream.hops[0].URL.Host
+	}
+	if got := selected(tp); got != "work:1080" {
+		t.Fatalf("Office before selecting = %s, want the first member", got)
+	}
+
+	if _, err := tp.SelectGroup("Office", "personal"); err != nil {
+		t.Fatalf("SelectGroup() error = %v", err)
+	}
+	if got := selected(tp); got != "personal:8080" {
+		t.Errorf("Office after selecting = %s, want personal:8080", got)
+	}
+
+	for _, tt := range []struct {
+		group, member string
+		want          error
+	}{
+		{"Missing", "work", ErrUnknownGroup},
+		{"Auto", "work", ErrInvalidSelection},
+		{"Office", "DIRECT", ErrInvalidSelection},
+	} {
+		if _, err := tp.SelectGroup(tt.group, tt.member); !errors.Is(err, tt.want) {
+			t.Errorf("SelectGroup(%s, %s) error = %v, want %v", tt.group, tt.member, err, tt.want)
+		}
+	}
+
+	tp.Reload(cfg, rules.NewMatcher(nil))
+	if got := selected(tp); got != "personal:8080" {
+		t.Errorf("Office after reload = %s, want the selection kept", got)
+	}
+	restarted, err := NewTransparentProxy(cfg, rules.NewMatcher(nil), NewBufferPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := selected(restarted); got != "personal:8080" {
+		t.Errorf("Office after restart = %s, want the persisted selection", got)
+	}
+}
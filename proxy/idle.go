@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatchdog runs onIdle once a relay has gone timeout without traffic.
+// Activity only records the time; the timer re-arms itself for the remainder
+// instead of being reset on every chunk.
+type idleWatchdog struct {
+	start   time.Time
+	last    atomic.Int64 // since start, monotonic
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func watchIdle(timeout time.Duration, onIdle func()) *idleWatchdog {
+	w := &idleWatchdog{start: time.Now(), timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		idle := time.Since(w.start) - time.Duration(w.last.Load())
+		if idle >= w.timeout {
+			onIdle()
+			return
+		}
+		w.timer.Reset(w.timeout - idle)
+	})
+	return w
+}
+
+// touch is the relay hook recording activity
+func (w *idleWatchdog) touch(int) error {
+	w.last.Store(int64(time.Since(w.start)))
+	return nil
+}
+
+func (w *idleWatchdog) stop() {
+	w.timer.Stop()
+}
+
+// copy is io.CopyBuffer recording activity without a relay hook, so the copy
+// keeps its splice and ReadFrom fast paths. It reads under deadlines of half
+// the timeout and records activity after each period that moved data, which
+// keeps an active relay alive and closes an idle one within 1.5 timeouts.
+// from must support read deadlines.
+func (w *idleWatchdog) copy(to, from net.Conn, buf []byte) (int64, error) {
+	var written int64
+	for {
+		from.SetReadDeadline(time.Now().Add(w.timeout / 2))
+		n, err := io.CopyBuffer(to, from, buf)
+		written += n
+		if n > 0 {
+			w.touch(int(n))
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return written, err
+		}
+	}
+}
+
+// connLimiter caps the number of connections handled concurrently
+type connLimiter chan struct{}
+
+func newConnLimiter(max int) connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(connLimiter, max)
+}
+
+// acquire takes a slot without waiting, reporting false when all are in use
+func (l connLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l connLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleWatchdog(t *testing.T) {
+	var fired atomic.Bool
+	w := watchIdle(50*time.Millisecond, func() { fired.Store(true) })
+	defer w.stop()
+
+	// Activity keeps the relay alive past the timeout
+	for range 5 {
+		time.Sleep(20 * time.Millisecond)
+		w.touch(1)
+	}
+	if fired.Load() {
+		t.Fatal("watchdog fired while the relay was active")
+	}
+
+	time.Sleep(120 * time.Millisecond)
+	if !fired.Load() {
+		t.Fatal("watchdog did not fire after the relay went idle")
+	}
+}
+
+// noDeadlineConn fails to set deadlines like a multiplexed stream
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (noDeadlineConn) SetReadDeadline(time.Time) error { return errors.ErrUnsupported }
+
+func TestRelay_IdleTimeout(t *testing.T) {
+	const timeout = 60 * time.Millisecond
+	tests := []struct {
+		name string
+		hook RelayHook
+		wrap func(net.Conn) net.Conn
+	}{
+		{name: "deadlines", wrap: func(c net.Conn) net.Conn { return c }},
+		{name: "hook", hook: func(int) error { return nil }, wrap: func(c net.Conn) net.Conn { return c }},
+		{name: "no deadlines", wrap: func(c net.Conn) net.Conn { return noDeadlineConn{c} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, clientPeer := net.Pipe()
+			server, serverPeer := net.Pipe()
+			defer clientPeer.Close()
+			defer serverPeer.Close()
+			go io.Copy(io.Discard, serverPeer)
+
+			done := make(chan struct{})
+			go func() {
+				Relay(tt.wrap(server), tt.wrap(client), NewBufferPool(), tt.hook, tt.hook, timeout)
+				close(done)
+			}()
+
+			// Traffic in one direction keeps the relay alive past the timeout
+			for range 10 {
+				if _, err := clientPeer.Write([]byte("ping")); err != nil {
+					t.Fatalf("relay closed while active: %v", err)
+				}
+				time.Sleep(timeout / 3)
+			}
+			select {
+			case <-done:
+				t.Fatal("relay closed while active")
+			default:
+			}
+
+			select {
+			case <-done:
+			case <-time.After(3 * timeout):
+				t.Fatal("relay still open after going idle")
+			}
+		})
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2)
+	if !l.acquire() || !l.acquire() {
+		t.Fatal("acquire failed below the limit")
+	}
+	if l.acquire() {
+		t.Fatal("acquire succeeded above the limit")
+	}
+	l.release()
+	if !l.acquire() {
+		t.Fatal("acquire failed after release")
+	}
+
+	var unlimited connLimiter = newConnLimiter(0)
+	for range 10 {
+		if !unlimited.acquire() {
+			t.Fatal("unlimited limiter refused a connection")
+		}
+	}
+	unlimited.release()
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// IdleIntervalFactor stretches the health check and password file intervals
+// while the proxy idles
+const IdleIntervalFactor = 10
+
+// idleMonitor puts the proxy into idle mode once no connection arrived for
+// a while, and wakes it on the next one
+type idleMonitor struct {
+	after   time.Duration
+	conns   atomic.Uint64 // connections seen, counted on the hot path
+	idle    atomic.Bool
+	changed chan struct{} // signaled on every transition
+}
+
+// newIdleMonitor returns nil, never idling, if after is not positive
+func newIdleMonitor(after time.Duration) *idleMonitor {
+	if after <= 0 {
+		return nil
+	}
+	return &idleMonitor{after: after, changed: make(chan struct{}, 1)}
+}
+
+// touch records a new connection, waking the proxy if it idles
+func (m *idleMonitor) touch() {
+	if m == nil {
+		return
+	}
+	m.conns.Add(1)
+	if m.idle.Load() && m.idle.CompareAndSwap(true, false) {
+		slog.Info("Leaving idle mode")
+		m.signal()
+	}
+}
+
+func (m *idleMonitor) isIdle() bool {
+	return m != nil && m.idle.Load()
+}
+
+// transitions signals entering and leaving idle mode, never for a nil monitor
+func (m *idleMonitor) transitions() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	return m.changed
+}
+
+func (m *idleMonitor) signal() {
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run enters idle mode whenever no connection arrived for after, calling
+// release once entered, until the context is cancelled
+func (m *idleMonitor) run(ctx context.Context, release func()) {
+	ticker := time.NewTicker(m.after / 4)
+	defer ticker.Stop()
+
+	seen, quietSince := m.conns.Load(), time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		if n := m.conns.Load(); n != seen {
+			seen, quietSince = n, now
+			continue
+		}
+		if m.idle.Load() || now.Sub(quietSince) < m.after {
+			continue
+		}
+		m.idle.Store(true)
+		// A connection arriving meanwhile saw the proxy awake
+		if m.conns.Load() != seen {
+			m.idle.CompareAndSwap(true, false)
+			continue
+		}
+		slog.Info("Entering idle mode", "quiet_for", now.Sub(quietSince).Round(time.Second))
+		m.signal()
+		release()
+	}
+}
+
+// releaseIdle drops what an idle proxy does not need: expired cached
+// domains, pooled buffers and the memory they held
+func (tp *TransparentProxy) releaseIdle() {
+	tp.domains.purge()
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleMonitor(t *testing.T) {
+	if m := newIdleMonitor(0); m != nil || m.isIdle() || m.transitions() != nil {
+		t.Fatal("newIdleMonitor(0) should never idle")
+	}
+	(*idleMonitor)(nil).touch()
+
+	m := newIdleMonitor(40 * time.Millisecond)
+	released := make(chan struct{}, 4)
+	go m.run(t.Context(), func() { released <- struct{}{} })
+
+	waitTransition := func(wantIdle bool) {
+		t.Helper()
+		select {
+		case <-m.transitions():
+		case <-time.After(time.Second):
+			t.Fatalf("no transition to idle = %v", wantIdle)
+		}
+		if m.isIdle() != wantIdle {
+			t.Fatalf("isIdle() = %v, want %v", m.isIdle(), wantIdle)
+		}
+	}
+
+	// Connections keep the proxy awake
+	for range 8 {
+		m.touch()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.isIdle() {
+		t.Fatal("idle while connections arrive")
+	}
+
+	waitTransition(true)
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("release not called on entering idle mode")
+	}
+
+	m.touch()
+	waitTransition(false)
+	waitTransition(true)
+}
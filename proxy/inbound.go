@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// InboundHandshakeTimeout bounds reading the request of an explicit proxy client
+const InboundHandshakeTimeout = 10 * time.Second
+
+const (
+	socks5RepSucceeded      = 0x00
+	socks5RepFailure        = 0x01
+	socks5RepNotAllowed     = 0x02
+	socks5RepCmdUnsupported = 0x07
+	socks5AuthNoAccepted    = 0xff
+)
+
+// runInbound accepts explicit proxy clients on addr. Their requests name the
+// destination, so connections skip sniffing and go straight to the matcher.
+// The listeners have no authentication, so only local clients and those
+// admitted by gateway_sources are served.
+func (tp *TransparentProxy) runInbound(ctx context.Context, kind, addr string, handle func(context.Context, net.Conn)) error {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	defer listener.Close()
+
+	slog.Info("Explicit proxy listening", "type", kind, "addr", addr)
+	if ip := addrIP(listener.Addr()); ip != nil && !ip.IsLoopback() {
+		if len(tp.sources.IncludeNets) == 0 {
+			slog.Warn("Explicit proxy listens beyond loopback but serves only local clients, set gateway_sources.include to admit LAN hosts", "type", kind, "addr", addr)
+		} else {
+			slog.Warn("Explicit proxy serves unauthenticated clients in gateway_sources", "type", kind, "addr", addr, "include", tp.sources.Include, "exclude", tp.sources.Exclude)
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				if _, ok := err.(net.Error); ok {
+					continue
+				}
+				return err
+			}
+		}
+
+		if !tp.inboundAllowed(conn.RemoteAddr()) {
+			slog.Info("Refusing explicit proxy client outside gateway_sources", "type", kind, "from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		tp.idle.touch()
+		if !tp.limiter.acquire() {
+			slog.Warn("Connection limit reached, refusing connection", "type", kind, "from", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer tp.limiter.release()
+			defer conn.Close()
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// inboundAllowed reports whether an explicit proxy client may connect: local
+// clients always, other hosts only when gateway_sources includes and does not
+// exclude them
+func (tp *TransparentProxy) inboundAllowed(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	contains := func(nets []*net.IPNet) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return contains(tp.sources.IncludeNets) && !contains(tp.sources.ExcludeNets)
+}
+
+// handleHTTPConnect serves an HTTP CONNECT request
+func (tp *TransparentProxy) handleHTTPConnect(ctx context.Context, client net.Conn) {
+	client.SetReadDeadline(time.Now().Add(InboundHandshakeTimeout))
+	br := bufio.NewReader(client)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		slog.Debug("Failed to read HTTP proxy request", "from", client.RemoteAddr(), "error", err)
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(client, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	domain, dst, err := parseTarget(req.Host, 443)
+	if err != nil {
+		io.WriteString(client, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	// Data pipelined after the request was already read into the buffer
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		client = NewPeekedConn(client, append([]byte(nil), buffered...), tp.pool)
+	}
+
+	slog.Debug("New HTTP CONNECT", "from", client.RemoteAddr(), "device", tp.deviceName(client.RemoteAddr()), "to", req.Host)
+
+	tp.forward(ctx, client, "http", domain, dst, nil, func(err error) error {
+		status := "200 Connection Established"
+		var rej *rejection
+		switch {
+		case errors.As(err, &rej) && rej.reason != "":
+			_, werr := io.WriteString(client, httpForbidden(rej.reason))
+			return werr
+		case errors.Is(err, errRejected):
+			status = "403 Forbidden"
+		case err != nil:
+			status = "502 Bad Gateway"
+		}
+		_, werr := io.WriteString(client, "HTTP/1.1 "+status+"\r\n\r\n")
+		return werr
+	})
+}
+
+// handleSOCKS5 serves a SOCKS5 CONNECT request without authentication
+func (tp *TransparentProxy) handleSOCKS5(ctx context.Context, client net.Conn) {
+	client.SetDeadline(time.Now().Add(InboundHandshakeTimeout))
+
+	host, port, err := socks5ReadRequest(client)
+	if err != nil {
+		slog.Debug("SOCKS5 handshake failed", "from", client.RemoteAddr(), "error", err)
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	domain, dst, err := parseTarget(net.JoinHostPort(host, strconv.Itoa(port)), port)
+	if err != nil {
+		socks5Reply(client, socks5RepFailure)
+		return
+	}
+
+	slog.Debug("New SOCKS5 CONNECT", "from", client.RemoteAddr(), "device", tp.deviceName(client.RemoteAddr()), "to", host)
+
+	tp.forward(ctx, client, "socks5", domain, dst, nil, func(err error) error {
+		rep := byte(socks5RepSucceeded)
+		switch {
+		case errors.Is(err, errRejected):
+			rep = socks5RepNotAllowed
+		case err != nil:
+			rep = socks5RepFailure
+		}
+		return socks5Reply(client, rep)
+	})
+}
+
+// socks5ReadRequest negotiates no authentication and reads a CONNECT request
+func socks5ReadRequest(rw io.ReadWriter) (string, int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socks5Version {
+		return "", 0, fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", 0, err
+	}
+	method := byte(socks5AuthNoAccepted)
+	for _, m := range methods {
+		if m == socks5AuthNone {
+			method = socks5AuthNone
+		}
+	}
+	if _, err := rw.Write([]byte{socks5Version, method}); err != nil {
+		return "", 0, err
+	}
+	if method != socks5AuthNone {
+		return "", 0, errors.New("client requires authentication")
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(rw, req); err != nil {
+		return "", 0, err
+	}
+	if req[1] != socks5CmdConnect {
+		socks5Reply(rw, socks5RepCmdUnsupported)
+		return "", 0, fmt.Errorf("unsupported command %d", req[1])
+	}
+	return readSOCKS5Addr(rw)
+}
+
+// socks5Reply sends a reply with an unspecified bound address
+func socks5Reply(w io.Writer, rep byte) error {
+	reply := []byte{socks5Version, rep, 0x00}
+	reply = appendSOCKS5Addr(reply, &net.UDPAddr{IP: net.IPv4zero})
+	_, err := w.Write(reply)
+	return err
+}
+
+// parseTarget splits an explicit proxy destination into a domain or an IP.
+// The returned address has a nil IP when the host is a name.
+func parseTarget(hostport string, defaultPort int) (string, *net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = hostport, strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 || host == "" {
+		return "", nil, fmt.Errorf("invalid target %q", hostport)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return "", &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return host, &net.TCPAddr{Port: port}, nil
+}
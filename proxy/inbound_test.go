@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// newTestProxy returns a proxy for cfg with entries appended to its rules
+func newTestProxy(t *testing.T, cfg *config.Config, entries ...string) *TransparentProxy {
+	t.Helper()
+	cfg.Listen = ":12345"
+	for _, raw := range entries {
+		cfg.Rules = append(cfg.Rules, config.RuleEntry{Raw: raw})
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := rules.ParseRuleEntries(cfg.Rules, cfg.PolicyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &TransparentProxy{pool: NewBufferPool(), schedule: newSchedule(filepath.Join(t.TempDir(), ScheduleFile))}
+	tp.routing.Store(newRouting(cfg, rules.NewMatcher(parsed)))
+	return tp
+}
+
+func newInboundTestProxy(t *testing.T, entries ...string) *TransparentProxy {
+	t.Helper()
+	return newTestProxy(t, &config.Config{}, entries...)
+}
+
+// startEcho runs a TCP server that echoes everything back
+func startEcho(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func expectEcho(t *testing.T, conn io.ReadWriter) {
+	t.Helper()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("echo = %q, want ping", buf)
+	}
+}
+
+func TestHandleHTTPConnect(t *testing.T) {
+	echo := startEcho(t)
+	tp := newInboundTestProxy(t, "DOMAIN,blocked.example,REJECT", "MATCH,DIRECT")
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"direct", echo.String(), http.StatusOK},
+		{"rejected by domain", "blocked.example:443", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				tp.handleHTTPConnect(t.Context(), server)
+			}()
+
+			io.WriteString(client, "CONNECT "+tt.target+" HTTP/1.1\r\nHost: "+tt.target+"\r\n\r\n")
+			br := bufio.NewReader(client)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				expectEcho(t, struct {
+					io.Reader
+					io.Writer
+				}{br, client})
+			}
+		})
+	}
+}
+
+func TestHandleSOCKS5(t *testing.T) {
+	echo := startEcho(t)
+	tp := newInboundTestProxy(t, "DOMAIN,blocked.example,REJECT", "MATCH,DIRECT")
+
+	connect := func(t *testing.T, addr []byte) (net.Conn, byte) {
+		t.Helper()
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tp.handleSOCKS5(t.Context(), server)
+		}()
+
+		client.Write([]byte{socks5Version, 1, socks5AuthNone})
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(client, method); err != nil || method[1] != socks5AuthNone {
+			t.Fatalf("method negotiation = %v, %v", method, err)
+		}
+		client.Write(append([]byte{socks5Version, socks5CmdConnect, 0}, addr...))
+		reply := make([]byte, 3)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readSOCKS5Addr(client); err != nil {
+			t.Fatal(err)
+		}
+		return client, reply[1]
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		client, rep := connect(t, appendSOCKS5Addr(nil, &net.UDPAddr{IP: echo.IP, Port: echo.Port}))
+		defer client.Close()
+		if rep != socks5RepSucceeded {
+			t.Fatalf("reply = %d, want succeeded", rep)
+		}
+		expectEcho(t, client)
+	})
+
+	t.Run("rejected by domain", func(t *testing.T) {
+		name := "blocked.example"
+		addr := append([]byte{socks5AtypDomain, byte(len(name))}, name...)
+		addr = append(addr, 1, 187)
+		client, rep := connect(t, addr)
+		defer client.Close()
+		if rep != socks5RepNotAllowed {
+			t.Fatalf("reply = %d, want not allowed", rep)
+		}
+	})
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in     string
+		domain string
+		ip     string
+		port   int
+		err    bool
+	}{
+		{in: "example.com:8443", domain: "example.com", port: 8443},
+		{in: "example.com", domain: "example.com", port: 443},
+		{in: "1.2.3.4:80", ip: "1.2.3.4", port: 80},
+		{in: "[2001:db8::1]:443", ip: "2001:db8::1", port: 443},
+		{in: "example.com:0", err: true},
+		{in: ":443", err: true},
+	}
+	for _, tt := range tests {
+		domain, dst, err := parseTarget(tt.in, 443)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseTarget(%q) expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTarget(%q) error: %v", tt.in, err)
+			continue
+		}
+		var ip string
+		if dst.IP != nil {
+			ip = dst.IP.String()
+		}
+		if domain != tt.domain || ip != tt.ip || dst.Port != tt.port {
+			t.Errorf("parseTarget(%q) = %q, %s port %d, want %q, %s port %d", tt.in, domain, ip, dst.Port, tt.domain, tt.ip, tt.port)
+		}
+	}
+}
+
+func TestInboundAllowed(t *testing.T) {
+	open := newInboundTestProxy(t, "MATCH,DIRECT")
+	cfg := &config.Config{GatewaySources: config.SourceFilter{
+		Include: []string{"192.168.1.0/24"},
+		Exclude: []string{"192.168.1.10"},
+	}}
+	lan := newTestProxy(t, cfg, "MATCH,DIRECT")
+	lan.sources = cfg.GatewaySources
+
+	tests := []struct {
+		tp   *TransparentProxy
+		ip   string
+		want bool
+	}{
+		{open, "127.0.0.1", true},
+		{open, "::1", true},
+		{open, "192.168.1.20", false},
+		{lan, "127.0.0.1", true},
+		{lan, "192.168.1.20", true},
+		{lan, "192.168.1.10", false},
+		{lan, "203.0.113.1", false},
+	}
+	for _, tt := range tests {
+		if got := tt.tp.inboundAllowed(&net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 40000}); got != tt.want {
+			t.Errorf("inboundAllowed(%s) with include %v = %v, want %v", tt.ip, tt.tp.sources.Include, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// ErrTransferLimit aborts a relay whose connection exceeded a closing transfer limit
+var ErrTransferLimit = errors.New("connection transfer limit exceeded")
+
+// RelayHook is called by Relay with the size of each chunk before it is written.
+// It may block to slow the transfer down or return an error to abort the connection.
+// Both relay directions call it concurrently.
+type RelayHook func(n int) error
+
+// transferMeter applies the transfer limits of one connection to both relay directions
+type transferMeter struct {
+	total  atomic.Int64
+	limits []config.TransferLimit // sorted by After
+}
+
+// newTransferHook returns a hook enforcing the limits that apply to policy, or nil if none do
+func newTransferHook(limits []config.TransferLimit, policy config.Policy) RelayHook {
+	var applicable []config.TransferLimit
+	for _, l := range limits {
+		if l.Policy == "" || l.Policy == policy {
+			applicable = append(applicable, l)
+		}
+	}
+	if len(applicable) == 0 {
+		return nil
+	}
+	slices.SortFunc(applicable, func(a, b config.TransferLimit) int {
+		return cmp.Compare(a.After, b.After)
+	})
+
+	m := &transferMeter{limits: applicable}
+	return m.account
+}
+
+func (m *transferMeter) account(n int) error {
+	total := m.total.Add(int64(n))
+
+	// The highest threshold already crossed decides the current pace
+	var active *config.TransferLimit
+	for i := range m.limits {
+		if total < int64(m.limits[i].After) {
+			break
+		}
+		active = &m.limits[i]
+	}
+	if active == nil {
+		return nil
+	}
+	if active.Rate == 0 {
+		return ErrTransferLimit
+	}
+
+	time.Sleep(time.Duration(float64(n) / float64(active.Rate) * float64(time.Second)))
+	return nil
+}
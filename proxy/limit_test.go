@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestNewTransferHook(t *testing.T) {
+	limits := []config.TransferLimit{
+		{Policy: config.PolicyProxy, After: 100, Rate: 0},
+	}
+
+	if hook := newTransferHook(nil, config.PolicyProxy); hook != nil {
+		t.Error("Expected nil hook without limits")
+	}
+	if hook := newTransferHook(limits, config.PolicyDirect); hook != nil {
+		t.Error("Expected nil hook for a policy without limits")
+	}
+
+	hook := newTransferHook(limits, config.PolicyProxy)
+	if hook == nil {
+		t.Fatal("Expected hook for PROXY")
+	}
+	if err := hook(60); err != nil {
+		t.Fatalf("hook(60) error = %v", err)
+	}
+	if err := hook(60); !errors.Is(err, ErrTransferLimit) {
+		t.Fatalf("hook past threshold error = %v, want ErrTransferLimit", err)
+	}
+}
+
+func TestTransferHook_Throttle(t *testing.T) {
+	hook := newTransferHook([]config.TransferLimit{
+		{After: 10, Rate: 0},
+		{After: 1, Rate: 1000},
+	}, config.PolicyDirect)
+
+	// Limits are applied by threshold regardless of configuration order
+	start := time.Now()
+	if err := hook(5); err != nil {
+		t.Fatalf("hook(5) error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Errorf("Expected throttling of about 5ms, took %v", elapsed)
+	}
+	if err := hook(5); !errors.Is(err, ErrTransferLimit) {
+		t.Errorf("hook past closing threshold error = %v, want ErrTransferLimit", err)
+	}
+}
+
+func TestRelay_TransferLimit(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	server, serverPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer serverPeer.Close()
+
+	hook := newTransferHook([]config.TransferLimit{{After: 4}}, config.PolicyDirect)
+	done := make(chan struct{})
+	go func() {
+		Relay(server, client, NewBufferPool(), hook, hook, 0)
+		close(done)
+	}()
+
+	go clientPeer.Write([]byte("hello"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Relay did not stop after exceeding the transfer limit")
+	}
+
+	serverPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := serverPeer.Read(make([]byte, 8)); n != 0 {
+		t.Errorf("Expected nothing forwarded past the limit, got %d bytes", n)
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/metrics"
+)
+
+// proxyMetrics instruments TCP connections, labeled by the matched policy and rule
+type proxyMetrics struct {
+	registry    *metrics.Registry
+	connections *metrics.CounterVec   // inbound, policy, rule
+	active      *metrics.GaugeVec     // inbound
+	bytes       *metrics.CounterVec   // direction, policy, rule
+	dialErrors  *metrics.CounterVec   // policy
+	connectTime *metrics.HistogramVec // upstream
+
+	// Sampled connection sizes and durations
+	sampleEvery uint64
+	sampleSeq   atomic.Uint64
+	connBytes   *metrics.HistogramVec // direction, policy, rule
+	connTime    *metrics.HistogramVec // policy, rule
+}
+
+// Connection size buckets from 1 KiB to 1 GiB, and durations up to an hour
+var (
+	connBytesBuckets = metrics.ExponentialBuckets(1024, 4, 11)
+	connTimeBuckets  = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+)
+
+// newProxyMetrics records the connection histograms for one in every sampleEvery connections
+func newProxyMetrics(sampleEvery int) *proxyMetrics {
+	reg := metrics.NewRegistry()
+	return &proxyMetrics{
+		registry:    reg,
+		connections: reg.NewCounterVec("tproxy_connections_total", "TCP connections matched by the rules.", "inbound", "policy", "rule"),
+		active:      reg.NewGaugeVec("tproxy_active_relays", "TCP connections being relayed.", "inbound"),
+		bytes:       reg.NewCounterVec("tproxy_relay_bytes_total", "Bytes relayed, up from clients and down to them.", "direction", "policy", "rule"),
+		dialErrors:  reg.NewCounterVec("tproxy_dial_errors_total", "Failed connections to destinations or upstream proxies.", "policy"),
+		connectTime: reg.NewHistogramVec("tproxy_upstream_connect_seconds", "Time to establish a tunnel through an upstream proxy.", metrics.DefBuckets, "upstream"),
+		sampleEvery: uint64(max(sampleEvery, 1)),
+		connBytes:   reg.NewHistogramVec("tproxy_connection_bytes", "Bytes relayed per sampled connection, by direction.", connBytesBuckets, "direction", "policy", "rule"),
+		connTime:    reg.NewHistogramVec("tproxy_connection_duration_seconds", "Relay duration of sampled connections.", connTimeBuckets, "policy", "rule"),
+	}
+}
+
+// sample reports whether the next connection is recorded in the histograms
+func (m *proxyMetrics) sample() bool {
+	return m.sampleSeq.Add(1)%m.sampleEvery == 0
+}
+
+// observeConnection records the size and duration of a sampled connection
+func (m *proxyMetrics) observeConnection(policy, rule string, up, down int64, d time.Duration) {
+	m.connBytes.With("up", policy, rule).Observe(float64(up))
+	m.connBytes.With("down", policy, rule).Observe(float64(down))
+	m.connTime.With(policy, rule).Observe(d.Seconds())
+}
+
+// observeConnect records the latency of a successful upstream CONNECT
+func (m *proxyMetrics) observeConnect(upstream *Upstream, d time.Duration) {
+	m.connectTime.With(upstream.String()).Observe(d.Seconds())
+}
+
+// relayHooks returns byte counting hooks for both directions of a connection.
+// When the connection is sampled, done records its histograms once the relay ends.
+func (m *proxyMetrics) relayHooks(policy, rule string) (up, down RelayHook, done func()) {
+	upBytes := m.bytes.With("up", policy, rule)
+	downBytes := m.bytes.With("down", policy, rule)
+	if !m.sample() {
+		up = func(n int) error {
+			upBytes.Add(int64(n))
+			return nil
+		}
+		down = func(n int) error {
+			downBytes.Add(int64(n))
+			return nil
+		}
+		return up, down, func() {}
+	}
+
+	// Each direction is copied by one goroutine and the relay waits for both
+	var upTotal, downTotal int64
+	start := time.Now()
+	up = func(n int) error {
+		upBytes.Add(int64(n))
+		upTotal += int64(n)
+		return nil
+	}
+	down = func(n int) error {
+		downBytes.Add(int64(n))
+		downTotal += int64(n)
+		return nil
+	}
+	done = func() {
+		m.observeConnection(policy, rule, upTotal, downTotal, time.Since(start))
+	}
+	return up, down, done
+}
+
+// Metrics returns the registry exported on metrics_listen, or nil if metrics are disabled
+func (tp *TransparentProxy) Metrics() *metrics.Registry {
+	if tp.metrics == nil {
+		return nil
+	}
+	return tp.metrics.registry
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// ConnInfo describes a forwarded connection to the middleware
+type ConnInfo struct {
+	Inbound     string // tproxy, http or socks5
+	Source      net.Addr
+	Device      string
+	Destination string // address dialed, host:port
+	Domain      string
+
+	// Set by the rules before OnMatch runs. OnMatch may change Policy to
+	// another rule policy, such as REJECT.
+	Rule   string
+	Policy config.Policy
+}
+
+// Middleware is layered around every forwarded connection. Its hooks run on
+// the connection's goroutine before relaying starts, so they delay the
+// connection and must be quick. An error from a hook rejects the connection
+// like the REJECT policy, with the error as the reason.
+type Middleware interface {
+	// OnAccept runs before the rules are matched
+	OnAccept(info *ConnInfo) error
+	// OnMatch runs once the rules chose info.Policy
+	OnMatch(info *ConnInfo) error
+	// OnDialed runs once the destination is connected and may return a
+	// wrapper of server that sees the data relayed to and from it. The relay
+	// half-closes the wrapper through its CloseWrite method, or else the
+	// connection its NetConn method returns.
+	OnDialed(info *ConnInfo, server net.Conn) (net.Conn, error)
+	// OnClose runs when the relay ends, with the bytes sent and received by the client
+	OnClose(info *ConnInfo, up, down int64)
+}
+
+// BaseMiddleware implements every Middleware hook as a no-op, for embedding
+// in middleware that needs only some of them
+type BaseMiddleware struct{}
+
+func (BaseMiddleware) OnAccept(*ConnInfo) error { return nil }
+func (BaseMiddleware) OnMatch(*ConnInfo) error  { return nil }
+func (BaseMiddleware) OnDialed(_ *ConnInfo, server net.Conn) (net.Conn, error) {
+	return server, nil
+}
+func (BaseMiddleware) OnClose(*ConnInfo, int64, int64) {}
+
+// MiddlewareFactory creates a middleware from the options in its config entry
+type MiddlewareFactory func(options map[string]any) (Middleware, error)
+
+var (
+	middlewareMu        sync.Mutex
+	middlewareFactories = make(map[string]MiddlewareFactory)
+)
+
+// RegisterMiddleware makes a middleware available to the middleware config
+// under name. It is meant to be called from init in a file selected with a
+// build tag, so the middleware is compiled in only on request, and panics if
+// name is already registered.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	if _, ok := middlewareFactories[name]; ok {
+		panic("proxy: middleware " + name + " registered twice")
+	}
+	middlewareFactories[name] = factory
+}
+
+// middlewareChain runs the configured middleware in order
+type middlewareChain []Middleware
+
+func newMiddlewareChain(cfgs []config.MiddlewareConfig) (middlewareChain, error) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	chain := make(middlewareChain, 0, len(cfgs))
+	for _, c := range cfgs {
+		factory, ok := middlewareFactories[c.Name]
+		if !ok {
+			registered := slices.Sorted(maps.Keys(middlewareFactories))
+			return nil, fmt.Errorf("middleware %s is not compiled in (available: %s)", c.Name, strings.Join(registered, ", "))
+		}
+		m, err := factory(c.Options)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", c.Name, err)
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+func (c middlewareChain) accept(info *ConnInfo) error {
+	for _, m := range c {
+		if err := m.OnAccept(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c middlewareChain) match(info *ConnInfo) error {
+	for _, m := range c {
+		if err := m.OnMatch(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialed passes server through every middleware, closing it on an error
+func (c middlewareChain) dialed(info *ConnInfo, server net.Conn) (net.Conn, error) {
+	for _, m := range c {
+		wrapped, err := m.OnDialed(info, server)
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+		server = wrapped
+	}
+	return server, nil
+}
+
+// relayed returns hooks counting the relayed bytes and a function reporting
+// them to every middleware, in reverse order, once the relay ends
+func (c middlewareChain) relayed(info *ConnInfo) (up, down RelayHook, closed func()) {
+	var sent, received atomic.Int64
+	up = func(n int) error { sent.Add(int64(n)); return nil }
+	down = func(n int) error { received.Add(int64(n)); return nil }
+	closed = func() {
+		for _, m := range slices.Backward(c) {
+			m.OnClose(info, sent.Load(), received.Load())
+		}
+	}
+	return up, down, closed
+}
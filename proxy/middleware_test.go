@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// recorder logs the hooks it sees and rejects connections to its block option
+type recorder struct {
+	block string
+	mu    sync.Mutex
+	calls []string
+	done  chan struct{}
+}
+
+func (r *recorder) record(call string) {
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+}
+
+func (r *recorder) OnAccept(info *ConnInfo) error {
+	r.record("accept " + info.Inbound)
+	return nil
+}
+
+func (r *recorder) OnMatch(info *ConnInfo) error {
+	r.record("match " + string(info.Policy))
+	if strings.HasPrefix(info.Destination, r.block+":") {
+		info.Policy = config.PolicyReject
+	}
+	return nil
+}
+
+func (r *recorder) OnDialed(info *ConnInfo, server net.Conn) (net.Conn, error) {
+	r.record("dialed")
+	return server, nil
+}
+
+func (r *recorder) OnClose(info *ConnInfo, up, down int64) {
+	r.record(fmt.Sprintf("close %d %d", up, down))
+	close(r.done)
+}
+
+var lastRecorder *recorder
+
+func init() {
+	RegisterMiddleware("test-recorder", func(options map[string]any) (Middleware, error) {
+		block, _ := options["block"].(string)
+		lastRecorder = &recorder{block: block, done: make(chan struct{})}
+		return lastRecorder, nil
+	})
+	RegisterMiddleware("test-broken", func(map[string]any) (Middleware, error) {
+		return nil, errors.New("broken")
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	echo := startEcho(t)
+	tp := newInboundTestProxy(t, "MATCH,DIRECT")
+	chain, err := newMiddlewareChain([]config.MiddlewareConfig{{Name: "test-recorder", Options: map[string]any{"block": "blocked.example"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.middleware = chain
+
+	connect := func(target string) (*http.Response, io.ReadWriter, net.Conn) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			tp.handleHTTPConnect(t.Context(), server)
+		}()
+		io.WriteString(client, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+		br := bufio.NewReader(client)
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, struct {
+			io.Reader
+			io.Writer
+		}{br, client}, client
+	}
+
+	resp, _, client := connect("blocked.example:443")
+	client.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("blocked status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	rec := lastRecorder
+	rec.mu.Lock()
+	rec.calls = nil
+	rec.mu.Unlock()
+	resp, rw, client := connect(echo.String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	expectEcho(t, rw)
+	client.Close()
+	select {
+	case <-rec.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+	want := []string{"accept http", "match DIRECT", "dialed", "close 4 4"}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if !slices.Equal(rec.calls, want) {
+		t.Errorf("hooks = %q, want %q", rec.calls, want)
+	}
+}
+
+func TestNewMiddlewareChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"missing", "not compiled in"},
+		{"test-broken", "broken"},
+	}
+	for _, tt := range tests {
+		_, err := newMiddlewareChain([]config.MiddlewareConfig{{Name: tt.name}})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("newMiddlewareChain(%s) error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
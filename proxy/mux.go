@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// MuxIdleTimeout closes multiplexed connections without streams
+	MuxIdleTimeout = 90 * time.Second
+	// MuxPingInterval is how long a multiplexed connection may stay silent
+	// before it is health checked with a ping
+	MuxPingInterval = 30 * time.Second
+)
+
+// muxClient opens tunnels through an https proxy as HTTP/2 CONNECT streams,
+// sharing TLS connections between them
+type muxClient struct {
+	addr      string
+	transport *http2.Transport
+}
+
+func newMuxClient(hop config.ProxyHop) *muxClient {
+	tlsConfig := hop.TLS.Clone()
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	return &muxClient{
+		addr: hopAddr(hop.URL),
+		transport: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := hosts.dial(ctx, newBypassDialer(), network, addr)
+				if err != nil {
+					return nil, fmt.Errorf("failed to connect to multiplexed proxy: %w", err)
+				}
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					tcpConn.SetNoDelay(true)
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+				}
+				return tlsConn, nil
+			},
+			IdleConnTimeout: MuxIdleTimeout,
+			ReadIdleTimeout: MuxPingInterval,
+		},
+	}
+}
+
+// connect opens a stream tunneling to targetAddr. ctx bounds only the setup,
+// the stream lives until the returned connection is closed.
+func (c *muxClient) connect(ctx context.Context, user *url.Userinfo, targetAddr string) (net.Conn, error) {
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+
+	pr, pw := io.Pipe()
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: c.addr},
+		Host:   targetAddr,
+		Header: make(http.Header),
+		Body:   pr,
+	}).WithContext(streamCtx)
+	if user != nil {
+		req.Header.Set("Proxy-Authorization", proxyAuthorization(user))
+	}
+
+	resp, err := c.transport.RoundTrip(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("CONNECT failed with status: %s", resp.Status)
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			err = fmt.Errorf("%w: %s", errProxyAuth, resp.Status)
+		}
+	}
+	if err == nil && !stop() {
+		resp.Body.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		stop()
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	return &streamConn{body: resp.Body, pw: pw, cancel: cancel, remote: streamAddr(c.addr)}, nil
+}
+
+// streamConn is a tunnel carried by an HTTP/2 stream. Deadlines are not
+// supported and setting one fails, closing the connection aborts pending
+// reads and writes.
+type streamConn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	remote net.Addr
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.body.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.pw.Write(b) }
+
+// CloseWrite ends the request body, half-closing the stream
+func (c *streamConn) CloseWrite() error { return c.pw.Close() }
+
+// Close resets the stream
+func (c *streamConn) Close() error {
+	c.cancel()
+	c.pw.CloseWithError(net.ErrClosed)
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return streamAddr("") }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+// streamAddr is the proxy address of a stream
+type streamAddr string
+
+func (a streamAddr) Network() string { return "h2" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// NeighborRefreshInterval is how long a neighbor table snapshot is trusted
+	NeighborRefreshInterval = 5 * time.Second
+	// NeighborMissRefreshInterval limits table dumps triggered by unknown clients
+	NeighborMissRefreshInterval = time.Second
+)
+
+// neighborTable resolves client MAC addresses from the kernel neighbor (ARP/NDP) table
+type neighborTable struct {
+	mu        sync.Mutex
+	entries   map[string]net.HardwareAddr
+	refreshed time.Time
+}
+
+func newNeighborTable() *neighborTable {
+	return &neighborTable{entries: make(map[string]net.HardwareAddr)}
+}
+
+// Lookup returns the MAC address of a directly connected client, or nil if unknown
+func (t *neighborTable) Lookup(ip net.IP) net.HardwareAddr {
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+	key := ip.String()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	age := time.Since(t.refreshed)
+	mac, ok := t.entries[key]
+	if ok && age < NeighborRefreshInterval {
+		return mac
+	}
+	if !ok && age < NeighborMissRefreshInterval {
+		return nil
+	}
+
+	t.refresh()
+	return t.entries[key]
+}
+
+// refresh reloads the neighbor table; must be called with mu held
+func (t *neighborTable) refresh() {
+	t.refreshed = time.Now()
+
+	entries, err := listNeighbors()
+	if err != nil {
+		slog.Debug("Failed to list neighbors", "error", err)
+		return
+	}
+	t.entries = entries
+}
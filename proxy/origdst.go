@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+const (
+	// SO_ORIGINAL_DST returns the pre-NAT destination of a REDIRECTed IPv4 socket
+	SO_ORIGINAL_DST = 80
+	// IP6T_SO_ORIGINAL_DST is the IPv6 version of SO_ORIGINAL_DST
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// OriginalDst recovers the destination a client intended to reach before its
+// traffic was intercepted, independently of the interception backend
+type OriginalDst interface {
+	// TCP returns the original destination of an accepted connection
+	TCP(conn net.Conn) (*net.TCPAddr, error)
+	// UDP returns the original destination from a datagram's control messages
+	UDP(oob []byte) (*net.UDPAddr, error)
+}
+
+// NewOriginalDst returns the resolver for the given interception mode
+func NewOriginalDst(mode string) (OriginalDst, error) {
+	switch mode {
+	case config.ModeTProxy:
+		return tproxyOriginalDst{}, nil
+	case config.ModeRedirect:
+		return redirectOriginalDst{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported interception mode: %s", mode)
+	}
+}
+
+// tproxyOriginalDst reads destinations preserved by TPROXY: the local address of
+// accepted sockets and IP_RECVORIGDSTADDR control messages for datagrams
+type tproxyOriginalDst struct{}
+
+func (tproxyOriginalDst) TCP(conn net.Conn) (*net.TCPAddr, error) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("not a TCP address: %T", conn.LocalAddr())
+	}
+	return addr, nil
+}
+
+func (tproxyOriginalDst) UDP(oob []byte) (*net.UDPAddr, error) {
+	return parseOrigDstAddr(oob)
+}
+
+// redirectOriginalDst queries conntrack via SO_ORIGINAL_DST for NAT REDIRECT setups
+type redirectOriginalDst struct{}
+
+func (redirectOriginalDst) TCP(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection does not expose a file descriptor: %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	isIPv6 := local != nil && local.IP.To4() == nil
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		addr, sockErr = getsockoptOriginalDst(int(fd), isIPv6)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+func (redirectOriginalDst) UDP([]byte) (*net.UDPAddr, error) {
+	return nil, errors.New("UDP interception requires tproxy mode")
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func buildCmsg(level, typ int, data []byte) []byte {
+	buf := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&buf[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(buf[syscall.CmsgLen(0):], data)
+	return buf
+}
+
+func TestParseOrigDstAddr(t *testing.T) {
+	// struct sockaddr_in: family, port (big endian), addr, zero padding
+	sa4 := []byte{2, 0, 0x01, 0xbb, 192, 0, 2, 7, 0, 0, 0, 0, 0, 0, 0, 0}
+	addr, err := parseOrigDstAddr(buildCmsg(syscall.IPPROTO_IP, IP_RECVORIGDSTADDR, sa4))
+	if err != nil {
+		t.Fatalf("parseOrigDstAddr() error = %v", err)
+	}
+	if addr.String() != "192.0.2.7:443" {
+		t.Errorf("addr = %v, want 192.0.2.7:443", addr)
+	}
+
+	// struct sockaddr_in6: family, port, flowinfo, addr, scope id
+	sa6 := make([]byte, 28)
+	sa6[2], sa6[3] = 0x00, 0x35
+	copy(sa6[8:24], net.ParseIP("2001:db8::1"))
+	addr, err = parseOrigDstAddr(buildCmsg(syscall.IPPROTO_IPV6, IPV6_RECVORIGDSTADDR, sa6))
+	if err != nil {
+		t.Fatalf("parseOrigDstAddr() error = %v", err)
+	}
+	if addr.String() != "[2001:db8::1]:53" {
+		t.Errorf("addr = %v, want [2001:db8::1]:53", addr)
+	}
+
+	if _, err := parseOrigDstAddr(nil); err == nil {
+		t.Error("Expected error without control messages")
+	}
+}
+
+func TestTProxyOriginalDst_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resolver, err := NewOriginalDst("tproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := resolver.TCP(conn)
+	if err != nil {
+		t.Fatalf("TCP() error = %v", err)
+	}
+	if addr.String() != listener.Addr().String() {
+		t.Errorf("TCP() = %v, want local address %v", addr, listener.Addr())
+	}
+}
+
+func TestNewOriginalDst(t *testing.T) {
+	for _, mode := range []string{"tproxy", "redirect"} {
+		if _, err := NewOriginalDst(mode); err != nil {
+			t.Errorf("NewOriginalDst(%q) error = %v", mode, err)
+		}
+	}
+	if _, err := NewOriginalDst("tun"); err == nil {
+		t.Error("Expected error for unsupported mode")
+	}
+
+	redirect, _ := NewOriginalDst("redirect")
+	if _, err := redirect.UDP(nil); err == nil {
+		t.Error("Expected redirect mode to reject UDP")
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"slices"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// plaintextInspectLimit bounds how many client bytes are inspected for
+// plaintext protocols, later traffic is relayed untouched
+const plaintextInspectLimit = 4096
+
+// plaintextStandardPorts are the ports where a plaintext protocol is expected.
+// POP3 logs in with the same USER command as FTP.
+var plaintextStandardPorts = map[string][]int{
+	"http": {80},
+	"ftp":  {21, 110},
+	"smtp": {25},
+}
+
+// errPlaintext aborts the relay of a rejected plaintext connection
+var errPlaintext = errors.New("plaintext protocol on non-standard port")
+
+// plaintextConn inspects the first bytes a client sends for a plaintext
+// protocol. FTP and SMTP servers speak first, so they are recognized by the
+// client commands sent before any STARTTLS or AUTH TLS upgrade.
+type plaintextConn struct {
+	net.Conn
+	port      int
+	ignore    []int
+	inspected int // -1 once inspection is over
+	// detected is called with the protocol found and returns whether to abort
+	detected func(protocol string) bool
+}
+
+func newPlaintextConn(conn net.Conn, cfg config.PlaintextConfig, port int, detected func(protocol string) bool) *plaintextConn {
+	return &plaintextConn{Conn: conn, port: port, ignore: cfg.IgnorePorts, detected: detected}
+}
+
+func (c *plaintextConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.inspected >= 0 {
+		if protocol := c.inspect(b[:n]); protocol != "" && c.detected(protocol) {
+			return 0, errPlaintext
+		}
+	}
+	return n, err
+}
+
+func (c *plaintextConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// inspect returns the plaintext protocol data reveals on a non-standard port
+func (c *plaintextConn) inspect(data []byte) string {
+	first := c.inspected == 0
+	if c.inspected += len(data); c.inspected >= plaintextInspectLimit {
+		c.inspected = -1
+	}
+
+	protocol := ""
+	switch {
+	case first && data[0] == 0x16:
+		c.inspected = -1
+		return ""
+	case first && isHTTPRequest(data):
+		protocol = "http"
+	default:
+	lines:
+		for line := range bytes.Lines(data) {
+			switch {
+			case hasPrefixFold(line, "STARTTLS"), hasPrefixFold(line, "AUTH TLS"), hasPrefixFold(line, "AUTH SSL"):
+				c.inspected = -1
+				return ""
+			case hasPrefixFold(line, "MAIL FROM:"), hasPrefixFold(line, "AUTH "):
+				protocol = "smtp"
+				break lines
+			case hasPrefixFold(line, "USER "):
+				protocol = "ftp"
+				break lines
+			}
+		}
+	}
+	if protocol == "" {
+		return ""
+	}
+	c.inspected = -1
+	if slices.Contains(plaintextStandardPorts[protocol], c.port) || slices.Contains(c.ignore, c.port) {
+		return ""
+	}
+	return protocol
+}
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// isHTTPRequest reports whether data starts with an HTTP/1 request line
+func isHTTPRequest(data []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(data, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && bytes.EqualFold(b[:len(prefix)], []byte(prefix))
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestPlaintextConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		ignore []int
+		chunks []string
+		want   string
+	}{
+		{"http on standard port", 80, nil, []string{"GET / HTTP/1.1\r\n\r\n"}, ""},
+		{"http on other port", 8080, nil, []string{"GET / HTTP/1.1\r\n\r\n"}, "http"},
+		{"ignored port", 8080, []int{8080}, []string{"GET / HTTP/1.1\r\n\r\n"}, ""},
+		{"tls", 8443, nil, []string{"\x16\x03\x01\x00\x05", "USER alice\r\n"}, ""},
+		{"smtp mail", 2525, nil, []string{"EHLO client\r\n", "MAIL FROM:<a@example.com>\r\n"}, "smtp"},
+		{"smtp auth", 587, nil, []string{"EHLO client\r\nAUTH PLAIN AGFsaWNl\r\n"}, "smtp"},
+		{"smtp starttls", 587, nil, []string{"EHLO client\r\n", "STARTTLS\r\n", "MAIL FROM:<a@example.com>\r\n"}, ""},
+		{"smtp helo is not http", 25, nil, []string{"HELO client\r\n", "MAIL FROM:<a@example.com>\r\n"}, ""},
+		{"ftp", 2121, nil, []string{"user alice\r\n"}, "ftp"},
+		{"ftp auth tls", 2121, nil, []string{"AUTH TLS\r\n", "USER alice\r\n"}, ""},
+		{"ssh", 2222, nil, []string{"SSH-2.0-OpenSSH_9.6\r\n"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				for _, c := range tt.chunks {
+					io.WriteString(client, c)
+				}
+				client.Close()
+			}()
+
+			var got string
+			conn := newPlaintextConn(server, config.PlaintextConfig{IgnorePorts: tt.ignore}, tt.port, func(protocol string) bool {
+				got = protocol
+				return true
+			})
+			_, err := io.ReadAll(conn)
+			if got != tt.want {
+				t.Errorf("detected = %q, want %q", got, tt.want)
+			}
+			if (tt.want != "") != errors.Is(err, errPlaintext) {
+				t.Errorf("read error = %v, want abort only when detected", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// QoSBurst is how long a direction may stay below its cap and still send the
+// unused share at once, so short exchanges on a quiet link are not delayed
+const QoSBurst = 50 * time.Millisecond
+
+// qos paces relays to the download and upload caps, dividing each between
+// traffic classes by weight
+type qos struct {
+	up, down *shaper
+	weights  map[string]int // by rule string or policy
+}
+
+// newQoS returns nil when no cap is configured
+func newQoS(cfg *config.Config) (*qos, error) {
+	c := cfg.QoS
+	if c.Download == 0 && c.Upload == 0 {
+		return nil, nil
+	}
+	q := &qos{
+		up:      newShaper(int64(c.Upload)),
+		down:    newShaper(int64(c.Download)),
+		weights: make(map[string]int, len(c.Weights)),
+	}
+	for key, w := range c.Weights {
+		if strings.Contains(key, ",") {
+			parsed, err := rules.ParseRuleEntries([]config.RuleEntry{{Raw: key}}, cfg.PolicyNames())
+			if err != nil {
+				return nil, fmt.Errorf("qos: weight of %q: %w", key, err)
+			}
+			key = parsed[0].String()
+		}
+		q.weights[key] = w
+	}
+	return q, nil
+}
+
+// class returns the traffic class of a connection: its rule if weighted,
+// then its policy, then the default class
+func (q *qos) class(rule string, policy config.Policy) (string, int) {
+	if w, ok := q.weights[rule]; ok {
+		return rule, w
+	}
+	if w, ok := q.weights[string(policy)]; ok {
+		return string(policy), w
+	}
+	return "", config.DefaultQoSWeight
+}
+
+// hooks returns the relay hooks pacing a connection in its class, nil for
+// uncapped directions
+func (q *qos) hooks(rule string, policy config.Policy) (up, down RelayHook) {
+	if q == nil {
+		return nil, nil
+	}
+	class, weight := q.class(rule, policy)
+	return q.up.hook(class, weight), q.down.hook(class, weight)
+}
+
+// shaper sends chunks at a fixed rate. While they have to wait, chunks are
+// served in the order of their finish tags (self-clocked fair queueing), so
+// each class gets bandwidth in proportion to its weight however many
+// connections it has.
+type shaper struct {
+	perByte float64 // nanoseconds per byte at the cap
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	free    time.Time // when the chunks granted so far are sent at the cap
+	vtime   float64   // finish tag of the chunk served last
+	seq     uint64
+	queue   shaperQueue
+	flows   map[string]*shaperFlow
+	pending bool // timer armed to serve the queue
+}
+
+type shaperFlow struct {
+	weight float64
+	finish float64 // tag of its last queued chunk
+}
+
+type shaperRequest struct {
+	n     int
+	tag   float64
+	seq   uint64 // orders equal tags by arrival
+	ready chan struct{}
+}
+
+// newShaper returns nil for an unlimited rate
+func newShaper(rate int64) *shaper {
+	if rate <= 0 {
+		return nil
+	}
+	s := &shaper{perByte: float64(time.Second) / float64(rate), flows: make(map[string]*shaperFlow)}
+	s.timer = time.AfterFunc(time.Hour, s.dispatch)
+	s.timer.Stop()
+	return s
+}
+
+func (s *shaper) hook(class string, weight int) RelayHook {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	f, ok := s.flows[class]
+	if !ok {
+		f = &shaperFlow{weight: float64(weight)}
+		s.flows[class] = f
+	}
+	s.mu.Unlock()
+	return func(n int) error {
+		s.wait(f, n)
+		return nil
+	}
+}
+
+// wait blocks until n bytes of f may be sent
+func (s *shaper) wait(f *shaperFlow, n int) {
+	s.mu.Lock()
+	now := time.Now()
+	if len(s.queue) == 0 && !s.free.After(now) {
+		s.grant(n, now)
+		s.mu.Unlock()
+		return
+	}
+	f.finish = max(f.finish, s.vtime) + float64(n)/f.weight
+	s.seq++
+	r := &shaperRequest{n: n, tag: f.finish, seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.queue, r)
+	if !s.pending {
+		s.pending = true
+		s.timer.Reset(s.free.Sub(now))
+	}
+	s.mu.Unlock()
+	<-r.ready
+}
+
+// dispatch serves the queued chunks the cap allows now and rearms the timer
+// for the rest
+func (s *shaper) dispatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for len(s.queue) > 0 && !s.free.After(now) {
+		r := heap.Pop(&s.queue).(*shaperRequest)
+		s.vtime = r.tag
+		s.grant(r.n, now)
+		close(r.ready)
+	}
+	if len(s.queue) > 0 {
+		s.timer.Reset(s.free.Sub(now))
+	} else {
+		s.pending = false
+	}
+}
+
+// grant accounts n bytes sent at the cap, crediting at most QoSBurst of
+// unused time
+func (s *shaper) grant(n int, now time.Time) {
+	if earliest := now.Add(-QoSBurst); s.free.Before(earliest) {
+		s.free = earliest
+	}
+	s.free = s.free.Add(time.Duration(float64(n) * s.perByte))
+}
+
+// shaperQueue is a min-heap of requests by finish tag
+type shaperQueue []*shaperRequest
+
+func (q shaperQueue) Len() int { return len(q) }
+func (q shaperQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+func (q shaperQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *shaperQueue) Push(x any)   { *q = append(*q, x.(*shaperRequest)) }
+func (q *shaperQueue) Pop() any {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return r
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestShaper_Rate(t *testing.T) {
+	const rate = 1 << 20
+	hook := newShaper(rate).hook("", 1)
+	start := time.Now()
+	for range 32 {
+		hook(8 << 10)
+	}
+	// 256 KiB at 1 MiB/s, less the burst sent at once
+	want := 256*time.Second/1024 - QoSBurst
+	if elapsed := time.Since(start); elapsed < want-20*time.Millisecond || elapsed > 2*want {
+		t.Errorf("sending 256 KiB took %v, want about %v", elapsed, want)
+	}
+}
+
+func TestShaper_Weights(t *testing.T) {
+	s := newShaper(4 << 20)
+	var interactive, bulk atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	send := func(hook RelayHook, sent *atomic.Int64) {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			hook(16 << 10)
+			sent.Add(16 << 10)
+		}
+	}
+	wg.Go(func() { send(s.hook("interactive", 4), &interactive) })
+	// Several bulk connections share one class
+	for range 3 {
+		wg.Go(func() { send(s.hook("bulk", 1), &bulk) })
+	}
+	// Skip the burst allowed at the start
+	time.Sleep(100 * time.Millisecond)
+	i0, b0 := interactive.Load(), bulk.Load()
+	time.Sleep(400 * time.Millisecond)
+	i, b := interactive.Load()-i0, bulk.Load()-b0
+	close(stop)
+	wg.Wait()
+
+	if ratio := float64(i) / float64(b); ratio < 3 || ratio > 5 {
+		t.Errorf("interactive/bulk = %d/%d = %.1f, want about 4", i, b, ratio)
+	}
+}
+
+func TestQoS_Class(t *testing.T) {
+	q, err := newQoS(&config.Config{
+		ProxyGroups: []config.ProxyGroup{{Name: "meetings"}},
+		QoS: config.QoS{Download: 1 << 20, Weights: map[string]int{
+			"domain-suffix,zoom.us,meetings": 8,
+			"DIRECT":                         4,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule   string
+		policy config.Policy
+		class  string
+		weight int
+	}{
+		{"DOMAIN-SUFFIX,zoom.us,meetings", "meetings", "DOMAIN-SUFFIX,zoom.us,meetings", 8},
+		{"MATCH,DIRECT", config.PolicyDirect, "DIRECT", 4},
+		{"MATCH,PROXY", config.PolicyProxy, "", config.DefaultQoSWeight},
+	}
+	for _, tt := range tests {
+		if class, weight := q.class(tt.rule, tt.policy); class != tt.class || weight != tt.weight {
+			t.Errorf("class(%s) = %q, %d, want %q, %d", tt.rule, class, weight, tt.class, tt.weight)
+		}
+	}
+	if up, down := q.hooks("MATCH,PROXY", config.PolicyProxy); up != nil || down == nil {
+		t.Error("Expected only the download direction to be paced")
+	}
+
+	if q, err := newQoS(&config.Config{}); q != nil || err != nil {
+		t.Errorf("newQoS() without caps = %v, %v, want nil", q, err)
+	}
+	if _, err := newQoS(&config.Config{QoS: config.QoS{Upload: 1, Weights: map[string]int{"BOGUS,x,DIRECT": 1}}}); err == nil {
+		t.Error("Expected error for an invalid rule weight")
+	}
+}
+
+func TestForward_QoSRuleWeight(t *testing.T) {
+	weighted, other := startEcho(t), startEcho(t)
+	// The weighted server is reached by name so that a rule tells it from the other
+	rule := "DOMAIN,localhost,DIRECT"
+	cfg := &config.Config{QoS: config.QoS{Download: 4 << 20, Weights: map[string]int{rule: 4}}}
+	tp := newTestProxy(t, cfg, rule, "MATCH,DIRECT")
+	// Without the API, metrics or middleware, only qos needs the matched rule
+	var err error
+	if tp.qos, err = newQoS(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := func(host string, port int) net.Conn {
+		client, server := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		go func() {
+			defer server.Close()
+			tp.handleSOCKS5(t.Context(), server)
+		}()
+		client.Write([]byte{socks5Version, 1, socks5AuthNone})
+		io.ReadFull(client, make([]byte, 2))
+		client.Write(append([]byte{socks5Version, socks5CmdConnect, 0}, appendSOCKS5Host(nil, host, port)...))
+		io.ReadFull(client, make([]byte, 3))
+		readSOCKS5Addr(client)
+		return client
+	}
+	var fast, slow atomic.Int64
+	pump := func(conn net.Conn, received *atomic.Int64) {
+		go func() {
+			chunk := make([]byte, 16<<10)
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			buf := make([]byte, 16<<10)
+			for {
+				n, err := conn.Read(buf)
+				received.Add(int64(n))
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	pump(connect("localhost", weighted.Port), &fast)
+	pump(connect(other.IP.String(), other.Port), &slow)
+
+	// Skip the burst allowed at the start
+	time.Sleep(100 * time.Millisecond)
+	f0, s0 := fast.Load(), slow.Load()
+	time.Sleep(400 * time.Millisecond)
+	f, s := fast.Load()-f0, slow.Load()-s0
+
+	if ratio := float64(f) / float64(s); ratio < 2.5 || ratio > 6 {
+		t.Errorf("weighted/default = %d/%d = %.1f, want about 4", f, s, ratio)
+	}
+}
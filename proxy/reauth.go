@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// ReauthRetryInterval is how long a failed credential renewal is not retried
+const ReauthRetryInterval = 30 * time.Second
+
+// DeviceFlowRequestTimeout bounds each request to the OAuth endpoints
+const DeviceFlowRequestTimeout = 30 * time.Second
+
+// errProxyAuth is returned when a proxy rejects the credentials offered
+var errProxyAuth = errors.New("proxy authentication failed")
+
+// authError is a rejection of the credentials user sent to hop
+type authError struct {
+	hop  int
+	user *url.Userinfo
+	err  error
+}
+
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
+
+// authFailure marks err as the rejection of user by hop i if the proxy refused
+// the credentials
+func authFailure(i int, user *url.Userinfo, err error) error {
+	if !errors.Is(err, errProxyAuth) {
+		return err
+	}
+	return &authError{hop: i, user: user, err: err}
+}
+
+// renew obtains new credentials after the proxy rejected used, waiting until
+// they are stored or ctx ends. Connections rejected together share a single
+// renewal, which goes on when they give up so later connections can use its
+// result, and a failed renewal is not repeated for ReauthRetryInterval.
+func (c *hopCredentials) renew(ctx context.Context, used *url.Userinfo, proxy string) error {
+	c.renewMu.Lock()
+	if c.user.Load() != used {
+		// Renewed since the rejected connection loaded them
+		c.renewMu.Unlock()
+		return nil
+	}
+	if c.renewing == nil {
+		if c.renewErr != nil && time.Since(c.renewed) < ReauthRetryInterval {
+			err := c.renewErr
+			c.renewMu.Unlock()
+			return err
+		}
+		slog.Info("Upstream rejected its credentials, renewing them", "upstream", proxy)
+		c.renewing = make(chan struct{})
+		go c.runRenewal(proxy, c.renewing, c.refreshToken)
+	}
+	done := c.renewing
+	c.renewMu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	return c.renewErr
+}
+
+// runRenewal obtains and stores new credentials, then closes done
+func (c *hopCredentials) runRenewal(proxy string, done chan struct{}, refreshToken string) {
+	var password string
+	var err error
+	if c.reauth.DeviceFlow != nil {
+		password, refreshToken, err = deviceFlowToken(c.reauth.DeviceFlow, refreshToken, proxy)
+	} else {
+		password, err = runReauthCommand(c.reauth)
+	}
+
+	c.renewMu.Lock()
+	if err == nil {
+		username := ""
+		if current := c.user.Load(); current != nil {
+			username = current.Username()
+		}
+		c.user.Store(url.UserPassword(username, password))
+		c.refreshToken = refreshToken
+		slog.Info("Upstream credentials renewed", "upstream", proxy)
+	} else {
+		slog.Warn("Failed to renew upstream credentials", "upstream", proxy, "error", err)
+	}
+	c.renewErr, c.renewed, c.renewing = err, time.Now(), nil
+	c.renewMu.Unlock()
+	close(done)
+}
+
+// keepRenewed carries the credentials renewed by the upstreams of old over to
+// the same upstreams of t, so a reload does not ask for another login
+func (t *policyTable) keepRenewed(old *policyTable) {
+	prev := make(map[string]*Upstream)
+	old.eachUpstream(func(name string, u *Upstream) { prev[name] = u })
+	t.eachUpstream(func(name string, u *Upstream) {
+		p := prev[name]
+		if p == nil || p.String() != u.String() {
+			return
+		}
+		for i, c := range u.creds {
+			if c.reauth == nil || p.creds[i].reauth == nil {
+				continue
+			}
+			o := p.creds[i]
+			o.renewMu.Lock()
+			if !o.renewed.IsZero() {
+				c.user.Store(o.user.Load())
+				c.refreshToken = o.refreshToken
+			}
+			o.renewMu.Unlock()
+		}
+	})
+}
+
+// runReauthCommand runs the reauth command and returns the password it prints
+func runReauthCommand(r *config.Reauth) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout)*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, r.Command[0], r.Command[1:]...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("reauth command: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("reauth command: %w", err)
+	}
+	password := strings.TrimSpace(string(out))
+	if password == "" {
+		return "", errors.New("reauth command printed no credentials")
+	}
+	return password, nil
+}
+
+// tokenResponse is the reply of an OAuth token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// deviceFlowToken returns a new access token and refresh token, with the
+// refresh token if there is one and otherwise by asking the user to approve
+// the device (RFC 8628)
+func deviceFlowToken(f *config.DeviceFlow, refreshToken, proxy string) (string, string, error) {
+	client := NewBypassHTTPClient()
+	client.Timeout = DeviceFlowRequestTimeout
+
+	if refreshToken != "" {
+		resp, err := postOAuth(client, f.TokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+			"client_id":     {f.ClientID},
+		}, nil)
+		if err == nil && resp.AccessToken != "" {
+			return resp.AccessToken, cmp.Or(resp.RefreshToken, refreshToken), nil
+		}
+		slog.Debug("Refresh token rejected, starting device authorization", "upstream", proxy, "error", err)
+	}
+
+	form := url.Values{"client_id": {f.ClientID}}
+	if f.Scope != "" {
+		form.Set("scope", f.Scope)
+	}
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if _, err := postOAuth(client, f.DeviceURL, form, &device); err != nil {
+		return "", "", fmt.Errorf("device authorization: %w", err)
+	}
+	if device.DeviceCode == "" {
+		return "", "", errors.New("device authorization returned no device_code")
+	}
+	slog.Warn("Upstream proxy login required, open the URL and enter the code",
+		"upstream", proxy, "url", cmp.Or(device.VerificationURIComplete, device.VerificationURI), "code", device.UserCode)
+
+	interval := time.Duration(cmp.Or(device.Interval, 5)) * time.Second
+	deadline := time.Now().Add(time.Duration(cmp.Or(device.ExpiresIn, 600)) * time.Second)
+	for time.Now().Add(interval).Before(deadline) {
+		time.Sleep(interval)
+		resp, err := postOAuth(client, f.TokenURL, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+			"client_id":   {f.ClientID},
+		}, nil)
+		switch {
+		case err == nil && resp.AccessToken != "":
+			return resp.AccessToken, resp.RefreshToken, nil
+		case resp.Error == "authorization_pending":
+		case resp.Error == "slow_down":
+			interval += 5 * time.Second
+		case err != nil:
+			return "", "", fmt.Errorf("device token: %w", err)
+		default:
+			return "", "", errors.New("device token response has no access_token")
+		}
+	}
+	return "", "", errors.New("device code expired before the login was approved")
+}
+
+// postOAuth posts form to an OAuth endpoint and decodes the JSON reply into
+// v, or into the returned token response when v is nil. Error replies return
+// the response with its error code along with an error.
+func postOAuth(client *http.Client, endpoint string, form url.Values, v any) (tokenResponse, error) {
+	var token tokenResponse
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return token, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		json.Unmarshal(body, &token)
+		if token.Error != "" {
+			return token, fmt.Errorf("%s: %s %s", resp.Status, token.Error, token.Description)
+		}
+		return token, fmt.Errorf("%s", resp.Status)
+	}
+	if v == nil {
+		v = &token
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return token, fmt.Errorf("invalid response: %w", err)
+	}
+	return token, nil
+}
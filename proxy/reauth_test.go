@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// startAuthProxy runs an HTTP CONNECT proxy answering 407 unless the
+// Proxy-Authorization header equals the current value of want
+func startAuthProxy(t *testing.T, want *atomic.Value) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Header.Get("Proxy-Authorization") != want.Load().(string) {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstream_ReauthCommand(t *testing.T) {
+	echo := startEcho(t)
+	var want atomic.Value
+	want.Store("Basic dXNlcjpuZXc=") // user:new
+	addr := startAuthProxy(t, &want)
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	u, _ := url.Parse("http://user:old@" + addr)
+	upstream := NewUpstream(config.ProxyHop{URL: u, Reauth: &config.Reauth{
+		Command: []string{"sh", "-c", "echo run >> " + runs + "; sleep 0.2; echo new"},
+		Timeout: 5,
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Go(func() {
+			conn, err := upstream.Connect(ctx, echo.String())
+			if err != nil {
+				t.Errorf("Connect() error = %v", err)
+				return
+			}
+			defer conn.Close()
+			expectEcho(t, conn)
+		})
+	}
+	wg.Wait()
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 1 {
+		t.Errorf("reauth command ran %d times, want once", strings.Count(string(data), "run"))
+	}
+
+	// A reload keeps the renewed credentials
+	reloaded := &policyTable{upstream: NewUpstream(upstream.hops...)}
+	reloaded.keepRenewed(&policyTable{upstream: upstream})
+	if password, _ := reloaded.upstream.user(0).Password(); password != "new" {
+		t.Errorf("password after reload = %q, want the renewed one", password)
+	}
+
+	// A failed renewal is reported and not repeated right away
+	want.Store("Basic dXNlcjpuZXdlcg==")
+	upstream.creds[0].reauth = &config.Reauth{Command: []string{"sh", "-c", "echo run >> " + runs + "; echo denied >&2; exit 1"}, Timeout: 5}
+	for range 2 {
+		_, err := upstream.Connect(ctx, echo.String())
+		if err == nil || !strings.Contains(err.Error(), "denied") {
+			t.Errorf("Connect() error = %v, want the command's failure", err)
+		}
+	}
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 2 {
+		t.Errorf("reauth command ran %d times, want twice", strings.Count(string(data), "run"))
+	}
+}
+
+func TestUpstream_ReauthDeviceFlow(t *testing.T) {
+	echo := startEcho(t)
+	var want atomic.Value
+	want.Store("Bearer first")
+	addr := startAuthProxy(t, &want)
+
+	var polls atomic.Int32
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "tproxy" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var reply map[string]any
+		switch r.URL.Path + " " + r.Form.Get("grant_type") {
+		case "/device ":
+			reply = map[string]any{"device_code": "dev", "user_code": "ABCD-EFGH", "verification_uri": "https://login.example/device", "interval": 1}
+		case "/token urn:ietf:params:oauth:grant-type:device_code":
+			if polls.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				reply = map[string]any{"error": "authorization_pending"}
+				break
+			}
+			reply = map[string]any{"access_token": "first", "refresh_token": "refresh"}
+		case "/token refresh_token":
+			if r.Form.Get("refresh_token") != "refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				reply = map[string]any{"error": "invalid_grant"}
+				break
+			}
+			reply = map[string]any{"access_token": "second"}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer oauth.Close()
+
+	u, _ := url.Parse("http://" + addr)
+	upstream := NewUpstream(config.ProxyHop{URL: u, Reauth: &config.Reauth{DeviceFlow: &config.DeviceFlow{
+		DeviceURL: oauth.URL + "/device",
+		TokenURL:  oauth.URL + "/token",
+		ClientID:  "tproxy",
+	}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, token := range []string{"first", "second"} {
+		want.Store("Bearer " + token)
+		conn, err := upstream.Connect(ctx, echo.String())
+		if err != nil {
+			t.Fatalf("Connect() with %s token error = %v", token, err)
+		}
+		expectEcho(t, conn)
+		conn.Close()
+	}
+	if polls.Load() != 2 {
+		t.Errorf("token polls = %d, want 2", polls.Load())
+	}
+}
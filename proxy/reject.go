@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/cnfatal/proxy/rules"
+)
+
+// rejectWriteTimeout bounds writing a reject response to a client
+const rejectWriteTimeout = time.Second
+
+// rejection is reported to explicit proxy clients of rejected connections.
+// reason is empty unless reject_response is enabled.
+type rejection struct {
+	reason string
+}
+
+func (r *rejection) Error() string { return errRejected.Error() }
+func (r *rejection) Unwrap() error { return errRejected }
+
+// rejectReason describes the rule rejecting a connection for end users
+func rejectReason(rule *rules.Rule) string {
+	if rule == nil {
+		return "Blocked by policy REJECT"
+	}
+	if rule.Comment != "" {
+		return fmt.Sprintf("Blocked by rule %s (%s)", rule, rule.Comment)
+	}
+	return fmt.Sprintf("Blocked by rule %s", rule)
+}
+
+// httpForbidden is a 403 response carrying reason as its plain text body
+func httpForbidden(reason string) string {
+	body := reason + "\n"
+	return fmt.Sprintf("HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+// tlsAccessDenied is a fatal access_denied alert record. Alerts only carry a
+// code, so the reason cannot be included.
+func tlsAccessDenied(version [2]byte) []byte {
+	return []byte{0x15, version[0], version[1], 0x00, 0x02, 0x02, 49}
+}
+
+// rejectIntercepted answers a rejected intercepted connection in the protocol
+// its client spoke: an HTTP 403 page with reason or a TLS alert. Other
+// protocols are closed without a response.
+func rejectIntercepted(client net.Conn, reason string) {
+	peeked, ok := client.(*PeekedConn)
+	if !ok || len(peeked.peeked) == 0 {
+		return
+	}
+	data := peeked.peeked
+	client.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+
+	var err error
+	switch sniffProtocol(data) {
+	case "http":
+		_, err = io.WriteString(client, httpForbidden(reason))
+	case "tls":
+		version := [2]byte{0x03, 0x01}
+		if len(data) >= 3 {
+			version = [2]byte{data[1], data[2]}
+		}
+		_, err = client.Write(tlsAccessDenied(version))
+	default:
+		return
+	}
+	if err != nil {
+		slog.Debug("Failed to send reject response", "from", client.RemoteAddr(), "error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestForward_RejectResponse(t *testing.T) {
+	tp := newTestProxy(t, &config.Config{
+		RejectResponse: true,
+		Rules:          []config.RuleEntry{{Raw: "DOMAIN,blocked.example,REJECT", Comment: "ads"}},
+	}, "MATCH,DIRECT")
+
+	const reason = "Blocked by rule DOMAIN,blocked.example,REJECT (ads)\n"
+	tests := []struct {
+		name   string
+		peeked []byte
+		want   []byte
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\nHost: blocked.example\r\n\r\n"), []byte(reason)},
+		{"tls", []byte{0x16, 0x03, 0x01, 0x00, 0x05}, tlsAccessDenied([2]byte{0x03, 0x01})},
+		{"unknown", []byte("SSH-2.0-OpenSSH\r\n"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				conn := NewPeekedConn(server, append([]byte(nil), tt.peeked...), tp.pool)
+				defer conn.Close()
+				tp.forward(t.Context(), conn, "tproxy", "blocked.example", &net.TCPAddr{Port: 443}, nil, nil)
+			}()
+
+			got, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "http" {
+				resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(got)), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusForbidden {
+					t.Errorf("status = %d, want 403", resp.StatusCode)
+				}
+				got, _ = io.ReadAll(resp.Body)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("response = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("http connect", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			tp.handleHTTPConnect(t.Context(), server)
+		}()
+
+		io.WriteString(client, "CONNECT blocked.example:443 HTTP/1.1\r\nHost: blocked.example:443\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusForbidden || string(body) != reason {
+			t.Errorf("response = %d %q, want 403 %q", resp.StatusCode, body, reason)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// MaxConcurrentLookups bounds the host name lookups running at once
+	MaxConcurrentLookups = 64
+
+	// LookupTimeout bounds a lookup shared by every connection waiting for it
+	LookupTimeout = 10 * time.Second
+
+	// ConnectionAttemptDelay is how long a dial to one address of a host runs
+	// alone before the next address is tried alongside it (RFC 8305)
+	ConnectionAttemptDelay = 250 * time.Millisecond
+)
+
+// hosts resolves the host names of the proxy's own connections: upstream
+// proxies, direct connections to sniffed domains and its HTTP clients
+var hosts = newResolver(net.DefaultResolver, MaxConcurrentLookups)
+
+// resolver looks up host names with concurrent lookups of a name sharing one
+// query, so a burst of connections to a new domain resolves it once, and at
+// most a fixed number of lookups running at once
+type resolver struct {
+	r     *net.Resolver
+	group singleflight.Group
+	slots chan struct{}
+}
+
+func newResolver(r *net.Resolver, concurrency int) *resolver {
+	return &resolver{r: r, slots: make(chan struct{}, concurrency)}
+}
+
+// lookup returns the addresses of host. The lookup outlives callers that give
+// up, so the others still waiting for it get its result.
+func (r *resolver) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	ch := r.group.DoChan(host, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), LookupTimeout)
+		defer cancel()
+		select {
+		case r.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-r.slots }()
+		return r.r.LookupNetIP(ctx, "ip", host)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]netip.Addr), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial connects to addr with dialer, resolving its host with r. Addresses
+// are tried alternating between families, starting another attempt every
+// ConnectionAttemptDelay or as soon as the running ones fail.
+func (r *resolver) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil || host == "" {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = attemptOrder(ips, network)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	return dialAttempts(ctx, dialer, network, ips, port)
+}
+
+// attemptOrder keeps the addresses usable with network, alternating between
+// the families starting with the first one returned
+func attemptOrder(ips []netip.Addr, network string) []netip.Addr {
+	var first, second []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		switch {
+		case strings.HasSuffix(network, "4") && !ip.Is4(), strings.HasSuffix(network, "6") && !ip.Is6():
+		case len(first) == 0 || ip.Is4() == first[0].Is4():
+			first = append(first, ip)
+		default:
+			second = append(second, ip)
+		}
+	}
+	ordered := make([]netip.Addr, 0, len(first)+len(second))
+	for i := range max(len(first), len(second)) {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialAttempts returns the first connection established to one of ips,
+// closing those that complete after it
+func dialAttempts(ctx context.Context, dialer *net.Dialer, network string, ips []netip.Addr, port string) (net.Conn, error) {
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan attempt, len(ips))
+	started, done := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[started].String(), port)
+		started++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			results <- attempt{conn, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(ConnectionAttemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case res := <-results:
+			done++
+			if res.err == nil {
+				go func(pending int) {
+					for range pending {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(started - done)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if done == len(ips) {
+				return nil, firstErr
+			}
+			if done == started {
+				start()
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		case <-timer.C:
+			if started < len(ips) {
+				start()
+				timer.Reset(ConnectionAttemptDelay)
+			}
+		}
+	}
+}
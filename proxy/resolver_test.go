@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startCountingDNS serves 127.0.0.1 for every A query after a delay,
+// counting the queries it receives
+func startCountingDNS(t *testing.T, queries *atomic.Int32) *net.Resolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(127, 0, 0, 1),
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, pc.LocalAddr().String())
+	}}
+}
+
+func TestResolver_SharedLookup(t *testing.T) {
+	var queries atomic.Int32
+	r := newResolver(startCountingDNS(t, &queries), 4)
+	echo := startEcho(t)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			conn, err := r.dial(context.Background(), &net.Dialer{}, "tcp", net.JoinHostPort("burst.test", strconv.Itoa(echo.Port)))
+			if err != nil {
+				t.Errorf("dial() error = %v", err)
+				return
+			}
+			defer conn.Close()
+			expectEcho(t, conn)
+		})
+	}
+	wg.Wait()
+	// One A and one AAAA query
+	if n := queries.Load(); n != 2 {
+		t.Errorf("DNS queries = %d, want 2", n)
+	}
+}
+
+func TestAttemptOrder(t *testing.T) {
+	addrs := func(s ...string) []netip.Addr {
+		ips := make([]netip.Addr, len(s))
+		for i, a := range s {
+			ips[i] = netip.MustParseAddr(a)
+		}
+		return ips
+	}
+	tests := []struct {
+		network string
+		ips     []netip.Addr
+		want    []netip.Addr
+	}{
+		{"tcp", addrs("2001:db8::1", "2001:db8::2", "192.0.2.1"), addrs("2001:db8::1", "192.0.2.1", "2001:db8::2")},
+		{"tcp", addrs("192.0.2.1", "192.0.2.2", "2001:db8::1"), addrs("192.0.2.1", "2001:db8::1", "192.0.2.2")},
+		{"tcp4", addrs("2001:db8::1", "::ffff:192.0.2.1"), addrs("192.0.2.1")},
+		{"tcp6", addrs("192.0.2.1"), nil},
+	}
+	for _, tt := range tests {
+		if got := attemptOrder(tt.ips, tt.network); !slices.Equal(got, tt.want) {
+			t.Errorf("attemptOrder(%v, %s) = %v, want %v", tt.ips, tt.network, got, tt.want)
+		}
+	}
+}
+
+func TestDialAttempts_Fallback(t *testing.T) {
+	echo := startEcho(t)
+	// Nothing listens on 127.0.0.2, so the second address is tried right away
+	ips := []netip.Addr{netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.1")}
+	start := time.Now()
+	conn, err := dialAttempts(context.Background(), &net.Dialer{}, "tcp", ips, strconv.Itoa(echo.Port))
+	if err != nil {
+		t.Fatalf("dialAttempts() error = %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+	if elapsed := time.Since(start); elapsed >= ConnectionAttemptDelay {
+		t.Errorf("fallback took %v, want it before the attempt delay", elapsed)
+	}
+}
@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/datadir"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// ScheduleFile is where scheduled rules are persisted, relative to the data directory
+const ScheduleFile = "schedules.json"
+
+// ErrInvalidSchedule is returned for scheduled rules that cannot be added
+var ErrInvalidSchedule = errors.New("invalid scheduled rule")
+
+// ScheduledRule is a rule taking precedence over the configured rules every
+// day from From until To, as HH:MM in local time. From after To spans midnight.
+type ScheduledRule struct {
+	ID   uint64 `json:"id"`
+	Rule string `json:"rule"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type scheduleEntry struct {
+	ScheduledRule
+	matcher  *rules.Matcher
+	from, to int // minutes after midnight
+}
+
+// active reports whether the window of e contains t
+func (e *scheduleEntry) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if e.from < e.to {
+		return m >= e.from && m < e.to
+	}
+	return m >= e.from || m < e.to
+}
+
+// schedule holds the scheduled rules. Matching reads an immutable snapshot,
+// changes are persisted before they are published.
+type schedule struct {
+	path    string
+	entries atomic.Pointer[[]*scheduleEntry]
+
+	mu     sync.Mutex // serializes changes
+	nextID uint64
+}
+
+// newSchedule returns an empty schedule persisted at path
+func newSchedule(path string) *schedule {
+	s := &schedule{path: path, nextID: 1}
+	s.entries.Store(new([]*scheduleEntry))
+	return s
+}
+
+// loadSchedule restores the scheduled rules saved at path, if any
+func loadSchedule(path string) (*schedule, error) {
+	s := newSchedule(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read scheduled rules: %w", err)
+	}
+	var saved []ScheduledRule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled rules %s: %w", path, err)
+	}
+	var entries []*scheduleEntry
+	for _, r := range saved {
+		e, err := newScheduleEntry(r)
+		if err != nil {
+			return nil, fmt.Errorf("scheduled rule %d in %s: %w", r.ID, path, err)
+		}
+		entries = append(entries, e)
+		s.nextID = max(s.nextID, r.ID+1)
+	}
+	s.entries.Store(&entries)
+	if len(entries) > 0 {
+		slog.Info("Scheduled rules loaded", "path", path, "count", len(entries))
+	}
+	return s, nil
+}
+
+func newScheduleEntry(r ScheduledRule) (*scheduleEntry, error) {
+	rule, err := rules.ParseRule(r.Rule)
+	if err != nil {
+		return nil, err
+	}
+	switch rule.Type {
+	case rules.RuleTypeMatch, rules.RuleTypeGeoIP, rules.RuleTypeRuleSet:
+		return nil, fmt.Errorf("%s rules cannot be scheduled", rule.Type)
+	}
+	e := &scheduleEntry{ScheduledRule: r, matcher: rules.NewMatcher([]*rules.Rule{rule})}
+	e.Rule = rule.String()
+	if e.from, err = config.ParseClock(r.From); err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	if e.to, err = config.ParseClock(r.To); err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+	if e.from == e.to {
+		return nil, fmt.Errorf("from and to must differ")
+	}
+	return e, nil
+}
+
+// match returns the first scheduled rule active at now that matches md
+func (s *schedule) match(md *rules.Metadata, now time.Time) (rules.MatchResult, bool) {
+	for _, e := range *s.entries.Load() {
+		if !e.active(now) {
+			continue
+		}
+		if result := e.matcher.MatchMetadata(md); result.Rule != nil {
+			return rules.MatchResult{Policy: result.Policy, Rule: result.Rule, Index: -1}, true
+		}
+	}
+	return rules.MatchResult{}, false
+}
+
+// hasSourceMACRules reports whether any scheduled rule needs the client MAC address
+func (s *schedule) hasSourceMACRules() bool {
+	for _, e := range *s.entries.Load() {
+		if e.matcher.HasSourceMACRules() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *schedule) list() []ScheduledRule {
+	entries := *s.entries.Load()
+	out := make([]ScheduledRule, len(entries))
+	for i, e := range entries {
+		out[i] = e.ScheduledRule
+	}
+	return out
+}
+
+func (s *schedule) add(r ScheduledRule) (ScheduledRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = s.nextID
+	e, err := newScheduleEntry(r)
+	if err != nil {
+		return ScheduledRule{}, fmt.Errorf("%w: %w", ErrInvalidSchedule, err)
+	}
+	entries := append(slices.Clone(*s.entries.Load()), e)
+	if err := s.save(entries); err != nil {
+		return ScheduledRule{}, err
+	}
+	s.nextID++
+	s.entries.Store(&entries)
+	slog.Info("Scheduled rule added", "id", e.ID, "rule", e.Rule, "from", e.From, "to", e.To)
+	return e.ScheduledRule, nil
+}
+
+func (s *schedule) remove(id uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := *s.entries.Load()
+	i := slices.IndexFunc(entries, func(e *scheduleEntry) bool { return e.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	entries = slices.Delete(slices.Clone(entries), i, i+1)
+	if err := s.save(entries); err != nil {
+		return false, err
+	}
+	s.entries.Store(&entries)
+	slog.Info("Scheduled rule removed", "id", id)
+	return true, nil
+}
+
+func (s *schedule) save(entries []*scheduleEntry) error {
+	saved := make([]ScheduledRule, len(entries))
+	for i, e := range entries {
+		saved[i] = e.ScheduledRule
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode scheduled rules: %w", err)
+	}
+	if err := datadir.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save scheduled rules: %w", err)
+	}
+	return nil
+}
+
+// Schedules lists the scheduled rules in evaluation order
+func (tp *TransparentProxy) Schedules() []ScheduledRule {
+	return tp.schedule.list()
+}
+
+// AddSchedule adds and persists a scheduled rule, returning it with its assigned ID.
+// Invalid rules are reported with ErrInvalidSchedule.
+func (tp *TransparentProxy) AddSchedule(r ScheduledRule) (ScheduledRule, error) {
+	return tp.schedule.add(r)
+}
+
+// RemoveSchedule deletes a scheduled rule, reporting whether it existed
+func (tp *TransparentProxy) RemoveSchedule(id uint64) (bool, error) {
+	return tp.schedule.remove(id)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+func TestSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ScheduleFile)
+	s := newSchedule(path)
+
+	night, err := s.add(ScheduledRule{Rule: "domain-suffix,tiktok.com,reject", From: "22:00", To: "07:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if night.ID != 1 || night.Rule != "DOMAIN-SUFFIX,tiktok.com,REJECT" {
+		t.Errorf("added = %+v", night)
+	}
+	if _, err := s.add(ScheduledRule{Rule: "IP-CIDR,10.0.0.0/8,DIRECT", From: "09:00", To: "17:00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	day := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name   string
+		md     rules.Metadata
+		now    time.Time
+		ok     bool
+		policy config.Policy
+	}{
+		{"before midnight", rules.Metadata{Domain: "www.tiktok.com"}, day(23, 0), true, config.PolicyReject},
+		{"after midnight", rules.Metadata{Domain: "www.tiktok.com"}, day(6, 59), true, config.PolicyReject},
+		{"window end is exclusive", rules.Metadata{Domain: "www.tiktok.com"}, day(7, 0), false, ""},
+		{"outside the window", rules.Metadata{Domain: "www.tiktok.com"}, day(12, 0), false, ""},
+		{"daytime window", rules.Metadata{DstIP: net.ParseIP("10.1.2.3")}, day(9, 0), true, config.PolicyDirect},
+		{"other destination", rules.Metadata{Domain: "example.com"}, day(23, 0), false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := s.match(&tt.md, tt.now)
+			if ok != tt.ok || result.Policy != tt.policy {
+				t.Errorf("match() = %v, %v, want %v, %v", result.Policy, ok, tt.policy, tt.ok)
+			}
+		})
+	}
+
+	// Changes survive a restart
+	if removed, err := s.remove(2); err != nil || !removed {
+		t.Fatalf("remove(2) = %v, %v", removed, err)
+	}
+	if removed, _ := s.remove(2); removed {
+		t.Error("remove(2) twice reported success")
+	}
+	loaded, err := loadSchedule(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.list(); len(got) != 1 || got[0] != night {
+		t.Errorf("loaded = %+v, want [%+v]", got, night)
+	}
+	if added, err := loaded.add(ScheduledRule{Rule: "IP-CIDR,192.168.1.0/24,REJECT", From: "00:00", To: "06:00"}); err != nil || added.ID != 2 {
+		t.Errorf("add after load = %+v, %v, want ID 2", added, err)
+	}
+}
+
+func TestSchedule_Invalid(t *testing.T) {
+	s := newSchedule(filepath.Join(t.TempDir(), ScheduleFile))
+	for _, r := range []ScheduledRule{
+		{Rule: "DOMAIN,a.com,NOPE", From: "22:00", To: "07:00"},
+		{Rule: "MATCH,REJECT", From: "22:00", To: "07:00"},
+		{Rule: "GEOIP,CN,DIRECT", From: "22:00", To: "07:00"},
+		{Rule: "DOMAIN,a.com,REJECT", From: "25:00", To: "07:00"},
+		{Rule: "DOMAIN,a.com,REJECT", From: "07:00", To: "07:00"},
+	} {
+		if _, err := s.add(r); !errors.Is(err, ErrInvalidSchedule) {
+			t.Errorf("add(%+v) error = %v, want ErrInvalidSchedule", r, err)
+		}
+	}
+	if n := len(s.list()); n != 0 {
+		t.Errorf("list() has %d rules, want 0", n)
+	}
+}
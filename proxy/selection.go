@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/datadir"
+)
+
+// SelectionFile is where the members chosen for select groups are persisted,
+// relative to the data directory
+const SelectionFile = "selections.json"
+
+var (
+	// ErrUnknownGroup is returned when selecting in a group that does not exist
+	ErrUnknownGroup = errors.New("unknown proxy group")
+	// ErrInvalidSelection is returned for a member the group cannot select
+	ErrInvalidSelection = errors.New("invalid selection")
+)
+
+// GroupSelection is the member a select group sends its connections to
+type GroupSelection struct {
+	Group    string `json:"group"`
+	Selected string `json:"selected"`
+}
+
+// selections holds the chosen member of each select group by name, so the
+// choice survives reloads and restarts. Groups without one use their first
+// member.
+type selections struct {
+	path string
+
+	mu     sync.Mutex // serializes changes and applying them to new groups
+	chosen map[string]string
+}
+
+// loadSelections restores the selections saved at path, if any
+func loadSelections(path string) (*selections, error) {
+	s := &selections{path: path, chosen: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("failed to read group selections: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.chosen); err != nil {
+		return nil, fmt.Errorf("failed to decode group selections %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// apply points the select groups of t at their chosen members. Choices of
+// members a group no longer has are ignored.
+func (s *selections) apply(t *policyTable) {
+	for name, member := range s.chosen {
+		if g, ok := t.groups[name]; ok && g.kind == config.GroupSelect {
+			if i := slices.Index(g.members, config.Policy(member)); i >= 0 {
+				g.selected.Store(int32(i))
+			}
+		}
+	}
+}
+
+// choose persists member as the choice of the select group name and applies
+// it to t. The caller holds s.mu.
+func (s *selections) choose(t *policyTable, name, member string) error {
+	g, ok := t.groups[name]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownGroup, name)
+	}
+	if g.kind != config.GroupSelect {
+		return fmt.Errorf("%w: %s is a %s group", ErrInvalidSelection, name, g.kind)
+	}
+	i := slices.Index(g.members, config.Policy(member))
+	if i < 0 {
+		return fmt.Errorf("%w: %q is not a member of %s", ErrInvalidSelection, member, name)
+	}
+
+	chosen := maps.Clone(s.chosen)
+	chosen[name] = member
+	data, err := json.MarshalIndent(chosen, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode group selections: %w", err)
+	}
+	if err := datadir.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save group selections: %w", err)
+	}
+	s.chosen = chosen
+	g.selected.Store(int32(i))
+	slog.Info("Proxy group selection changed", "group", name, "selected", member)
+	return nil
+}
+
+// SelectGroup makes member the one the select group name sends its
+// connections to, and persists the choice. Unknown groups are reported with
+// ErrUnknownGroup, other groups and members with ErrInvalidSelection.
+func (tp *TransparentProxy) SelectGroup(name, member string) (GroupSelection, error) {
+	s := tp.selections
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.choose(tp.routing.Load().policies, name, member); err != nil {
+		return GroupSelection{}, err
+	}
+	return GroupSelection{Group: name, Selected: member}, nil
+}
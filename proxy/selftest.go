@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SelfTestTimeout bounds the startup self-test connection
+const SelfTestTimeout = 3 * time.Second
+
+// selfTestAddr is the destination of the self-test connection, a
+// documentation address (RFC 5737) on an intercepted port that no server has
+var selfTestAddr = &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 80}
+
+// selfTestReply is the proxy's answer to intercepted connections to selfTestAddr
+const selfTestReply = "tproxy self-test\n"
+
+// isSelfTest reports whether an intercepted connection is the self-test's
+func isSelfTest(dst *net.TCPAddr) bool {
+	return dst.Port == selfTestAddr.Port && dst.IP.Equal(selfTestAddr.IP)
+}
+
+// SelfTest waits for the transparent listener and connects to a documentation
+// address as any local program would. The connection only gets the proxy's
+// answer if the nftables rules and policy routing deliver it to the listener,
+// so interception that does not work is found at startup.
+func (tp *TransparentProxy) SelfTest(ctx context.Context) error {
+	select {
+	case <-tp.listening:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return probeSelfTest(ctx, selfTestAddr.String())
+}
+
+// probeSelfTest connects to addr without the bypass mark and expects selfTestReply
+func probeSelfTest(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, SelfTestTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("connection to %s did not reach the proxy: %w", addr, err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	reply := make([]byte, len(selfTestReply))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("connection to %s did not reach the proxy: %w", addr, err)
+	}
+	if string(reply) != selfTestReply {
+		return fmt.Errorf("connection to %s reached another server", addr)
+	}
+	return nil
+}
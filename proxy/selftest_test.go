@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fixedOriginalDst reports the same original destination for every connection
+type fixedOriginalDst struct{ addr *net.TCPAddr }
+
+func (d fixedOriginalDst) TCP(net.Conn) (*net.TCPAddr, error) { return d.addr, nil }
+
+func (fixedOriginalDst) UDP([]byte) (*net.UDPAddr, error) { return nil, nil }
+
+func TestSelfTest(t *testing.T) {
+	serve := func(handle func(net.Conn)) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go handle(conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	tp := &TransparentProxy{listenAddr: ":12345", origDst: fixedOriginalDst{selfTestAddr}}
+	tests := []struct {
+		name    string
+		handle  func(net.Conn)
+		wantErr string
+	}{
+		{"intercepted", func(c net.Conn) { tp.handleConnection(context.Background(), c) }, ""},
+		{"other server", func(c net.Conn) { io.WriteString(c, "HTTP/1.1 400 Bad Request\r\n\r\n"); c.Close() }, "another server"},
+		{"closed", func(c net.Conn) { c.Close() }, "did not reach the proxy"},
+	}
+	for _, tt := range tests {
+		err := probeSelfTest(context.Background(), serve(tt.handle))
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: probeSelfTest() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Server is the remote end of the tunnels, run by "tproxy server". It serves
+// HTTP CONNECT over TLS: each HTTP/1.1 connection carries one tunnel, HTTP/2
+// connections carry multiplexed tunnels as streams. Clients authenticate with
+// Basic proxy authorization whose password is the token; the username is ignored.
+type Server struct {
+	token       []byte
+	dialTimeout time.Duration
+	pool        BufferPool
+}
+
+// NewServer creates a server accepting clients presenting token
+func NewServer(token string, dialTimeout time.Duration, pool BufferPool) *Server {
+	return &Server{token: []byte(token), dialTimeout: dialTimeout, pool: pool}
+}
+
+// authorized reports whether a Proxy-Authorization header carries the token
+func (s *Server) authorized(header string) bool {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	_, password, ok := strings.Cut(string(decoded), ":")
+	return ok && subtle.ConstantTimeCompare([]byte(password), s.token) == 1
+}
+
+// ServeHTTP opens the requested tunnel and relays it until either side closes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r.Header.Get("Proxy-Authorization")) {
+		slog.Info("Rejecting unauthorized tunnel", "from", r.RemoteAddr, "target", r.Host)
+		w.Header().Set("Proxy-Authenticate", `Basic realm="tproxy"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: s.dialTimeout}
+	target, err := hosts.dial(r.Context(), &dialer, "tcp", r.Host)
+	if err != nil {
+		slog.Debug("Failed to connect tunnel", "from", r.RemoteAddr, "target", r.Host, "error", err)
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+	if tcpConn, ok := target.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+	slog.Debug("Tunnel opened", "from", r.RemoteAddr, "target", r.Host, "proto", r.Proto)
+
+	if r.ProtoMajor == 1 {
+		s.relayHijacked(w, target)
+	} else {
+		s.relayStream(w, r, target)
+	}
+	slog.Debug("Tunnel closed", "from", r.RemoteAddr, "target", r.Host)
+}
+
+// relayHijacked takes over an HTTP/1.1 connection as the tunnel
+func (s *Server) relayHijacked(w http.ResponseWriter, target net.Conn) {
+	client, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		slog.Error("Failed to take over tunnel connection", "error", err)
+		return
+	}
+	defer client.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		client = NewPeekedConn(client, append([]byte(nil), buffered...), s.pool)
+	}
+	Relay(target, client, s.pool, nil, nil, 0)
+}
+
+// relayStream relays an HTTP/2 stream. The stream ends once the target stops
+// sending, HTTP/2 handlers cannot half-close their response.
+func (s *Server) relayStream(w http.ResponseWriter, r *http.Request, target net.Conn) {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	go func() {
+		buf := s.pool.Get()
+		defer s.pool.Put(buf)
+		io.CopyBuffer(target, r.Body, buf)
+		if tcpConn, ok := target.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+	}()
+
+	buf := s.pool.Get()
+	defer s.pool.Put(buf)
+	for {
+		n, err := target.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if rc.Flush() != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestServer_Tunnel(t *testing.T) {
+	echo := startEcho(t)
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(NewServer("t0ken", time.Second, NewBufferPool()))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	tests := []struct {
+		name      string
+		user      string
+		multiplex bool
+		wantErr   bool
+		wantConns int32
+	}{
+		{"http1", "any:t0ken", false, false, 2},
+		{"multiplexed", "any:t0ken", true, false, 1},
+		{"wrong token", "any:wrong", false, true, 0},
+		{"multiplexed wrong token", "any:wrong", true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse("https://" + tt.user + "@" + addr)
+			upstream := NewUpstream(config.ProxyHop{URL: u, TLS: &tls.Config{InsecureSkipVerify: true}, Multiplex: tt.multiplex})
+			conns.Store(0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for range 2 {
+				conn, err := upstream.Connect(ctx, echo.String())
+				if tt.wantErr {
+					if err == nil {
+						conn.Close()
+						t.Fatal("Connect() succeeded, want authentication failure")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Connect() error = %v", err)
+				}
+				expectEcho(t, conn)
+				conn.(interface{ CloseWrite() error }).CloseWrite()
+				if rest, err := io.ReadAll(conn); err != nil || len(rest) != 0 {
+					t.Errorf("read after half-close = %q, %v, want EOF", rest, err)
+				}
+				conn.Close()
+			}
+			if got := conns.Load(); got != tt.wantConns {
+				t.Errorf("server connections = %d, want %d", got, tt.wantConns)
+			}
+		})
+	}
+}
@@ -87,20 +87,13 @@ func (s *domainSniffer) Sniff(conn net.Conn) (string, []byte, error) {
 		}
 
 		peeked := buf[:total]
-		switch {
-		case peeked[0] == 0x16:
-			if domain, done := sniffSNI(peeked); done {
-				s.logSniffResult(conn, "tls", total, domain, "", nil)
-				return domain, peeked, nil
+		if domain, protocol, done := parseDomain(peeked); done {
+			reason := ""
+			if protocol == "unknown" {
+				reason = "unrecognized initial bytes"
 			}
-		case isLikelyHTTP(peeked):
-			if domain, done := sniffHTTP(peeked); done {
-				s.logSniffResult(conn, "http", total, domain, "", nil)
-				return domain, peeked, nil
-			}
-		default:
-			s.logSniffResult(conn, "unknown", total, "", "unrecognized initial bytes", nil)
-			return "", peeked, nil
+			s.logSniffResult(conn, protocol, total, domain, reason, nil)
+			return domain, peeked, nil
 		}
 
 		if err != nil {
@@ -117,6 +110,30 @@ func (s *domainSniffer) Sniff(conn net.Conn) (string, []byte, error) {
 	return "", buf[:total], nil
 }
 
+// SniffDomain extracts the TLS SNI or HTTP Host from the first bytes a client
+// sent. done is false while more bytes are needed to decide.
+func SniffDomain(data []byte) (domain string, done bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+	domain, _, done = parseDomain(data)
+	return domain, done
+}
+
+// parseDomain extracts the domain from the initial bytes of a connection.
+// done is false while a TLS ClientHello or HTTP header is still incomplete.
+func parseDomain(peeked []byte) (domain, protocol string, done bool) {
+	switch {
+	case peeked[0] == 0x16:
+		domain, done = sniffSNI(peeked)
+		return domain, "tls", done
+	case isLikelyHTTP(peeked):
+		domain, done = sniffHTTP(peeked)
+		return domain, "http", done
+	}
+	return "", "unknown", true
+}
+
 func (s *domainSniffer) logSniffResult(conn net.Conn, protocol string, peekedLen int, domain, reason string, err error) {
 	attrs := []any{
 		"remote", conn.RemoteAddr(),
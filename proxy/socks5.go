@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version     = 0x05
+	socks5AuthNone    = 0x00
+	socks5AuthPasswd  = 0x02
+	socks5CmdConnect  = 0x01
+	socks5CmdUDPAssoc = 0x03
+	socks5AtypIPv4    = 0x01
+	socks5AtypDomain  = 0x03
+	socks5AtypIPv6    = 0x04
+
+	// SOCKS5HandshakeTimeout bounds the UDP ASSOCIATE negotiation
+	SOCKS5HandshakeTimeout = 10 * time.Second
+)
+
+// socks5Connect asks a SOCKS5 proxy to open a TCP connection to targetAddr
+func socks5Connect(rw io.ReadWriter, user *url.Userinfo, targetAddr string) error {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port in %q", targetAddr)
+	}
+
+	if len(host) > 255 {
+		return fmt.Errorf("host name too long: %q", host)
+	}
+
+	if err := socks5Auth(rw, user); err != nil {
+		return err
+	}
+	_, _, err = socks5Command(rw, socks5CmdConnect, appendSOCKS5Host(nil, host, port))
+	return err
+}
+
+// socks5Auth negotiates no authentication, or username/password when user is set
+func socks5Auth(rw io.ReadWriter, user *url.Userinfo) error {
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPasswd
+	}
+	if _, err := rw.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version || resp[1] != method {
+		return fmt.Errorf("%w: method 0x%02x not accepted", errProxyAuth, method)
+	}
+	if method != socks5AuthPasswd {
+		return nil
+	}
+
+	name := user.Username()
+	password, _ := user.Password()
+	if len(name) > 255 || len(password) > 255 {
+		return errors.New("username or password too long")
+	}
+	req := []byte{0x01, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("%w: username/password rejected", errProxyAuth)
+	}
+	return nil
+}
+
+// socks5Command sends a request for the encoded address and returns the bound address of the reply
+func socks5Command(rw io.ReadWriter, cmd byte, addr []byte) (string, int, error) {
+	req := append([]byte{socks5Version, cmd, 0x00}, addr...)
+	if _, err := rw.Write(req); err != nil {
+		return "", 0, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socks5Version {
+		return "", 0, fmt.Errorf("unexpected SOCKS version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		return "", 0, fmt.Errorf("server replied with code %d", header[1])
+	}
+	return readSOCKS5Addr(rw)
+}
+
+// readSOCKS5Addr reads ATYP, DST.ADDR and DST.PORT
+func readSOCKS5Addr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if atyp[0] == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// appendSOCKS5Addr appends the SOCKS5 encoding of addr
+func appendSOCKS5Addr(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// appendSOCKS5Host appends the SOCKS5 encoding of a host name or IP and port
+func appendSOCKS5Host(b []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSOCKS5Addr(b, &net.UDPAddr{IP: ip, Port: port})
+	}
+	b = append(b, socks5AtypDomain, byte(len(host)))
+	b = append(b, host...)
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// supportsUDP reports whether the upstream can relay datagrams, which needs
+// UDP ASSOCIATE on a single SOCKS5 proxy unless it is a direct route
+func (u *Upstream) supportsUDP() bool {
+	if len(u.hops) == 0 {
+		return true
+	}
+	if len(u.hops) != 1 {
+		return false
+	}
+	scheme := u.hops[0].URL.Scheme
+	return scheme == config.SchemeSOCKS5 || scheme == config.SchemeSOCKS5TLS
+}
+
+// ListenPacket opens a SOCKS5 UDP ASSOCIATE session on the upstream proxy,
+// or a marked socket for a direct route. The returned PacketConn sends each
+// datagram to the address given to WriteTo.
+func (u *Upstream) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if len(u.hops) == 0 {
+		lc := net.ListenConfig{Control: markControl(u.mark)}
+		return lc.ListenPacket(ctx, "udp", "")
+	}
+	if !u.supportsUDP() {
+		return nil, fmt.Errorf("UDP relay requires a single socks5 upstream, got %s", u)
+	}
+
+	hop := u.hops[0]
+	ctrl, err := dialHop(ctx, hop)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl.SetDeadline(time.Now().Add(SOCKS5HandshakeTimeout))
+	relayAddr, err := socks5Associate(ctrl, u.user(0))
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 UDP ASSOCIATE failed: %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// Servers commonly answer with an unspecified address meaning "same host as the control connection"
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	relay, err := newBypassDialer().DialContext(ctx, "udp", relayAddr.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to connect to SOCKS5 UDP relay: %w", err)
+	}
+
+	conn := &socks5PacketConn{ctrl: ctrl, relay: relay}
+
+	// The association ends when the control connection closes
+	go func() {
+		io.Copy(io.Discard, ctrl)
+		relay.Close()
+	}()
+
+	return conn, nil
+}
+
+// socks5Associate negotiates authentication and requests a UDP relay
+func socks5Associate(ctrl net.Conn, user *url.Userinfo) (*net.UDPAddr, error) {
+	if err := socks5Auth(ctrl, user); err != nil {
+		return nil, err
+	}
+
+	// Client address is unknown before the relay socket exists, so send 0.0.0.0:0
+	host, port, err := socks5Command(ctrl, socks5CmdUDPAssoc, []byte{socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		return addr, nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// socks5PacketConn carries datagrams over a SOCKS5 UDP relay, adding and
+// stripping the RSV/FRAG/address header on each packet
+type socks5PacketConn struct {
+	ctrl    net.Conn
+	relay   net.Conn
+	readBuf []byte // used only by the single reading goroutine
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	packet := make([]byte, 0, 3+1+net.IPv6len+2+len(b))
+	packet = append(packet, 0, 0, 0) // RSV, FRAG
+	packet = appendSOCKS5Addr(packet, udpAddr)
+	packet = append(packet, b...)
+
+	if _, err := c.relay.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.readBuf == nil {
+		c.readBuf = make([]byte, 65535)
+	}
+	for {
+		n, err := c.relay.Read(c.readBuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Fragmented datagrams are not supported and are dropped, as RFC 1928 allows
+		if n < 4 || c.readBuf[2] != 0 {
+			continue
+		}
+
+		r := bytes.NewReader(c.readBuf[3:n])
+		host, port, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		copied := copy(b, c.readBuf[n-r.Len():n])
+		return copied, &net.UDPAddr{IP: net.ParseIP(host), Port: port}, nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.relay.Close()
+	return c.ctrl.Close()
+}
+
+func (c *socks5PacketConn) LocalAddr() net.Addr                { return c.relay.LocalAddr() }
+func (c *socks5PacketConn) SetDeadline(t time.Time) error      { return c.relay.SetDeadline(t) }
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) error  { return c.relay.SetReadDeadline(t) }
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) error { return c.relay.SetWriteDeadline(t) }
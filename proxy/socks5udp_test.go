@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// startMockSOCKS5UDP runs a SOCKS5 server that accepts UDP ASSOCIATE with
+// user/pass auth and echoes every datagram back with an upper-cased payload
+func startMockSOCKS5UDP(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		relay.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			reply := append([]byte(nil), buf[:n]...)
+			payload := reply[10:] // RSV(2) FRAG(1) ATYP(1) IPv4(4) PORT(2)
+			copy(payload, bytes.ToUpper(payload))
+			relay.WriteTo(reply, from)
+		}
+	}()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		greeting := make([]byte, 3)
+		io.ReadFull(conn, greeting)
+		conn.Write([]byte{0x05, 0x02})
+
+		// RFC 1929 sub-negotiation
+		header := make([]byte, 2)
+		io.ReadFull(conn, header)
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+		plen := make([]byte, 1)
+		io.ReadFull(conn, plen)
+		pass := make([]byte, plen[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "secret" {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+
+		req := make([]byte, 10)
+		io.ReadFull(conn, req)
+		if req[1] != socks5CmdUDPAssoc {
+			return
+		}
+
+		// Reply with an unspecified relay address to exercise the fallback
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		resp := []byte{0x05, 0x00, 0x00, socks5AtypIPv4, 0, 0, 0, 0}
+		resp = binary.BigEndian.AppendUint16(resp, uint16(port))
+		conn.Write(resp)
+
+		io.Copy(io.Discard, conn)
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestUpstream_ListenPacketSOCKS5(t *testing.T) {
+	addr := startMockSOCKS5UDP(t)
+	u, _ := url.Parse("socks5://user:secret@" + addr)
+	upstream := NewUpstream(config.ProxyHop{URL: u})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := upstream.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	defer conn.Close()
+
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}
+	if _, err := conn.WriteTo([]byte("quic"), target); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if string(buf[:n]) != "QUIC" {
+		t.Errorf("payload = %q, want QUIC", buf[:n])
+	}
+	if from.String() != target.String() {
+		t.Errorf("from = %v, want %v", from, target)
+	}
+}
+
+func TestUpstream_ListenPacketRequiresSOCKS5(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:8080")
+	if _, err := NewUpstream(config.ProxyHop{URL: u}).ListenPacket(context.Background()); err == nil {
+		t.Error("Expected error for http upstream")
+	}
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/datadir"
+)
+
+// sessionState is the session metadata persisted across graceful restarts.
+// Transfer counters are not part of it: transfer limits count per connection,
+// and a restart closes the connections, while the metrics are counters their
+// scrapers expect to reset with the process.
+type sessionState struct {
+	SavedAt     time.Time         `json:"saved_at"`
+	Domains     []domainState     `json:"domains"`
+	UDPSessions []udpSessionState `json:"udp_sessions"`
+}
+
+// domainState records the domain learned for a destination IP, so connections
+// made right after a restart still match domain rules without a sniff
+type domainState struct {
+	IP      string    `json:"ip"`
+	Domain  string    `json:"domain"`
+	Expires time.Time `json:"expires"`
+}
+
+// udpSessionState records a UDP NAT entry. LocalAddr is the address of the
+// remote-facing socket, rebound on restore so peers keep seeing the same source port.
+type udpSessionState struct {
+	Client     string    `json:"client"`
+	Target     string    `json:"target"`
+	LocalAddr  string    `json:"local_addr"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// saveState writes the current session metadata to the state file
+func (tp *TransparentProxy) saveState() error {
+	if tp.stateFile == "" {
+		return nil
+	}
+
+	state := sessionState{SavedAt: time.Now(), Domains: tp.domains.states()}
+	if tp.udp != nil {
+		state.UDPSessions = tp.udp.sessionStates()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	if err := datadir.WriteFile(tp.stateFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+
+	slog.Info("Session state saved", "path", tp.stateFile, "domains", len(state.Domains), "udp_sessions", len(state.UDPSessions))
+	return nil
+}
+
+// restoreState brings back the session metadata saved by a previous graceful
+// shutdown
+func (tp *TransparentProxy) restoreState(ctx context.Context) error {
+	if tp.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(tp.stateFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+
+	var state sessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to decode state: %w", err)
+	}
+
+	domains := tp.domains.restore(state.Domains)
+	sessions := 0
+	if tp.udp != nil {
+		sessions = tp.udp.restoreSessions(ctx, state.UDPSessions)
+	}
+
+	slog.Info("Session state restored", "path", tp.stateFile, "domains", domains, "udp_sessions", sessions, "saved_at", state.SavedAt)
+	return nil
+}
+
+// states returns the entries that have not expired
+func (c *domainCache) states() []domainState {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	states := make([]domainState, 0, len(c.entries))
+	for addr, e := range c.entries {
+		if now.After(e.expires) {
+			continue
+		}
+		states = append(states, domainState{IP: addr.String(), Domain: e.domain, Expires: e.expires})
+	}
+	return states
+}
+
+// restore adds the entries that have not expired, keeping their expiry, and
+// returns how many it added
+func (c *domainCache) restore(states []domainState) int {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	restored := 0
+	for _, s := range states {
+		addr, err := netip.ParseAddr(s.IP)
+		if err != nil || s.Domain == "" || now.After(s.Expires) || len(c.entries) >= maxCachedDomains {
+			continue
+		}
+		c.entries[addr.Unmap()] = cachedDomain{domain: s.Domain, expires: s.Expires}
+		restored++
+	}
+	return restored
+}
+
+// sessionStates returns the sessions a new process can resume
+func (u *UDPProxy) sessionStates() []udpSessionState {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var states []udpSessionState
+	for _, session := range u.sessions {
+		// SOCKS5 associations cannot be resumed by a new process, and restored
+		// sockets would lose the mark of a direct route
+		if session.upstream != nil {
+			continue
+		}
+		states = append(states, udpSessionState{
+			Client:     session.clientAddr.String(),
+			Target:     session.target.String(),
+			LocalAddr:  session.remoteConn.LocalAddr().String(),
+			LastActive: session.lastActive,
+		})
+	}
+	return states
+}
+
+// restoreSessions recreates saved sessions and returns how many it restored.
+// Entries older than the session timeout are discarded, as are those the
+// current rules no longer send directly on the default route.
+func (u *UDPProxy) restoreSessions(ctx context.Context, states []udpSessionState) int {
+	lc := net.ListenConfig{Control: bypassControl}
+	now := time.Now()
+	restored := 0
+
+	for _, s := range states {
+		if now.Sub(s.LastActive) > UDPSessionTimeout {
+			continue
+		}
+
+		clientAddr, err := net.ResolveUDPAddr("udp", s.Client)
+		if err != nil {
+			continue
+		}
+		target, err := net.ResolveUDPAddr("udp", s.Target)
+		if err != nil {
+			continue
+		}
+		if policy, upstream := u.router.route(target.IP, target.Port, clientAddr); policy != config.PolicyDirect || upstream != nil {
+			slog.Debug("Dropping UDP session routed differently since the restart", "from", clientAddr, "to", target, "policy", policy)
+			continue
+		}
+
+		remoteConn, err := lc.ListenPacket(ctx, "udp", s.LocalAddr)
+		if err != nil {
+			slog.Debug("Failed to rebind UDP session", "local", s.LocalAddr, "error", err)
+			continue
+		}
+
+		session := &udpSession{
+			clientAddr: clientAddr,
+			target:     target,
+			remoteConn: remoteConn,
+			lastActive: s.LastActive,
+		}
+
+		u.mu.Lock()
+		u.sessions[newUDPFlow(clientAddr, target)] = session
+		u.mu.Unlock()
+
+		go u.relaySession(ctx, session)
+		restored++
+	}
+	return restored
+}
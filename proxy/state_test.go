@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestSessionState_RoundTrip(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	remoteConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := remoteConn.LocalAddr().String()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+	key := newUDPFlow(client, target)
+	stale := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 53}
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	domains := newDomainCache()
+	domains.store(net.ParseIP("203.0.113.10"), "cdn.example.com")
+	domains.entries[netip.MustParseAddr("203.0.113.11")] = cachedDomain{domain: "old.example.com", expires: time.Now().Add(-time.Second)}
+	u := &UDPProxy{
+		conn: udpConn,
+		sessions: map[udpFlow]*udpSession{
+			key: {clientAddr: client, target: target, remoteConn: remoteConn, lastActive: time.Now()},
+			newUDPFlow(client, stale): {
+				clientAddr: client,
+				target:     stale,
+				remoteConn: remoteConn,
+				lastActive: time.Now().Add(-2 * UDPSessionTimeout),
+			},
+		},
+	}
+
+	tp := &TransparentProxy{stateFile: statePath, domains: domains, udp: u}
+	if err := tp.saveState(); err != nil {
+		t.Fatalf("saveState() error = %v", err)
+	}
+	remoteConn.Close()
+
+	// Rules rejecting the target since the restart drop the session
+	rejecting := &UDPProxy{
+		conn:     udpConn,
+		router:   &countingRouter{policy: config.PolicyReject},
+		sessions: make(map[udpFlow]*udpSession),
+	}
+	tp = &TransparentProxy{stateFile: statePath, domains: newDomainCache(), udp: rejecting}
+	if err := tp.restoreState(context.Background()); err != nil {
+		t.Fatalf("restoreState() error = %v", err)
+	}
+	if len(rejecting.sessions) != 0 {
+		t.Fatalf("restored %d sessions the rules reject, want 0", len(rejecting.sessions))
+	}
+
+	restored := &UDPProxy{
+		conn:     udpConn,
+		router:   &countingRouter{policy: config.PolicyDirect},
+		sessions: make(map[udpFlow]*udpSession),
+	}
+	tp = &TransparentProxy{stateFile: statePath, domains: newDomainCache(), udp: restored}
+	if err := tp.restoreState(context.Background()); err != nil {
+		t.Fatalf("restoreState() error = %v", err)
+	}
+
+	if got := tp.domains.lookup(net.ParseIP("203.0.113.10")); got != "cdn.example.com" {
+		t.Errorf("restored domain = %q, want cdn.example.com", got)
+	}
+	if n := len(tp.domains.entries); n != 1 {
+		t.Errorf("restored %d domains, want 1 without the expired one", n)
+	}
+
+	if len(restored.sessions) != 1 {
+		t.Fatalf("restored %d sessions, want 1", len(restored.sessions))
+	}
+	session, ok := restored.sessions[key]
+	if !ok {
+		t.Fatalf("session %v not restored", key)
+	}
+	defer session.remoteConn.Close()
+
+	if got := session.remoteConn.LocalAddr().String(); got != localAddr {
+		t.Errorf("rebound local addr = %s, want %s", got, localAddr)
+	}
+}
+
+func TestSessionState_MissingFile(t *testing.T) {
+	tp := &TransparentProxy{
+		stateFile: filepath.Join(t.TempDir(), "missing.json"),
+		domains:   newDomainCache(),
+		udp:       &UDPProxy{sessions: make(map[udpFlow]*udpSession)},
+	}
+	if err := tp.restoreState(context.Background()); err != nil {
+		t.Errorf("restoreState() error = %v, want nil for missing file", err)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/cnfatal/proxy/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// bypassControl marks outbound sockets so nftables does not intercept them again
+func bypassControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, iptables.BypassMark)
+	})
+}
+
+// markControl marks outbound sockets of a direct route, whose mark both
+// selects its routing table and bypasses interception
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+		})
+	}
+}
+
+// transparentTCPControl lets the TCP listener accept TPROXY connections to any destination
+func transparentTCPControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_TCP, syscall.TCP_NODELAY, 1)
+	})
+}
+
+// transparentUDPControl lets the UDP listener receive TPROXY datagrams along
+// with their original destination
+func transparentUDPControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, IP_RECVORIGDSTADDR, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, IPV6_RECVORIGDSTADDR, 1)
+	})
+}
+
+// transparentReplyControl allows binding UDP reply sockets to non-local addresses
+func transparentReplyControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+		if network == "udp6" {
+			level, opt = syscall.SOL_IPV6, IPV6_TRANSPARENT
+		}
+		if sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1); sockErr != nil {
+			return
+		}
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, iptables.BypassMark)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func getsockoptOriginalDst(fd int, isIPv6 bool) (*net.TCPAddr, error) {
+	if isIPv6 {
+		// sockaddr_in6 fits in the IPv6MTUInfo buffer
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, IP6T_SO_ORIGINAL_DST)
+		if err != nil {
+			return nil, fmt.Errorf("getsockopt IP6T_SO_ORIGINAL_DST: %w", err)
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	}
+
+	// sockaddr_in fits in the IPv6Mreq buffer
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", err)
+	}
+	raw := mreq.Multiaddr
+	ip := net.IPv4(raw[4], raw[5], raw[6], raw[7])
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(raw[2:4]))}, nil
+}
+
+// parseOrigDstAddr extracts the IP_RECVORIGDSTADDR/IPV6_RECVORIGDSTADDR control message
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == IP_RECVORIGDSTADDR {
+			if len(msg.Data) >= 16 {
+				port := binary.BigEndian.Uint16(msg.Data[2:4])
+				ip := net.IP(msg.Data[4:8])
+				return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+			}
+		} else if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR {
+			if len(msg.Data) >= 28 {
+				port := binary.BigEndian.Uint16(msg.Data[2:4])
+				ip := net.IP(msg.Data[8:24])
+				return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+			}
+		}
+	}
+	return nil, errors.New("no original destination control message")
+}
+
+// listNeighbors returns the MAC address of every resolved ARP/NDP neighbor
+func listNeighbors() (map[string]net.HardwareAddr, error) {
+	neighs, err := netlink.NeighList(0, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]net.HardwareAddr, len(neighs))
+	for _, n := range neighs {
+		if n.IP == nil || len(n.HardwareAddr) == 0 {
+			continue
+		}
+		if n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 {
+			continue
+		}
+		entries[n.IP.String()] = n.HardwareAddr
+	}
+	return entries, nil
+}
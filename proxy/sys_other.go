@@ -0,0 +1,44 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/cnfatal/proxy/iptables"
+)
+
+// bypassControl is a no-op: without nftables there is no interception to bypass
+func bypassControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// markControl is a no-op: socket marks and policy routing are Linux only
+func markControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return bypassControl
+}
+
+func transparentTCPControl(network, address string, c syscall.RawConn) error {
+	return iptables.ErrNotSupported
+}
+
+func transparentUDPControl(network, address string, c syscall.RawConn) error {
+	return iptables.ErrNotSupported
+}
+
+func transparentReplyControl(network, address string, c syscall.RawConn) error {
+	return iptables.ErrNotSupported
+}
+
+func getsockoptOriginalDst(fd int, isIPv6 bool) (*net.TCPAddr, error) {
+	return nil, iptables.ErrNotSupported
+}
+
+func parseOrigDstAddr(oob []byte) (*net.UDPAddr, error) {
+	return nil, iptables.ErrNotSupported
+}
+
+func listNeighbors() (map[string]net.HardwareAddr, error) {
+	return nil, iptables.ErrNotSupported
+}
@@ -2,95 +2,274 @@ package proxy
 
 import (
 	"context"
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"os"
 	"strconv"
-	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/dhcp"
 	"github.com/cnfatal/proxy/rules"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
-	// IP_RECVORIGDSTADDR is the socket option to receive the original destination address
-	IP_RECVORIGDSTADDR = 20
-	// IPV6_RECVORIGDSTADDR is the IPv6 version of IP_RECVORIGDSTADDR
-	IPV6_RECVORIGDSTADDR = 74
-	// SniffTimeout is the timeout for sniffing domain names
-	SniffTimeout = 150 * time.Millisecond
-	// UDPSessionCleanupInterval is the interval for cleaning up stale UDP sessions
-	UDPSessionCleanupInterval = 30 * time.Second
-	// UDPSessionTimeout is the timeout for inactive UDP sessions
-	UDPSessionTimeout = 60 * time.Second
+	// SniffTimeout bounds how long connection setup waits for the client to
+	// reveal a domain. Slower connections are matched by the domain last seen
+	// for their IP, or by IP, and finish the sniff while relaying.
+	SniffTimeout = 50 * time.Millisecond
 )
 
 // TransparentProxy handles transparent proxy connections
 type TransparentProxy struct {
 	listenAddr  string
-	dnsConfig   config.DNSConfig
-	upstream    *Upstream
-	matcher     *rules.Matcher
-	udpConn     *net.UDPConn
+	listening   chan struct{} // closed once the transparent TCP listener is bound
+	conns       *connTracker  // nil unless the control or status API is enabled
+	metrics     *proxyMetrics // nil unless metrics are enabled
+	explained   explainThrottle
+	schedule    *schedule
+	selections  *selections
+	limiter     connLimiter
+	idle        *idleMonitor // nil unless idle_mode_after is set
+	httpListen  string
+	socksListen string
+	sources     config.SourceFilter // non-loopback clients admitted by the explicit listeners
+	routing     atomic.Pointer[routing]
+	reloaded    chan struct{}
+	neighbors   *neighborTable
+	devices     *dhcp.Leases
+	udp         *UDPProxy
+	stateFile   string
 	sniffer     Sniffer
+	domains     *domainCache
+	origDst     OriginalDst
 	pool        BufferPool
-	udpSessions map[string]*udpSession
-	udpMu       sync.Mutex
+	marker      connMarker
+	middleware  middlewareChain
+	qos         *qos
 }
 
-type udpSession struct {
-	remoteConn net.PacketConn
-	lastActive time.Time
+// routing is the rule and policy state replaced as a whole on reload. A
+// connection loads it once so its rules and policies always agree.
+type routing struct {
+	matcher        *rules.Matcher
+	policies       *policyTable
+	dns            config.DNSConfig
+	transferLimits []config.TransferLimit
+	dialTimeout    time.Duration
+	idleTimeout    time.Duration // 0 disables
+	rejectReply    bool          // answer rejected connections with their reason
+	plaintext      config.PlaintextConfig
+	alg            algPolicy
+	warm           warmPool
+	connMarks      connMarks
+}
+
+func newRouting(cfg *config.Config, matcher *rules.Matcher) *routing {
+	policies := newPolicyTable(cfg)
+	policies.country = matcher.Country
+	return &routing{
+		matcher:        matcher,
+		policies:       policies,
+		dns:            cfg.DNS,
+		transferLimits: cfg.TransferLimits,
+		dialTimeout:    time.Duration(cfg.DialTimeout) * time.Second,
+		idleTimeout:    time.Duration(max(cfg.IdleTimeout, 0)) * time.Second,
+		rejectReply:    cfg.RejectResponse,
+		plaintext:      cfg.Plaintext,
+		alg:            newALGPolicy(cfg.ALG),
+		warm:           newWarmPool(cfg.KeepWarm),
+		connMarks:      newConnMarks(cfg.ConnMark),
+	}
 }
 
 // NewTransparentProxy creates a new transparent proxy
-func NewTransparentProxy(cfg *config.Config, matcher *rules.Matcher, pool BufferPool) *TransparentProxy {
-	var upstream *Upstream
-	if cfg.UpstreamURL != nil {
-		upstream = NewUpstream(cfg.UpstreamURL)
+func NewTransparentProxy(cfg *config.Config, matcher *rules.Matcher, pool BufferPool) (*TransparentProxy, error) {
+	origDst, err := NewOriginalDst(cfg.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices *dhcp.Leases
+	if len(cfg.DHCPLeases) > 0 {
+		files := make([]dhcp.LeaseFile, 0, len(cfg.DHCPLeases))
+		for _, l := range cfg.DHCPLeases {
+			files = append(files, dhcp.LeaseFile{Path: l.Path, Format: l.Format})
+		}
+		devices = dhcp.NewLeases(files)
+	}
+
+	sched, err := loadSchedule(cfg.DataPath(ScheduleFile))
+	if err != nil {
+		return nil, err
+	}
+	chosen, err := loadSelections(cfg.DataPath(SelectionFile))
+	if err != nil {
+		return nil, err
+	}
+
+	middleware, err := newMiddlewareChain(cfg.Middleware)
+	if err != nil {
+		return nil, err
 	}
 
-	return &TransparentProxy{
+	shaping, err := newQoS(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := &TransparentProxy{
 		listenAddr:  cfg.Listen,
-		dnsConfig:   cfg.DNS,
-		upstream:    upstream,
-		matcher:     matcher,
+		httpListen:  cfg.HTTPListen,
+		socksListen: cfg.SOCKSListen,
+		sources:     cfg.GatewaySources,
+		reloaded:    make(chan struct{}, 1),
+		listening:   make(chan struct{}),
+		neighbors:   newNeighborTable(),
+		devices:     devices,
 		sniffer:     NewSniffer(pool, SniffTimeout),
+		domains:     newDomainCache(),
+		stateFile:   cfg.DataPath(cfg.StateFile),
+		origDst:     origDst,
 		pool:        pool,
-		udpSessions: make(map[string]*udpSession),
+		limiter:     newConnLimiter(cfg.MaxConnections),
+		idle:        newIdleMonitor(time.Duration(cfg.IdleModeAfter) * time.Second),
+		schedule:    sched,
+		selections:  chosen,
+		middleware:  middleware,
+		qos:         shaping,
+	}
+	rt := newRouting(cfg, matcher)
+	chosen.apply(rt.policies)
+	tp.routing.Store(rt)
+	if cfg.APIListen != "" || cfg.StatusListen != "" {
+		tp.conns = newConnTracker()
+	}
+	if cfg.MetricsListen != "" {
+		tp.metrics = newProxyMetrics(cfg.MetricsSample)
 	}
+	if len(cfg.UDPPorts) > 0 {
+		tp.udp = newUDPProxy(cfg.Listen, tp.origDst, tp)
+	}
+	return tp, nil
+}
+
+// Reload replaces the rules, proxies, groups, DNS settings, transfer limits and
+// timeouts. Relays already running keep the state they started with. The
+// listener, interception mode, connection limit, UDP and DHCP settings only
+// change on restart.
+func (tp *TransparentProxy) Reload(cfg *config.Config, matcher *rules.Matcher) {
+	rt := newRouting(cfg, matcher)
+	rt.policies.keepRenewed(tp.routing.Load().policies)
+	// Holding the lock keeps a selection made meanwhile from being lost
+	tp.selections.mu.Lock()
+	tp.selections.apply(rt.policies)
+	tp.routing.Store(rt)
+	tp.selections.mu.Unlock()
+	select {
+	case tp.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+// DisableInterception leaves out the transparent TCP and UDP listeners, for
+// running without nftables where only the explicit listeners get connections
+func (tp *TransparentProxy) DisableInterception() {
+	tp.listenAddr = ""
+	tp.udp = nil
 }
 
 // Run begins listening for connections and runs until context is cancelled
 func (tp *TransparentProxy) Run(ctx context.Context) error {
 	g, ctx := errgroup.WithContext(ctx)
 
-	g.Go(func() error {
-		return tp.runTCP(ctx)
-	})
+	if err := tp.restoreState(ctx); err != nil {
+		slog.Warn("Failed to restore session state", "path", tp.stateFile, "error", err)
+	}
+	defer func() {
+		if err := tp.saveState(); err != nil {
+			slog.Warn("Failed to save session state", "path", tp.stateFile, "error", err)
+		}
+	}()
+
+	if tp.listenAddr != "" {
+		g.Go(func() error {
+			return tp.runTCP(ctx)
+		})
+	}
+
+	if tp.udp != nil {
+		g.Go(func() error {
+			return tp.udp.Run(ctx)
+		})
+	}
+
+	if tp.httpListen != "" {
+		g.Go(func() error {
+			return tp.runInbound(ctx, "http", tp.httpListen, tp.handleHTTPConnect)
+		})
+	}
+	if tp.socksListen != "" {
+		g.Go(func() error {
+			return tp.runInbound(ctx, "socks5", tp.socksListen, tp.handleSOCKS5)
+		})
+	}
 
 	g.Go(func() error {
-		return tp.runUDP(ctx)
+		return tp.runPolicies(ctx)
 	})
 
+	if tp.devices != nil {
+		g.Go(func() error {
+			return tp.devices.Run(ctx)
+		})
+	}
+
 	return g.Wait()
 }
 
+// runPolicies health checks the current policy table and keeps its warm
+// tunnels connected, restarting both for the new routing after each reload
+// and whenever the proxy enters or leaves idle mode. Idle proxies keep no
+// warm tunnels.
+func (tp *TransparentProxy) runPolicies(ctx context.Context) error {
+	for {
+		rt := tp.routing.Load()
+		idle := tp.idle.isIdle()
+		checkCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			wg.Go(func() { rt.policies.Run(checkCtx, idle) })
+			if !idle {
+				wg.Go(func() { rt.warm.run(checkCtx, tp, rt) })
+			}
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-tp.reloaded:
+		case <-tp.idle.transitions():
+		}
+		cancel()
+		<-done
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
 func (tp *TransparentProxy) runTCP(ctx context.Context) error {
 	// Start TCP listener with IP_TRANSPARENT to support TPROXY
-	lc := net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
-				syscall.SetsockoptInt(int(fd), syscall.SOL_TCP, syscall.TCP_NODELAY, 1)
-			})
-		},
-	}
+	lc := net.ListenConfig{Control: transparentTCPControl}
 
 	listener, err := lc.Listen(ctx, "tcp", tp.listenAddr)
 	if err != nil {
@@ -99,6 +278,7 @@ func (tp *TransparentProxy) runTCP(ctx context.Context) error {
 	defer listener.Close()
 
 	slog.Info("Transparent TCP proxy listening", "addr", tp.listenAddr)
+	close(tp.listening)
 
 	go func() {
 		<-ctx.Done()
@@ -119,195 +299,16 @@ func (tp *TransparentProxy) runTCP(ctx context.Context) error {
 			}
 		}
 
-		go tp.handleConnection(ctx, conn)
-	}
-}
-
-func (tp *TransparentProxy) runUDP(ctx context.Context) error {
-	// Start UDP listener for DNS and general UDP
-	lc := net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
-				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, IP_RECVORIGDSTADDR, 1)
-				syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, IPV6_RECVORIGDSTADDR, 1)
-			})
-		},
-	}
-
-	packetConn, err := lc.ListenPacket(ctx, "udp", tp.listenAddr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on UDP %s: %w", tp.listenAddr, err)
-	}
-	udpConn, ok := packetConn.(*net.UDPConn)
-	if !ok {
-		return fmt.Errorf("expected *net.UDPConn, got %T", packetConn)
-	}
-	tp.udpConn = udpConn
-	defer udpConn.Close()
-
-	slog.Info("Transparent UDP proxy listening", "addr", tp.listenAddr)
-
-	go tp.cleanupUDPSessions(ctx)
-
-	go func() {
-		<-ctx.Done()
-		udpConn.Close()
-	}()
-
-	tp.udpLoop(ctx)
-	return nil
-}
-
-func (tp *TransparentProxy) udpLoop(ctx context.Context) {
-	buf := make([]byte, 65535)
-	oob := make([]byte, 1024)
-	for {
-		n, oobn, _, srcAddr, err := tp.udpConn.ReadMsgUDP(buf, oob)
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				return
-			}
-			slog.Error("UDP read error", "error", err)
-			continue
-		}
-
-		origDst := tp.getOriginalUDPAddr(oob[:oobn])
-		if origDst == nil {
+		tp.idle.touch()
+		if !tp.limiter.acquire() {
+			slog.Warn("Connection limit reached, refusing connection", "from", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-
-		// Loop detection: if the original destination is the proxy itself, ignore it
-		listenPort, _ := GetListenPort(tp.listenAddr)
-		if origDst.Port == listenPort {
-			if origDst.IP.IsLoopback() || origDst.IP.IsUnspecified() {
-				continue
-			}
-		}
-
-		data := make([]byte, n)
-		copy(data, buf[:n])
-
-		if origDst.Port == 53 {
-			go tp.handleDNSUDP(ctx, srcAddr, origDst, data)
-		} else {
-			go tp.handleGeneralUDP(ctx, srcAddr, origDst, data)
-		}
-	}
-}
-
-func (tp *TransparentProxy) getOriginalUDPAddr(oob []byte) *net.UDPAddr {
-	msgs, err := syscall.ParseSocketControlMessage(oob)
-	if err != nil {
-		return nil
-	}
-	for _, msg := range msgs {
-		if msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == IP_RECVORIGDSTADDR {
-			if len(msg.Data) >= 16 {
-				port := binary.BigEndian.Uint16(msg.Data[2:4])
-				ip := net.IP(msg.Data[4:8])
-				return &net.UDPAddr{IP: ip, Port: int(port)}
-			}
-		} else if msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == IPV6_RECVORIGDSTADDR {
-			if len(msg.Data) >= 28 {
-				port := binary.BigEndian.Uint16(msg.Data[2:4])
-				ip := net.IP(msg.Data[8:24])
-				return &net.UDPAddr{IP: ip, Port: int(port)}
-			}
-		}
-	}
-	return nil
-}
-
-func (tp *TransparentProxy) handleGeneralUDP(ctx context.Context, srcAddr net.Addr, origDst *net.UDPAddr, data []byte) {
-	result := tp.matcher.Match("", origDst.IP)
-	switch result.Policy {
-	case config.PolicyReject:
-		slog.Info("Rejecting UDP connection", "target", origDst.String(), "ip", origDst.IP)
-		return
-	case config.PolicyProxy:
-		slog.Warn("UDP proxy is not supported, dropping packet", "target", origDst.String(), "ip", origDst.IP, "port", origDst.Port, "upstream", tp.upstreamScheme())
-		if origDst.Port == 443 {
-			slog.Info("Dropping UDP/443 traffic because transparent UDP proxying is unsupported", "target", origDst.String(), "ip", origDst.IP)
-		}
-		return
-	}
-
-	key := fmt.Sprintf("%s-%s", srcAddr.String(), origDst.String())
-
-	tp.udpMu.Lock()
-	session, ok := tp.udpSessions[key]
-	if !ok {
-		// Create new session
-		lc := net.ListenConfig{
-			Control: bypassControl,
-		}
-		remoteConn, err := lc.ListenPacket(ctx, "udp", "")
-		if err != nil {
-			tp.udpMu.Unlock()
-			slog.Error("Failed to create UDP session", "error", err)
-			return
-		}
-
-		session = &udpSession{
-			remoteConn: remoteConn,
-			lastActive: time.Now(),
-		}
-		tp.udpSessions[key] = session
-		tp.udpMu.Unlock()
-
-		// Start relay from remote to client
 		go func() {
-			buf := make([]byte, 65535)
-			for {
-				n, _, err := remoteConn.ReadFrom(buf)
-				if err != nil {
-					return
-				}
-
-				tp.udpMu.Lock()
-				session.lastActive = time.Now()
-				tp.udpMu.Unlock()
-
-				if _, err := tp.udpConn.WriteTo(buf[:n], srcAddr); err != nil {
-					return
-				}
-			}
+			defer tp.limiter.release()
+			tp.handleConnection(ctx, conn)
 		}()
-	} else {
-		session.lastActive = time.Now()
-		tp.udpMu.Unlock()
-	}
-
-	_, _ = session.remoteConn.WriteTo(data, origDst)
-}
-
-func (tp *TransparentProxy) upstreamScheme() string {
-	if tp.upstream == nil || tp.upstream.url == nil {
-		return ""
-	}
-	return tp.upstream.url.Scheme
-}
-
-func (tp *TransparentProxy) cleanupUDPSessions(ctx context.Context) {
-	ticker := time.NewTicker(UDPSessionCleanupInterval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			tp.udpMu.Lock()
-			now := time.Now()
-			for key, session := range tp.udpSessions {
-				if now.Sub(session.lastActive) > UDPSessionTimeout {
-					session.remoteConn.Close()
-					delete(tp.udpSessions, key)
-				}
-			}
-			tp.udpMu.Unlock()
-		}
 	}
 }
 
@@ -323,9 +324,14 @@ func (tp *TransparentProxy) handleConnection(ctx context.Context, client net.Con
 	}
 
 	// Get the original destination address
-	origDst, ok := client.LocalAddr().(*net.TCPAddr)
-	if !ok {
-		slog.Error("Failed to get original destination: not a TCP address")
+	origDst, err := tp.origDst.TCP(client)
+	if err != nil {
+		slog.Error("Failed to get original destination", "from", client.RemoteAddr(), "error", err)
+		return
+	}
+
+	if isSelfTest(origDst) {
+		io.WriteString(client, selfTestReply)
 		return
 	}
 
@@ -344,10 +350,16 @@ func (tp *TransparentProxy) handleConnection(ctx context.Context, client net.Con
 		return // client will be closed by handleDNSTCP
 	}
 
-	targetAddr := origDst.String()
-	clientAddr := client.RemoteAddr().String()
+	slog.Debug("New connection", "from", client.RemoteAddr(), "device", tp.deviceName(client.RemoteAddr()), "to", origDst)
 
-	slog.Debug("New connection", "from", clientAddr, "to", targetAddr)
+	// Destinations seen recently are dialed while sniffing, unless middleware
+	// may still refuse the connection
+	cached := tp.domains.lookup(origDst.IP)
+	var pre *earlyDial
+	if cached != "" && len(tp.middleware) == 0 {
+		pre = tp.dialEarly(ctx, cached, origDst, client.RemoteAddr())
+		defer pre.release()
+	}
 
 	// Sniff domain from the connection (TLS SNI or HTTP Host)
 	domain, peeked, err := tp.sniffer.Sniff(client)
@@ -360,45 +372,279 @@ func (tp *TransparentProxy) handleConnection(ctx context.Context, client net.Con
 		client = NewPeekedConn(client, peeked, tp.pool)
 	}
 
-	ip := origDst.IP
+	switch {
+	case domain != "":
+		tp.domains.store(origDst.IP, domain)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		domain = cached
+		client = newLateSniffConn(client, tp.pool, origDst.IP, tp.domains)
+	}
+
+	tp.forward(ctx, client, "tproxy", domain, origDst, pre, nil)
+}
+
+// forward matches a connection against the rules, connects to its destination
+// and relays until either side closes. dst.IP is nil when only the domain is
+// known, as for explicit proxy requests by hostname. reply, if set, reports the
+// outcome to an explicit proxy client before relaying: a *rejection for REJECT,
+// the dial error, or nil once connected. pre, if set, is a connection dialed
+// while sniffing, used when the rules lead to the same destination, and its
+// match is reused when the sniff confirms the cached domain.
+func (tp *TransparentProxy) forward(ctx context.Context, client net.Conn, inbound, domain string, dst *net.TCPAddr, pre *earlyDial, reply func(error) error) {
+	targetAddr := dst.String()
+	if dst.IP == nil {
+		targetAddr = net.JoinHostPort(domain, strconv.Itoa(dst.Port))
+	}
+	device := tp.deviceName(client.RemoteAddr())
+	ip := dst.IP
+	rt := tp.routing.Load()
+
+	reject := func(reason func() string) {
+		rej := &rejection{}
+		if rt.rejectReply {
+			rej.reason = reason()
+		}
+		switch {
+		case reply != nil:
+			reply(rej)
+		case rt.rejectReply:
+			rejectIntercepted(client, rej.reason)
+		}
+	}
+	var info *ConnInfo
+	if len(tp.middleware) > 0 {
+		info = &ConnInfo{Inbound: inbound, Source: client.RemoteAddr(), Device: device, Destination: targetAddr, Domain: domain}
+		if err := tp.middleware.accept(info); err != nil {
+			slog.Info("Middleware rejected connection", "target", targetAddr, "domain", domain, "device", device, "error", err)
+			reject(err.Error)
+			return
+		}
+	}
+
+	// Match against rules, unless the early dial already matched this domain
+	result, ok := pre.matched(rt, domain)
+	if !ok {
+		result = tp.match(rt, domain, ip, dst.Port, client.RemoteAddr())
+	}
+
+	var rule string
+	if result.Rule != nil && (tp.conns != nil || tp.metrics != nil || tp.qos != nil || info != nil) {
+		rule = result.Rule.String()
+	}
+	if info != nil {
+		info.Rule, info.Policy = rule, result.Policy
+		if err := tp.middleware.match(info); err != nil {
+			slog.Info("Middleware rejected connection", "target", targetAddr, "domain", domain, "device", device, "error", err)
+			reject(err.Error)
+			return
+		}
+		result.Policy = info.Policy
+	}
 
-	// Match against rules
-	result := tp.matcher.Match(domain, ip)
+	routeKey := routingKey(domain, ip)
+	policy, upstream := rt.policies.resolve(result.Policy, routeKey)
+	alg := rt.alg.protocol(dst.Port)
+	policy, upstream = rt.alg.apply(alg, policy, upstream)
+
+	if tp.metrics != nil {
+		tp.metrics.connections.With(inbound, string(result.Policy), rule).Inc()
+	}
 
 	var serverConn net.Conn
+	var err error
 
-	switch result.Policy {
+	switch policy {
 	case config.PolicyReject:
-		slog.Info("Rejecting connection", "target", targetAddr, "domain", domain, "ip", ip)
+		slog.Info("Rejecting connection", "target", targetAddr, "domain", domain, "ip", ip, "device", device)
+		reject(func() string { return rejectReason(result.Rule) })
 		return
 
 	case config.PolicyDirect:
-		slog.Debug("Direct connection", "target", targetAddr, "domain", domain)
-		serverConn, err = DirectConnect(ctx, targetAddr)
+		if upstream != nil {
+			slog.Debug("Direct connection", "target", targetAddr, "domain", domain, "route", upstream)
+		} else {
+			slog.Debug("Direct connection", "target", targetAddr, "domain", domain)
+		}
 
 	case config.PolicyProxy:
-		if tp.upstream == nil {
+		if upstream == nil {
 			slog.Warn("No upstream proxy configured, using direct connection")
-			serverConn, err = DirectConnect(ctx, targetAddr)
 		} else {
-			upstreamTargetAddr := buildUpstreamTargetAddr(domain, origDst)
-			slog.Debug("Proxying connection", "target", targetAddr, "upstream_target", upstreamTargetAddr, "domain", domain, "policy", result.Policy)
-			serverConn, err = tp.upstream.Connect(ctx, upstreamTargetAddr)
+			slog.Debug("Proxying connection", "target", targetAddr, "upstream_target", buildUpstreamTargetAddr(domain, dst), "domain", domain, "policy", result.Policy)
 		}
 	}
 
+	plan := newDialPlan(policy, upstream, domain, dst, targetAddr)
+	var early bool
+	if serverConn, err, early = pre.take(plan); !early {
+		if serverConn = rt.warm.take(plan); serverConn != nil {
+			slog.Debug("Using warm connection", "target", plan.target, "upstream", plan.upstream)
+		} else {
+			dialCtx, cancel := context.WithTimeout(ctx, rt.dialTimeout)
+			serverConn, err = tp.dial(dialCtx, plan)
+			cancel()
+		}
+	}
+
+	if err != nil && tp.metrics != nil {
+		tp.metrics.dialErrors.With(string(result.Policy)).Inc()
+	}
+	if reply != nil {
+		if replyErr := reply(err); replyErr != nil && err == nil {
+			err = replyErr
+		}
+	}
 	if err != nil {
-		slog.Error("Failed to connect", "target", targetAddr, "error", err)
+		if serverConn != nil {
+			serverConn.Close()
+		}
+		slog.Error("Failed to connect", "target", targetAddr, "device", device, "error", err)
 		return
 	}
 	defer serverConn.Close()
+	if mark, ok := rt.connMarks.lookup(result.Policy, policy); ok {
+		tp.marker.mark(rt.connMarks.mask, mark, client, serverConn)
+	}
+	if info != nil {
+		if serverConn, err = tp.middleware.dialed(info, serverConn); err != nil {
+			slog.Info("Middleware closed connection", "target", targetAddr, "device", device, "error", err)
+			return
+		}
+	}
 
 	// Relay data between client and server
-	Relay(serverConn, client, tp.pool)
+	hook := chainHooks(
+		newTransferHook(rt.transferLimits, result.Policy),
+		rt.policies.classifier(result.Policy, routeKey),
+	)
+	up, down := hook, hook
+	if tp.qos != nil {
+		paceUp, paceDown := tp.qos.hooks(rule, result.Policy)
+		up, down = chainHooks(up, paceUp), chainHooks(down, paceDown)
+	}
+	if info != nil {
+		countUp, countDown, closed := tp.middleware.relayed(info)
+		up, down = chainHooks(up, countUp), chainHooks(down, countDown)
+		defer closed()
+	}
+	if tp.metrics != nil {
+		countUp, countDown, observe := tp.metrics.relayHooks(string(result.Policy), rule)
+		up, down = chainHooks(up, countUp), chainHooks(down, countDown)
+		defer observe()
+
+		active := tp.metrics.active.With(inbound)
+		active.Inc()
+		defer active.Dec()
+	}
+	var src net.Conn = client
+	if rt.plaintext.Action != "" {
+		src = newPlaintextConn(client, rt.plaintext, dst.Port, func(protocol string) bool {
+			if rt.plaintext.Action != config.PlaintextReject {
+				slog.Warn("Plaintext connection", "protocol", protocol, "target", targetAddr, "domain", domain, "device", device)
+				return false
+			}
+			slog.Warn("Rejecting plaintext connection", "protocol", protocol, "target", targetAddr, "domain", domain, "device", device)
+			client.Close()
+			serverConn.Close()
+			return true
+		})
+	}
+	switch alg {
+	case algSIP:
+		if rt.alg.action == config.ALGWarn {
+			slog.Warn("SIP connection, addresses in its messages are not rewritten", "target", targetAddr, "device", device)
+		}
+	case algFTP:
+		ctl := &ftpControl{
+			client:   addrIP(client.RemoteAddr()),
+			extended: ip != nil && ip.To4() == nil,
+			rewrite:  rt.alg.action == config.ALGRewrite,
+			warn: func() {
+				slog.Warn("Active FTP fails through the proxy, use passive mode", "target", targetAddr, "device", device)
+			},
+			openData: func(port int, addr *net.TCPAddr) {
+				up, down := tp.qos.hooks(rule, result.Policy)
+				tp.relayFTPData(ctx, rt, plan, port, addr, up, down)
+			},
+		}
+		src = &ftpConn{Conn: src, ctl: ctl, filter: ctl.command}
+		if ctl.rewrite {
+			serverConn = &ftpConn{Conn: serverConn, ctl: ctl, filter: ctl.reply}
+		}
+	}
+	if tp.conns != nil {
+		info := Connection{
+			Inbound:     inbound,
+			Source:      client.RemoteAddr().String(),
+			Device:      device,
+			Destination: targetAddr,
+			Domain:      domain,
+			Rule:        rule,
+			Policy:      result.Policy,
+		}
+		if upstream != nil {
+			info.Upstream = upstream.String()
+		}
+		tracked := tp.conns.add(info, func() {
+			client.Close()
+			serverConn.Close()
+		})
+		defer tp.conns.remove(tracked)
+		up, down = chainHooks(up, tracked.countUpload), chainHooks(down, tracked.countDownload)
+	}
+	Relay(serverConn, src, tp.pool, up, down, rt.idleTimeout)
 
 	slog.Debug("Relay completed", "target", targetAddr)
 }
 
+// match evaluates the rules for a connection, resolving the client MAC only when a rule needs it
+func (tp *TransparentProxy) match(rt *routing, domain string, dst net.IP, port int, src net.Addr) rules.MatchResult {
+	md := &rules.Metadata{Domain: domain, DstIP: dst, DstPort: uint16(port)}
+	if tp.neighbors != nil && (rt.matcher.HasSourceMACRules() || tp.schedule.hasSourceMACRules()) {
+		md.SrcMAC = tp.neighbors.Lookup(addrIP(src))
+	}
+	if result, ok := tp.schedule.match(md, time.Now()); ok {
+		slog.Debug("Scheduled rule matched", "target", routingKey(domain, dst), "rule", result.Rule.String())
+		return result
+	}
+	result := rt.matcher.MatchMetadata(md)
+	tp.explainMatch(rt, md, result)
+	return result
+}
+
+// route matches the rules for a datagram and resolves the policy serving it
+func (tp *TransparentProxy) route(dst net.IP, port int, src net.Addr) (config.Policy, *Upstream) {
+	tp.idle.touch()
+	rt := tp.routing.Load()
+	result := tp.match(rt, "", dst, port, src)
+	policy, upstream := rt.policies.resolve(result.Policy, dst.String())
+	return rt.alg.apply(rt.alg.protocol(port), policy, upstream)
+}
+
+// deviceName returns the DHCP hostname of the client at addr, if known
+func (tp *TransparentProxy) deviceName(addr net.Addr) string {
+	return tp.devices.Name(addrIP(addr))
+}
+
+// addrIP extracts the IP from a TCP or UDP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// routingKey identifies a destination for load-balance groups
+func routingKey(domain string, ip net.IP) string {
+	if domain != "" {
+		return domain
+	}
+	return ip.String()
+}
+
 func buildUpstreamTargetAddr(domain string, origDst *net.TCPAddr) string {
 	if domain == "" {
 		return origDst.String()
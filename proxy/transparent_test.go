@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"net"
-	"net/url"
 	"testing"
+	"time"
 
 	"github.com/cnfatal/proxy/config"
 	"github.com/cnfatal/proxy/rules"
@@ -19,8 +22,6 @@ func TestTransparentProxy_UDPPolicyByIP(t *testing.T) {
 		{Type: rules.RuleTypeMatch, Policy: config.PolicyProxy},
 	})
 
-	tp := &TransparentProxy{matcher: matcher}
-
 	tests := []struct {
 		name string
 		ip   string
@@ -33,7 +34,7 @@ func TestTransparentProxy_UDPPolicyByIP(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := tp.matcher.Match("", net.ParseIP(tt.ip)).Policy
+			got := matcher.Match("", net.ParseIP(tt.ip)).Policy
 			if got != tt.want {
 				t.Fatalf("Match(%s) = %s, want %s", tt.ip, got, tt.want)
 			}
@@ -41,31 +42,107 @@ func TestTransparentProxy_UDPPolicyByIP(t *testing.T) {
 	}
 }
 
-func TestTransparentProxy_UpstreamScheme(t *testing.T) {
-	tp := &TransparentProxy{}
-	if got := tp.upstreamScheme(); got != "" {
-		t.Fatalf("upstreamScheme() = %q, want empty", got)
+func TestBuildUpstreamTargetAddr(t *testing.T) {
+	origDst := &net.TCPAddr{IP: net.ParseIP("104.244.43.104"), Port: 443}
+
+	if got := buildUpstreamTargetAddr("chatgpt.com", origDst); got != "chatgpt.com:443" {
+		t.Fatalf("buildUpstreamTargetAddr(domain) = %q, want %q", got, "chatgpt.com:443")
+	}
+
+	if got := buildUpstreamTargetAddr("", origDst); got != "104.244.43.104:443" {
+		t.Fatalf("buildUpstreamTargetAddr(ip) = %q, want %q", got, "104.244.43.104:443")
 	}
+}
 
-	proxyURL, err := url.Parse("socks5://127.0.0.1:1080")
+func TestTransparentProxy_SniffedDomainDrivesMatch(t *testing.T) {
+	parsed, err := rules.ParseRules([]string{
+		"DOMAIN-SUFFIX,example.com,PROXY",
+		"MATCH,DIRECT",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tp.upstream = NewUpstream(proxyURL)
-	if got := tp.upstreamScheme(); got != "socks5" {
-		t.Fatalf("upstreamScheme() = %q, want socks5", got)
+	pool := NewBufferPool()
+	tp := &TransparentProxy{
+		sniffer:  NewSniffer(pool, time.Second),
+		pool:     pool,
+		schedule: newSchedule(""),
+	}
+	rt := &routing{matcher: rules.NewMatcher(parsed)}
+
+	hello := captureClientHello(t, "cdn.example.com")
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go c1.Write(hello)
+
+	domain, peeked, err := tp.sniffer.Sniff(c2)
+	if err != nil {
+		t.Fatalf("Sniff failed: %v", err)
+	}
+
+	// The CDN address alone would fall through to MATCH; the SNI must select PROXY
+	dst := net.ParseIP("203.0.113.10")
+	if got := tp.match(rt, domain, dst, 443, nil).Policy; got != config.PolicyProxy {
+		t.Errorf("match(%q) = %v, want PROXY", domain, got)
+	}
+	if got := tp.match(rt, "", dst, 443, nil).Policy; got != config.PolicyDirect {
+		t.Errorf("match(ip only) = %v, want DIRECT", got)
+	}
+
+	// The buffered ClientHello is replayed before the rest of the stream
+	replay := NewPeekedConn(c2, peeked, pool)
+	buf := make([]byte, len(hello))
+	if _, err := io.ReadFull(replay, buf); err != nil {
+		t.Fatalf("replay read: %v", err)
+	}
+	if !bytes.Equal(buf, hello) {
+		t.Error("replayed bytes differ from the original ClientHello")
 	}
 }
 
-func TestBuildUpstreamTargetAddr(t *testing.T) {
-	origDst := &net.TCPAddr{IP: net.ParseIP("104.244.43.104"), Port: 443}
+func TestTransparentProxy_Reload(t *testing.T) {
+	parse := func(entries ...string) *rules.Matcher {
+		t.Helper()
+		parsed, err := rules.ParseRules(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules.NewMatcher(parsed)
+	}
 
-	if got := buildUpstreamTargetAddr("chatgpt.com", origDst); got != "chatgpt.com:443" {
-		t.Fatalf("buildUpstreamTargetAddr(domain) = %q, want %q", got, "chatgpt.com:443")
+	cfg := &config.Config{Listen: ":12345", UDPPorts: []uint16{53}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tp, err := NewTransparentProxy(cfg, parse("MATCH,DIRECT"), NewBufferPool())
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if got := buildUpstreamTargetAddr("", origDst); got != "104.244.43.104:443" {
-		t.Fatalf("buildUpstreamTargetAddr(ip) = %q, want %q", got, "104.244.43.104:443")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- tp.runPolicies(ctx) }()
+
+	dst := net.ParseIP("203.0.113.10")
+	if policy, _ := tp.route(dst, 443, nil); policy != config.PolicyDirect {
+		t.Fatalf("route() before reload = %s, want DIRECT", policy)
+	}
+
+	tp.Reload(cfg, parse("IP-CIDR,203.0.113.0/24,REJECT", "MATCH,DIRECT"))
+	if policy, _ := tp.route(dst, 443, nil); policy != config.PolicyReject {
+		t.Fatalf("route() after reload = %s, want REJECT", policy)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runPolicies() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("runPolicies did not stop")
 	}
 }
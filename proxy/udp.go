@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	// IP_RECVORIGDSTADDR is the socket option to receive the original destination address
+	IP_RECVORIGDSTADDR = 20
+	// IPV6_RECVORIGDSTADDR is the IPv6 version of IP_RECVORIGDSTADDR
+	IPV6_RECVORIGDSTADDR = 74
+	// IPV6_TRANSPARENT is the IPv6 version of IP_TRANSPARENT
+	IPV6_TRANSPARENT = 75
+	// UDPSessionCleanupInterval is the interval for cleaning up stale UDP sessions
+	UDPSessionCleanupInterval = 30 * time.Second
+	// UDPSessionTimeout is the timeout for inactive UDP sessions, and how long
+	// the datagrams of a rejected flow are dropped without routing them again
+	UDPSessionTimeout = 60 * time.Second
+)
+
+// udpRouter is the rule and DNS logic the UDP relay shares with the TCP proxy
+type udpRouter interface {
+	route(dst net.IP, port int, src net.Addr) (config.Policy, *Upstream)
+	warnALG(dst *net.UDPAddr, src net.Addr)
+	deviceName(addr net.Addr) string
+	handleDNSRequest(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
+}
+
+// UDPProxy relays UDP datagrams intercepted by TPROXY, either directly or
+// through a SOCKS5 UDP ASSOCIATE session. Replies are sent from a transparent
+// socket bound to the original destination so clients accept them.
+type UDPProxy struct {
+	listenAddr string
+	origDst    OriginalDst
+	router     udpRouter
+
+	conn     *net.UDPConn
+	sessions map[udpFlow]*udpSession
+	rejected map[udpFlow]time.Time // flows dropped until then
+	mu       sync.Mutex
+}
+
+// udpFlow identifies a session by its client and original destination
+type udpFlow struct {
+	client, target netip.AddrPort
+}
+
+func newUDPFlow(client, target *net.UDPAddr) udpFlow {
+	return udpFlow{client: unmapAddrPort(client), target: unmapAddrPort(target)}
+}
+
+// unmapAddrPort keys IPv4 addresses the same whether read as 4 or 16 bytes
+func unmapAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	ap := addr.AddrPort()
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// udpSession is a flow routed once when its first datagram arrived
+type udpSession struct {
+	clientAddr *net.UDPAddr
+	target     *net.UDPAddr
+	remoteConn net.PacketConn
+	upstream   *Upstream // nil for a direct route
+	lastActive time.Time
+}
+
+func newUDPProxy(listenAddr string, origDst OriginalDst, router udpRouter) *UDPProxy {
+	return &UDPProxy{
+		listenAddr: listenAddr,
+		origDst:    origDst,
+		router:     router,
+		sessions:   make(map[udpFlow]*udpSession),
+		rejected:   make(map[udpFlow]time.Time),
+	}
+}
+
+// Run receives intercepted datagrams until the context is cancelled
+func (u *UDPProxy) Run(ctx context.Context) error {
+	lc := net.ListenConfig{Control: transparentUDPControl}
+
+	packetConn, err := lc.ListenPacket(ctx, "udp", u.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP %s: %w", u.listenAddr, err)
+	}
+	udpConn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("expected *net.UDPConn, got %T", packetConn)
+	}
+	u.conn = udpConn
+	defer udpConn.Close()
+
+	slog.Info("Transparent UDP proxy listening", "addr", u.listenAddr)
+
+	go u.cleanupSessions(ctx)
+
+	go func() {
+		<-ctx.Done()
+		udpConn.Close()
+	}()
+
+	u.loop(ctx)
+	return nil
+}
+
+func (u *UDPProxy) loop(ctx context.Context) {
+	listenPort, _ := GetListenPort(u.listenAddr)
+	buf := make([]byte, 65535)
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, srcAddr, err := u.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("UDP read error", "error", err)
+			continue
+		}
+
+		origDst, err := u.origDst.UDP(oob[:oobn])
+		if err != nil {
+			slog.Debug("Failed to get original UDP destination", "from", srcAddr, "error", err)
+			continue
+		}
+
+		// Loop detection: if the original destination is the proxy itself, ignore it
+		if origDst.Port == listenPort {
+			if origDst.IP.IsLoopback() || origDst.IP.IsUnspecified() {
+				continue
+			}
+		}
+
+		flow := newUDPFlow(srcAddr, origDst)
+		if origDst.Port != 53 && u.forward(flow, origDst, buf[:n]) {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		if origDst.Port == 53 {
+			go u.handleDNS(ctx, srcAddr, origDst, data)
+		} else {
+			go u.handlePacket(ctx, flow, srcAddr, origDst, data)
+		}
+	}
+}
+
+// forward sends a datagram of an established flow and drops one of a
+// rejected flow, reporting false when the flow has yet to be routed
+func (u *UDPProxy) forward(flow udpFlow, origDst *net.UDPAddr, data []byte) bool {
+	now := time.Now()
+	u.mu.Lock()
+	session, ok := u.sessions[flow]
+	if ok {
+		session.lastActive = now
+	} else if until, rejected := u.rejected[flow]; rejected && now.Before(until) {
+		u.mu.Unlock()
+		return true
+	}
+	u.mu.Unlock()
+	if !ok {
+		return false
+	}
+	_, _ = session.remoteConn.WriteTo(data, origDst)
+	return true
+}
+
+// reject drops the datagrams of flow for the session timeout, reporting
+// false if it was already rejected so the log shows each flow once
+func (u *UDPProxy) reject(flow udpFlow) bool {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if until, ok := u.rejected[flow]; ok && now.Before(until) {
+		return false
+	}
+	u.rejected[flow] = now.Add(UDPSessionTimeout)
+	return true
+}
+
+func (u *UDPProxy) handleDNS(ctx context.Context, srcAddr, origDst *net.UDPAddr, data []byte) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return
+	}
+
+	reply, err := dialTransparentUDP(ctx, origDst, srcAddr)
+	if err != nil {
+		slog.Error("Failed to create DNS reply socket", "from", origDst, "to", srcAddr, "error", err)
+		return
+	}
+	defer reply.Close()
+
+	u.router.handleDNSRequest(ctx, &udpDNSWriter{conn: reply}, msg)
+}
+
+// handlePacket routes the first datagram of a flow and opens its session
+func (u *UDPProxy) handlePacket(ctx context.Context, flow udpFlow, srcAddr, origDst *net.UDPAddr, data []byte) {
+	policy, upstream := u.router.route(origDst.IP, origDst.Port, srcAddr)
+
+	switch policy {
+	case config.PolicyReject:
+		if u.reject(flow) {
+			slog.Info("Rejecting UDP connection", "target", origDst.String(), "ip", origDst.IP, "device", u.router.deviceName(srcAddr))
+		}
+		return
+	case config.PolicyProxy:
+		switch {
+		case upstream == nil:
+			slog.Warn("No upstream proxy configured, using direct UDP", "target", origDst.String())
+		case !upstream.supportsUDP():
+			if u.reject(flow) {
+				slog.Warn("UDP proxy requires a single socks5 upstream, dropping flow", "target", origDst.String(), "upstream", upstream)
+			}
+			return
+		}
+	}
+
+	session, created, err := u.newSession(ctx, flow, srcAddr, origDst, upstream)
+	if err != nil {
+		slog.Error("Failed to create UDP session", "target", origDst.String(), "proxied", upstream != nil, "error", err)
+		return
+	}
+	if created {
+		u.router.warnALG(origDst, srcAddr)
+	}
+	_, _ = session.remoteConn.WriteTo(data, origDst)
+}
+
+// newSession opens the outbound side of a UDP flow and starts relaying replies.
+// The outbound socket is created without holding the lock since a SOCKS5
+// association needs a round trip; if another packet won the race its session is used.
+// A nil upstream sends the flow directly on the default route.
+func (u *UDPProxy) newSession(ctx context.Context, flow udpFlow, srcAddr, origDst *net.UDPAddr, upstream *Upstream) (*udpSession, bool, error) {
+	var remoteConn net.PacketConn
+	var err error
+	if upstream != nil {
+		remoteConn, err = upstream.ListenPacket(ctx)
+	} else {
+		lc := net.ListenConfig{Control: bypassControl}
+		remoteConn, err = lc.ListenPacket(ctx, "udp", "")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	session := &udpSession{
+		clientAddr: srcAddr,
+		target:     origDst,
+		remoteConn: remoteConn,
+		upstream:   upstream,
+		lastActive: time.Now(),
+	}
+
+	u.mu.Lock()
+	if existing, ok := u.sessions[flow]; ok {
+		existing.lastActive = session.lastActive
+		u.mu.Unlock()
+		remoteConn.Close()
+		return existing, false, nil
+	}
+	u.sessions[flow] = session
+	u.mu.Unlock()
+
+	slog.Debug("UDP session created", "from", srcAddr, "to", origDst, "proxied", upstream != nil)
+
+	go u.relaySession(ctx, session)
+	return session, true, nil
+}
+
+// relaySession copies packets from the remote side of a session back to its client
+func (u *UDPProxy) relaySession(ctx context.Context, session *udpSession) {
+	var reply net.Conn
+	defer func() {
+		if reply != nil {
+			reply.Close()
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := session.remoteConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		u.mu.Lock()
+		session.lastActive = time.Now()
+		u.mu.Unlock()
+
+		if reply == nil {
+			reply, err = dialTransparentUDP(ctx, session.target, session.clientAddr)
+			if err != nil {
+				slog.Error("Failed to create UDP reply socket", "from", session.target, "to", session.clientAddr, "error", err)
+				return
+			}
+		}
+
+		if _, err := reply.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (u *UDPProxy) cleanupSessions(ctx context.Context) {
+	ticker := time.NewTicker(UDPSessionCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.mu.Lock()
+			now := time.Now()
+			for flow, session := range u.sessions {
+				if now.Sub(session.lastActive) > UDPSessionTimeout {
+					session.remoteConn.Close()
+					delete(u.sessions, flow)
+				}
+			}
+			for flow, until := range u.rejected {
+				if !now.Before(until) {
+					delete(u.rejected, flow)
+				}
+			}
+			u.mu.Unlock()
+		}
+	}
+}
+
+// dialTransparentUDP opens a UDP socket bound to the non-local address from and
+// connected to to, so datagrams appear to come from the client's original destination
+func dialTransparentUDP(ctx context.Context, from, to *net.UDPAddr) (net.Conn, error) {
+	dialer := net.Dialer{LocalAddr: from, Control: transparentReplyControl}
+	return dialer.DialContext(ctx, "udp", to.String())
+}
+
+// udpDNSWriter answers a DNS query over a connected transparent reply socket
+type udpDNSWriter struct {
+	conn net.Conn
+}
+
+func (w *udpDNSWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *udpDNSWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w *udpDNSWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.conn.Write(data)
+	return err
+}
+
+func (w *udpDNSWriter) Write(b []byte) (int, error) {
+	return w.conn.Write(b)
+}
+func (w *udpDNSWriter) Close() error        { return nil }
+func (w *udpDNSWriter) TsigStatus() error   { return nil }
+func (w *udpDNSWriter) TsigTimersOnly(bool) {}
+func (w *udpDNSWriter) Hijack()             {}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/miekg/dns"
+)
+
+// countingRouter sends every flow to policy, counting how often it is asked
+type countingRouter struct {
+	policy config.Policy
+	routes int
+}
+
+func (r *countingRouter) route(net.IP, int, net.Addr) (config.Policy, *Upstream) {
+	r.routes++
+	return r.policy, nil
+}
+func (r *countingRouter) warnALG(*net.UDPAddr, net.Addr)                                 {}
+func (r *countingRouter) deviceName(net.Addr) string                                     { return "" }
+func (r *countingRouter) handleDNSRequest(context.Context, dns.ResponseWriter, *dns.Msg) {}
+
+func TestUDPProxy_RoutesOncePerFlow(t *testing.T) {
+	router := &countingRouter{policy: config.PolicyReject}
+	u := newUDPProxy("", nil, router)
+	client := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 40000}
+	target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 3478}
+
+	// IPv4 read as 16 bytes is the same flow
+	flow := newUDPFlow(client, target)
+	if mapped := newUDPFlow(&net.UDPAddr{IP: client.IP.To16(), Port: client.Port}, target); mapped != flow {
+		t.Fatalf("flow of a 16-byte address = %v, want %v", mapped, flow)
+	}
+
+	if u.forward(flow, target, []byte("x")) {
+		t.Fatal("forward() handled a flow never routed")
+	}
+	u.handlePacket(context.Background(), flow, client, target, []byte("x"))
+	for range 3 {
+		if !u.forward(flow, target, []byte("x")) {
+			t.Fatal("forward() did not drop a datagram of a rejected flow")
+		}
+	}
+	if router.routes != 1 {
+		t.Errorf("routes = %d, want 1", router.routes)
+	}
+	if u.reject(flow) {
+		t.Error("reject() of a rejected flow reported it as new")
+	}
+
+	// Rejections expire with the session timeout
+	u.rejected[flow] = time.Now().Add(-time.Second)
+	if u.forward(flow, target, []byte("x")) {
+		t.Error("forward() dropped a datagram after the rejection expired")
+	}
+
+	remoteConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteConn.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	local := peer.LocalAddr().(*net.UDPAddr)
+	established := newUDPFlow(client, local)
+	u.sessions[established] = &udpSession{clientAddr: client, target: local, remoteConn: remoteConn}
+	if !u.forward(established, local, []byte("ping")) {
+		t.Fatal("forward() did not send on an established session")
+	}
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Errorf("peer read %q, %v, want ping", buf[:n], err)
+	}
+	if router.routes != 1 {
+		t.Errorf("routes = %d after forwarding, want 1", router.routes)
+	}
+}
@@ -3,6 +3,8 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -11,80 +13,233 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"syscall"
+	"sync/atomic"
+	"time"
 
-	"github.com/cnfatal/proxy/iptables"
-	"golang.org/x/net/proxy"
+	"github.com/cnfatal/proxy/config"
 )
 
-func bypassControl(network, address string, c syscall.RawConn) error {
-	return c.Control(func(fd uintptr) {
-		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, iptables.BypassMark)
-	})
-}
-
 func newBypassDialer() *net.Dialer {
 	return &net.Dialer{
 		Control: bypassControl,
 	}
 }
 
-// Upstream handles connections to upstream proxy servers
+// NewBypassHTTPClient returns an HTTP client for the proxy's own requests,
+// whose connections are exempt from interception
+func NewBypassHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return hosts.dial(ctx, newBypassDialer(), network, addr)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// Upstream connects to destinations through an upstream proxy or a chain of
+// them. Without hops it is a direct route, connecting with its socket mark.
 type Upstream struct {
-	url *url.URL
+	hops  []config.ProxyHop
+	creds []*hopCredentials
+	mux   *muxClient // set if the first hop is multiplexed
+
+	// Direct route name and socket mark
+	route string
+	mark  int
+
+	exit atomic.Pointer[ExitInfo] // latest exit lookup, nil before the first
+}
+
+// NewUpstream creates a handler tunneling through hops in order
+func NewUpstream(hops ...config.ProxyHop) *Upstream {
+	creds := make([]*hopCredentials, len(hops))
+	for i, hop := range hops {
+		creds[i] = newHopCredentials(hop)
+	}
+	u := &Upstream{hops: hops, creds: creds}
+	if len(hops) > 0 && hops[0].Multiplex {
+		u.mux = newMuxClient(hops[0])
+	}
+	return u
+}
+
+// newDirectRoute creates an upstream connecting directly with mark
+func newDirectRoute(name string, mark int) *Upstream {
+	return &Upstream{route: name, mark: mark}
 }
 
-// NewUpstream creates a new upstream proxy handler
-func NewUpstream(proxyURL *url.URL) *Upstream {
-	return &Upstream{url: proxyURL}
+// String returns the proxy URLs of the chain without passwords, or the direct route name
+func (u *Upstream) String() string {
+	if len(u.hops) == 0 {
+		return u.route
+	}
+	urls := make([]string, len(u.hops))
+	for i, hop := range u.hops {
+		urls[i] = hop.URL.Redacted()
+	}
+	return strings.Join(urls, " -> ")
 }
 
-// Connect establishes a connection to the target through the upstream proxy
-// Returns a net.Conn that can be used to communicate with the target
+// Connect establishes a connection to the target through the upstream proxies.
+// Each proxy tunnels to the next one and the last one to the target. When a
+// proxy with reauth rejects its credentials, they are renewed and the
+// connection is tried once more.
 func (u *Upstream) Connect(ctx context.Context, targetAddr string) (net.Conn, error) {
-	switch u.url.Scheme {
-	case "http":
-		return u.connectHTTP(ctx, targetAddr)
-	case "socks5":
-		return u.connectSOCKS5(ctx, targetAddr)
-	default:
-		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.url.Scheme)
+	conn, err := u.connect(ctx, targetAddr)
+	var rejected *authError
+	if !errors.As(err, &rejected) || u.creds[rejected.hop].reauth == nil {
+		return conn, err
+	}
+	if rerr := u.creds[rejected.hop].renew(ctx, rejected.user, u.hops[rejected.hop].URL.Redacted()); rerr != nil {
+		return nil, fmt.Errorf("%w, renewing credentials failed: %v", err, rerr)
 	}
+	return u.connect(ctx, targetAddr)
 }
 
-// connectHTTP establishes a tunnel through an HTTP proxy using CONNECT
-func (u *Upstream) connectHTTP(ctx context.Context, targetAddr string) (net.Conn, error) {
-	proxyAddr := u.url.Host
-	if u.url.Port() == "" {
-		proxyAddr = net.JoinHostPort(u.url.Hostname(), "8080")
+func (u *Upstream) connect(ctx context.Context, targetAddr string) (net.Conn, error) {
+	if len(u.hops) == 0 {
+		return directConnect(ctx, &net.Dialer{Control: markControl(u.mark)}, targetAddr)
+	}
+	user := u.user(0)
+	conn, start, err := u.dialFirst(ctx, user, targetAddr)
+	if err != nil {
+		return nil, u.hopError(0, authFailure(0, user, err))
 	}
 
-	// Connect to the HTTP proxy
-	dialer := newBypassDialer()
-	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	// The handshakes below do not take a context, closing the socket aborts them
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	tunnel := conn
+	for i := start; i < len(u.hops); i++ {
+		hop := u.hops[i]
+		next := targetAddr
+		if i+1 < len(u.hops) {
+			next = hopAddr(u.hops[i+1].URL)
+		}
+		user := u.user(i)
+		if tunnel, err = connectHop(tunnel, hop.URL.Scheme, user, next); err == nil && i+1 < len(u.hops) {
+			tunnel, err = handshakeTLS(ctx, tunnel, u.hops[i+1])
+		}
+		if err != nil {
+			stop()
+			conn.Close()
+			return nil, u.hopError(i, authFailure(i, user, err))
+		}
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return tunnel, nil
+}
+
+// dialFirst connects to the first proxy of the chain and returns the index of
+// the first hop still to be asked for a tunnel. A multiplexed first hop opens
+// its tunnel right away as a stream with user's credentials, secured with TLS
+// for the next hop.
+func (u *Upstream) dialFirst(ctx context.Context, user *url.Userinfo, targetAddr string) (net.Conn, int, error) {
+	if u.mux == nil {
+		conn, err := dialHop(ctx, u.hops[0])
+		return conn, 0, err
+	}
+	next := targetAddr
+	if len(u.hops) > 1 {
+		next = hopAddr(u.hops[1].URL)
+	}
+	conn, err := u.mux.connect(ctx, user, next)
+	if err != nil || len(u.hops) == 1 {
+		return conn, 1, err
+	}
+	tunnel, err := handshakeTLS(ctx, conn, u.hops[1])
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to HTTP proxy: %w", err)
+		conn.Close()
+		return nil, 0, err
+	}
+	return tunnel, 1, nil
+}
+
+// hopError names the failing proxy when there is more than one
+func (u *Upstream) hopError(i int, err error) error {
+	if len(u.hops) == 1 {
+		return err
+	}
+	return fmt.Errorf("upstream hop %d (%s): %w", i+1, u.hops[i].URL.Redacted(), err)
+}
+
+// dialHop opens a connection to the proxy of hop, with TLS if it uses it
+func dialHop(ctx context.Context, hop config.ProxyHop) (net.Conn, error) {
+	conn, err := hosts.dial(ctx, newBypassDialer(), "tcp", hopAddr(hop.URL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s proxy: %w", hop.URL.Scheme, err)
 	}
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(true)
 	}
+	tunnel, err := handshakeTLS(ctx, conn, hop)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// handshakeTLS wraps conn in TLS for https and socks5+tls proxies
+func handshakeTLS(ctx context.Context, conn net.Conn, hop config.ProxyHop) (net.Conn, error) {
+	if hop.TLS == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, hop.TLS)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with proxy failed: %w", err)
+	}
+	return tlsConn, nil
+}
 
-	// Send CONNECT request
-	req := (&http.Request{
+// hopAddr returns the address of a proxy, with the default port of its scheme
+func hopAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case config.SchemeHTTP:
+		port = "8080"
+	case config.SchemeHTTPS:
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// connectHop asks the proxy at the other end of conn to open a tunnel to targetAddr
+func connectHop(conn net.Conn, scheme string, user *url.Userinfo, targetAddr string) (net.Conn, error) {
+	switch scheme {
+	case config.SchemeHTTP, config.SchemeHTTPS:
+		return connectHTTP(conn, user, targetAddr)
+	case config.SchemeSOCKS5, config.SchemeSOCKS5TLS:
+		if err := socks5Connect(conn, user, targetAddr); err != nil {
+			return nil, fmt.Errorf("failed to connect through SOCKS5: %w", err)
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", scheme)
+	}
+}
+
+// connectHTTP establishes a tunnel through an HTTP proxy using CONNECT
+func connectHTTP(conn net.Conn, user *url.Userinfo, targetAddr string) (net.Conn, error) {
+	req := &http.Request{
 		Method: "CONNECT",
 		URL:    &url.URL{Opaque: targetAddr},
 		Host:   targetAddr,
 		Header: make(http.Header),
-	}).WithContext(ctx)
+	}
 
 	// Add proxy authentication if present
-	if u.url.User != nil {
-		password, _ := u.url.User.Password()
-		req.SetBasicAuth(u.url.User.Username(), password)
+	if user != nil {
+		req.Header.Set("Proxy-Authorization", proxyAuthorization(user))
 	}
 
 	if err := req.Write(conn); err != nil {
-		conn.Close()
 		return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
 	}
 
@@ -92,14 +247,15 @@ func (u *Upstream) connectHTTP(ctx context.Context, targetAddr string) (net.Conn
 	br := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(br, req)
 	if err != nil {
-		conn.Close()
 		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
 	}
 	// Note: Do NOT close resp.Body here - the connection is the tunnel
 	// and we need it to remain open for data transfer
 
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("%w: %s", errProxyAuth, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
-		conn.Close()
 		return nil, fmt.Errorf("CONNECT failed with status: %s", resp.Status)
 	}
 
@@ -108,44 +264,14 @@ func (u *Upstream) connectHTTP(ctx context.Context, targetAddr string) (net.Conn
 	return &bufferedConn{Conn: conn, reader: br}, nil
 }
 
-// connectSOCKS5 establishes a connection through a SOCKS5 proxy
-func (u *Upstream) connectSOCKS5(ctx context.Context, targetAddr string) (net.Conn, error) {
-	proxyAddr := u.url.Host
-	if u.url.Port() == "" {
-		proxyAddr = net.JoinHostPort(u.url.Hostname(), "1080")
-	}
-
-	var auth *proxy.Auth
-	if u.url.User != nil {
-		password, _ := u.url.User.Password()
-		auth = &proxy.Auth{
-			User:     u.url.User.Username(),
-			Password: password,
-		}
-	}
-
-	dialer := newBypassDialer()
-
-	socks5Dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, dialer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
-	}
-
-	var conn net.Conn
-	if cd, ok := socks5Dialer.(proxy.ContextDialer); ok {
-		conn, err = cd.DialContext(ctx, "tcp", targetAddr)
-	} else {
-		conn, err = socks5Dialer.Dial("tcp", targetAddr)
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect through SOCKS5: %w", err)
-	}
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		tcpConn.SetNoDelay(true)
+// proxyAuthorization returns the Proxy-Authorization value for user, a bearer
+// token when it has no username
+func proxyAuthorization(user *url.Userinfo) string {
+	password, _ := user.Password()
+	if user.Username() == "" {
+		return "Bearer " + password
 	}
-
-	return conn, nil
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
 }
 
 // bufferedConn wraps a net.Conn with a buffered reader
@@ -167,8 +293,11 @@ func (c *bufferedConn) CloseWrite() error {
 
 // DirectConnect establishes a direct connection to the target
 func DirectConnect(ctx context.Context, targetAddr string) (net.Conn, error) {
-	dialer := newBypassDialer()
-	conn, err := dialer.DialContext(ctx, "tcp", targetAddr)
+	return directConnect(ctx, newBypassDialer(), targetAddr)
+}
+
+func directConnect(ctx context.Context, dialer *net.Dialer, targetAddr string) (net.Conn, error) {
+	conn, err := hosts.dial(ctx, dialer, "tcp", targetAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect directly: %w", err)
 	}
@@ -178,9 +307,22 @@ func DirectConnect(ctx context.Context, targetAddr string) (net.Conn, error) {
 	return conn, nil
 }
 
-// Relay copies data bidirectionally between two connections
-func Relay(dst, src net.Conn, pool BufferPool) {
-	copy := func(direction string, to, from net.Conn, done chan<- struct{}) {
+// Relay copies data bidirectionally between two connections. Non-nil hooks
+// see every chunk before it is forwarded: up for src->dst, down for dst->src.
+// A positive idleTimeout closes both connections once neither has sent data
+// for that long.
+func Relay(dst, src net.Conn, pool BufferPool, up, down RelayHook, idleTimeout time.Duration) {
+	var idle *idleWatchdog
+	if idleTimeout > 0 {
+		idle = watchIdle(idleTimeout, func() {
+			slog.Debug("Closing idle relay", "client", src.RemoteAddr(), "server", dst.RemoteAddr(), "timeout", idleTimeout)
+			src.Close()
+			dst.Close()
+		})
+		defer idle.stop()
+	}
+
+	copy := func(direction string, to, from net.Conn, hook RelayHook, done chan<- struct{}) {
 		var copied int64
 		var err error
 		defer func() { done <- struct{}{} }()
@@ -188,25 +330,81 @@ func Relay(dst, src net.Conn, pool BufferPool) {
 		buf := pool.Get()
 		defer pool.Put(buf)
 
-		copied, err = io.CopyBuffer(to, from, buf)
+		switch {
+		case hook == nil && idle == nil:
+			copied, err = io.CopyBuffer(to, from, buf)
+		case hook == nil && from.SetReadDeadline(time.Time{}) == nil:
+			copied, err = idle.copy(to, from, buf)
+		default:
+			if idle != nil {
+				// Without read deadlines, activity is only seen chunk by chunk
+				hook = chainHooks(hook, idle.touch)
+			}
+			copied, err = copyWithHook(to, from, buf, hook)
+			if errors.Is(err, ErrTransferLimit) {
+				// Abort both directions
+				to.Close()
+				from.Close()
+			}
+		}
 		logRelayResult(direction, from, to, copied, err)
 
-		if cw, ok := to.(interface{ CloseWrite() error }); ok {
-			if closeErr := cw.CloseWrite(); closeErr != nil && !isClosedError(closeErr) {
-				slog.Debug("Relay close-write error", "direction", direction, "to", to.RemoteAddr(), "error", closeErr)
-			}
+		if closeErr := closeWrite(to); closeErr != nil && !isClosedError(closeErr) {
+			slog.Debug("Relay close-write error", "direction", direction, "to", to.RemoteAddr(), "error", closeErr)
 		}
 	}
 
 	done := make(chan struct{}, 2)
-	go copy("client->server", dst, src, done)
-	go copy("server->client", src, dst, done)
+	go copy("client->server", dst, src, up, done)
+	go copy("server->client", src, dst, down, done)
 
 	// Wait for both directions to complete
 	<-done
 	<-done
 }
 
+// closeWrite half-closes conn, unwrapping it through NetConn like tls.Conn
+// exposes until a connection supports it. Without one it does nothing.
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// copyWithHook is io.CopyBuffer with the relay hook applied to each chunk
+func copyWithHook(to, from net.Conn, buf []byte, hook RelayHook) (int64, error) {
+	var written int64
+	for {
+		n, rerr := from.Read(buf)
+		if n > 0 {
+			if err := hook(n); err != nil {
+				return written, err
+			}
+			w, werr := to.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+			if w != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr != nil {
+			if errors.Is(rerr, io.EOF) {
+				return written, nil
+			}
+			return written, rerr
+		}
+	}
+}
+
 func logRelayResult(direction string, from, to net.Conn, copied int64, err error) {
 	attrs := []any{
 		"direction", direction,
@@ -9,18 +9,41 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/cnfatal/proxy/config"
 )
 
 func TestNewUpstream(t *testing.T) {
-	u, _ := url.Parse("http://proxy:8080")
-	upstream := NewUpstream(u)
+	a, _ := url.Parse("socks5://user:secret@a:1080")
+	b, _ := url.Parse("http://b:8080")
+	upstream := NewUpstream(config.ProxyHop{URL: a}, config.ProxyHop{URL: b})
 
-	if upstream.url.Host != "proxy:8080" {
-		t.Errorf("Host = %v, want proxy:8080", upstream.url.Host)
+	if got, want := upstream.String(), "socks5://user:xxxxx@a:1080 -> http://b:8080"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestHopAddr(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://proxy", "proxy:8080"},
+		{"https://proxy", "proxy:443"},
+		{"socks5://proxy", "proxy:1080"},
+		{"socks5+tls://proxy", "proxy:1080"},
+		{"https://proxy:8443", "proxy:8443"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := hopAddr(u); got != tt.want {
+			t.Errorf("hopAddr(%s) = %s, want %s", tt.url, got, tt.want)
+		}
 	}
 }
 
@@ -34,7 +57,7 @@ func TestRelay(t *testing.T) {
 	defer s2.Close()
 
 	pool := NewBufferPool()
-	go Relay(s1, s2, pool)
+	go Relay(s1, s2, pool, nil, nil, 0)
 
 	testData := "Hello, Relay!"
 
@@ -66,6 +89,100 @@ func TestRelay(t *testing.T) {
 	}
 }
 
+// netConnWrapper hides the CloseWrite of the connection it wraps
+type netConnWrapper struct {
+	net.Conn
+}
+
+func (w netConnWrapper) NetConn() net.Conn { return w.Conn }
+
+func TestCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if err := closeWrite(netConnWrapper{netConnWrapper{conn}}); err != nil {
+		t.Fatalf("closeWrite() error = %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("peer read error = %v, want EOF after the wrapped half-close", err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := closeWrite(netConnWrapper{c1}); err != nil {
+		t.Errorf("closeWrite() without support error = %v, want nil", err)
+	}
+}
+
+func TestRelay_HalfClose(t *testing.T) {
+	// The server answers only after the client finished sending
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		conn.Write([]byte("reply to " + string(req)))
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	go func() {
+		client, err := front.Accept()
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		upstream, err := net.Dial("tcp", server.Addr().String())
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		Relay(upstream, client, NewBufferPool(), nil, nil, 0)
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "reply to request" {
+		t.Errorf("response = %q, want %q", got, "reply to request")
+	}
+}
+
 func TestDirectConnect(t *testing.T) {
 	// 创建一个测试 TCP 服务器
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -164,7 +281,7 @@ func TestUpstreamHTTP_Mock(t *testing.T) {
 
 	// 解析代理 URL
 	proxyURL, _ := url.Parse("http://" + listener.Addr().String())
-	upstream := NewUpstream(proxyURL)
+	upstream := NewUpstream(config.ProxyHop{URL: proxyURL})
 
 	// 测试连接
 	conn, err := upstream.Connect(context.Background(), "example.com:80")
@@ -252,7 +369,7 @@ func TestUpstreamHTTP_TLSConnectTunnel(t *testing.T) {
 	}()
 
 	proxyURL, _ := url.Parse("http://" + proxyListener.Addr().String())
-	upstream := NewUpstream(proxyURL)
+	upstream := NewUpstream(config.ProxyHop{URL: proxyURL})
 
 	conn, err := upstream.Connect(context.Background(), target.Listener.Addr().String())
 	if err != nil {
@@ -292,3 +409,160 @@ func TestUpstreamHTTP_TLSConnectTunnel(t *testing.T) {
 		t.Fatalf("CONNECT host = %q, want %q", gotHost, target.Listener.Addr().String())
 	}
 }
+
+// startMockSOCKS5 runs a SOCKS5 server requiring user/pass auth that serves CONNECT
+func startMockSOCKS5(t *testing.T, user, password string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 2)
+				io.ReadFull(conn, buf)
+				io.ReadFull(conn, make([]byte, buf[1]))
+				conn.Write([]byte{socks5Version, socks5AuthPasswd})
+
+				io.ReadFull(conn, buf)
+				name := make([]byte, buf[1])
+				io.ReadFull(conn, name)
+				io.ReadFull(conn, buf[:1])
+				pass := make([]byte, buf[0])
+				io.ReadFull(conn, pass)
+				if string(name) != user || string(pass) != password {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+
+				io.ReadFull(conn, make([]byte, 3))
+				host, port, err := readSOCKS5Addr(conn)
+				if err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+				if err != nil {
+					socks5Reply(conn, socks5RepFailure)
+					return
+				}
+				defer target.Close()
+				socks5Reply(conn, socks5RepSucceeded)
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startMockHTTPSProxy runs a TLS HTTP CONNECT proxy recording the Proxy-Authorization header
+func startMockHTTPSProxy(t *testing.T, auth *string) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	cfg := srv.TLS
+	srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				*auth = req.Header.Get("Proxy-Authorization")
+				mu.Unlock()
+
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(target, br)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestUpstream_Chain(t *testing.T) {
+	echo := startEcho(t)
+	var auth string
+	socksAddr := startMockSOCKS5(t, "alice", "s3cret")
+	httpsAddr := startMockHTTPSProxy(t, &auth)
+
+	first, _ := url.Parse("socks5://alice:s3cret@" + socksAddr)
+	second, _ := url.Parse("https://bob:pw@" + httpsAddr)
+	upstream := NewUpstream(
+		config.ProxyHop{URL: first},
+		config.ProxyHop{URL: second, TLS: &tls.Config{InsecureSkipVerify: true}},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := upstream.Connect(ctx, echo.String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	if want := "Basic Ym9iOnB3"; auth != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", auth, want)
+	}
+
+	wrong, _ := url.Parse("socks5://alice:wrong@" + socksAddr)
+	_, err = NewUpstream(config.ProxyHop{URL: wrong}, config.ProxyHop{URL: second}).Connect(ctx, echo.String())
+	if err == nil || !strings.Contains(err.Error(), "hop 1") {
+		t.Errorf("Connect() with bad credentials error = %v, want hop 1 failure", err)
+	}
+}
+
+func TestDirectRoute(t *testing.T) {
+	echo := startEcho(t)
+	route := newDirectRoute("wan2", 202)
+	if route.String() != "wan2" || !route.supportsUDP() {
+		t.Errorf("direct route = %q, supportsUDP = %v", route, route.supportsUDP())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := route.Connect(ctx, echo.String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	pc, err := route.ListenPacket(ctx)
+	if err != nil {
+		t.Fatalf("ListenPacket() error = %v", err)
+	}
+	pc.Close()
+}
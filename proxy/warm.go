@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// warmRetry is how long a keep_warm destination waits after a failed dial
+const warmRetry = 5 * time.Second
+
+// warmPool holds the keep_warm tunnels of a routing, keyed by target
+type warmPool map[string]*warmTunnel
+
+// warmTunnel keeps one connected upstream tunnel to a destination. The tunnel
+// is redialed as soon as it is taken and replaced once it sat unused for
+// refresh. It is only handed to connections dialed with the same plan.
+type warmTunnel struct {
+	domain  string
+	ip      net.IP
+	port    int
+	refresh time.Duration
+	used    chan struct{}
+
+	mu   sync.Mutex
+	plan dialPlan
+	conn net.Conn
+}
+
+func newWarmPool(entries []config.KeepWarm) warmPool {
+	pool := make(warmPool, len(entries))
+	for _, e := range entries {
+		host, port, _ := net.SplitHostPort(e.Target)
+		w := &warmTunnel{refresh: time.Duration(e.Refresh) * time.Second, used: make(chan struct{}, 1)}
+		w.port, _ = strconv.Atoi(port)
+		if w.ip = net.ParseIP(host); w.ip == nil {
+			// Keyed like the targets of sniffed domains, in A-labels
+			w.domain = rules.CanonicalDomain(host)
+			host = w.domain
+		}
+		pool[net.JoinHostPort(host, port)] = w
+	}
+	return pool
+}
+
+// take hands out the tunnel waiting for plan, if any
+func (p warmPool) take(plan dialPlan) net.Conn {
+	w, ok := p[plan.target]
+	if !ok {
+		return nil
+	}
+	w.mu.Lock()
+	var conn net.Conn
+	if w.conn != nil && w.plan == plan {
+		conn, w.conn = w.conn, nil
+	}
+	w.mu.Unlock()
+	if conn != nil {
+		select {
+		case w.used <- struct{}{}:
+		default:
+		}
+	}
+	return conn
+}
+
+// run keeps the tunnels of rt connected until ctx is done
+func (p warmPool) run(ctx context.Context, tp *TransparentProxy, rt *routing) {
+	var wg sync.WaitGroup
+	for _, w := range p {
+		wg.Go(func() { w.run(ctx, tp, rt) })
+	}
+	wg.Wait()
+}
+
+// resolve returns where the destination is currently dialed. Only tunnels
+// through an upstream are kept warm.
+func (w *warmTunnel) resolve(rt *routing) (dialPlan, bool) {
+	result := rt.matcher.MatchMetadata(&rules.Metadata{Domain: w.domain, DstIP: w.ip, DstPort: uint16(w.port)})
+	policy, upstream := rt.policies.resolve(result.Policy, routingKey(w.domain, w.ip))
+	if policy != config.PolicyProxy || upstream == nil {
+		return dialPlan{}, false
+	}
+	return newDialPlan(policy, upstream, w.domain, &net.TCPAddr{IP: w.ip, Port: w.port}, ""), true
+}
+
+func (w *warmTunnel) run(ctx context.Context, tp *TransparentProxy, rt *routing) {
+	defer w.put(dialPlan{}, nil)
+	for {
+		wait := w.refresh
+		if plan, ok := w.resolve(rt); ok {
+			dialCtx, cancel := context.WithTimeout(ctx, rt.dialTimeout)
+			conn, err := tp.dial(dialCtx, plan)
+			cancel()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Debug("Failed to warm connection", "target", plan.target, "upstream", plan.upstream, "error", err)
+				wait = min(wait, warmRetry)
+			}
+			// Replace the previous tunnel only once the new one is connected
+			w.put(plan, conn)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-w.used:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// put makes conn the waiting tunnel, closing the one it replaces
+func (w *warmTunnel) put(plan dialPlan, conn net.Conn) {
+	w.mu.Lock()
+	old := w.conn
+	w.plan, w.conn = plan, conn
+	w.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// startEchoProxy runs an HTTP CONNECT proxy whose tunnels echo, reporting
+// each requested target and each closed tunnel
+func startEchoProxy(t *testing.T) (addr string, targets, closed chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	targets, closed = make(chan string, 8), make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				targets <- req.Host
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				io.Copy(conn, br)
+				closed <- req.Host
+			}()
+		}
+	}()
+	return ln.Addr().String(), targets, closed
+}
+
+func TestWarmPool(t *testing.T) {
+	addr, targets, closed := startEchoProxy(t)
+	tp := newTestProxy(t, &config.Config{
+		Upstream: config.ProxyChain{{URL: "http://" + addr}},
+		KeepWarm: []config.KeepWarm{{Target: "sso.example:443"}, {Target: "direct.example:443"}},
+	}, "DOMAIN,sso.example,PROXY", "MATCH,DIRECT")
+	rt := tp.routing.Load()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		rt.warm.run(ctx, tp, rt)
+		close(stopped)
+	}()
+	expectTarget := func(ch chan string, what string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if got != "sso.example:443" {
+				t.Errorf("%s %s, want sso.example:443", what, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no tunnel %s", what)
+		}
+	}
+	waitWarm := func() {
+		t.Helper()
+		w := rt.warm["sso.example:443"]
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+			w.mu.Lock()
+			ready := w.conn != nil
+			w.mu.Unlock()
+			if ready {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("warm tunnel not ready")
+			}
+		}
+	}
+	expectTarget(targets, "opened to")
+	waitWarm()
+
+	// A connection routed differently does not get the tunnel
+	other := newDialPlan(config.PolicyProxy, NewUpstream(), "sso.example", &net.TCPAddr{Port: 443}, "")
+	if conn := rt.warm.take(other); conn != nil {
+		t.Error("take() handed the tunnel to another upstream")
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		tp.forward(t.Context(), server, "tproxy", "sso.example", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, nil, nil)
+	}()
+	expectEcho(t, client)
+	client.Close()
+	<-done
+	expectTarget(closed, "closed to")
+
+	// Using the tunnel dials its replacement, which closes with the pool
+	expectTarget(targets, "reopened to")
+	waitWarm()
+	cancel()
+	<-stopped
+	expectTarget(closed, "closed to")
+	select {
+	case got := <-targets:
+		t.Errorf("tunnel opened to %s, want only the PROXY destination kept warm", got)
+	default:
+	}
+}
+
+func TestNewWarmPool_IDN(t *testing.T) {
+	pool := newWarmPool([]config.KeepWarm{{Target: "bücher.example:443"}, {Target: "192.0.2.1:443"}})
+	w, ok := pool["xn--bcher-kva.example:443"]
+	if !ok {
+		t.Fatalf("pool keys = %v, want the A-label target", slices.Collect(maps.Keys(pool)))
+	}
+	if w.domain != "xn--bcher-kva.example" {
+		t.Errorf("domain = %q, want xn--bcher-kva.example", w.domain)
+	}
+	if w := pool["192.0.2.1:443"]; w == nil || w.domain != "" || !w.ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("IP target = %+v, want dialed by address", w)
+	}
+
+	// The target of a connection sniffed to the unicode name finds the tunnel
+	plan := newDialPlan(config.PolicyProxy, NewUpstream(), rules.CanonicalDomain("Bücher.example"), &net.TCPAddr{Port: 443}, "")
+	if _, ok := pool[plan.target]; !ok {
+		t.Errorf("no tunnel for target %s", plan.target)
+	}
+}
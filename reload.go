@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/iptables"
+	"github.com/cnfatal/proxy/proxy"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// loadMatcher parses the rules of cfg and loads the GeoIP database and rule sets they use
+func loadMatcher(ctx context.Context, cfg *config.Config, prev rules.Providers) (*rules.Matcher, rules.Providers, error) {
+	parsed, err := rules.ParseRuleEntries(cfg.Rules, cfg.PolicyNames())
+	if err != nil {
+		return nil, rules.Providers{}, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	matcher := rules.NewMatcher(parsed)
+
+	providers, err := rules.LoadProviders(ctx, cfg, proxy.NewBypassHTTPClient(), prev)
+	if err == nil {
+		err = matcher.SetProviders(providers)
+	}
+	if err != nil {
+		return nil, rules.Providers{}, fmt.Errorf("failed to load rule providers: %w", err)
+	}
+	return matcher, providers, nil
+}
+
+// interceptRules returns the nftables rules steering traffic to the proxy port
+func interceptRules(cfg *config.Config, port int) []iptables.TProxyRule {
+	intercept := []iptables.TProxyRule{
+		{Protocols: "tcp", Ports: []uint16{80, 443}, DstPort: uint16(port)},
+	}
+	if len(cfg.UDPPorts) > 0 {
+		intercept = append(intercept, iptables.TProxyRule{Protocols: "udp", Ports: cfg.UDPPorts, DstPort: uint16(port)})
+	}
+	return intercept
+}
+
+// reloader re-reads the configuration on SIGHUP and applies it without
+// dropping connections: the matcher and policies are swapped in the proxy and
+// only changed ports are updated in nftables
+type reloader struct {
+	mu    sync.Mutex // serializes SIGHUP and API reloads
+	cfg   *config.Config
+	port  int
+	udp   bool // whether the UDP listener was started
+	proxy *proxy.TransparentProxy
+	nft   *iptables.Manager
+
+	// providers are the current rule sets, reused by reloads if unchanged
+	providers rules.Providers
+	// stopProviders ends the refresh loops of the current rule sets
+	stopProviders context.CancelFunc
+}
+
+func newReloader(ctx context.Context, cfg *config.Config, port int, tp *proxy.TransparentProxy, nft *iptables.Manager, providers rules.Providers) *reloader {
+	r := &reloader{cfg: cfg, port: port, udp: len(cfg.UDPPorts) > 0, proxy: tp, nft: nft}
+	r.startProviders(ctx, providers)
+	return r
+}
+
+func (r *reloader) startProviders(ctx context.Context, providers rules.Providers) {
+	if r.stopProviders != nil {
+		r.stopProviders()
+	}
+	ctx, r.stopProviders = context.WithCancel(ctx)
+	r.providers = providers
+	providers.Run(ctx)
+}
+
+// run reloads on each SIGHUP until the context is cancelled
+func (r *reloader) run(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			if err := r.reload(ctx); err != nil {
+				slog.Error("Reload failed, keeping the current configuration", "error", err)
+			}
+		}
+	}
+}
+
+// reload applies the configuration file; nothing changes if it is invalid
+func (r *reloader) reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := config.Load(*configPath, *dataDir)
+	if err != nil {
+		return err
+	}
+
+	matcher, providers, err := loadMatcher(ctx, cfg, r.providers)
+	if err != nil {
+		return err
+	}
+
+	// The UDP listener only exists if UDP was intercepted at startup
+	if !r.udp && len(cfg.UDPPorts) > 0 {
+		slog.Warn("Enabling udp_ports requires a restart, keeping UDP disabled")
+		cfg.UDPPorts = nil
+	}
+	// Only the marks of the direct routes installed at startup bypass interception
+	if !reflect.DeepEqual(r.cfg.DirectRoutes, cfg.DirectRoutes) {
+		return errors.New("direct_routes changed, a restart is required")
+	}
+	if changed := restartFields(r.cfg, cfg); len(changed) > 0 {
+		slog.Warn("Some settings only take effect after a restart", "fields", changed)
+	}
+
+	if r.nft != nil {
+		if err := r.nft.Update(interceptRules(cfg, r.port)); err != nil {
+			return err
+		}
+	}
+	r.proxy.Reload(cfg, matcher)
+	r.startProviders(ctx, providers)
+	level := parseLogLevel(cfg.LogLevel)
+	logLevel.Set(level)
+	configuredLevel.Set(level)
+	r.cfg = cfg
+
+	slog.Info("Configuration reloaded",
+		"upstream", cfg.Upstream,
+		"proxies", len(cfg.Proxies),
+		"proxy_groups", len(cfg.ProxyGroups),
+		"rules", len(cfg.Rules),
+		"udp_ports", cfg.UDPPorts,
+	)
+	return nil
+}
+
+// restartFields lists the changed settings that cannot be applied while running
+func restartFields(old, cur *config.Config) []string {
+	var changed []string
+	check := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("listen", old.Listen, cur.Listen)
+	check("http_listen", old.HTTPListen, cur.HTTPListen)
+	check("socks_listen", old.SOCKSListen, cur.SOCKSListen)
+	check("api_listen", old.APIListen, cur.APIListen)
+	check("api_token_file", old.APITokenFile, cur.APITokenFile)
+	check("status_listen", old.StatusListen, cur.StatusListen)
+	check("status_group", old.StatusGroup, cur.StatusGroup)
+	check("authz_listen", old.AuthzListen, cur.AuthzListen)
+	check("metrics_listen", old.MetricsListen, cur.MetricsListen)
+	check("metrics_sample", old.MetricsSample, cur.MetricsSample)
+	check("mode", old.Mode, cur.Mode)
+	check("gateway", old.Gateway, cur.Gateway)
+	check("gateway_sources", old.GatewaySources, cur.GatewaySources)
+	check("max_open_files", old.MaxOpenFiles, cur.MaxOpenFiles)
+	check("max_connections", old.MaxConnections, cur.MaxConnections)
+	check("idle_mode_after", old.IdleModeAfter, cur.IdleModeAfter)
+	check("dhcp_leases", old.DHCPLeases, cur.DHCPLeases)
+	check("data_dir", old.DataDir, cur.DataDir)
+	check("state_file", old.StateFile, cur.StateFile)
+	check("middleware", old.Middleware, cur.Middleware)
+	check("qos", old.QoS, cur.QoS)
+	check("require_upstream_healthy", old.RequireUpstreamHealthy, cur.RequireUpstreamHealthy)
+	return changed
+}
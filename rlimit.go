@@ -0,0 +1,59 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"syscall"
+)
+
+// raiseFileLimit raises RLIMIT_NOFILE to target, lifting the hard limit when permitted
+func raiseFileLimit(target uint64) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		slog.Warn("Failed to read RLIMIT_NOFILE", "error", err)
+		return
+	}
+	if lim.Cur >= target {
+		slog.Debug("RLIMIT_NOFILE already sufficient", "soft", lim.Cur, "hard", lim.Max, "target", target)
+		return
+	}
+
+	want := syscall.Rlimit{Cur: target, Max: max(lim.Max, target)}
+	err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want)
+	if err == nil {
+		slog.Info("Raised RLIMIT_NOFILE", "from", lim.Cur, "to", target)
+		return
+	}
+
+	// Raising the hard limit needs CAP_SYS_RESOURCE, and darwin rejects soft
+	// limits above kern.maxfilesperproc with EINVAL; settle for the highest allowed
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) {
+		if ceiling := min(fileLimitCeiling(lim.Max), target); lim.Cur < ceiling {
+			want = syscall.Rlimit{Cur: ceiling, Max: lim.Max}
+			if syscall.Setrlimit(syscall.RLIMIT_NOFILE, &want) == nil {
+				lim.Cur = ceiling
+			}
+		}
+	}
+
+	slog.Warn("Could not raise RLIMIT_NOFILE to target, connections may fail with 'too many open files'",
+		"soft", lim.Cur,
+		"hard", lim.Max,
+		"target", target,
+		"error", err,
+		"hint", "raise the hard limit (e.g. LimitNOFILE= in the systemd unit) or run with CAP_SYS_RESOURCE",
+	)
+}
+
+// openFileCount returns the number of file descriptors currently open by this
+// process, not counting the one reading fdDir
+func openFileCount() (int, error) {
+	entries, err := os.ReadDir(fdDir)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries) - 1, nil
+}
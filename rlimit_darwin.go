@@ -0,0 +1,16 @@
+package main
+
+import "syscall"
+
+// fdDir lists the open file descriptors of the process, darwin has no /proc
+const fdDir = "/dev/fd"
+
+// fileLimitCeiling is the highest soft RLIMIT_NOFILE allowed under hard,
+// which darwin also caps at kern.maxfilesperproc
+func fileLimitCeiling(hard uint64) uint64 {
+	perProc, err := syscall.SysctlUint32("kern.maxfilesperproc")
+	if err != nil {
+		return hard
+	}
+	return min(hard, uint64(perProc))
+}
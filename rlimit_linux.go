@@ -0,0 +1,9 @@
+package main
+
+// fdDir lists the open file descriptors of the process
+const fdDir = "/proc/self/fd"
+
+// fileLimitCeiling is the highest soft RLIMIT_NOFILE allowed under hard
+func fileLimitCeiling(hard uint64) uint64 {
+	return hard
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// raiseFileLimit is a no-op: RLIMIT_NOFILE is not available on this platform
+func raiseFileLimit(target uint64) {}
+
+func openFileCount() (int, error) {
+	return 0, errors.ErrUnsupported
+}
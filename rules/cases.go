@@ -0,0 +1,83 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/cnfatal/proxy/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Case is an expected policy decision for a connection
+type Case struct {
+	Domain string        `yaml:"domain"`
+	IP     string        `yaml:"ip"`
+	SrcMAC string        `yaml:"src_mac"`
+	Expect config.Policy `yaml:"expect"`
+}
+
+// Mismatch is a case whose matched policy differs from the expected one
+type Mismatch struct {
+	Index  int
+	Case   Case
+	Result MatchResult
+}
+
+// LoadCases reads a YAML list of rule test cases
+func LoadCases(path string) ([]Case, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cases file: %w", err)
+	}
+
+	var cases []Case
+	if err := yaml.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("failed to parse cases file: %w", err)
+	}
+
+	for i := range cases {
+		c := &cases[i]
+		c.Expect = config.ParsePolicy(string(c.Expect))
+		if c.Expect == "" {
+			return nil, fmt.Errorf("case %d: expect is required", i+1)
+		}
+		if c.Domain == "" && c.IP == "" {
+			return nil, fmt.Errorf("case %d: domain or ip is required", i+1)
+		}
+		if c.IP != "" && net.ParseIP(c.IP) == nil {
+			return nil, fmt.Errorf("case %d: invalid ip: %s", i+1, c.IP)
+		}
+		if c.SrcMAC != "" {
+			if _, err := net.ParseMAC(c.SrcMAC); err != nil {
+				return nil, fmt.Errorf("case %d: invalid src_mac: %s", i+1, c.SrcMAC)
+			}
+		}
+	}
+
+	return cases, nil
+}
+
+// Metadata returns the connection metadata described by the case
+func (c *Case) Metadata() *Metadata {
+	md := &Metadata{
+		Domain: c.Domain,
+		DstIP:  net.ParseIP(c.IP),
+	}
+	if c.SrcMAC != "" {
+		md.SrcMAC, _ = net.ParseMAC(c.SrcMAC)
+	}
+	return md
+}
+
+// Check evaluates every case and returns those that did not match their expected policy
+func (m *Matcher) Check(cases []Case) []Mismatch {
+	var mismatches []Mismatch
+	for i, c := range cases {
+		result := m.MatchMetadata(c.Metadata())
+		if result.Policy != c.Expect {
+			mismatches = append(mismatches, Mismatch{Index: i + 1, Case: c, Result: result})
+		}
+	}
+	return mismatches
+}
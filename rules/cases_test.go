@@ -0,0 +1,79 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestLoadCases(t *testing.T) {
+	content := `
+- domain: www.google.com
+  expect: proxy
+- ip: 10.1.2.3
+  expect: DIRECT
+`
+	path := filepath.Join(t.TempDir(), "cases.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases, err := LoadCases(path)
+	if err != nil {
+		t.Fatalf("LoadCases() error = %v", err)
+	}
+	if len(cases) != 2 {
+		t.Fatalf("len(cases) = %d, want 2", len(cases))
+	}
+	if cases[0].Expect != config.PolicyProxy {
+		t.Errorf("Expect = %v, want PROXY", cases[0].Expect)
+	}
+}
+
+func TestLoadCases_Invalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing expect": "- domain: example.com\n",
+		"missing target": "- expect: DIRECT\n",
+		"invalid ip":     "- ip: 10.0.0\n  expect: DIRECT\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cases.yaml")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadCases(path); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestMatcher_Check(t *testing.T) {
+	rules, err := ParseRules([]string{
+		"DOMAIN-SUFFIX,google.com,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"MATCH,REJECT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := NewMatcher(rules)
+
+	mismatches := matcher.Check([]Case{
+		{Domain: "www.google.com", Expect: config.PolicyProxy},
+		{IP: "10.1.2.3", Expect: config.PolicyDirect},
+		{Domain: "example.org", Expect: config.PolicyDirect},
+	})
+
+	if len(mismatches) != 1 {
+		t.Fatalf("len(mismatches) = %d, want 1", len(mismatches))
+	}
+	if mismatches[0].Index != 3 || mismatches[0].Result.Policy != config.PolicyReject {
+		t.Errorf("mismatch = %+v, want case 3 matched REJECT", mismatches[0])
+	}
+	if got := mismatches[0].Result.Rule.String(); got != "MATCH,REJECT" {
+		t.Errorf("Rule.String() = %q, want MATCH,REJECT", got)
+	}
+}
@@ -0,0 +1,48 @@
+package rules
+
+import (
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// CanonicalDomain returns the form hostnames are matched in: lower case
+// A-labels without a port or trailing dot, so "Bücher.example.:443" and
+// "xn--bcher-kva.example" are the same name. Invalid IDNs are only lowercased.
+func CanonicalDomain(host string) string {
+	if strings.IndexByte(host, ':') >= 0 {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	host = strings.TrimSuffix(host, ".")
+	if !isASCII(host) {
+		if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+			return ascii
+		}
+	}
+	return strings.ToLower(host)
+}
+
+// unicodeDomain returns the U-label form of a canonical domain containing
+// A-labels, for keyword and prefix rules written in unicode
+func unicodeDomain(domain string) string {
+	if !strings.Contains(domain, "xn--") {
+		return domain
+	}
+	if u, err := idna.Lookup.ToUnicode(domain); err == nil {
+		return u
+	}
+	return domain
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package rules
+
+import "testing"
+
+func TestCanonicalDomain(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:8443", "example.com"},
+		{"Bücher.example.:443", "xn--bcher-kva.example"},
+		{"XN--BCHER-KVA.example", "xn--bcher-kva.example"},
+		{"例子.测试", "xn--fsqu00a.xn--0zwm56d"},
+		{"_sip._tcp.Example.com", "_sip._tcp.example.com"},
+		{"[::1]:53", "::1"},
+		{"::1", "::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := CanonicalDomain(tt.host); got != tt.want {
+			t.Errorf("CanonicalDomain(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_IDN(t *testing.T) {
+	parsed, err := ParseRules([]string{
+		"DOMAIN-SUFFIX,bücher.example,PROXY",
+		"DOMAIN,Example.COM.,REJECT",
+		"DOMAIN-KEYWORD,例子,PROXY",
+		"DOMAIN-PREFIX,Shop,REJECT",
+		"MATCH,DIRECT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMatcher(parsed)
+
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"www.xn--bcher-kva.example", "PROXY"},
+		{"www.Bücher.example", "PROXY"},
+		{"example.com.", "REJECT"},
+		{"EXAMPLE.com:443", "REJECT"},
+		{"xn--fsqu00a.xn--0zwm56d", "PROXY"},
+		{"shop.example.org", "REJECT"},
+		{"buecher.example", "DIRECT"},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.domain, nil).Policy; string(got) != tt.want {
+			t.Errorf("Match(%q) = %s, want %s", tt.domain, got, tt.want)
+		}
+	}
+}
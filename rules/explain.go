@@ -0,0 +1,44 @@
+package rules
+
+// Explanation describes why a rule won a match
+type Explanation struct {
+	// Evaluated is the number of rules considered, in order, before the
+	// result was decided; all but the last did not match
+	Evaluated int
+	// Field is the connection attribute the rule matched, empty for MATCH
+	// and for the default when no rule matched
+	Field string
+	Value string
+}
+
+// Explain reports how result was reached for md. It repeats lookups done by
+// MatchMetadata, so it is meant for debug logging only.
+func (m *Matcher) Explain(md *Metadata, result MatchResult) Explanation {
+	if result.Rule == nil {
+		return Explanation{Evaluated: len(m.rules)}
+	}
+
+	e := Explanation{Evaluated: result.Index + 1}
+	switch r := result.Rule; r.Type {
+	case RuleTypeDomain, RuleTypeDomainSuffix, RuleTypeDomainPrefix, RuleTypeDomainKeyword:
+		e.Field, e.Value = "domain", md.Domain
+	case RuleTypeIPCIDR, RuleTypeIPCIDR6:
+		e.Field, e.Value = "dst_ip", md.DstIP.String()
+	case RuleTypeSrcMAC:
+		e.Field, e.Value = "src_mac", md.SrcMAC.String()
+	case RuleTypeGeoIP:
+		e.Field, e.Value = "country", m.geoip.Country(md.DstIP)
+	case RuleTypeRuleSet:
+		// Name the entry of the set that matched; its policy is a placeholder
+		for _, rs := range m.ruleSetRules {
+			if rs.rule == r && rs.set != nil {
+				e.Field = "rule_set"
+				if inner := rs.set.matcher.Load().MatchMetadata(md).Rule; inner != nil {
+					e.Value = string(inner.Type) + "," + inner.Value
+				}
+				break
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP maps an address to its ISO 3166-1 country code
+type GeoIP interface {
+	Country(ip net.IP) string
+}
+
+// MMDB is a GeoIP backed by a MaxMind/GeoLite2 country database
+type MMDB struct {
+	path    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	modTime time.Time // of the file when it was last read
+}
+
+// OpenMMDB reads a MaxMind database file into memory. Unlike a memory map the
+// database stays valid for lookups in flight after a reload drops it.
+func OpenMMDB(path string) (*MMDB, error) {
+	db := &MMDB{path: path}
+	if _, err := db.reopen(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// reopen reads the database file again if it was modified since it was last
+// read, reporting whether it was
+func (db *MMDB) reopen() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	if info.ModTime().Equal(db.modTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to open GeoIP database: %w", err)
+	}
+	db.reader.Store(reader)
+	db.modTime = info.ModTime()
+	return true, nil
+}
+
+// Country returns the upper-case country code of ip, or "" if unknown
+func (db *MMDB) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.reader.Load().Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
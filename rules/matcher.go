@@ -1,6 +1,7 @@
 package rules
 
 import (
+	"fmt"
 	"net"
 	"strings"
 
@@ -14,8 +15,13 @@ type Matcher struct {
 	ipTree       *IPTree
 	keywordRules []keywordRule
 	prefixRules  []prefixRule
+	macRules     map[string]macRule
+	geoRules     map[string]geoRule
+	ruleSetRules []ruleSetRule
+	geoip        GeoIP
 	matchRule    *Rule
 	matchIndex   int
+	unicodeRules bool // a keyword or prefix rule is written in unicode
 }
 
 type keywordRule struct {
@@ -28,12 +34,30 @@ type prefixRule struct {
 	index int
 }
 
+type macRule struct {
+	rule  *Rule
+	index int
+}
+
+type geoRule struct {
+	rule  *Rule
+	index int
+}
+
+type ruleSetRule struct {
+	rule  *Rule
+	index int
+	set   *RuleSet
+}
+
 // NewMatcher creates a new rule matcher
 func NewMatcher(rules []*Rule) *Matcher {
 	m := &Matcher{
 		rules:      rules,
 		domainTrie: NewDomainTrie(),
 		ipTree:     NewIPTree(),
+		macRules:   make(map[string]macRule),
+		geoRules:   make(map[string]geoRule),
 		matchIndex: -1,
 	}
 
@@ -43,10 +67,22 @@ func NewMatcher(rules []*Rule) *Matcher {
 			m.domainTrie.Insert(rule.Value, rule, i, rule.Type == RuleTypeDomainSuffix)
 		case RuleTypeDomainPrefix:
 			m.prefixRules = append(m.prefixRules, prefixRule{rule: rule, index: i})
+			m.unicodeRules = m.unicodeRules || !isASCII(rule.Value)
 		case RuleTypeDomainKeyword:
 			m.keywordRules = append(m.keywordRules, keywordRule{rule: rule, index: i})
+			m.unicodeRules = m.unicodeRules || !isASCII(rule.Value)
 		case RuleTypeIPCIDR, RuleTypeIPCIDR6:
 			m.ipTree.Insert(rule.Network, rule, i)
+		case RuleTypeSrcMAC:
+			if _, ok := m.macRules[rule.Value]; !ok {
+				m.macRules[rule.Value] = macRule{rule: rule, index: i}
+			}
+		case RuleTypeGeoIP:
+			if _, ok := m.geoRules[rule.Value]; !ok {
+				m.geoRules[rule.Value] = geoRule{rule: rule, index: i}
+			}
+		case RuleTypeRuleSet:
+			m.ruleSetRules = append(m.ruleSetRules, ruleSetRule{rule: rule, index: i})
 		case RuleTypeMatch:
 			if m.matchRule == nil {
 				m.matchRule = rule
@@ -62,12 +98,71 @@ func NewMatcher(rules []*Rule) *Matcher {
 type MatchResult struct {
 	Policy config.Policy
 	Rule   *Rule
+	Index  int // position of Rule in the rule list, -1 for the default
+}
+
+// Metadata describes a connection being matched against rules
+type Metadata struct {
+	Domain  string
+	DstIP   net.IP
+	DstPort uint16
+	SrcMAC  net.HardwareAddr
+}
+
+// Providers supplies the external data GEOIP and RULE-SET rules match against
+type Providers struct {
+	GeoIP    GeoIP
+	RuleSets map[string]*RuleSet
+
+	updates *updates
+}
+
+// SetProviders binds GEOIP and RULE-SET rules to their data sources.
+// It must be called before the matcher is used.
+func (m *Matcher) SetProviders(p Providers) error {
+	if len(m.geoRules) > 0 && p.GeoIP == nil {
+		return fmt.Errorf("GEOIP rules require geoip_database")
+	}
+	m.geoip = p.GeoIP
+
+	for i := range m.ruleSetRules {
+		rs := &m.ruleSetRules[i]
+		set, ok := p.RuleSets[rs.rule.Value]
+		if !ok {
+			return fmt.Errorf("rule %d (%s): unknown rule provider %q", rs.index+1, rs.rule, rs.rule.Value)
+		}
+		rs.set = set
+	}
+	if p.updates != nil {
+		p.updates.matcher.Store(m)
+	}
+	return nil
+}
+
+// HasSourceMACRules reports whether any rule needs the client MAC address
+func (m *Matcher) HasSourceMACRules() bool {
+	return len(m.macRules) > 0
+}
+
+// Country returns the GeoIP country of ip, empty without a GeoIP database
+func (m *Matcher) Country(ip net.IP) string {
+	if m.geoip == nil {
+		return ""
+	}
+	return m.geoip.Country(ip)
 }
 
 // Match finds the first matching rule for the given domain and/or IP
 // Returns PolicyDirect if no rules match
 func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
-	domain = strings.ToLower(domain)
+	return m.MatchMetadata(&Metadata{Domain: domain, DstIP: ip})
+}
+
+// MatchMetadata finds the first matching rule for the given connection metadata
+// Returns PolicyDirect if no rules match
+func (m *Matcher) MatchMetadata(md *Metadata) MatchResult {
+	domain := CanonicalDomain(md.Domain)
+	ip := md.DstIP
 
 	var bestRule *Rule
 	bestIndex := -1
@@ -79,12 +174,17 @@ func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
 			bestIndex = idx
 		}
 
+		udomain := domain
+		if m.unicodeRules {
+			udomain = unicodeDomain(domain)
+		}
+
 		// 2. Check Domain Prefixes
 		for _, pr := range m.prefixRules {
 			if bestIndex != -1 && pr.index >= bestIndex {
 				break
 			}
-			if strings.HasPrefix(domain, strings.ToLower(pr.rule.Value)) {
+			if strings.HasPrefix(domain, pr.rule.Value) || (udomain != domain && strings.HasPrefix(udomain, pr.rule.Value)) {
 				bestRule = pr.rule
 				bestIndex = pr.index
 			}
@@ -95,7 +195,7 @@ func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
 			if bestIndex != -1 && kr.index >= bestIndex {
 				break
 			}
-			if strings.Contains(domain, strings.ToLower(kr.rule.Value)) {
+			if strings.Contains(domain, kr.rule.Value) || (udomain != domain && strings.Contains(udomain, kr.rule.Value)) {
 				bestRule = kr.rule
 				bestIndex = kr.index
 				break
@@ -113,7 +213,39 @@ func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
 		}
 	}
 
-	// 5. Check MATCH rule
+	// 5. Check source MAC
+	if md.SrcMAC != nil {
+		if mr, ok := m.macRules[md.SrcMAC.String()]; ok {
+			if bestIndex == -1 || mr.index < bestIndex {
+				bestRule = mr.rule
+				bestIndex = mr.index
+			}
+		}
+	}
+
+	// 6. Check GeoIP country
+	if ip != nil && m.geoip != nil && len(m.geoRules) > 0 {
+		if gr, ok := m.geoRules[m.geoip.Country(ip)]; ok {
+			if bestIndex == -1 || gr.index < bestIndex {
+				bestRule = gr.rule
+				bestIndex = gr.index
+			}
+		}
+	}
+
+	// 7. Check rule sets, each backed by its own tries
+	for _, rs := range m.ruleSetRules {
+		if bestIndex != -1 && rs.index >= bestIndex {
+			break
+		}
+		if rs.set != nil && rs.set.Contains(md) {
+			bestRule = rs.rule
+			bestIndex = rs.index
+			break
+		}
+	}
+
+	// 8. Check MATCH rule
 	if m.matchRule != nil {
 		if bestIndex == -1 || m.matchIndex < bestIndex {
 			bestRule = m.matchRule
@@ -125,6 +257,7 @@ func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
 		return MatchResult{
 			Policy: bestRule.Policy,
 			Rule:   bestRule,
+			Index:  bestIndex,
 		}
 	}
 
@@ -132,5 +265,6 @@ func (m *Matcher) Match(domain string, ip net.IP) MatchResult {
 	return MatchResult{
 		Policy: config.PolicyDirect,
 		Rule:   nil,
+		Index:  -1,
 	}
 }
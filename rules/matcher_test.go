@@ -27,6 +27,7 @@ func TestMatcher_DomainMatch(t *testing.T) {
 		{"suffix match", "www.google.com", config.PolicyProxy},
 		{"suffix exact match", "google.com", config.PolicyProxy},
 		{"suffix no match", "notgoogle.com", config.PolicyDirect},
+		{"exact does not cover subdomains", "www.example.com", config.PolicyDirect},
 		{"keyword match", "www.youtube.com", config.PolicyProxy},
 		{"keyword match anywhere", "myyoutubesite.com", config.PolicyProxy},
 		{"no match falls through", "unknown.org", config.PolicyDirect},
@@ -116,3 +117,154 @@ func TestMatcher_RejectPolicy(t *testing.T) {
 		t.Errorf("Expected REJECT for ads domain, got %v", result.Policy)
 	}
 }
+
+func TestMatcher_SrcMAC(t *testing.T) {
+	rules := []*Rule{
+		{Type: RuleTypeSrcMAC, Value: "aa:bb:cc:dd:ee:ff", Policy: config.PolicyReject},
+		{Type: RuleTypeDomainSuffix, Value: "google.com", Policy: config.PolicyProxy},
+		{Type: RuleTypeMatch, Policy: config.PolicyDirect},
+	}
+
+	matcher := NewMatcher(rules)
+	if !matcher.HasSourceMACRules() {
+		t.Fatal("HasSourceMACRules() = false, want true")
+	}
+
+	mac, _ := net.ParseMAC("AA:BB:CC:DD:EE:FF")
+	other, _ := net.ParseMAC("11:22:33:44:55:66")
+
+	tests := []struct {
+		name string
+		md   Metadata
+		want config.Policy
+	}{
+		{"mac rule wins by order", Metadata{Domain: "www.google.com", SrcMAC: mac}, config.PolicyReject},
+		{"other device", Metadata{Domain: "www.google.com", SrcMAC: other}, config.PolicyProxy},
+		{"unknown mac", Metadata{Domain: "example.org"}, config.PolicyDirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matcher.MatchMetadata(&tt.md).Policy; got != tt.want {
+				t.Errorf("MatchMetadata() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeGeoIP map[string]string
+
+func (f fakeGeoIP) Country(ip net.IP) string { return f[ip.String()] }
+
+func TestMatcher_GeoIP(t *testing.T) {
+	parsed, err := ParseRules([]string{
+		"IP-CIDR,1.0.1.0/24,REJECT",
+		"GEOIP,cn,DIRECT",
+		"MATCH,PROXY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := NewMatcher(parsed)
+
+	if err := matcher.SetProviders(Providers{}); err == nil {
+		t.Fatal("Expected error for GEOIP rules without a database")
+	}
+	if err := matcher.SetProviders(Providers{GeoIP: fakeGeoIP{"1.0.1.1": "CN", "1.0.2.1": "CN", "8.8.8.8": "US"}}); err != nil {
+		t.Fatalf("SetProviders() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want config.Policy
+	}{
+		{"1.0.1.1", config.PolicyReject},
+		{"1.0.2.1", config.PolicyDirect},
+		{"8.8.8.8", config.PolicyProxy},
+	}
+	for _, tt := range tests {
+		if got := matcher.Match("", net.ParseIP(tt.ip)).Policy; got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_RuleSet(t *testing.T) {
+	parsed, err := ParseRules([]string{
+		"DOMAIN,blocked.example,REJECT",
+		"RULE-SET,streaming,PROXY",
+		"MATCH,DIRECT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := NewMatcher(parsed)
+
+	if err := matcher.SetProviders(Providers{}); err == nil {
+		t.Fatal("Expected error for unknown rule set")
+	}
+
+	set := NewRuleSet("streaming", config.RuleProvider{Behavior: config.BehaviorDomain}, nil, nil)
+	entries, _ := parseRuleSet([]byte("+.example\n"), config.BehaviorDomain)
+	set.matcher.Store(NewMatcher(entries))
+	if err := matcher.SetProviders(Providers{RuleSets: map[string]*RuleSet{"streaming": set}}); err != nil {
+		t.Fatalf("SetProviders() error = %v", err)
+	}
+
+	tests := []struct {
+		domain string
+		want   config.Policy
+	}{
+		{"blocked.example", config.PolicyReject},
+		{"video.example", config.PolicyProxy},
+		{"other.org", config.PolicyDirect},
+	}
+	for _, tt := range tests {
+		if got := matcher.Match(tt.domain, nil).Policy; got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestMatcher_Explain(t *testing.T) {
+	parsed, err := ParseRules([]string{
+		"DOMAIN-SUFFIX,google.com,PROXY",
+		"IP-CIDR,10.0.0.0/8,DIRECT",
+		"SRC-MAC,aa:bb:cc:dd:ee:ff,REJECT",
+		"RULE-SET,streaming,PROXY",
+		"MATCH,DIRECT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := NewMatcher(parsed)
+	set := NewRuleSet("streaming", config.RuleProvider{Behavior: config.BehaviorDomain}, nil, nil)
+	entries, _ := parseRuleSet([]byte("+.example\n"), config.BehaviorDomain)
+	set.matcher.Store(NewMatcher(entries))
+	if err := matcher.SetProviders(Providers{RuleSets: map[string]*RuleSet{"streaming": set}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		md        Metadata
+		evaluated int
+		field     string
+		value     string
+	}{
+		{Metadata{Domain: "www.google.com"}, 1, "domain", "www.google.com"},
+		{Metadata{DstIP: net.ParseIP("10.1.2.3")}, 2, "dst_ip", "10.1.2.3"},
+		{Metadata{DstIP: net.ParseIP("1.1.1.1"), SrcMAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}, 3, "src_mac", "aa:bb:cc:dd:ee:ff"},
+		{Metadata{Domain: "video.example"}, 4, "rule_set", "DOMAIN-SUFFIX,example"},
+		{Metadata{Domain: "other.org"}, 5, "", ""},
+	}
+	for _, tt := range tests {
+		e := matcher.Explain(&tt.md, matcher.MatchMetadata(&tt.md))
+		if e.Evaluated != tt.evaluated || e.Field != tt.field || e.Value != tt.value {
+			t.Errorf("Explain(%+v) = %+v, want %d %s=%s", tt.md, e, tt.evaluated, tt.field, tt.value)
+		}
+	}
+
+	if e := NewMatcher(parsed[:1]).Explain(&Metadata{Domain: "other.org"}, MatchResult{Index: -1}); e.Evaluated != 1 || e.Field != "" {
+		t.Errorf("Explain(default) = %+v", e)
+	}
+}
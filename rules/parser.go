@@ -18,6 +18,9 @@ const (
 	RuleTypeDomainKeyword RuleType = "DOMAIN-KEYWORD"
 	RuleTypeIPCIDR        RuleType = "IP-CIDR"
 	RuleTypeIPCIDR6       RuleType = "IP-CIDR6"
+	RuleTypeSrcMAC        RuleType = "SRC-MAC"
+	RuleTypeGeoIP         RuleType = "GEOIP"
+	RuleTypeRuleSet       RuleType = "RULE-SET"
 	RuleTypeMatch         RuleType = "MATCH"
 )
 
@@ -27,6 +30,15 @@ type Rule struct {
 	Value   string
 	Policy  config.Policy
 	Network *net.IPNet // Parsed CIDR for IP-CIDR rules
+	Comment string     // Optional description from structured config entries
+}
+
+// String returns the rule in Clash format
+func (r *Rule) String() string {
+	if r.Type == RuleTypeMatch {
+		return fmt.Sprintf("%s,%s", r.Type, r.Policy)
+	}
+	return fmt.Sprintf("%s,%s,%s", r.Type, r.Value, r.Policy)
 }
 
 // ParseRules parses a list of Clash-format rule strings
@@ -44,9 +56,47 @@ func ParseRules(ruleStrings []string) ([]*Rule, error) {
 	return rules, nil
 }
 
-// ParseRule parses a single Clash-format rule string
+// ParseRuleEntries parses rules from the configuration, in either string or structured form.
+// Policies other than PROXY, DIRECT and REJECT must be one of the named proxies or groups.
+func ParseRuleEntries(entries []config.RuleEntry, named []string) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(entries))
+
+	known := make(map[string]bool, len(named))
+	for _, name := range named {
+		known[name] = true
+	}
+
+	for i, entry := range entries {
+		var rule *Rule
+		var err error
+		if entry.Raw != "" {
+			rule, err = parseRule(entry.Raw, known)
+		} else {
+			rule, err = newRule(
+				RuleType(strings.ToUpper(strings.TrimSpace(entry.Type))),
+				strings.TrimSpace(entry.Value),
+				strings.TrimSpace(entry.Policy),
+				known,
+			)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i+1, entry, err)
+		}
+		rule.Comment = entry.Comment
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// ParseRule parses a single Clash-format rule string with a built-in policy
 // Format: TYPE,ARGUMENT,POLICY or MATCH,POLICY
 func ParseRule(ruleStr string) (*Rule, error) {
+	return parseRule(ruleStr, nil)
+}
+
+// parseRule parses a Clash-format rule string whose policy is built-in or in known
+func parseRule(ruleStr string, known map[string]bool) (*Rule, error) {
 	ruleStr = strings.TrimSpace(ruleStr)
 	parts := strings.Split(ruleStr, ",")
 
@@ -71,9 +121,14 @@ func ParseRule(ruleStr string) (*Rule, error) {
 		policyStr = strings.TrimSpace(parts[2])
 	}
 
-	policy := config.Policy(strings.ToUpper(policyStr))
-	if policy != config.PolicyProxy && policy != config.PolicyDirect && policy != config.PolicyReject {
-		return nil, fmt.Errorf("invalid policy: %s (must be PROXY, DIRECT, or REJECT)", policyStr)
+	return newRule(ruleType, value, policyStr, known)
+}
+
+// newRule validates and builds a rule from its components
+func newRule(ruleType RuleType, value, policyStr string, known map[string]bool) (*Rule, error) {
+	policy := config.ParsePolicy(policyStr)
+	if !policy.IsBuiltin() && !known[policyStr] {
+		return nil, fmt.Errorf("invalid policy: %s (must be PROXY, DIRECT, REJECT or a proxy group)", policyStr)
 	}
 
 	rule := &Rule{
@@ -90,8 +145,28 @@ func ParseRule(ruleStr string) (*Rule, error) {
 			return nil, fmt.Errorf("invalid CIDR: %s", value)
 		}
 		rule.Network = network
-	case RuleTypeDomain, RuleTypeDomainSuffix, RuleTypeDomainPrefix, RuleTypeDomainKeyword, RuleTypeMatch:
-		// Valid rule types
+	case RuleTypeSrcMAC:
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address: %s", value)
+		}
+		rule.Value = mac.String()
+	case RuleTypeGeoIP:
+		if value == "" {
+			return nil, fmt.Errorf("country code is required")
+		}
+		rule.Value = strings.ToUpper(value)
+	case RuleTypeRuleSet:
+		if value == "" {
+			return nil, fmt.Errorf("rule set name is required")
+		}
+	case RuleTypeDomain, RuleTypeDomainSuffix:
+		rule.Value = CanonicalDomain(value)
+	case RuleTypeDomainPrefix, RuleTypeDomainKeyword:
+		// Fragments of a name have no A-label form, unicode ones are matched
+		// against the U-labels of the domain
+		rule.Value = strings.ToLower(value)
+	case RuleTypeMatch:
 	default:
 		return nil, fmt.Errorf("unsupported rule type: %s", ruleType)
 	}
@@ -159,3 +159,92 @@ func TestParseRules(t *testing.T) {
 		t.Errorf("len(rules) = %v, want 3", len(rules))
 	}
 }
+
+func TestParseRule_SrcMAC(t *testing.T) {
+	rule, err := ParseRule("SRC-MAC,AA:BB:CC:DD:EE:FF,REJECT")
+	if err != nil {
+		t.Fatalf("ParseRule() error = %v", err)
+	}
+	if rule.Type != RuleTypeSrcMAC {
+		t.Errorf("Type = %v, want %v", rule.Type, RuleTypeSrcMAC)
+	}
+	if rule.Value != "aa:bb:cc:dd:ee:ff" {
+		t.Errorf("Value = %v, want normalized lowercase MAC", rule.Value)
+	}
+
+	if _, err := ParseRule("SRC-MAC,not-a-mac,DIRECT"); err == nil {
+		t.Error("Expected error for invalid MAC")
+	}
+}
+
+func TestParseRuleEntries(t *testing.T) {
+	entries := []config.RuleEntry{
+		{Raw: "DOMAIN-SUFFIX,cn,DIRECT"},
+		{Type: "domain-keyword", Value: "ads", Policy: "reject", Comment: "block ads"},
+		{Type: "MATCH", Policy: "PROXY"},
+	}
+
+	rules, err := ParseRuleEntries(entries, nil)
+	if err != nil {
+		t.Fatalf("ParseRuleEntries() error = %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("len(rules) = %v, want 3", len(rules))
+	}
+	if rules[1].Type != RuleTypeDomainKeyword || rules[1].Policy != config.PolicyReject {
+		t.Errorf("rules[1] = %+v", rules[1])
+	}
+	if rules[1].Comment != "block ads" {
+		t.Errorf("Comment = %q, want %q", rules[1].Comment, "block ads")
+	}
+
+	_, err = ParseRuleEntries([]config.RuleEntry{{Type: "IP-CIDR", Value: "not-a-cidr", Policy: "DIRECT"}}, nil)
+	if err == nil {
+		t.Error("Expected error for invalid CIDR in structured entry")
+	}
+}
+
+func TestParseRuleEntries_NamedPolicy(t *testing.T) {
+	entries := []config.RuleEntry{
+		{Raw: "DOMAIN-SUFFIX,corp.example,Work"},
+		{Type: "MATCH", Policy: "direct"},
+	}
+
+	rules, err := ParseRuleEntries(entries, []string{"Work"})
+	if err != nil {
+		t.Fatalf("ParseRuleEntries() error = %v", err)
+	}
+	if rules[0].Policy != "Work" {
+		t.Errorf("Policy = %q, want Work", rules[0].Policy)
+	}
+	if rules[1].Policy != config.PolicyDirect {
+		t.Errorf("Policy = %q, want DIRECT", rules[1].Policy)
+	}
+
+	// Group names are case-sensitive
+	if _, err := ParseRuleEntries([]config.RuleEntry{{Raw: "DOMAIN,a.example,work"}}, []string{"Work"}); err == nil {
+		t.Error("Expected error for unknown policy name")
+	}
+}
+
+func TestParseRule_GeoIPAndRuleSet(t *testing.T) {
+	rule, err := ParseRule("GEOIP,cn,DIRECT,no-resolve")
+	if err != nil {
+		t.Fatalf("ParseRule() error = %v", err)
+	}
+	if rule.Type != RuleTypeGeoIP || rule.Value != "CN" {
+		t.Errorf("rule = %+v, want GEOIP CN", rule)
+	}
+
+	rule, err = ParseRule("RULE-SET,streaming,PROXY")
+	if err != nil {
+		t.Fatalf("ParseRule() error = %v", err)
+	}
+	if rule.Type != RuleTypeRuleSet || rule.Value != "streaming" {
+		t.Errorf("rule = %+v, want RULE-SET streaming", rule)
+	}
+
+	if _, err := ParseRule("GEOIP,,DIRECT"); err == nil {
+		t.Error("Expected error for empty country code")
+	}
+}
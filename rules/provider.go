@@ -0,0 +1,278 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/datadir"
+	"gopkg.in/yaml.v3"
+)
+
+// ProviderFetchTimeout bounds a single rule set download
+const ProviderFetchTimeout = 60 * time.Second
+
+// RuleSet is a named rule list from a rule provider. Its contents are
+// compiled into a Matcher so lookups use the same tries as inline rules,
+// and are swapped atomically on refresh.
+type RuleSet struct {
+	name     string
+	provider config.RuleProvider
+	client   *http.Client
+	geoip    GeoIP
+	updates  atomic.Pointer[updates] // replaced when reused by a reload
+	matcher  atomic.Pointer[Matcher]
+}
+
+// NewRuleSet creates an empty rule set. The client downloads http providers
+// and geoip, which may be nil, serves GEOIP entries of classical sets.
+func NewRuleSet(name string, provider config.RuleProvider, client *http.Client, geoip GeoIP) *RuleSet {
+	s := &RuleSet{name: name, provider: provider, client: client, geoip: geoip}
+	s.updates.Store(new(updates))
+	s.matcher.Store(NewMatcher(nil))
+	return s
+}
+
+// Contains reports whether any entry of the set matches md
+func (s *RuleSet) Contains(md *Metadata) bool {
+	return s.matcher.Load().MatchMetadata(md).Rule != nil
+}
+
+// Load reads the set from its file. Http providers download a fresh copy
+// first, unless the update window is closed and the file is cached, and fall
+// back to the cached file when the download fails. Replacing loaded entries
+// logs how many were added and removed.
+func (s *RuleSet) Load(ctx context.Context) error {
+	u := s.updates.Load()
+	if s.provider.Type == config.ProviderHTTP {
+		_, statErr := os.Stat(s.provider.Path)
+		if statErr != nil || u.Until(time.Now()) == 0 {
+			if err := s.download(ctx); err != nil {
+				if statErr != nil {
+					return err
+				}
+				slog.Warn("Failed to download rule set, using cached copy", "name", s.name, "error", err)
+			}
+		}
+	}
+
+	data, err := os.ReadFile(s.provider.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read rule set %s: %w", s.name, err)
+	}
+
+	rules, skipped := parseRuleSet(data, s.provider.Behavior)
+	if skipped > 0 {
+		slog.Warn("Skipped invalid rule set entries", "name", s.name, "count", skipped)
+	}
+	m := NewMatcher(rules)
+	m.geoip = s.geoip
+	before := u.samples()
+	prev := s.matcher.Swap(m)
+
+	if len(prev.rules) == 0 {
+		slog.Info("Rule set loaded", "name", s.name, "entries", len(rules))
+		return nil
+	}
+	added, removed := diffRules(prev.rules, rules)
+	slog.Info("Rule set updated", "name", s.name, "entries", len(rules), "added", added, "removed", removed)
+	u.logChanges("rule set "+s.name, before)
+	return nil
+}
+
+// download fetches the provider URL and replaces the cached file atomically
+func (s *RuleSet) download(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ProviderFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.provider.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download rule set %s: %w", s.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download rule set %s: %s", s.name, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download rule set %s: %w", s.name, err)
+	}
+
+	return datadir.WriteFile(s.provider.Path, data, 0644)
+}
+
+// Run refreshes the set every provider interval, delaying refreshes due
+// outside the update window until it opens, until the context is cancelled
+func (s *RuleSet) Run(ctx context.Context) {
+	if s.provider.Interval <= 0 {
+		return
+	}
+
+	interval := time.Duration(s.provider.Interval) * time.Second
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if !s.updates.Load().wait(ctx) {
+			return
+		}
+		if err := s.Load(ctx); err != nil {
+			slog.Warn("Failed to refresh rule set", "name", s.name, "error", err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// parseRuleSet converts provider contents into rules. Both Clash YAML
+// ("payload:" list) and plain text with one entry per line are accepted.
+func parseRuleSet(data []byte, behavior string) ([]*Rule, int) {
+	var doc struct {
+		Payload []string `yaml:"payload"`
+	}
+	var entries []string
+	if err := yaml.Unmarshal(data, &doc); err == nil && doc.Payload != nil {
+		entries = doc.Payload
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			entries = append(entries, scanner.Text())
+		}
+	}
+
+	rules := make([]*Rule, 0, len(entries))
+	skipped := 0
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		rule, err := parseRuleSetEntry(entry, behavior)
+		if err != nil {
+			skipped++
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, skipped
+}
+
+// parseRuleSetEntry parses one entry; the policy is irrelevant inside a set
+func parseRuleSetEntry(entry, behavior string) (*Rule, error) {
+	const policy = string(config.PolicyDirect)
+
+	switch behavior {
+	case config.BehaviorDomain:
+		// "+.example.com" covers the domain and its subdomains, as does ".example.com" here
+		if after, ok := strings.CutPrefix(entry, "+."); ok {
+			return newRule(RuleTypeDomainSuffix, after, policy, nil)
+		}
+		if after, ok := strings.CutPrefix(entry, "."); ok {
+			return newRule(RuleTypeDomainSuffix, after, policy, nil)
+		}
+		return newRule(RuleTypeDomain, entry, policy, nil)
+	case config.BehaviorIPCIDR:
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		return newRule(RuleTypeIPCIDR, entry, policy, nil)
+	default: // classical: TYPE,VALUE with optional trailing options
+		parts := strings.Split(entry, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid entry: %s", entry)
+		}
+		ruleType := RuleType(strings.ToUpper(strings.TrimSpace(parts[0])))
+		// SRC-MAC is excluded since the MAC is only resolved for inline rules
+		if ruleType == RuleTypeMatch || ruleType == RuleTypeRuleSet || ruleType == RuleTypeSrcMAC {
+			return nil, fmt.Errorf("%s is not allowed in a rule set", ruleType)
+		}
+		return newRule(ruleType, strings.TrimSpace(parts[1]), policy, nil)
+	}
+}
+
+// LoadProviders opens the GeoIP database and loads every rule provider of cfg.
+// Relative paths are resolved against the data directory. Loaded http sets
+// of prev whose provider is unchanged are kept without downloading them
+// again, their Run loops refresh them.
+func LoadProviders(ctx context.Context, cfg *config.Config, client *http.Client, prev Providers) (Providers, error) {
+	p := Providers{updates: &updates{Updates: cfg.Updates}}
+
+	if cfg.GeoIPDatabase != "" {
+		db, err := OpenMMDB(cfg.DataPath(cfg.GeoIPDatabase))
+		if err != nil {
+			return p, err
+		}
+		p.GeoIP = db
+	}
+
+	p.RuleSets = make(map[string]*RuleSet, len(cfg.RuleProviders))
+	for name, provider := range cfg.RuleProviders {
+		provider.Path = cfg.DataPath(provider.Path)
+		if set := prev.RuleSets[name]; set.reusable(provider, p.GeoIP) {
+			set.updates.Store(p.updates)
+			p.RuleSets[name] = set
+			continue
+		}
+		set := NewRuleSet(name, provider, client, p.GeoIP)
+		set.updates.Store(p.updates)
+		if err := set.Load(ctx); err != nil {
+			if provider.Type != config.ProviderHTTP {
+				return p, err
+			}
+			// Keep running with an empty set and retry on the next refresh
+			slog.Warn("Rule set unavailable", "name", name, "error", err)
+		}
+		p.RuleSets[name] = set
+	}
+
+	return p, nil
+}
+
+// reusable reports whether s is a loaded http set of provider. Classical
+// sets also need the same GeoIP database for their GEOIP entries.
+func (s *RuleSet) reusable(provider config.RuleProvider, geoip GeoIP) bool {
+	if s == nil || s.provider != provider || provider.Type != config.ProviderHTTP {
+		return false
+	}
+	if provider.Behavior == config.BehaviorClassical && s.geoip != geoip {
+		return false
+	}
+	return len(s.matcher.Load().rules) > 0
+}
+
+// Run refreshes all rule sets and the GeoIP database until the context is cancelled
+func (p Providers) Run(ctx context.Context) {
+	for _, set := range p.RuleSets {
+		go set.Run(ctx)
+	}
+	if db, ok := p.GeoIP.(*MMDB); ok {
+		go p.updates.runGeoIP(ctx, db)
+	}
+}
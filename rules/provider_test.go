@@ -0,0 +1,171 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestParseRuleSet(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior string
+		data     string
+		want     int
+		skipped  int
+		match    Metadata
+	}{
+		{
+			name:     "domain yaml",
+			behavior: config.BehaviorDomain,
+			data:     "payload:\n  - '+.google.com'\n  - 'example.org'\n",
+			want:     2,
+			match:    Metadata{Domain: "mail.google.com"},
+		},
+		{
+			name:     "ipcidr text",
+			behavior: config.BehaviorIPCIDR,
+			data:     "# comment\n10.0.0.0/8\n2001:db8::1\nnot-an-ip\n",
+			want:     2,
+			skipped:  1,
+			match:    Metadata{DstIP: net.ParseIP("2001:db8::1")},
+		},
+		{
+			name:     "classical",
+			behavior: config.BehaviorClassical,
+			data:     "payload:\n  - DOMAIN-KEYWORD,tracker\n  - IP-CIDR,192.0.2.0/24,no-resolve\n  - MATCH,DIRECT\n",
+			want:     2,
+			skipped:  1,
+			match:    Metadata{Domain: "ads.tracker.net"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, skipped := parseRuleSet([]byte(tt.data), tt.behavior)
+			if len(rules) != tt.want || skipped != tt.skipped {
+				t.Fatalf("parseRuleSet() = %d rules, %d skipped; want %d, %d", len(rules), skipped, tt.want, tt.skipped)
+			}
+			if NewMatcher(rules).MatchMetadata(&tt.match).Rule == nil {
+				t.Errorf("Expected %+v to match the set", tt.match)
+			}
+		})
+	}
+
+	t.Run("exact domain", func(t *testing.T) {
+		rules, _ := parseRuleSet([]byte("example.org\n"), config.BehaviorDomain)
+		if NewMatcher(rules).Match("www.example.org", nil).Rule != nil {
+			t.Error("Exact entry should not match subdomains")
+		}
+	})
+}
+
+func TestRuleSet_LoadHTTP(t *testing.T) {
+	var unavailable atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "payload:\n  - '+.example.com'\n")
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "rules", "example.yaml")
+	set := NewRuleSet("example", config.RuleProvider{
+		Type:     config.ProviderHTTP,
+		Behavior: config.BehaviorDomain,
+		URL:      server.URL,
+		Path:     path,
+	}, server.Client(), nil)
+
+	if err := set.Load(context.Background()); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !set.Contains(&Metadata{Domain: "www.example.com"}) {
+		t.Error("Expected downloaded entries to match")
+	}
+	if data, err := os.ReadFile(path); err != nil || !strings.Contains(string(data), "example.com") {
+		t.Fatalf("cache file = %q, %v", data, err)
+	}
+
+	// A failed refresh keeps serving the cached copy
+	unavailable.Store(true)
+	if err := set.Load(context.Background()); err != nil {
+		t.Fatalf("Load() with cache error = %v", err)
+	}
+	if !set.Contains(&Metadata{Domain: "www.example.com"}) {
+		t.Error("Expected cached entries to match")
+	}
+
+	os.Remove(path)
+	if err := set.Load(context.Background()); err == nil {
+		t.Error("Expected error without server or cache")
+	}
+}
+
+func TestLoadProviders_MissingFile(t *testing.T) {
+	cfg := &config.Config{RuleProviders: map[string]config.RuleProvider{
+		"local": {Type: config.ProviderFile, Behavior: config.BehaviorDomain, Path: filepath.Join(t.TempDir(), "missing.txt")},
+	}}
+	if _, err := LoadProviders(context.Background(), cfg, nil, Providers{}); err == nil {
+		t.Error("Expected error for missing local rule set")
+	}
+}
+
+func TestLoadProviders_ReusesHTTPSets(t *testing.T) {
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		fmt.Fprint(w, "payload:\n  - '+.example.com'\n")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local.txt")
+	os.WriteFile(local, []byte("+.local.example\n"), 0644)
+	cfg := &config.Config{DataDir: dir, RuleProviders: map[string]config.RuleProvider{
+		"remote": {Type: config.ProviderHTTP, Behavior: config.BehaviorDomain, URL: server.URL, Path: "remote.yaml"},
+		"local":  {Type: config.ProviderFile, Behavior: config.BehaviorDomain, Path: local},
+	}}
+
+	first, err := LoadProviders(context.Background(), cfg, server.Client(), Providers{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadProviders(context.Background(), cfg, server.Client(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("downloads = %d after an unchanged reload, want 1", n)
+	}
+	if second.RuleSets["remote"] != first.RuleSets["remote"] {
+		t.Error("Expected the unchanged http set to be reused")
+	}
+	if second.RuleSets["local"] == first.RuleSets["local"] {
+		t.Error("Expected the file set to be read again")
+	}
+	if second.RuleSets["remote"].updates.Load() != second.updates {
+		t.Error("Expected the reused set to follow the new update window")
+	}
+
+	remote := cfg.RuleProviders["remote"]
+	remote.Interval = 3600
+	cfg.RuleProviders["remote"] = remote
+	if _, err := LoadProviders(context.Background(), cfg, server.Client(), second); err != nil {
+		t.Fatal(err)
+	}
+	if n := downloads.Load(); n != 2 {
+		t.Errorf("downloads = %d after the provider changed, want 2", n)
+	}
+}
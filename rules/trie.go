@@ -67,7 +67,8 @@ func (t *DomainTrie) Search(domain string) (*Rule, int) {
 		part := parts[i]
 		next, ok := node.children[part]
 		if !ok {
-			break
+			// Exact rules only apply when every label matched
+			return bestRule, bestIndex
 		}
 		node = next
 
@@ -81,7 +82,7 @@ func (t *DomainTrie) Search(domain string) (*Rule, int) {
 	}
 
 	// Check for exact match at the final level
-	if node != nil && node.exactRule != nil {
+	if node.exactRule != nil {
 		if bestIndex == -1 || node.exactIndex < bestIndex {
 			bestRule = node.exactRule
 			bestIndex = node.exactIndex
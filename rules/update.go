@@ -0,0 +1,122 @@
+package rules
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// GeoIPCheckInterval is how often the GeoIP database file is checked for a
+// new version, e.g. one written by geoipupdate
+const GeoIPCheckInterval = time.Hour
+
+// updates holds back automatic updates until the configured window opens and
+// reports what they change: the entries gained and lost by a rule set and
+// the rules matching the sample destinations
+type updates struct {
+	config.Updates
+	matcher atomic.Pointer[Matcher] // matching with the providers, set by SetProviders
+}
+
+// wait blocks until the update window opens, reporting false if ctx ends first
+func (u *updates) wait(ctx context.Context) bool {
+	d := u.Until(time.Now())
+	if d == 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// samples returns the rule matching each sample destination, nil before the
+// providers are bound to a matcher
+func (u *updates) samples() []string {
+	m := u.matcher.Load()
+	if m == nil || len(u.Samples) == 0 {
+		return nil
+	}
+	matched := make([]string, len(u.Samples))
+	for i, s := range u.Samples {
+		md := Metadata{DstPort: 443}
+		if md.DstIP = net.ParseIP(s); md.DstIP == nil {
+			md.Domain = s
+		}
+		result := m.MatchMetadata(&md)
+		matched[i] = string(result.Policy)
+		if result.Rule != nil {
+			matched[i] = result.Rule.String()
+		}
+	}
+	return matched
+}
+
+// logChanges logs the sample destinations matching another rule than before
+// the update of source
+func (u *updates) logChanges(source string, before []string) {
+	if before == nil {
+		return
+	}
+	for i, after := range u.samples() {
+		if after != before[i] {
+			slog.Info("Update changed the rule of a sample", "source", source, "sample", u.Samples[i], "from", before[i], "to", after)
+		}
+	}
+}
+
+// runGeoIP reads db again whenever its file changed, checking every
+// GeoIPCheckInterval within the update window, until ctx is cancelled
+func (u *updates) runGeoIP(ctx context.Context, db *MMDB) {
+	timer := time.NewTimer(GeoIPCheckInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if !u.wait(ctx) {
+			return
+		}
+		before := u.samples()
+		prev := db.reader.Load().Metadata
+		if changed, err := db.reopen(); err != nil {
+			slog.Warn("Failed to update GeoIP database", "path", db.path, "error", err)
+		} else if changed {
+			next := db.reader.Load().Metadata
+			slog.Info("GeoIP database updated", "path", db.path,
+				"built", time.Unix(int64(next.BuildEpoch), 0), "previous_built", time.Unix(int64(prev.BuildEpoch), 0),
+				"nodes", next.NodeCount, "previous_nodes", prev.NodeCount)
+			u.logChanges("GeoIP database", before)
+		}
+		timer.Reset(GeoIPCheckInterval)
+	}
+}
+
+// diffRules counts the entries of next missing from prev and those of prev
+// missing from next
+func diffRules(prev, next []*Rule) (added, removed int) {
+	seen := make(map[string]struct{}, len(prev))
+	for _, r := range prev {
+		seen[r.String()] = struct{}{}
+	}
+	for _, r := range next {
+		key := r.String()
+		if _, ok := seen[key]; ok {
+			delete(seen, key)
+		} else {
+			added++
+		}
+	}
+	return added, len(seen)
+}
@@ -0,0 +1,101 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+func TestDiffRules(t *testing.T) {
+	prev, _ := parseRuleSet([]byte("a.example\nb.example\nc.example\n"), config.BehaviorDomain)
+	next, _ := parseRuleSet([]byte("b.example\nc.example\nd.example\ne.example\n"), config.BehaviorDomain)
+	if added, removed := diffRules(prev, next); added != 2 || removed != 1 {
+		t.Errorf("diffRules() = +%d -%d, want +2 -1", added, removed)
+	}
+}
+
+func TestRuleSet_UpdateWindow(t *testing.T) {
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		fmt.Fprint(w, "payload:\n  - '+.example.com'\n")
+	}))
+	defer server.Close()
+
+	// A window that opened a minute ago is open, one opening in five minutes closed
+	now := time.Now()
+	minute := now.Hour()*60 + now.Minute()
+	closed := &updates{Updates: config.Updates{From: "set", FromMinute: (minute + 5) % 1440, ToMinute: (minute + 10) % 1440}}
+	open := &updates{Updates: config.Updates{From: "set", FromMinute: (minute + 1439) % 1440, ToMinute: (minute + 5) % 1440}}
+
+	set := NewRuleSet("example", config.RuleProvider{
+		Type:     config.ProviderHTTP,
+		Behavior: config.BehaviorDomain,
+		URL:      server.URL,
+		Path:     filepath.Join(t.TempDir(), "example.yaml"),
+	}, server.Client(), nil)
+
+	tests := []struct {
+		name    string
+		updates *updates
+		want    int32
+	}{
+		{"closed without cache", closed, 1},
+		{"closed with cache", closed, 1},
+		{"open", open, 2},
+	}
+	for _, tt := range tests {
+		set.updates.Store(tt.updates)
+		if err := set.Load(context.Background()); err != nil {
+			t.Fatalf("%s: Load() error = %v", tt.name, err)
+		}
+		if n := downloads.Load(); n != tt.want {
+			t.Errorf("%s: downloads = %d, want %d", tt.name, n, tt.want)
+		}
+	}
+}
+
+func TestUpdates_Samples(t *testing.T) {
+	parsed, err := ParseRules([]string{"RULE-SET,streaming,PROXY", "MATCH,DIRECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := NewMatcher(parsed)
+	path := filepath.Join(t.TempDir(), "streaming.txt")
+	os.WriteFile(path, []byte("+.video.example\n"), 0644)
+
+	u := &updates{Updates: config.Updates{Samples: []string{"www.video.example", "music.example"}}}
+	set := NewRuleSet("streaming", config.RuleProvider{Type: config.ProviderFile, Behavior: config.BehaviorDomain, Path: path}, nil, nil)
+	set.updates.Store(u)
+	if got := u.samples(); got != nil {
+		t.Errorf("samples() before SetProviders = %q, want nil", got)
+	}
+	if err := set.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := matcher.SetProviders(Providers{RuleSets: map[string]*RuleSet{"streaming": set}, updates: u}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"RULE-SET,streaming,PROXY", "MATCH,DIRECT"}
+	if got := u.samples(); !slices.Equal(got, want) {
+		t.Errorf("samples() = %q, want %q", got, want)
+	}
+
+	os.WriteFile(path, []byte("+.music.example\n"), 0644)
+	if err := set.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"MATCH,DIRECT", "RULE-SET,streaming,PROXY"}
+	if got := u.samples(); !slices.Equal(got, want) {
+		t.Errorf("samples() after update = %q, want %q", got, want)
+	}
+}
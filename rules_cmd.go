@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/cnfatal/proxy/capture"
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/rules"
+)
+
+// runRulesCommand implements the "rules" subcommand and returns the exit code
+func runRulesCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "test":
+			return runRulesTest(args[1:])
+		case "replay":
+			return runRulesReplay(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: tproxy rules test [-config config.yaml] -f cases.yaml")
+	fmt.Fprintln(os.Stderr, "       tproxy rules replay [-config config.yaml] [-compare other.yaml] -f capture.pcap")
+	return 2
+}
+
+func runRulesTest(args []string) int {
+	fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	casesPath := fs.String("f", "", "Path to YAML test cases")
+	dataDir := fs.String("data-dir", "", "Directory for downloaded and persisted data (overrides data_dir)")
+	fs.Parse(args)
+
+	if *casesPath == "" {
+		fmt.Fprintln(os.Stderr, "-f is required")
+		return 2
+	}
+
+	matcher, err := loadRules(*cfgPath, *dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	cases, err := rules.LoadCases(*casesPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	mismatches := matcher.Check(cases)
+	for _, m := range mismatches {
+		fmt.Printf("FAIL case %d: domain=%q ip=%q src_mac=%q: expected %s, got %s via %s\n",
+			m.Index, m.Case.Domain, m.Case.IP, m.Case.SrcMAC, m.Case.Expect, m.Result.Policy, matchedRule(m.Result))
+	}
+
+	fmt.Printf("%d cases, %d passed, %d failed\n", len(cases), len(cases)-len(mismatches), len(mismatches))
+	if len(mismatches) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runRulesReplay matches recorded connections against the rules, printing
+// the decisions, or only those that differ from the rules of another config
+func runRulesReplay(args []string) int {
+	fs := flag.NewFlagSet("rules replay", flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	comparePath := fs.String("compare", "", "Configuration whose decisions are compared against -config")
+	inputPath := fs.String("f", "", "pcap or pcapng capture, or JSON connection list from GET /connections")
+	dataDir := fs.String("data-dir", "", "Directory for downloaded and persisted data (overrides data_dir)")
+	fs.Parse(args)
+
+	if *inputPath == "" {
+		fmt.Fprintln(os.Stderr, "-f is required")
+		return 2
+	}
+
+	matcher, err := loadRules(*cfgPath, *dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var other *rules.Matcher
+	if *comparePath != "" {
+		if other, err = loadRules(*comparePath, *dataDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	flows, err := capture.Read(*inputPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Connections with the same metadata get the same decision
+	type replayed struct {
+		flow  capture.Flow
+		count int
+	}
+	var distinct []*replayed
+	index := make(map[string]*replayed)
+	for _, f := range flows {
+		key := fmt.Sprintf("%s|%s|%s|%d|%s", f.Network, f.Domain, f.IP, f.Port, f.SrcMAC)
+		if r, ok := index[key]; ok {
+			r.count++
+			continue
+		}
+		r := &replayed{flow: f, count: 1}
+		index[key] = r
+		distinct = append(distinct, r)
+	}
+
+	if other == nil {
+		counts := make(map[config.Policy]int)
+		for _, r := range distinct {
+			result := matcher.MatchMetadata(r.flow.Metadata())
+			counts[result.Policy] += r.count
+			fmt.Printf("%s: %s via %s (%d)\n", describeFlow(r.flow), result.Policy, matchedRule(result), r.count)
+		}
+		fmt.Printf("%d flows, %d distinct\n", len(flows), len(distinct))
+		policies := make([]config.Policy, 0, len(counts))
+		for p := range counts {
+			policies = append(policies, p)
+		}
+		slices.Sort(policies)
+		for _, p := range policies {
+			fmt.Printf("  %s: %d\n", p, counts[p])
+		}
+		return 0
+	}
+
+	differ := 0
+	for _, r := range distinct {
+		md := r.flow.Metadata()
+		a, b := matcher.MatchMetadata(md), other.MatchMetadata(md)
+		if a.Policy == b.Policy {
+			continue
+		}
+		differ += r.count
+		fmt.Printf("DIFF %s: %s via %s -> %s via %s (%d)\n",
+			describeFlow(r.flow), a.Policy, matchedRule(a), b.Policy, matchedRule(b), r.count)
+	}
+	fmt.Printf("%d flows, %d distinct, %d with a different policy\n", len(flows), len(distinct), differ)
+	if differ > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadRules loads a configuration file and the matcher of its rules
+func loadRules(path, dataDir string) (*rules.Matcher, error) {
+	cfg, err := config.Load(path, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	matcher, _, err := loadMatcher(context.Background(), cfg, rules.Providers{})
+	return matcher, err
+}
+
+func matchedRule(result rules.MatchResult) string {
+	if result.Rule == nil {
+		return "(no rule)"
+	}
+	return result.Rule.String()
+}
+
+func describeFlow(f capture.Flow) string {
+	port := strconv.Itoa(int(f.Port))
+	s := f.Network + " "
+	switch {
+	case f.IP == nil:
+		s += net.JoinHostPort(f.Domain, port)
+	case f.Domain != "":
+		s += f.Domain + " " + net.JoinHostPort(f.IP.String(), port)
+	default:
+		s += net.JoinHostPort(f.IP.String(), port)
+	}
+	if f.SrcMAC != nil {
+		s += " from " + f.SrcMAC.String()
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cnfatal/proxy/certs"
+	"github.com/cnfatal/proxy/config"
+	"github.com/cnfatal/proxy/datadir"
+	"github.com/cnfatal/proxy/proxy"
+)
+
+// runServerCommand implements the "server" subcommand, the remote end that
+// upstreams of other instances tunnel through, and returns the exit code
+func runServerCommand(args []string) int {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	listen := fs.String("listen", ":8443", "Address to accept tunnels on")
+	certFile := fs.String("cert", "", "TLS certificate file")
+	keyFile := fs.String("key", "", "TLS private key file")
+	acmeDomains := fs.String("acme-domain", "", "Comma-separated domains to obtain certificates for through ACME instead of -cert and -key")
+	acmeEmail := fs.String("acme-email", "", "Contact address registered with the ACME CA")
+	acmeHTTP := fs.String("acme-http", "", "Address answering ACME HTTP-01 challenges, e.g. :80 (TLS-ALPN-01 is always answered)")
+	acmeDirectory := fs.String("acme-directory", "", "ACME directory URL (default Let's Encrypt)")
+	dataDir := fs.String("data-dir", datadir.Default, "Directory storing ACME accounts and certificates")
+	tokenFile := fs.String("token-file", "", "File holding the token clients authenticate with")
+	dialTimeout := fs.Int("dial-timeout", config.DefaultDialTimeout, "Seconds allowed to connect to a destination")
+	level := fs.String("log-level", "info", "Log level (debug, info, warn, error)")
+	fs.Parse(args)
+
+	spec := &config.ServerTLS{Cert: *certFile, Key: *keyFile}
+	if *acmeDomains != "" {
+		spec.ACME = &config.ACMEConfig{
+			Domains:      strings.Split(*acmeDomains, ","),
+			Email:        *acmeEmail,
+			HTTPListen:   *acmeHTTP,
+			DirectoryURL: *acmeDirectory,
+		}
+	}
+	err := spec.Validate()
+	if err == nil && *tokenFile == "" {
+		err = errors.New("-token-file is required")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "usage: tproxy server {-cert cert.pem -key key.pem | -acme-domain example.com} -token-file token [-listen :8443]")
+		return 2
+	}
+	token, err := config.ReadPassword(*tokenFile)
+	if err == nil && token == "" {
+		err = fmt.Errorf("token file %s is empty", *tokenFile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	source, err := certs.New(spec, *dataDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: parseLogLevel(*level)})))
+
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           proxy.NewServer(token, time.Duration(*dialTimeout)*time.Second, proxy.NewBufferPool()),
+		TLSConfig:         source.TLSConfig(),
+		ReadHeaderTimeout: proxy.InboundHandshakeTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := source.Run(ctx); err != nil {
+			slog.Error("ACME challenge server error", "error", err)
+		}
+	}()
+
+	slog.Info("Tunnel server listening", "addr", *listen)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Tunnel server error", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "context"
+
+// toggleDebugOnSignal is a no-op: SIGUSR2 does not exist on this platform
+func toggleDebugOnSignal(ctx context.Context) {}
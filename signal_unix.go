@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// toggleDebugOnSignal switches between debug and the configured level on each
+// SIGUSR2, following the level of the last reload
+func toggleDebugOnSignal(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			next := slog.LevelDebug
+			if logLevel.Level() == slog.LevelDebug {
+				next = max(configuredLevel.Level(), slog.LevelInfo)
+			}
+			logLevel.Set(next)
+			slog.Info("Log level changed", "level", next)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cnfatal/proxy/config"
+)
+
+// userModeEnv is a shell snippet pointing programs at the explicit listeners,
+// the only way traffic reaches the rules when nftables cannot be set up. The
+// HTTP listener only serves CONNECT, so it is offered for HTTPS alone.
+func userModeEnv(cfg *config.Config) string {
+	var b strings.Builder
+	b.WriteString("# tproxy runs without nftables, only programs using these proxies follow the rules\n")
+	if cfg.SOCKSListen != "" {
+		fmt.Fprintf(&b, "export ALL_PROXY=socks5h://%[1]s all_proxy=socks5h://%[1]s\n", loopbackAddr(cfg.SOCKSListen))
+	}
+	if cfg.HTTPListen != "" {
+		fmt.Fprintf(&b, "export HTTPS_PROXY=http://%[1]s https_proxy=http://%[1]s\n", loopbackAddr(cfg.HTTPListen))
+	}
+	b.WriteString("export NO_PROXY=localhost,127.0.0.0/8,::1 no_proxy=localhost,127.0.0.0/8,::1\n")
+
+	// proxychains tunnels any TCP program, through either listener
+	kind, listen := "socks5", cfg.SOCKSListen
+	if listen == "" {
+		kind, listen = "http", cfg.HTTPListen
+	}
+	host, port, _ := net.SplitHostPort(loopbackAddr(listen))
+	b.WriteString("# proxychains4 -f tproxy-proxychains.conf <command>, with tproxy-proxychains.conf:\n")
+	b.WriteString("#   strict_chain\n#   proxy_dns\n#   [ProxyList]\n")
+	fmt.Fprintf(&b, "#   %s %s %s\n", kind, host, port)
+	return b.String()
+}
+
+// loopbackAddr is the address local programs reach a listener on
+func loopbackAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}